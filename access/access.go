@@ -0,0 +1,384 @@
+// Package access implements an IP access controller for use as
+// server.Server.Allow. It supports CIDR allow and deny lists for IPv4 and
+// IPv6, optionally loaded from files that are watched for changes, and a list
+// of temporarily banned clients that filters can add offenders to.
+package access
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultMaxBans       = 100000
+)
+
+// Reasons for denying a connection, as counted in DeniedConnections.
+const (
+	ReasonDenyList   = "deny_list"
+	ReasonNotAllowed = "not_allowed"
+	ReasonBanned     = "banned"
+)
+
+var (
+	log = golog.LoggerFor("access")
+
+	// DeniedConnections counts denied connections by reason.
+	DeniedConnections = metrics.Map("denied_connections")
+)
+
+// Opts configures a Controller.
+type Opts struct {
+	// Allow lists the networks (CIDRs like 10.0.0.0/8 or single addresses)
+	// from which connections are allowed. If neither Allow nor AllowFile
+	// lists anything, connections from all addresses not on a deny list are
+	// allowed.
+	Allow []string
+
+	// Deny lists the networks from which connections are denied. Deny lists
+	// take precedence over allow lists.
+	Deny []string
+
+	// AllowFile and DenyFile name files with additional networks to allow and
+	// deny, one per line. Blank lines and comments starting with # are
+	// ignored. The files are reloaded when they change.
+	AllowFile string
+	DenyFile  string
+
+	// CheckInterval is how often the files are checked for changes. Defaults
+	// to 10 seconds.
+	CheckInterval time.Duration
+
+	// MaxBans caps the number of banned clients. When it's reached, the ban
+	// closest to expiring is lifted to make room. Defaults to 100000.
+	MaxBans int
+}
+
+// BanInfo describes a ban.
+type BanInfo struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// Controller decides which clients may connect. It is safe for concurrent
+// use.
+type Controller struct {
+	opts  Opts
+	lists atomic.Value // *lists
+	files map[string]os.FileInfo
+
+	bansMx sync.Mutex
+	bans   map[string]*BanInfo
+
+	now       func() time.Time
+	stop      chan interface{}
+	closeOnce sync.Once
+}
+
+type lists struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// New constructs a Controller, loading its lists. Call Close to stop watching
+// the list files.
+func New(opts *Opts) (*Controller, error) {
+	c := &Controller{
+		opts:  *opts,
+		files: make(map[string]os.FileInfo),
+		bans:  make(map[string]*BanInfo),
+		now:   time.Now,
+		stop:  make(chan interface{}),
+	}
+	if c.opts.CheckInterval <= 0 {
+		c.opts.CheckInterval = defaultCheckInterval
+	}
+	if c.opts.MaxBans <= 0 {
+		c.opts.MaxBans = defaultMaxBans
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if c.opts.AllowFile != "" || c.opts.DenyFile != "" {
+		go c.watch()
+	}
+	metrics.Func("banned_clients", func() interface{} {
+		return len(c.Bans())
+	})
+	return c, nil
+}
+
+// Allow checks whether connections from the given client, normally an IP
+// address, are allowed, counting denied connections in DeniedConnections. It
+// can be used as server.Server.Allow. Clients that aren't identified by an IP
+// address, like Unix domain socket peers, are only subject to bans.
+func (c *Controller) Allow(client string) bool {
+	if reason := c.check(client); reason != "" {
+		DeniedConnections.Add(reason, 1)
+		log.Debugf("Denying connection from %v: %v", client, reason)
+		return false
+	}
+	return true
+}
+
+// check returns the reason for denying the given client, or "" if it's
+// allowed.
+func (c *Controller) check(client string) string {
+	if c.IsBanned(client) {
+		return ReasonBanned
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return ""
+	}
+	l := c.lists.Load().(*lists)
+	if contains(l.deny, ip) {
+		return ReasonDenyList
+	}
+	if len(l.allow) > 0 && !contains(l.allow, ip) {
+		return ReasonNotAllowed
+	}
+	return ""
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban denies connections from the given client for the given duration. If the
+// client is already banned for longer, the ban is left as is.
+func (c *Controller) Ban(client string, d time.Duration, reason string) {
+	until := c.now().Add(d)
+	c.bansMx.Lock()
+	defer c.bansMx.Unlock()
+	if existing, found := c.bans[client]; found && existing.Until.After(until) {
+		return
+	}
+	if _, found := c.bans[client]; !found && len(c.bans) >= c.opts.MaxBans {
+		c.purgeExpired()
+		if len(c.bans) >= c.opts.MaxBans {
+			c.liftSoonestExpiring()
+		}
+	}
+	log.Debugf("Banning %v until %v: %v", client, until, reason)
+	c.bans[client] = &BanInfo{Until: until, Reason: reason}
+}
+
+// Unban lifts the ban on the given client, returning false if it wasn't
+// banned.
+func (c *Controller) Unban(client string) bool {
+	c.bansMx.Lock()
+	defer c.bansMx.Unlock()
+	_, found := c.bans[client]
+	delete(c.bans, client)
+	return found
+}
+
+// ClearBans lifts all bans.
+func (c *Controller) ClearBans() {
+	c.bansMx.Lock()
+	c.bans = make(map[string]*BanInfo)
+	c.bansMx.Unlock()
+}
+
+// IsBanned checks whether the given client is currently banned.
+func (c *Controller) IsBanned(client string) bool {
+	c.bansMx.Lock()
+	defer c.bansMx.Unlock()
+	ban, found := c.bans[client]
+	if !found {
+		return false
+	}
+	if !c.now().Before(ban.Until) {
+		delete(c.bans, client)
+		return false
+	}
+	return true
+}
+
+// Bans returns the current bans by client.
+func (c *Controller) Bans() map[string]BanInfo {
+	c.bansMx.Lock()
+	defer c.bansMx.Unlock()
+	c.purgeExpired()
+	result := make(map[string]BanInfo, len(c.bans))
+	for client, ban := range c.bans {
+		result[client] = *ban
+	}
+	return result
+}
+
+func (c *Controller) purgeExpired() {
+	now := c.now()
+	for client, ban := range c.bans {
+		if !now.Before(ban.Until) {
+			delete(c.bans, client)
+		}
+	}
+}
+
+func (c *Controller) liftSoonestExpiring() {
+	clients := make([]string, 0, len(c.bans))
+	for client := range c.bans {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return c.bans[clients[i]].Until.Before(c.bans[clients[j]].Until)
+	})
+	delete(c.bans, clients[0])
+}
+
+// Close stops watching the list files.
+func (c *Controller) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *Controller) watch() {
+	ticker := time.NewTicker(c.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if c.filesChanged() {
+				if err := c.load(); err != nil {
+					log.Errorf("Unable to reload access lists, keeping previous ones: %v", err)
+				}
+			}
+			c.bansMx.Lock()
+			c.purgeExpired()
+			c.bansMx.Unlock()
+		}
+	}
+}
+
+func (c *Controller) filesChanged() bool {
+	for _, path := range []string{c.opts.AllowFile, c.opts.DenyFile} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Errorf("Unable to check %v: %v", path, err)
+			continue
+		}
+		prior := c.files[path]
+		if prior == nil || !fi.ModTime().Equal(prior.ModTime()) || fi.Size() != prior.Size() {
+			return true
+		}
+	}
+	return false
+}
+
+// load (re)loads the lists. It's only called from New and the watch loop.
+func (c *Controller) load() error {
+	allow, err := parseNets(c.opts.Allow, "allow list")
+	if err != nil {
+		return err
+	}
+	deny, err := parseNets(c.opts.Deny, "deny list")
+	if err != nil {
+		return err
+	}
+	files := make(map[string]os.FileInfo)
+	for _, f := range []struct {
+		path string
+		nets *[]*net.IPNet
+	}{{c.opts.AllowFile, &allow}, {c.opts.DenyFile, &deny}} {
+		if f.path == "" {
+			continue
+		}
+		nets, fi, err := loadFile(f.path)
+		if err != nil {
+			return err
+		}
+		*f.nets = append(*f.nets, nets...)
+		files[f.path] = fi
+	}
+	c.lists.Store(&lists{allow: allow, deny: deny})
+	c.files = files
+	log.Debugf("Loaded %d allowed and %d denied networks", len(allow), len(deny))
+	return nil
+}
+
+func loadFile(path string) ([]*net.IPNet, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.New("Unable to open %v: %v", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, errors.New("Unable to stat %v: %v", path, err)
+	}
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entries = append(entries, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.New("Unable to read %v: %v", path, err)
+	}
+	nets, err := parseNets(entries, path)
+	return nets, fi, err
+}
+
+// parseNets parses networks in CIDR notation or single IP addresses, skipping
+// blank entries and comments.
+func parseNets(entries []string, source string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for i, entry := range entries {
+		if comment := strings.IndexByte(entry, '#'); comment >= 0 {
+			entry = entry[:comment]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		n, err := ParseNet(entry)
+		if err != nil {
+			return nil, errors.New("Invalid entry %d in %v: %v", i+1, source, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ParseNet parses a network in CIDR notation or a single IP address.
+func ParseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.New("Invalid CIDR %q", s)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("Invalid IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
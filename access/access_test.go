@@ -0,0 +1,114 @@
+package access
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func denied(reason string) int64 {
+	if v, ok := DeniedConnections.Get(reason).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestLists(t *testing.T) {
+	c, err := New(&Opts{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1"},
+		Deny:  []string{"10.1.0.0/16", "2001:db8:bad::/48"},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for client, allowed := range map[string]bool{
+		"10.0.0.1":          true,
+		"10.1.2.3":          false,
+		"192.168.1.1":       true,
+		"192.168.1.2":       false,
+		"::ffff:10.0.0.1":   true,
+		"2001:db8::1":       true,
+		"2001:db8:bad::1":   false,
+		"2001:db9::1":       false,
+		"uid=0/gid=0/pid=1": true,
+	} {
+		assert.Equal(t, allowed, c.Allow(client), client)
+	}
+
+	beforeDeny, beforeNotAllowed := denied(ReasonDenyList), denied(ReasonNotAllowed)
+	c.Allow("10.1.0.1")
+	c.Allow("8.8.8.8")
+	assert.Equal(t, beforeDeny+1, denied(ReasonDenyList))
+	assert.Equal(t, beforeNotAllowed+1, denied(ReasonNotAllowed))
+
+	_, err = New(&Opts{Deny: []string{"10.0.0.0/33"}})
+	assert.Error(t, err)
+}
+
+func TestBans(t *testing.T) {
+	now := time.Now()
+	c, err := New(&Opts{MaxBans: 2})
+	require.NoError(t, err)
+	defer c.Close()
+	c.now = func() time.Time { return now }
+
+	before := denied(ReasonBanned)
+	c.Ban("1.1.1.1", time.Minute, "too many failures")
+	assert.False(t, c.Allow("1.1.1.1"))
+	assert.True(t, c.Allow("1.1.1.2"))
+	assert.Equal(t, before+1, denied(ReasonBanned))
+	assert.Equal(t, map[string]BanInfo{"1.1.1.1": {Until: now.Add(time.Minute), Reason: "too many failures"}}, c.Bans())
+
+	c.Ban("1.1.1.1", time.Second, "shorter")
+	assert.Equal(t, "too many failures", c.Bans()["1.1.1.1"].Reason, "shorter ban should not replace longer one")
+
+	c.Ban("2.2.2.2", 2*time.Minute, "other")
+	c.Ban("3.3.3.3", 3*time.Minute, "other")
+	assert.Len(t, c.Bans(), 2)
+	assert.False(t, c.IsBanned("1.1.1.1"), "ban closest to expiring should be lifted when full")
+
+	assert.True(t, c.Unban("2.2.2.2"))
+	assert.False(t, c.Unban("2.2.2.2"))
+	assert.True(t, c.Allow("2.2.2.2"))
+
+	now = now.Add(3 * time.Minute)
+	assert.True(t, c.Allow("3.3.3.3"), "ban should expire")
+	assert.Empty(t, c.Bans())
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	allowFile := filepath.Join(dir, "allow")
+	denyFile := filepath.Join(dir, "deny")
+	require.NoError(t, ioutil.WriteFile(allowFile, []byte("# office\n10.0.0.0/8\n\n::1 # localhost\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(denyFile, nil, 0644))
+
+	c, err := New(&Opts{AllowFile: allowFile, DenyFile: denyFile, Allow: []string{"127.0.0.1"}, CheckInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer c.Close()
+	assert.True(t, c.Allow("10.1.1.1"))
+	assert.True(t, c.Allow("::1"))
+	assert.True(t, c.Allow("127.0.0.1"))
+	assert.False(t, c.Allow("11.1.1.1"))
+
+	require.NoError(t, ioutil.WriteFile(denyFile, []byte("10.1.0.0/16\n"), 0644))
+	assert.Eventually(t, func() bool {
+		return !c.Allow("10.1.1.1")
+	}, 5*time.Second, 10*time.Millisecond, "should reload changed file")
+
+	require.NoError(t, ioutil.WriteFile(denyFile, []byte("not an address\n10.2.0.0/16\n"), 0644))
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, c.Allow("10.1.1.1"), "should keep previous lists when reloading fails")
+	assert.True(t, c.Allow("10.2.1.1"))
+
+	_, err = New(&Opts{AllowFile: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
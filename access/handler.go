@@ -0,0 +1,35 @@
+package access
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// BansHandler returns an http.Handler for inspecting and clearing the bans on
+// the given Controller. GET lists the current bans as JSON, DELETE lifts the
+// ban on the client given by the "client" query parameter, or all bans if
+// there is none.
+func BansHandler(c *Controller) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(resp).Encode(c.Bans())
+		case http.MethodDelete:
+			client := req.URL.Query().Get("client")
+			if client == "" {
+				c.ClearBans()
+				log.Debug("Cleared all bans")
+			} else if !c.Unban(client) {
+				http.Error(resp, "Not banned", http.StatusNotFound)
+				return
+			} else {
+				log.Debugf("Unbanned %v", client)
+			}
+			resp.WriteHeader(http.StatusNoContent)
+		default:
+			resp.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
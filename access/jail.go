@@ -0,0 +1,237 @@
+package access
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+const (
+	defaultBanDuration    = 10 * time.Minute
+	defaultMaxBanDuration = 24 * time.Hour
+	defaultResetAfter     = 24 * time.Hour
+	defaultMaxClients     = 100000
+)
+
+// AutoBans counts bans imposed by a Jail, broken down by the reason of the
+// failure that triggered them.
+var AutoBans = metrics.Map("auto_bans")
+
+// Rule bans clients that fail at least MaxFailures times within Window.
+type Rule struct {
+	// Reasons are the failure reasons that count toward this rule. If empty,
+	// all failures count.
+	Reasons []errorpages.Reason
+
+	MaxFailures int
+	Window      time.Duration
+}
+
+func (r *Rule) matches(reason errorpages.Reason) bool {
+	if len(r.Reasons) == 0 {
+		return true
+	}
+	for _, candidate := range r.Reasons {
+		if candidate == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRules parses a semicolon separated list of rules given as space
+// separated key=value pairs. Keys are reasons (comma separated failure
+// reasons, all if omitted), failures (MaxFailures) and window (a duration).
+// Omitted failures and windows are left at zero for the caller to default.
+// For example:
+//
+//	reasons=blocked-local,port-not-allowed failures=5 window=1m; reasons=rate-limited failures=100 window=10m
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := Rule{}
+		for _, field := range fields {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.New("Invalid ban rule %q, expected key=value", field)
+			}
+			var err error
+			switch strings.ToLower(kv[0]) {
+			case "reasons":
+				for _, reason := range strings.Split(kv[1], ",") {
+					if reason != "" {
+						rule.Reasons = append(rule.Reasons, errorpages.Reason(strings.ToLower(reason)))
+					}
+				}
+			case "failures":
+				rule.MaxFailures, err = strconv.Atoi(kv[1])
+				if err == nil && rule.MaxFailures <= 0 {
+					err = errors.New("not positive")
+				}
+			case "window":
+				rule.Window, err = time.ParseDuration(kv[1])
+				if err == nil && rule.Window <= 0 {
+					err = errors.New("not positive")
+				}
+			default:
+				return nil, errors.New("Unknown ban rule key %q", kv[0])
+			}
+			if err != nil {
+				return nil, errors.New("Invalid %v in ban rule %q: %v", kv[0], strings.TrimSpace(part), err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// JailOpts configures a Jail.
+type JailOpts struct {
+	Rules []Rule
+
+	// BanDuration is how long clients are banned the first time. Every
+	// subsequent ban doubles the duration up to MaxBanDuration. Defaults to 10
+	// minutes.
+	BanDuration time.Duration
+
+	// MaxBanDuration caps how long clients are banned. Defaults to 24 hours.
+	MaxBanDuration time.Duration
+
+	// ResetAfter is how long a client has to go without being banned for its
+	// ban duration to go back to BanDuration. Defaults to 24 hours.
+	ResetAfter time.Duration
+
+	// MaxClients caps the number of clients whose failures are tracked, the
+	// least recently failing ones are forgotten first. Defaults to 100000.
+	MaxClients int
+}
+
+// Jail tracks failures per client over sliding windows and bans clients on a
+// Controller when they exceed the thresholds of one of its rules, fail2ban
+// style. Bans are enforced by the Controller, so use its Allow as
+// server.Server.Allow to reject banned clients before reading anything from
+// them. It is safe for concurrent use.
+type Jail struct {
+	controller *Controller
+	opts       JailOpts
+	clients    *lru.Cache
+	mx         sync.Mutex
+}
+
+type offender struct {
+	// failures holds the times of recent failures for each rule
+	failures [][]time.Time
+	bans     int
+	lastBan  time.Time
+}
+
+// NewJail constructs a Jail that bans clients on the given Controller.
+func NewJail(controller *Controller, opts *JailOpts) *Jail {
+	j := &Jail{controller: controller, opts: *opts}
+	if j.opts.BanDuration <= 0 {
+		j.opts.BanDuration = defaultBanDuration
+	}
+	if j.opts.MaxBanDuration < j.opts.BanDuration {
+		j.opts.MaxBanDuration = defaultMaxBanDuration
+		if j.opts.MaxBanDuration < j.opts.BanDuration {
+			j.opts.MaxBanDuration = j.opts.BanDuration
+		}
+	}
+	if j.opts.ResetAfter <= 0 {
+		j.opts.ResetAfter = defaultResetAfter
+	}
+	if j.opts.MaxClients <= 0 {
+		j.opts.MaxClients = defaultMaxClients
+	}
+	j.clients, _ = lru.New(j.opts.MaxClients)
+	return j
+}
+
+// Failure records a failure with the given reason for the given client and
+// bans the client if that exceeds the threshold of one of the rules. It
+// returns true if the client got banned.
+func (j *Jail) Failure(client string, reason errorpages.Reason) bool {
+	if client == "" {
+		return false
+	}
+	now := j.controller.now()
+
+	j.mx.Lock()
+	o := j.offender(client)
+	banned := false
+	for i := range j.opts.Rules {
+		rule := &j.opts.Rules[i]
+		if !rule.matches(reason) {
+			continue
+		}
+		o.failures[i] = append(expire(o.failures[i], now.Add(-rule.Window)), now)
+		if len(o.failures[i]) >= rule.MaxFailures {
+			banned = true
+		}
+	}
+	var d time.Duration
+	if banned {
+		if now.Sub(o.lastBan) > j.opts.ResetAfter {
+			o.bans = 0
+		}
+		d = j.opts.BanDuration
+		for i := 0; i < o.bans && d < j.opts.MaxBanDuration; i++ {
+			d *= 2
+		}
+		if d > j.opts.MaxBanDuration {
+			d = j.opts.MaxBanDuration
+		}
+		o.bans++
+		o.lastBan = now
+		for i := range o.failures {
+			o.failures[i] = nil
+		}
+	}
+	j.mx.Unlock()
+
+	if banned {
+		AutoBans.Add(string(reason), 1)
+		log.Debugf("Banning %v for %v after repeated %v failures", client, d, reason)
+		j.controller.Ban(client, d, string(reason))
+	}
+	return banned
+}
+
+// Forgive lifts any ban on the given client and forgets its failures, so
+// that its next ban won't be escalated.
+func (j *Jail) Forgive(client string) {
+	j.mx.Lock()
+	j.clients.Remove(client)
+	j.mx.Unlock()
+	j.controller.Unban(client)
+}
+
+func (j *Jail) offender(client string) *offender {
+	if o, found := j.clients.Get(client); found {
+		return o.(*offender)
+	}
+	o := &offender{failures: make([][]time.Time, len(j.opts.Rules))}
+	j.clients.Add(client, o)
+	return o
+}
+
+// expire drops the times before cutoff from the given chronologically ordered
+// times.
+func expire(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return append(times[:0], times[i:]...)
+}
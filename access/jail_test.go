@@ -0,0 +1,127 @@
+package access
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+func TestJail(t *testing.T) {
+	now := time.Now()
+	c, err := New(&Opts{})
+	require.NoError(t, err)
+	defer c.Close()
+	c.now = func() time.Time { return now }
+	j := NewJail(c, &JailOpts{
+		Rules: []Rule{
+			{Reasons: []errorpages.Reason{errorpages.BlockedLocal, errorpages.PortNotAllowed}, MaxFailures: 3, Window: time.Minute},
+			{MaxFailures: 10, Window: time.Second},
+		},
+		BanDuration:    time.Minute,
+		MaxBanDuration: 3 * time.Minute,
+		ResetAfter:     time.Hour,
+	})
+	client := "1.2.3.4"
+
+	// Failures outside of the window don't count
+	assert.False(t, j.Failure(client, errorpages.BlockedLocal))
+	now = now.Add(50 * time.Second)
+	assert.False(t, j.Failure(client, errorpages.PortNotAllowed))
+	now = now.Add(20 * time.Second)
+	assert.False(t, j.Failure(client, errorpages.RateLimited), "reason not covered by rule")
+	assert.False(t, j.Failure(client, errorpages.BlockedLocal))
+	assert.True(t, c.Allow(client))
+	assert.True(t, j.Failure(client, errorpages.BlockedLocal))
+	assert.False(t, c.Allow(client))
+	assert.Equal(t, BanInfo{Until: now.Add(time.Minute), Reason: string(errorpages.BlockedLocal)}, c.Bans()[client])
+
+	// Bans escalate up to the maximum
+	for _, expected := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		now = now.Add(5 * time.Minute)
+		assert.True(t, c.Allow(client), "ban should have expired")
+		for i := 0; i < 3; i++ {
+			j.Failure(client, errorpages.PortNotAllowed)
+		}
+		assert.Equal(t, now.Add(expected), c.Bans()[client].Until)
+	}
+
+	// Escalation resets after a while
+	now = now.Add(2 * time.Hour)
+	for i := 0; i < 3; i++ {
+		j.Failure(client, errorpages.PortNotAllowed)
+	}
+	assert.Equal(t, now.Add(time.Minute), c.Bans()[client].Until)
+
+	// Any failure counts toward the catch-all rule
+	other := "5.6.7.8"
+	for i := 0; i < 9; i++ {
+		assert.False(t, j.Failure(other, errorpages.RateLimited))
+	}
+	assert.True(t, j.Failure(other, errorpages.RateLimited))
+	assert.False(t, c.Allow(other))
+
+	j.Forgive(other)
+	assert.True(t, c.Allow(other))
+	for i := 0; i < 10; i++ {
+		j.Failure(other, errorpages.RateLimited)
+	}
+	assert.Equal(t, now.Add(time.Minute), c.Bans()[other].Until, "forgiven client should start over")
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("reasons=blocked-local,Port-Not-Allowed failures=3 window=1m; ; reasons=rate-limited failures=100 window=10m; window=1s")
+	require.NoError(t, err)
+	assert.Equal(t, []Rule{
+		{Reasons: []errorpages.Reason{errorpages.BlockedLocal, errorpages.PortNotAllowed}, MaxFailures: 3, Window: time.Minute},
+		{Reasons: []errorpages.Reason{errorpages.RateLimited}, MaxFailures: 100, Window: 10 * time.Minute},
+		{Window: time.Second},
+	}, rules)
+
+	for _, invalid := range []string{
+		"reasons",
+		"reasons=blocked-local failures=0",
+		"reasons=blocked-local failures=many",
+		"reasons=blocked-local window=-1m",
+		"reasons=blocked-local threshold=5",
+	} {
+		_, err := ParseRules(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestBansHandler(t *testing.T) {
+	c, err := New(&Opts{})
+	require.NoError(t, err)
+	defer c.Close()
+	c.Ban("1.1.1.1", time.Minute, "test")
+	c.Ban("2.2.2.2", time.Minute, "test")
+	h := BansHandler(c)
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var bans map[string]BanInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &bans))
+	assert.Len(t, bans, 2)
+	assert.Equal(t, "test", bans["1.1.1.1"].Reason)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/?client=1.1.1.1").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/?client=1.1.1.1").Code)
+	assert.True(t, c.Allow("1.1.1.1"))
+	assert.False(t, c.Allow("2.2.2.2"))
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/").Code)
+	assert.Empty(t, c.Bans())
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "/").Code)
+}
@@ -0,0 +1,320 @@
+// Package circuitbreaker tracks dial failures per destination and stops
+// dialing destinations that keep failing, so that requests to an origin that's
+// down fail fast instead of each one waiting for a dial timeout.
+package circuitbreaker
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy/v2"
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenDuration     = 10 * time.Second
+	defaultMaxOpenDuration  = 5 * time.Minute
+	defaultMaxHosts         = 10000
+)
+
+var (
+	log = golog.LoggerFor("circuitbreaker")
+
+	openedCount   = metrics.Counter("circuitbreaker_opened")
+	rejectedCount = metrics.Counter("circuitbreaker_rejected")
+)
+
+// State is the state of the circuit breaker for a given destination.
+type State int
+
+const (
+	// Closed means that dials are allowed.
+	Closed State = iota
+	// Open means that dials are rejected until the breaker's open period ends.
+	Open
+	// HalfOpen means that a single probe dial is allowed to find out whether
+	// the destination has recovered.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// OpenError is returned when dialing a destination whose circuit is open.
+type OpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("Circuit open for %v, retry after %v", e.Host, e.RetryAfter)
+}
+
+// ServiceUnavailable returns a 503 Service Unavailable response to req with a
+// Retry-After header if err is (or wraps) an *OpenError, or nil otherwise.
+func ServiceUnavailable(req *http.Request, err error) *http.Response {
+	var openErr *OpenError
+	if err == nil || !stderrors.As(err, &openErr) {
+		return nil
+	}
+	resp := errorpages.Default.Response(req, http.StatusServiceUnavailable, errorpages.CircuitOpen, err)
+	resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(openErr.RetryAfter.Seconds()))))
+	return resp
+}
+
+// Opts are used to configure Breakers
+type Opts struct {
+	// FailureThreshold is the number of consecutive dial failures after which
+	// the circuit opens. Defaults to 5.
+	FailureThreshold int
+
+	// OpenDuration is how long the circuit stays open the first time it opens.
+	// Every time a probe fails, the duration doubles up to MaxOpenDuration.
+	// Defaults to 10 seconds.
+	OpenDuration time.Duration
+
+	// MaxOpenDuration caps how long the circuit stays open. Defaults to 5
+	// minutes.
+	MaxOpenDuration time.Duration
+
+	// MaxHosts caps the number of destinations tracked. Defaults to 10000.
+	MaxHosts int
+}
+
+// Breakers tracks a circuit breaker per destination host. It is safe for
+// concurrent use.
+type Breakers struct {
+	opts     Opts
+	breakers *lru.Cache
+	mx       sync.Mutex
+	now      func() time.Time
+}
+
+type breaker struct {
+	state        State
+	failures     int
+	openFor      time.Duration
+	openUntil    time.Time
+	probing      bool
+	lastFailure  error
+	lastModified time.Time
+}
+
+// New constructs new Breakers using the given options.
+func New(opts *Opts) *Breakers {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	b := &Breakers{opts: *opts, now: time.Now}
+	if b.opts.FailureThreshold <= 0 {
+		b.opts.FailureThreshold = defaultFailureThreshold
+	}
+	if b.opts.OpenDuration <= 0 {
+		b.opts.OpenDuration = defaultOpenDuration
+	}
+	if b.opts.MaxOpenDuration < b.opts.OpenDuration {
+		b.opts.MaxOpenDuration = defaultMaxOpenDuration
+		if b.opts.MaxOpenDuration < b.opts.OpenDuration {
+			b.opts.MaxOpenDuration = b.opts.OpenDuration
+		}
+	}
+	if b.opts.MaxHosts <= 0 {
+		b.opts.MaxHosts = defaultMaxHosts
+	}
+	b.breakers, _ = lru.New(b.opts.MaxHosts)
+	metrics.Func("circuitbreaker_states", func() interface{} {
+		return b.States()
+	})
+	return b
+}
+
+// Allow checks whether we're allowed to dial the given host. If not, it returns
+// an *OpenError.
+func (b *Breakers) Allow(host string) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	_br, found := b.breakers.Get(host)
+	if !found {
+		return nil
+	}
+	br := _br.(*breaker)
+	now := b.now()
+	switch br.state {
+	case Open:
+		if now.Before(br.openUntil) {
+			rejectedCount.Add(1)
+			return &OpenError{Host: host, RetryAfter: br.openUntil.Sub(now)}
+		}
+		log.Debugf("Circuit for %v is half-open, allowing probe", host)
+		br.state = HalfOpen
+		br.probing = true
+		br.lastModified = now
+		return nil
+	case HalfOpen:
+		if br.probing {
+			// Only one probe at a time
+			rejectedCount.Add(1)
+			return &OpenError{Host: host, RetryAfter: time.Second}
+		}
+		br.probing = true
+		return nil
+	}
+	return nil
+}
+
+// Success records a successful dial to the given host, closing its circuit.
+func (b *Breakers) Success(host string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if _br, found := b.breakers.Peek(host); found {
+		br := _br.(*breaker)
+		if br.state != Closed {
+			log.Debugf("Circuit for %v closed", host)
+		}
+		b.breakers.Remove(host)
+	}
+}
+
+// Failure records a failed dial to the given host, opening its circuit if the
+// failure threshold has been reached.
+func (b *Breakers) Failure(host string, err error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	var br *breaker
+	_br, found := b.breakers.Get(host)
+	if found {
+		br = _br.(*breaker)
+	} else {
+		br = &breaker{openFor: b.opts.OpenDuration}
+		b.breakers.Add(host, br)
+	}
+
+	now := b.now()
+	br.failures++
+	br.lastFailure = err
+	br.lastModified = now
+	switch br.state {
+	case HalfOpen:
+		// Probe failed, back off further
+		br.openFor *= 2
+		if br.openFor > b.opts.MaxOpenDuration {
+			br.openFor = b.opts.MaxOpenDuration
+		}
+		b.open(host, br, now)
+	case Closed:
+		if br.failures >= b.opts.FailureThreshold {
+			b.open(host, br, now)
+		}
+	}
+}
+
+func (b *Breakers) open(host string, br *breaker, now time.Time) {
+	br.state = Open
+	br.probing = false
+	br.openUntil = now.Add(br.openFor)
+	openedCount.Add(1)
+	log.Debugf("Circuit for %v opened for %v after %d consecutive failures: %v", host, br.openFor, br.failures, br.lastFailure)
+}
+
+// State returns the current state of the circuit for the given host.
+func (b *Breakers) State(host string) State {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if _br, found := b.breakers.Peek(host); found {
+		return _br.(*breaker).state
+	}
+	return Closed
+}
+
+// States returns the state of all destinations whose circuit isn't closed.
+func (b *Breakers) States() map[string]string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	result := make(map[string]string)
+	for _, host := range b.breakers.Keys() {
+		if _br, found := b.breakers.Peek(host); found {
+			if state := _br.(*breaker).state; state != Closed {
+				result[host.(string)] = state.String()
+			}
+		}
+	}
+	return result
+}
+
+// WrapDial wraps the given dial function so that dials to destinations whose
+// circuit is open fail immediately with an *OpenError, and so that the outcome
+// of every dial is recorded. If the dial context was pinned to a specific IP
+// using WithIP, that IP is dialed instead of the host.
+func (b *Breakers) WrapDial(dial proxy.DialFunc) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if err := b.Allow(addr); err != nil {
+			return nil, err
+		}
+		dialAddr := addr
+		if ip := ipFrom(ctx); ip != nil {
+			if _, port, err := net.SplitHostPort(addr); err == nil {
+				dialAddr = net.JoinHostPort(ip.String(), port)
+			}
+		}
+		conn, err := dial(ctx, isCONNECT, network, dialAddr)
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				// The client went away, that's not the destination's fault
+				b.release(addr)
+				return nil, err
+			}
+			b.Failure(addr, err)
+			return nil, err
+		}
+		b.Success(addr)
+		return conn, nil
+	}
+}
+
+// release gives up a probe without recording its outcome.
+func (b *Breakers) release(host string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if _br, found := b.breakers.Peek(host); found {
+		_br.(*breaker).probing = false
+	}
+}
+
+type ipKey struct{}
+
+// WithIP pins dials made with the returned context to the given IP instead of
+// whatever the host resolves to.
+func WithIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, ipKey{}, ip)
+}
+
+func ipFrom(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(ipKey{}).(net.IP)
+	return ip
+}
@@ -0,0 +1,104 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+func TestStateTransitions(t *testing.T) {
+	now := time.Now()
+	b := New(&Opts{FailureThreshold: 3, OpenDuration: 10 * time.Second, MaxOpenDuration: 30 * time.Second})
+	b.now = func() time.Time { return now }
+	host := "origin:80"
+	failure := errors.New("connection refused")
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, b.Allow(host))
+		b.Failure(host, failure)
+	}
+	assert.Equal(t, Closed, b.State(host))
+	b.Success(host)
+	for i := 0; i < 2; i++ {
+		b.Failure(host, failure)
+	}
+	assert.Equal(t, Closed, b.State(host), "success should have reset failure count")
+	b.Failure(host, failure)
+	assert.Equal(t, Open, b.State(host))
+	assert.Equal(t, map[string]string{host: "open"}, b.States())
+
+	err := b.Allow(host)
+	if assert.Error(t, err) {
+		openErr, ok := err.(*OpenError)
+		if assert.True(t, ok) {
+			assert.Equal(t, 10*time.Second, openErr.RetryAfter)
+		}
+	}
+
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, b.Allow(host), "should allow probe once open period elapses")
+	assert.Equal(t, HalfOpen, b.State(host))
+	assert.Error(t, b.Allow(host), "should allow only one probe at a time")
+
+	// Failed probe doubles the open period
+	b.Failure(host, failure)
+	assert.Equal(t, Open, b.State(host))
+	err = b.Allow(host)
+	if assert.Error(t, err) {
+		assert.Equal(t, 20*time.Second, err.(*OpenError).RetryAfter)
+	}
+
+	now = now.Add(20 * time.Second)
+	assert.NoError(t, b.Allow(host))
+	b.Failure(host, failure)
+	assert.Equal(t, 30*time.Second, b.Allow(host).(*OpenError).RetryAfter, "open period should be capped")
+
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, b.Allow(host))
+	b.Success(host)
+	assert.Equal(t, Closed, b.State(host))
+	assert.Empty(t, b.States())
+}
+
+func TestWrapDial(t *testing.T) {
+	b := New(&Opts{FailureThreshold: 2})
+	dials := 0
+	var dialedAddr string
+	dial := b.WrapDial(func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		dials++
+		dialedAddr = addr
+		return nil, errors.New("connection refused")
+	})
+
+	opened := metrics.Counter("circuitbreaker_opened").Value()
+	for i := 0; i < 2; i++ {
+		_, err := dial(context.Background(), true, "tcp", "origin:443")
+		assert.EqualError(t, err, "connection refused")
+	}
+	_, err := dial(context.Background(), true, "tcp", "origin:443")
+	assert.IsType(t, &OpenError{}, err)
+	assert.Equal(t, 2, dials, "should not have dialed once circuit opened")
+	assert.Equal(t, opened+1, metrics.Counter("circuitbreaker_opened").Value())
+	assert.Equal(t, "open", metrics.Snapshot()["circuitbreaker_states"].(map[string]interface{})["origin:443"])
+
+	_, err = dial(WithIP(context.Background(), net.ParseIP("10.0.0.1")), false, "tcp", "other:80")
+	assert.Error(t, err)
+	assert.Equal(t, "10.0.0.1:80", dialedAddr, "should dial pinned IP")
+}
+
+func TestServiceUnavailable(t *testing.T) {
+	assert.Nil(t, ServiceUnavailable(nil, nil))
+	assert.Nil(t, ServiceUnavailable(nil, errors.New("other")))
+	resp := ServiceUnavailable(nil, &OpenError{Host: "origin:80", RetryAfter: 1500 * time.Millisecond})
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, 503, resp.StatusCode)
+		assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+		assert.Equal(t, "circuit-open", resp.Header.Get("X-Proxy-Error"))
+	}
+}
@@ -0,0 +1,124 @@
+// Command replay replays recorded requests (JSON lines or HAR files) against a
+// running proxy and reports latency percentiles, error rate and throughput.
+//
+//	replay -proxy localhost:8080 -standin 127.0.0.1:9000 -timescale 0.5 traffic.har
+//
+// With -standin, requests go to a local stand-in origin that answers with the
+// recorded status and body size. The proxy has to allow that address with
+// -allowlocal. With -maxp99 or -maxerrorrate, replay exits with status 1 if the
+// results are worse, for catching regressions in CI.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/replay"
+)
+
+var (
+	log = golog.LoggerFor("replay-cmd")
+
+	proxyAddr    = flag.String("proxy", "localhost:8080", "Address of the proxy to replay against")
+	concurrency  = flag.Int("concurrency", 10, "Maximum number of requests in flight")
+	timeScale    = flag.Float64("timescale", 1, "Scale of the recorded spacing between requests, 0.5 replays twice as fast, 0 as fast as possible")
+	origins      = flag.String("origins", "", "Comma separated list of host=address pairs of stand-in origins to send recorded hosts' requests to, * for all hosts")
+	standIn      = flag.String("standin", "", "Address to run a local stand-in origin on that all requests are sent to, unless -origins maps their host elsewhere")
+	timeout      = flag.Duration("timeout", 30*time.Second, "Timeout for each request")
+	jsonOutput   = flag.Bool("json", false, "Print the report as JSON")
+	maxP99       = flag.Duration("maxp99", 0, "Fail if the 99th percentile latency exceeds this, 0 to disable")
+	maxErrorRate = flag.Float64("maxerrorrate", -1, "Fail if the error rate (0 to 1) exceeds this, negative to disable")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var records []*replay.Record
+	for _, path := range flag.Args() {
+		loaded, err := replay.LoadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		records = append(records, loaded...)
+	}
+	if flag.NArg() > 1 {
+		// Interleave the files by time
+		records = replay.Merge(records)
+	}
+
+	originMap, err := replay.ParseOrigins(*origins)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *standIn != "" {
+		l, err := net.Listen("tcp", *standIn)
+		if err != nil {
+			log.Fatalf("Unable to listen for stand-in origin: %v", err)
+		}
+		defer l.Close()
+		go http.Serve(l, replay.StandIn)
+		if _, found := originMap["*"]; !found {
+			originMap["*"] = l.Addr().String()
+		}
+		log.Debugf("Stand-in origin listening at %v", l.Addr())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		log.Debug("Interrupted, reporting on what was replayed so far")
+		cancel()
+	}()
+
+	report, err := replay.Run(ctx, &replay.Opts{
+		Proxy:       *proxyAddr,
+		Concurrency: *concurrency,
+		TimeScale:   *timeScale,
+		Origins:     originMap,
+		Timeout:     *timeout,
+	}, records)
+	if err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report.Summary())
+	} else {
+		report.Print(os.Stdout)
+	}
+
+	ok := true
+	if *maxP99 > 0 && report.Percentile(99) > *maxP99 {
+		fmt.Fprintf(os.Stderr, "p99 latency %v exceeds %v\n", report.Percentile(99), *maxP99)
+		ok = false
+	}
+	if *maxErrorRate >= 0 && report.ErrorRate() > *maxErrorRate {
+		fmt.Fprintf(os.Stderr, "Error rate %.4f exceeds %.4f\n", report.ErrorRate(), *maxErrorRate)
+		ok = false
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,40 @@
+package dialer
+
+import (
+	"context"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+type clientInfoKey struct{}
+
+// ClientInfo identifies the client on whose behalf we're dialing. The server
+// attaches one ClientInfo per client connection to the dial context and to
+// every request's context, so filters that identify the user can set User
+// before the upstream gets dialed.
+//
+// For clients connected over a Unix domain socket, IP holds the peer
+// credentials formatted by listeners.PeerCred.String and Peer holds the
+// credentials themselves.
+//
+// Route names one of the dialer's Opts.Routes to take source IPs from. Like
+// User, filters can set it before the upstream gets dialed. The server clears
+// it at the start of every request.
+type ClientInfo struct {
+	IP    string
+	User  string
+	Peer  *listeners.PeerCred
+	Route string
+}
+
+// WithClientInfo returns a copy of ctx carrying the given ClientInfo.
+func WithClientInfo(ctx context.Context, info *ClientInfo) context.Context {
+	return context.WithValue(ctx, clientInfoKey{}, info)
+}
+
+// ClientInfoFrom returns the ClientInfo carried by ctx, or nil if there is
+// none.
+func ClientInfoFrom(ctx context.Context) *ClientInfo {
+	info, _ := ctx.Value(clientInfoKey{}).(*ClientInfo)
+	return info
+}
@@ -0,0 +1,396 @@
+// Package dialer provides a dialer for upstream connections that races IPv6
+// and IPv4 addresses per RFC 8305 (Happy Eyeballs v2) and that selects the
+// local source address from a pool of egress IPs.
+package dialer
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/ops"
+
+	"github.com/getlantern/http-proxy/resolver"
+	"github.com/getlantern/http-proxy/tracing"
+)
+
+const (
+	// DefaultFallbackDelay is the Connection Attempt Delay recommended by
+	// RFC 8305.
+	DefaultFallbackDelay = 250 * time.Millisecond
+
+	defaultTimeout = 30 * time.Second
+)
+
+var (
+	log = golog.LoggerFor("dialer")
+)
+
+// SourceSelection determines how the local source IP is picked from the pool.
+type SourceSelection int
+
+const (
+	// RoundRobin cycles through the source IPs on every dial.
+	RoundRobin SourceSelection = iota
+
+	// PerClient always uses the same source IP for a given client IP.
+	PerClient
+
+	// PerUser always uses the same source IP for a given user, falling back to
+	// PerClient if the user is unknown.
+	PerUser
+)
+
+// ParseSourceSelection parses the name of a SourceSelection ("roundrobin",
+// "client" or "user").
+func ParseSourceSelection(s string) (SourceSelection, error) {
+	switch strings.ToLower(s) {
+	case "", "roundrobin":
+		return RoundRobin, nil
+	case "client":
+		return PerClient, nil
+	case "user":
+		return PerUser, nil
+	default:
+		return RoundRobin, errors.New("Unknown source selection %v", s)
+	}
+}
+
+// Opts are used to configure a Dialer
+type Opts struct {
+	// Resolver resolves upstream hosts. If unspecified, a caching resolver
+	// backed by the system resolver is used.
+	Resolver *resolver.Resolver
+
+	// PreferIPv4 makes the dialer try IPv4 addresses first. By default, IPv6 is
+	// preferred as recommended by RFC 8305.
+	PreferIPv4 bool
+
+	// FallbackDelay is how long to wait for a connection attempt before racing
+	// the next address. Defaults to DefaultFallbackDelay.
+	FallbackDelay time.Duration
+
+	// Timeout bounds the whole dial. Defaults to 30 seconds.
+	Timeout time.Duration
+
+	// SourceIPs is a pool of local IP addresses to use as the source of
+	// upstream connections. If empty, the operating system picks one.
+	SourceIPs []string
+
+	// SourceSelection determines how source IPs are picked from the pool.
+	SourceSelection SourceSelection
+
+	// Routes are named pools of source IPs. Filters can route a client's
+	// upstream connections through one of them by setting ClientInfo.Route,
+	// in which case its source IPs are used instead of SourceIPs.
+	Routes map[string][]string
+}
+
+// Dialer dials upstream connections. It is safe for concurrent use.
+type Dialer struct {
+	resolver        *resolver.Resolver
+	preferIPv4      bool
+	fallbackDelay   time.Duration
+	timeout         time.Duration
+	sourceSelection SourceSelection
+	sources4        []net.IP
+	sources6        []net.IP
+	routes          map[string]*route
+	next            uint64
+
+	// dial performs a single connection attempt, replaced in tests
+	dial func(ctx context.Context, network string, laddr, raddr net.IP, port string) (net.Conn, error)
+}
+
+// New constructs a new Dialer using the given options.
+func New(opts *Opts) (*Dialer, error) {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	d := &Dialer{
+		resolver:        opts.Resolver,
+		preferIPv4:      opts.PreferIPv4,
+		fallbackDelay:   opts.FallbackDelay,
+		timeout:         opts.Timeout,
+		sourceSelection: opts.SourceSelection,
+		dial:            dialOne,
+	}
+	if d.resolver == nil {
+		d.resolver, _ = resolver.New(nil)
+	}
+	if d.fallbackDelay <= 0 {
+		d.fallbackDelay = DefaultFallbackDelay
+	}
+	if d.timeout <= 0 {
+		d.timeout = defaultTimeout
+	}
+	var err error
+	d.sources4, d.sources6, err = parseSources(opts.SourceIPs)
+	if err != nil {
+		return nil, err
+	}
+	d.routes = make(map[string]*route, len(opts.Routes))
+	for name, sources := range opts.Routes {
+		r := &route{}
+		r.sources4, r.sources6, err = parseSources(sources)
+		if err != nil {
+			return nil, err
+		}
+		d.routes[name] = r
+	}
+	return d, nil
+}
+
+// route is a named pool of source IPs.
+type route struct {
+	sources4 []net.IP
+	sources6 []net.IP
+}
+
+func parseSources(sources []string) (sources4 []net.IP, sources6 []net.IP, err error) {
+	for _, s := range sources {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return nil, nil, errors.New("Invalid source IP %v", s)
+		}
+		if ip.To4() != nil {
+			sources4 = append(sources4, ip.To4())
+		} else {
+			sources6 = append(sources6, ip)
+		}
+	}
+	return sources4, sources6, nil
+}
+
+// ParseRoutes parses a semicolon separated list of routes of the form
+// name=ip,ip like "eu=192.0.2.1,2001:db8::1;us=198.51.100.1" for use as
+// Opts.Routes.
+func ParseRoutes(s string) (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		nameAndSources := strings.SplitN(part, "=", 2)
+		name := strings.TrimSpace(nameAndSources[0])
+		if len(nameAndSources) != 2 || name == "" {
+			return nil, errors.New("Invalid route %q, expected name=ips", part)
+		}
+		for _, source := range strings.Split(nameAndSources[1], ",") {
+			if source = strings.TrimSpace(source); source != "" {
+				routes[name] = append(routes[name], source)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// sourcesFor returns the source IPs to use for the given client, which are
+// those of the client's route if it has one.
+func (d *Dialer) sourcesFor(client *ClientInfo) (sources4 []net.IP, sources6 []net.IP) {
+	if client != nil && client.Route != "" {
+		if r, found := d.routes[client.Route]; found {
+			return r.sources4, r.sources6
+		}
+		log.Debugf("Unknown route %v, using default sources", client.Route)
+	}
+	return d.sources4, d.sources6
+}
+
+// Dial implements proxy.DialFunc so that it can be used as server.Opts.Dial.
+func (d *Dialer) Dial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	return d.DialContext(ctx, network, addr)
+}
+
+// DialContext dials the given address, racing the resolved addresses with
+// Happy Eyeballs. The client on whose behalf we're dialing is taken from the
+// ClientInfo in ctx, if any.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	op := ops.Begin("dial").Set("dial_addr", addr)
+	defer op.End()
+	tracing.StartFromContext(ctx, op, tracing.Client)
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	ips, err := d.resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, op.FailIf(err)
+	}
+	client := ClientInfoFrom(ctx)
+	ips = d.sortAddrs(network, ips, client)
+	if len(ips) == 0 {
+		return nil, op.FailIf(errors.New("No suitable address for %v on %v", addr, network))
+	}
+
+	conn, err := d.race(ctx, network, ips, port, client)
+	op.FailIf(err)
+	return conn, err
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// race starts a connection attempt to each of the given addresses in order,
+// starting the next one whenever the fallback delay elapses or the prior
+// attempt fails. The first successful connection wins.
+func (d *Dialer) race(ctx context.Context, network string, ips []net.IP, port string, client *ClientInfo) (net.Conn, error) {
+	raceCtx, cancelRace := context.WithCancel(ctx)
+	defer cancelRace()
+
+	results := make(chan *dialResult, len(ips))
+	next, pending := 0, 0
+	startNext := func() {
+		ip := ips[next]
+		next++
+		pending++
+		source := d.pickSource(ip, client)
+		go func() {
+			conn, err := d.dial(raceCtx, network, source, ip, port)
+			results <- &dialResult{conn, err}
+		}()
+	}
+
+	timer := time.NewTimer(d.fallbackDelay)
+	defer timer.Stop()
+	resetTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d.fallbackDelay)
+	}
+
+	startNext()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if pending > 0 {
+					// Close connections from attempts that succeed after we've picked a
+					// winner.
+					go closeLosers(results, pending)
+				}
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(ips) && ctx.Err() == nil {
+				startNext()
+				resetTimer()
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				log.Tracef("Attempt to %v didn't finish within %v, racing %v", ips[next-1], d.fallbackDelay, ips[next])
+				startNext()
+				timer.Reset(d.fallbackDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+func closeLosers(results chan *dialResult, pending int) {
+	for i := 0; i < pending; i++ {
+		result := <-results
+		if result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
+
+// sortAddrs orders addresses per RFC 8305 section 4, interleaving address
+// families starting with the preferred one. Addresses of families that can't be
+// used for the given network or for which we have no source IP for the given
+// client are dropped.
+func (d *Dialer) sortAddrs(network string, ips []net.IP, client *ClientInfo) []net.IP {
+	sources4, sources6 := d.sourcesFor(client)
+	hasSources := len(sources4) > 0 || len(sources6) > 0
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if !strings.HasSuffix(network, "6") && (!hasSources || len(sources4) > 0) {
+				v4 = append(v4, ip)
+			}
+		} else if !strings.HasSuffix(network, "4") && (!hasSources || len(sources6) > 0) {
+			v6 = append(v6, ip)
+		}
+	}
+
+	first, second := v6, v4
+	if d.preferIPv4 {
+		first, second = v4, v6
+	}
+	result := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			result = append(result, first[i])
+		}
+		if i < len(second) {
+			result = append(result, second[i])
+		}
+	}
+	return result
+}
+
+// pickSource picks a source IP of the same family as dest, or nil to let the
+// operating system decide.
+func (d *Dialer) pickSource(dest net.IP, client *ClientInfo) net.IP {
+	sources4, sources6 := d.sourcesFor(client)
+	sources := sources6
+	if dest.To4() != nil {
+		sources = sources4
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	key := ""
+	if client != nil {
+		switch d.sourceSelection {
+		case PerUser:
+			key = client.User
+			if key == "" {
+				key = client.IP
+			}
+		case PerClient:
+			key = client.IP
+		}
+	}
+	if key == "" {
+		return sources[int(atomic.AddUint64(&d.next, 1)-1)%len(sources)]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return sources[int(h.Sum32()%uint32(len(sources)))]
+}
+
+func dialOne(ctx context.Context, network string, laddr, raddr net.IP, port string) (net.Conn, error) {
+	d := &net.Dialer{}
+	if laddr != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: laddr}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: laddr}
+		}
+	}
+	return d.DialContext(ctx, network, net.JoinHostPort(raddr.String(), port))
+}
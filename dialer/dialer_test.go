@@ -0,0 +1,196 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+func TestSortAddrs(t *testing.T) {
+	ips := parseIPs("1.1.1.1", "1.1.1.2", "2001:db8::1", "2001:db8::2", "2001:db8::3")
+
+	d, _ := New(nil)
+	assert.Equal(t, []string{"2001:db8::1", "1.1.1.1", "2001:db8::2", "1.1.1.2", "2001:db8::3"}, strs(d.sortAddrs("tcp", ips, nil)))
+	assert.Equal(t, []string{"1.1.1.1", "1.1.1.2"}, strs(d.sortAddrs("tcp4", ips, nil)))
+	assert.Equal(t, []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"}, strs(d.sortAddrs("tcp6", ips, nil)))
+
+	d, _ = New(&Opts{PreferIPv4: true})
+	assert.Equal(t, []string{"1.1.1.1", "2001:db8::1", "1.1.1.2", "2001:db8::2", "2001:db8::3"}, strs(d.sortAddrs("tcp", ips, nil)))
+
+	d, _ = New(&Opts{SourceIPs: []string{"10.0.0.1"}})
+	assert.Equal(t, []string{"1.1.1.1", "1.1.1.2"}, strs(d.sortAddrs("tcp", ips, nil)), "should skip IPv6 without IPv6 source")
+}
+
+func TestPickSource(t *testing.T) {
+	_, err := New(&Opts{SourceIPs: []string{"notanip"}})
+	assert.Error(t, err)
+
+	d, err := New(&Opts{SourceIPs: []string{"10.0.0.1", "10.0.0.2", "2001:db8::1"}})
+	require.NoError(t, err)
+	v4 := net.ParseIP("1.1.1.1")
+	v6 := net.ParseIP("2001:db8::99")
+	client := &ClientInfo{IP: "5.5.5.5"}
+	assert.Equal(t, "10.0.0.1", d.pickSource(v4, client).String())
+	assert.Equal(t, "10.0.0.2", d.pickSource(v4, client).String())
+	assert.Equal(t, "10.0.0.1", d.pickSource(v4, nil).String())
+	assert.Equal(t, "2001:db8::1", d.pickSource(v6, client).String())
+
+	d.sourceSelection = PerClient
+	first := d.pickSource(v4, client)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, d.pickSource(v4, client), "should stick to same source for client")
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[d.pickSource(v4, &ClientInfo{IP: net.IPv4(5, 5, 5, byte(i)).String()}).String()] = true
+	}
+	assert.Len(t, seen, 2, "different clients should be spread across sources")
+
+	d.sourceSelection = PerUser
+	alice := d.pickSource(v4, &ClientInfo{IP: "5.5.5.1", User: "alice"})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, alice, d.pickSource(v4, &ClientInfo{IP: net.IPv4(5, 5, 5, byte(i)).String(), User: "alice"}), "should stick to same source for user")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	routes, err := ParseRoutes("eu=10.1.0.1, 10.1.0.2; v6=2001:db8::1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"eu": {"10.1.0.1", "10.1.0.2"}, "v6": {"2001:db8::1"}}, routes)
+	_, err = ParseRoutes("eu")
+	assert.Error(t, err)
+
+	d, err := New(&Opts{SourceIPs: []string{"10.0.0.1"}, Routes: routes})
+	require.NoError(t, err)
+	ips := parseIPs("1.1.1.1", "2001:db8::99")
+	v4 := net.ParseIP("1.1.1.1")
+	assert.Equal(t, "10.0.0.1", d.pickSource(v4, &ClientInfo{IP: "5.5.5.5"}).String())
+	eu := &ClientInfo{IP: "5.5.5.5", Route: "eu"}
+	assert.ElementsMatch(t, []string{"10.1.0.1", "10.1.0.2"}, []string{d.pickSource(v4, eu).String(), d.pickSource(v4, eu).String()})
+	assert.Equal(t, "10.0.0.1", d.pickSource(v4, &ClientInfo{Route: "unknown"}).String(), "unknown routes should use the default sources")
+	assert.Equal(t, []string{"2001:db8::99"}, strs(d.sortAddrs("tcp", ips, &ClientInfo{Route: "v6"})), "should only use families the route has sources for")
+
+	_, err = New(&Opts{Routes: map[string][]string{"bad": {"notanip"}}})
+	assert.Error(t, err)
+}
+
+func TestHappyEyeballsFallback(t *testing.T) {
+	r, _ := resolver.New(&resolver.Opts{
+		Hosts: map[string][]string{"dualstack.test": {"2001:db8::1", "192.0.2.1"}},
+	})
+	d, _ := New(&Opts{Resolver: r, FallbackDelay: 50 * time.Millisecond})
+
+	var mx sync.Mutex
+	var attempts []string
+	d.dial = func(ctx context.Context, network string, laddr, raddr net.IP, port string) (net.Conn, error) {
+		mx.Lock()
+		attempts = append(attempts, raddr.String())
+		mx.Unlock()
+		if raddr.To4() == nil {
+			// IPv6 is black-holed
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", "dualstack.test:443")
+	require.NoError(t, err)
+	conn.Close()
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 50*time.Millisecond, "should have waited for fallback delay, only waited %v", elapsed)
+	assert.True(t, elapsed < 1*time.Second, "should not have waited for IPv6 to time out, waited %v", elapsed)
+	mx.Lock()
+	assert.Equal(t, []string{"2001:db8::1", "192.0.2.1"}, attempts)
+	mx.Unlock()
+}
+
+func TestHappyEyeballsImmediateFallbackOnFailure(t *testing.T) {
+	r, _ := resolver.New(&resolver.Opts{
+		Hosts: map[string][]string{"dualstack.test": {"2001:db8::1", "192.0.2.1"}},
+	})
+	d, _ := New(&Opts{Resolver: r, FallbackDelay: 10 * time.Second})
+	d.dial = func(ctx context.Context, network string, laddr, raddr net.IP, port string) (net.Conn, error) {
+		if raddr.To4() == nil {
+			return nil, errors.New("network unreachable")
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", "dualstack.test:443")
+	require.NoError(t, err)
+	conn.Close()
+	assert.True(t, time.Since(start) < 1*time.Second, "should have fallen back without waiting for delay")
+}
+
+func TestAllAttemptsFail(t *testing.T) {
+	r, _ := resolver.New(&resolver.Opts{
+		Hosts: map[string][]string{"dualstack.test": {"2001:db8::1", "192.0.2.1"}},
+	})
+	d, _ := New(&Opts{Resolver: r})
+	d.dial = func(ctx context.Context, network string, laddr, raddr net.IP, port string) (net.Conn, error) {
+		return nil, errors.New("failed to dial " + raddr.String())
+	}
+	_, err := d.DialContext(context.Background(), "tcp", "dualstack.test:443")
+	if assert.Error(t, err) {
+		assert.Equal(t, "failed to dial 2001:db8::1", err.Error(), "should return error from first attempt")
+	}
+}
+
+func TestSourceIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	remoteIPs := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			remoteIPs <- host
+			conn.Close()
+		}
+	}()
+
+	d, err := New(&Opts{SourceIPs: []string{"127.0.0.2", "127.0.0.3"}})
+	require.NoError(t, err)
+	for _, expected := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.2"} {
+		conn, err := d.Dial(context.Background(), true, "tcp", l.Addr().String())
+		require.NoError(t, err)
+		conn.Close()
+		assert.Equal(t, expected, <-remoteIPs)
+	}
+}
+
+func parseIPs(addrs ...string) []net.IP {
+	result := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		result = append(result, net.ParseIP(addr))
+	}
+	return result
+}
+
+func strs(ips []net.IP) []string {
+	result := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		result = append(result, ip.String())
+	}
+	return result
+}
@@ -0,0 +1,384 @@
+// Package errorpages renders the error responses that the proxy sends to
+// clients. Responses are negotiated based on the request's Accept header and
+// can be an HTML page, JSON, application/problem+json (RFC 7807) or plain
+// text. Every response carries a request ID and a reason code so that clients
+// and support staff can tell what went wrong without us exposing internal
+// error details, which are hidden by default.
+package errorpages
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	htmltemplate "html/template"
+	"net/http"
+	"strconv"
+	texttemplate "text/template"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+var log = golog.LoggerFor("errorpages")
+
+// Reason is a machine readable code explaining why a request failed.
+type Reason string
+
+const (
+	// BadRequest means the client sent a malformed request.
+	BadRequest Reason = "bad-request"
+	// RequestTimeout means the client took too long to send its request.
+	RequestTimeout Reason = "request-timeout"
+	// HeaderTooLarge means the request head was too big or had too many
+	// header fields.
+	HeaderTooLarge Reason = "header-too-large"
+	// BlockedLocal means the request targeted a local or private address.
+	BlockedLocal Reason = "blocked-local"
+	// PortNotAllowed means the request targeted a port that isn't allowed.
+	PortNotAllowed Reason = "port-not-allowed"
+	// HostNotAllowed means the request targeted a host that isn't allowed.
+	HostNotAllowed Reason = "host-not-allowed"
+	// RateLimited means the client exceeded its rate limit.
+	RateLimited Reason = "rate-limited"
+	// UpstreamUnavailable means we couldn't reach the origin.
+	UpstreamUnavailable Reason = "upstream-unavailable"
+	// UpstreamTimeout means the origin didn't respond in time.
+	UpstreamTimeout Reason = "upstream-timeout"
+	// CircuitOpen means the origin has been failing and we're not currently
+	// trying to reach it.
+	CircuitOpen Reason = "circuit-open"
+	// Internal means something went wrong inside the proxy.
+	Internal Reason = "internal-error"
+)
+
+var messages = map[Reason]string{
+	BadRequest:          "The request could not be understood by the proxy.",
+	RequestTimeout:      "The request was not received in time.",
+	HeaderTooLarge:      "The request headers are too large.",
+	BlockedLocal:        "The requested address is on a local or private network and cannot be reached through this proxy.",
+	PortNotAllowed:      "The requested port is not allowed by this proxy.",
+	HostNotAllowed:      "The requested site is not allowed by this proxy.",
+	RateLimited:         "Too many requests, please try again later.",
+	UpstreamUnavailable: "The requested site could not be reached.",
+	UpstreamTimeout:     "The requested site took too long to respond.",
+	CircuitOpen:         "The requested site is currently unreachable, please try again later.",
+	Internal:            "The proxy encountered an internal error.",
+}
+
+// ReasonForStatus returns the default reason for the given status code.
+func ReasonForStatus(status int) Reason {
+	switch status {
+	case http.StatusBadRequest:
+		return BadRequest
+	case http.StatusRequestTimeout:
+		return RequestTimeout
+	case http.StatusRequestHeaderFieldsTooLarge:
+		return HeaderTooLarge
+	case http.StatusTooManyRequests:
+		return RateLimited
+	case http.StatusBadGateway:
+		return UpstreamUnavailable
+	case http.StatusServiceUnavailable:
+		return CircuitOpen
+	case http.StatusGatewayTimeout:
+		return UpstreamTimeout
+	}
+	return Internal
+}
+
+// Error is an error that carries the status and reason with which it should be
+// rendered to clients.
+type Error struct {
+	Status int
+	Reason Reason
+	Err    error
+}
+
+// NewError constructs a new Error with a description formatted like
+// errors.New.
+func NewError(status int, reason Reason, description string, params ...interface{}) *Error {
+	return &Error{Status: status, Reason: reason, Err: errors.New(description, params...)}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ReasonOf returns the reason carried by err, if it is or wraps an *Error, or
+// an empty Reason otherwise.
+func ReasonOf(err error) Reason {
+	var e *Error
+	if err != nil && stderrors.As(err, &e) {
+		return e.Reason
+	}
+	return ""
+}
+
+// Page is the data available to templates.
+type Page struct {
+	Brand      string
+	Status     int
+	StatusText string
+	Reason     Reason
+	Message    string
+	RequestID  string
+	// Detail is the internal error text, only populated if the Renderer was
+	// configured with ExposeDetails.
+	Detail string
+}
+
+// Opts configures a Renderer.
+type Opts struct {
+	// Brand is shown in page titles. Defaults to "HTTP Proxy".
+	Brand string
+
+	// HTMLTemplate is an html/template used to render HTML pages. Defaults to
+	// a simple built-in page.
+	HTMLTemplate string
+
+	// TextTemplate is a text/template used to render plain text responses.
+	// Defaults to a short built-in message.
+	TextTemplate string
+
+	// ProblemTypeBase, if set, is prefixed to the reason code to form the type
+	// URI of problem+json responses. Otherwise, the type is "about:blank".
+	ProblemTypeBase string
+
+	// ExposeDetails includes internal error details in responses. Only enable
+	// this for debugging.
+	ExposeDetails bool
+}
+
+// Renderer renders error responses.
+type Renderer struct {
+	opts Opts
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+const (
+	defaultBrand = "HTTP Proxy"
+
+	defaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}} - {{.Brand}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .Detail}}<pre>{{.Detail}}</pre>
+{{end}}<p><small>{{.Brand}} &middot; Reason: {{.Reason}} &middot; Request ID: {{.RequestID}}</small></p>
+</body>
+</html>
+`
+
+	defaultTextTemplate = `{{.Status}} {{.StatusText}}: {{.Message}}
+Reason: {{.Reason}}
+Request ID: {{.RequestID}}
+{{if .Detail}}Detail: {{.Detail}}
+{{end}}`
+)
+
+// Default is the Renderer used by the proxy's filters and error handlers.
+var Default = mustNew(nil)
+
+// New constructs a new Renderer, returning an error if one of the configured
+// templates doesn't parse.
+func New(opts *Opts) (*Renderer, error) {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	r := &Renderer{opts: *opts}
+	if r.opts.Brand == "" {
+		r.opts.Brand = defaultBrand
+	}
+	if r.opts.HTMLTemplate == "" {
+		r.opts.HTMLTemplate = defaultHTMLTemplate
+	}
+	if r.opts.TextTemplate == "" {
+		r.opts.TextTemplate = defaultTextTemplate
+	}
+	var err error
+	r.html, err = htmltemplate.New("html").Parse(r.opts.HTMLTemplate)
+	if err != nil {
+		return nil, errors.New("Unable to parse HTML error template: %v", err)
+	}
+	r.text, err = texttemplate.New("text").Parse(r.opts.TextTemplate)
+	if err != nil {
+		return nil, errors.New("Unable to parse text error template: %v", err)
+	}
+	return r, nil
+}
+
+func mustNew(opts *Opts) *Renderer {
+	r, err := New(opts)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// body marks response bodies produced by a Renderer, see IsRendered.
+type body struct {
+	*bytes.Reader
+}
+
+func (b *body) Close() error {
+	return nil
+}
+
+// IsRendered indicates whether resp was produced by a Renderer.
+func IsRendered(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	_, ok := resp.Body.(*body)
+	return ok
+}
+
+// Response renders an error response for the given request, which may be nil
+// if the request couldn't be read. If reason is empty, it's taken from err if
+// that's an *Error, or else derived from the status.
+func (r *Renderer) Response(req *http.Request, status int, reason Reason, err error) *http.Response {
+	header, content := r.render(req, status, reason, err)
+	resp := &http.Response{
+		Request:       req,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		StatusCode:    status,
+		Header:        header,
+		Body:          &body{bytes.NewReader(content)},
+		ContentLength: int64(len(content)),
+		Close:         true,
+	}
+	if req != nil && req.ProtoMajor > 0 {
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = req.Proto, req.ProtoMajor, req.ProtoMinor
+	}
+	return resp
+}
+
+// ServeHTTP renders an error response for the given request to w.
+func (r *Renderer) ServeHTTP(w http.ResponseWriter, req *http.Request, status int, reason Reason, err error) {
+	header, content := r.render(req, status, reason, err)
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+func (r *Renderer) render(req *http.Request, status int, reason Reason, err error) (http.Header, []byte) {
+	if reason == "" {
+		reason = ReasonOf(err)
+	}
+	if reason == "" {
+		reason = ReasonForStatus(status)
+	}
+	message := messages[reason]
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	page := &Page{
+		Brand:      r.opts.Brand,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Reason:     reason,
+		Message:    message,
+		RequestID:  RequestID(req),
+	}
+	if r.opts.ExposeDetails && err != nil {
+		page.Detail = err.Error()
+	}
+
+	contentType := negotiate(req)
+	var buf bytes.Buffer
+	var renderErr error
+	switch contentType {
+	case contentTypeHTML:
+		renderErr = r.html.Execute(&buf, page)
+	case contentTypeJSON:
+		renderErr = json.NewEncoder(&buf).Encode(r.jsonBody(page))
+	case contentTypeProblem:
+		renderErr = json.NewEncoder(&buf).Encode(r.problemBody(page))
+	default:
+		renderErr = r.text.Execute(&buf, page)
+	}
+	if renderErr != nil {
+		log.Errorf("Unable to render %v error page: %v", contentType, renderErr)
+		contentType = contentTypeText
+		buf.Reset()
+		buf.WriteString(page.StatusText)
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set(RequestIDHeader, page.RequestID)
+	header.Set(ReasonHeader, string(reason))
+	header.Add("Vary", "Accept")
+	return header, buf.Bytes()
+}
+
+func (r *Renderer) jsonBody(page *Page) interface{} {
+	return &struct {
+		Status    int    `json:"status"`
+		Reason    Reason `json:"reason"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+		Detail    string `json:"detail,omitempty"`
+	}{page.Status, page.Reason, page.Message, page.RequestID, page.Detail}
+}
+
+func (r *Renderer) problemBody(page *Page) interface{} {
+	problemType := "about:blank"
+	if r.opts.ProblemTypeBase != "" {
+		problemType = r.opts.ProblemTypeBase + string(page.Reason)
+	}
+	return &struct {
+		Type      string `json:"type"`
+		Title     string `json:"title"`
+		Status    int    `json:"status"`
+		Detail    string `json:"detail"`
+		Instance  string `json:"instance"`
+		Reason    Reason `json:"reason"`
+		RequestID string `json:"request_id"`
+		Error     string `json:"error,omitempty"`
+	}{problemType, page.StatusText, page.Status, page.Message, "urn:request:" + page.RequestID, page.Reason, page.RequestID, page.Detail}
+}
+
+const (
+	// RequestIDHeader is the header that carries the request ID.
+	RequestIDHeader = "X-Request-Id"
+
+	// ReasonHeader is the header that carries the reason code of an error
+	// response.
+	ReasonHeader = "X-Proxy-Error"
+)
+
+// RequestID returns the ID of the given request, taken from its
+// X-Request-Id header. If the request doesn't have one, a new random ID is
+// generated.
+func RequestID(req *http.Request) string {
+	if req != nil {
+		if id := req.Header.Get(RequestIDHeader); id != "" {
+			return id
+		}
+	}
+	return NewRequestID()
+}
+
+// NewRequestID generates a new random request ID.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,106 @@
+package errorpages
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"":    contentTypeText,
+		"*/*": contentTypeText,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": contentTypeHTML,
+		"application/json":                                 contentTypeJSON,
+		"application/problem+json":                         contentTypeProblem,
+		"application/*":                                    contentTypeJSON,
+		"application/json;q=0.5, text/html":                contentTypeHTML,
+		"application/problem+json, application/json;q=0.9": contentTypeProblem,
+		"image/png":                                        contentTypeText,
+		"text/html;q=0, */*":                               contentTypeText,
+		"garbage;;;":                                       contentTypeText,
+	}
+	for accept, expected := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.Header.Set("Accept", accept)
+		assert.Equal(t, expected, negotiate(req), accept)
+	}
+	assert.Equal(t, contentTypeText, negotiate(nil))
+}
+
+func TestRender(t *testing.T) {
+	r, err := New(&Opts{Brand: "Acme Proxy", ProblemTypeBase: "https://errors.example.com/"})
+	require.NoError(t, err)
+	internal := NewError(http.StatusForbidden, BlockedLocal, "1.2.3.4 requested local address %v", "127.0.0.1")
+
+	render := func(accept string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set(RequestIDHeader, "abc123")
+		resp := r.Response(req, http.StatusForbidden, "", internal)
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.True(t, IsRendered(resp))
+		assert.Equal(t, "abc123", resp.Header.Get(RequestIDHeader))
+		assert.Equal(t, "blocked-local", resp.Header.Get(ReasonHeader))
+		assert.Equal(t, int64(len(b)), resp.ContentLength)
+		assert.NotContains(t, string(b), "127.0.0.1", "should not expose internal details")
+		return resp, string(b)
+	}
+
+	resp, body := render("text/html")
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, "<title>403 Forbidden - Acme Proxy</title>")
+	assert.Contains(t, body, "Request ID: abc123")
+
+	resp, body = render("application/json")
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"))
+	var j map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(body), &j))
+	assert.Equal(t, "blocked-local", j["reason"])
+	assert.Equal(t, "abc123", j["request_id"])
+	assert.EqualValues(t, 403, j["status"])
+	assert.Nil(t, j["detail"])
+
+	resp, body = render("application/problem+json")
+	assert.Equal(t, "application/problem+json; charset=utf-8", resp.Header.Get("Content-Type"))
+	var p map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(body), &p))
+	assert.Equal(t, "https://errors.example.com/blocked-local", p["type"])
+	assert.Equal(t, "Forbidden", p["title"])
+	assert.Equal(t, messages[BlockedLocal], p["detail"])
+	assert.Equal(t, "urn:request:abc123", p["instance"])
+
+	_, body = render("")
+	assert.Equal(t, "403 Forbidden: "+messages[BlockedLocal]+"\nReason: blocked-local\nRequest ID: abc123\n", body)
+}
+
+func TestExposeDetails(t *testing.T) {
+	r, err := New(&Opts{ExposeDetails: true})
+	require.NoError(t, err)
+	resp := r.Response(nil, http.StatusBadGateway, "", errors.New("dial tcp 10.0.0.1:80: connection refused"))
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(b), "Reason: upstream-unavailable")
+	assert.Contains(t, string(b), "Detail: dial tcp 10.0.0.1:80: connection refused")
+	assert.Len(t, resp.Header.Get(RequestIDHeader), 32, "should generate request ID")
+}
+
+func TestCustomTemplate(t *testing.T) {
+	_, err := New(&Opts{HTMLTemplate: "{{.Broken"})
+	assert.Error(t, err)
+
+	r, err := New(&Opts{HTMLTemplate: "<p>{{.Reason}} {{.Message}}</p>"})
+	require.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req, http.StatusForbidden, RateLimited, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "<p>rate-limited Too many requests, please try again later.</p>", w.Body.String())
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+}
@@ -0,0 +1,79 @@
+package errorpages
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeText    = "text/plain"
+	contentTypeHTML    = "text/html"
+	contentTypeJSON    = "application/json"
+	contentTypeProblem = "application/problem+json"
+)
+
+// offers are the content types we can render, in order of preference when the
+// client accepts several of them equally. Plain text comes first so that
+// clients that don't care (Accept: */*) get something readable in a terminal.
+var offers = []string{contentTypeText, contentTypeHTML, contentTypeJSON, contentTypeProblem}
+
+// negotiate picks the content type to render for req based on its Accept
+// header. It returns plain text if the client didn't send an Accept header or
+// accepts none of our offers.
+func negotiate(req *http.Request) string {
+	if req == nil {
+		return contentTypeText
+	}
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return contentTypeText
+	}
+
+	best := contentTypeText
+	bestQ := 0.0
+	bestSpecificity := -1
+	for _, offer := range offers {
+		q, specificity := quality(accept, offer)
+		if q > bestQ || q == bestQ && q > 0 && specificity > bestSpecificity {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+	return best
+}
+
+// quality returns the q value that accept assigns to offer, along with the
+// specificity of the matching media range (0 for */*, 1 for type/*, 2 for an
+// exact match). The most specific matching range determines the q value.
+func quality(accept string, offer string) (float64, int) {
+	offerType := offer[:strings.Index(offer, "/")]
+	q := 0.0
+	specificity := -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		s := -1
+		switch {
+		case mediaType == offer:
+			s = 2
+		case mediaType == offerType+"/*":
+			s = 1
+		case mediaType == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity = s
+		q = 1
+		if qs, found := params["q"]; found {
+			if parsed, err := strconv.ParseFloat(qs, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return q, specificity
+}
@@ -0,0 +1,232 @@
+package faults
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+type wrapped interface {
+	Wrapped() net.Conn
+}
+
+// ErrReset is returned by reads from wrapped connections and bodies once the
+// client connection was reset.
+var ErrReset = errors.New("Fault injected: connection reset")
+
+// Reset closes conn so that the peer sees a connection reset rather than an
+// orderly shutdown (see ResetOnClose).
+func Reset(conn net.Conn) {
+	ResetOnClose(conn)
+	conn.Close()
+}
+
+// ResetOnClose makes closing conn reset the connection rather than shut it
+// down in an orderly way, if the TCP connection underneath conn's wrappers can
+// be found. Data that wasn't sent yet when closing is discarded.
+func ResetOnClose(conn net.Conn) {
+	for c := conn; c != nil; {
+		if tcp, ok := c.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+			return
+		}
+		w, ok := c.(wrapped)
+		if !ok {
+			return
+		}
+		c = w.Wrapped()
+	}
+}
+
+// pacer limits the rate of reads or writes to a number of bytes per second.
+type pacer struct {
+	rate  int64
+	start time.Time
+	total int64
+	mx    sync.Mutex
+}
+
+func newPacer(rate int64) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacer{rate: rate}
+}
+
+// limit caps the size of a single read or write so that bursts stay small.
+func (p *pacer) limit(b []byte) []byte {
+	if p == nil || int64(len(b)) <= p.rate {
+		return b
+	}
+	return b[:p.rate]
+}
+
+// wait sleeps until transferring n more bytes doesn't exceed the rate.
+func (p *pacer) wait(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+	p.mx.Lock()
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+	p.total += int64(n)
+	due := p.start.Add(time.Duration(p.total) * time.Second / time.Duration(p.rate))
+	p.mx.Unlock()
+	time.Sleep(time.Until(due))
+}
+
+// resetter resets a connection once a number of bytes were transferred.
+type resetter struct {
+	conn      net.Conn
+	remaining int64
+	closeNow  bool
+	mx        sync.Mutex
+}
+
+func newResetter(f *Fault, conn net.Conn, closeNow bool) *resetter {
+	if !f.Reset {
+		return nil
+	}
+	return &resetter{conn: conn, remaining: f.ResetAfter, closeNow: closeNow}
+}
+
+// limit caps the size of a transfer so that it doesn't go past the reset. Once
+// all bytes were transferred, it resets the connection and returns ErrReset.
+// The reset only happens on the transfer after the last one so that the data
+// that was transferred has been passed on.
+func (r *resetter) limit(b []byte) ([]byte, error) {
+	if r == nil {
+		return b, nil
+	}
+	r.mx.Lock()
+	remaining := r.remaining
+	r.mx.Unlock()
+	if remaining <= 0 {
+		if r.closeNow {
+			Reset(r.conn)
+		} else {
+			ResetOnClose(r.conn)
+		}
+		return nil, ErrReset
+	}
+	if int64(len(b)) > remaining {
+		return b[:remaining], nil
+	}
+	return b, nil
+}
+
+func (r *resetter) transferred(n int) {
+	if r == nil {
+		return
+	}
+	r.mx.Lock()
+	r.remaining -= int64(n)
+	r.mx.Unlock()
+}
+
+// Conn injects the faults of a Fault into a tunnel's upstream connection.
+// Reads bring data from the origin, writes send data from the client.
+type Conn struct {
+	net.Conn
+	reset *resetter
+	read  *pacer
+	write *pacer
+}
+
+// WrapConn wraps the upstream connection of a tunnel so that it's throttled
+// and resets downstream, the client connection, as configured in f. It
+// returns upstream itself if f doesn't apply to tunnels.
+func WrapConn(upstream net.Conn, downstream net.Conn, f *Fault) net.Conn {
+	if !f.Reset && f.Throttle <= 0 {
+		return upstream
+	}
+	return &Conn{
+		Conn:  upstream,
+		reset: newResetter(f, downstream, true),
+		read:  newPacer(f.Throttle),
+		write: newPacer(f.Throttle),
+	}
+}
+
+// Throttle limits the rate of data transferred over conn to rate bytes per
+// second in each direction. It's used for bandwidth limits outside of fault
+// injection too.
+func Throttle(conn net.Conn, rate int64) net.Conn {
+	return WrapConn(conn, nil, &Fault{Throttle: rate})
+}
+
+// Read implements net.Conn.
+func (c *Conn) Read(b []byte) (int, error) {
+	b, err := c.reset.limit(c.read.limit(b))
+	if err != nil {
+		c.Conn.Close()
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	c.read.wait(n)
+	c.reset.transferred(n)
+	return n, err
+}
+
+// Write implements net.Conn.
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := c.write.limit(b[written:])
+		n, err := c.Conn.Write(chunk)
+		written += n
+		c.write.wait(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Wrapped returns the wrapped connection.
+func (c *Conn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// body injects the faults of a Fault into a response body.
+type body struct {
+	io.ReadCloser
+	reset *resetter
+	read  *pacer
+}
+
+// WrapBody wraps a response body so that it's throttled and resets the client
+// connection downstream as configured in f. Since the proxy buffers what it
+// writes to the client, the reset happens when it closes the connection after
+// failing to read the rest of the body. It returns rc itself if f doesn't
+// apply to bodies.
+func WrapBody(rc io.ReadCloser, downstream net.Conn, f *Fault) io.ReadCloser {
+	if !f.Reset && f.Throttle <= 0 {
+		return rc
+	}
+	return &body{
+		ReadCloser: rc,
+		reset:      newResetter(f, downstream, false),
+		read:       newPacer(f.Throttle),
+	}
+}
+
+// ThrottleBody limits the rate at which rc is read to rate bytes per second.
+func ThrottleBody(rc io.ReadCloser, rate int64) io.ReadCloser {
+	return WrapBody(rc, nil, &Fault{Throttle: rate})
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	p, err := b.reset.limit(b.read.limit(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read.wait(n)
+	b.reset.transferred(n)
+	return n, err
+}
@@ -0,0 +1,61 @@
+package faults
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapBody(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1000)
+	downstream, client := net.Pipe()
+	defer client.Close()
+
+	body := WrapBody(ioutil.NopCloser(bytes.NewReader(data)), downstream, &Fault{Reset: true, ResetAfter: 300})
+	read, err := ioutil.ReadAll(body)
+	assert.Equal(t, ErrReset, err)
+	assert.Len(t, read, 300)
+
+	body = WrapBody(ioutil.NopCloser(bytes.NewReader(data)), downstream, &Fault{Reset: true, ResetAfter: 5000})
+	read, err = ioutil.ReadAll(body)
+	assert.NoError(t, err, "short bodies should be read in full")
+	assert.Len(t, read, 1000)
+
+	body = WrapBody(ioutil.NopCloser(bytes.NewReader(data)), downstream, &Fault{Throttle: 2000})
+	start := time.Now()
+	read, err = ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Len(t, read, 1000)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "body should have been throttled")
+
+	plain := ioutil.NopCloser(bytes.NewReader(data))
+	assert.Equal(t, plain, WrapBody(plain, downstream, &Fault{Latency: time.Second}))
+}
+
+func TestWrapConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	downstream, err := l.Accept()
+	require.NoError(t, err)
+
+	origin, upstream := net.Pipe()
+	defer origin.Close()
+	conn := WrapConn(upstream, downstream, &Fault{Reset: true, ResetAfter: 10})
+	go origin.Write(bytes.Repeat([]byte("x"), 100))
+	go io.Copy(downstream, conn)
+
+	received, err := ioutil.ReadAll(client)
+	assert.Error(t, err, "client should see a reset")
+	assert.Contains(t, err.Error(), "reset")
+	assert.Len(t, received, 10)
+}
@@ -0,0 +1,287 @@
+// Package faults injects faults into proxied traffic for testing how clients
+// cope with a misbehaving proxy or origin: added latency, synthetic error
+// responses, connections reset in the middle of a response and throttled
+// tunnels. Faults are only ever injected when explicitly configured.
+package faults
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+const (
+	// Injected is the reason given on synthetic error responses.
+	Injected errorpages.Reason = "fault-injected"
+
+	maxRulesSize = 64 * 1024
+)
+
+var (
+	log = golog.LoggerFor("faults")
+)
+
+// Fault describes the faults to inject into matching requests. A single Fault
+// can combine several of them, like latency followed by a reset.
+type Fault struct {
+	// Hosts limits the fault to requests for these hosts, given as names like
+	// "example.com" or suffixes like ".example.com". Empty matches all hosts.
+	Hosts []string
+
+	// Percent is the percentage of matching requests that get the fault.
+	Percent float64
+
+	// Latency delays requests before they're sent upstream.
+	Latency time.Duration
+
+	// Status, if set, answers requests with a synthetic error response with
+	// this status code instead of sending them upstream.
+	Status int
+
+	// Reset resets the client connection once ResetAfter bytes of the response
+	// (or of data from the origin, for CONNECT tunnels) were sent.
+	Reset      bool
+	ResetAfter int64
+
+	// Throttle limits the rate of response bodies and tunneled data to this
+	// many bytes per second, in each direction.
+	Throttle int64
+}
+
+func (f *Fault) matches(host string) bool {
+	if len(f.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, h := range f.Hosts {
+		if h == "*" || h == host || (strings.HasPrefix(h, ".") && strings.HasSuffix(host, h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the fault the way ParseFaults expects it.
+func (f *Fault) String() string {
+	var fields []string
+	if len(f.Hosts) > 0 {
+		fields = append(fields, "host="+strings.Join(f.Hosts, ","))
+	}
+	fields = append(fields, "percent="+strconv.FormatFloat(f.Percent, 'f', -1, 64))
+	if f.Latency > 0 {
+		fields = append(fields, "latency="+f.Latency.String())
+	}
+	if f.Status > 0 {
+		fields = append(fields, "status="+strconv.Itoa(f.Status))
+	}
+	if f.Reset {
+		fields = append(fields, "reset="+strconv.FormatInt(f.ResetAfter, 10))
+	}
+	if f.Throttle > 0 {
+		fields = append(fields, "throttle="+strconv.FormatInt(f.Throttle, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// ParseFaults parses a semicolon separated list of faults given as space
+// separated key=value pairs. Keys are host (comma separated names and
+// suffixes), percent (defaults to 100), latency (a duration), status, reset
+// (bytes sent before resetting, 0 if omitted) and throttle (bytes per second).
+// For example:
+//
+//	host=.example.com latency=500ms percent=10; status=503 percent=1; host=api.example.com reset=1024; throttle=16384
+func ParseFaults(s string) ([]Fault, error) {
+	var faults []Fault
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		f := Fault{Percent: 100}
+		hasEffect := false
+		for _, field := range fields {
+			kv := strings.SplitN(field, "=", 2)
+			key := strings.ToLower(kv[0])
+			value := ""
+			if len(kv) == 2 {
+				value = kv[1]
+			} else if key != "reset" {
+				return nil, errors.New("Invalid fault %q, expected key=value", field)
+			}
+			var err error
+			switch key {
+			case "host":
+				for _, host := range strings.Split(value, ",") {
+					if host != "" {
+						f.Hosts = append(f.Hosts, strings.ToLower(host))
+					}
+				}
+			case "percent":
+				f.Percent, err = strconv.ParseFloat(value, 64)
+				if err == nil && (f.Percent < 0 || f.Percent > 100) {
+					err = errors.New("out of range")
+				}
+			case "latency":
+				f.Latency, err = time.ParseDuration(value)
+				if err == nil && f.Latency <= 0 {
+					err = errors.New("not positive")
+				}
+				hasEffect = true
+			case "status":
+				f.Status, err = strconv.Atoi(value)
+				if err == nil && (f.Status < 400 || f.Status > 599) {
+					err = errors.New("not an error status")
+				}
+				hasEffect = true
+			case "reset":
+				f.Reset = true
+				if value != "" {
+					f.ResetAfter, err = strconv.ParseInt(value, 10, 64)
+					if err == nil && f.ResetAfter < 0 {
+						err = errors.New("negative")
+					}
+				}
+				hasEffect = true
+			case "throttle":
+				f.Throttle, err = strconv.ParseInt(value, 10, 64)
+				if err == nil && f.Throttle <= 0 {
+					err = errors.New("not positive")
+				}
+				hasEffect = true
+			default:
+				return nil, errors.New("Unknown fault %q", field)
+			}
+			if err != nil {
+				return nil, errors.New("Invalid fault %q: %v", field, err)
+			}
+		}
+		if !hasEffect {
+			return nil, errors.New("Fault %q doesn't inject anything", strings.TrimSpace(part))
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+// Injector decides which requests get which faults. Its faults can be changed
+// at runtime, see ServeHTTP. It is safe for concurrent use.
+type Injector struct {
+	mx      sync.RWMutex
+	enabled bool
+	faults  []Fault
+}
+
+// New creates an enabled Injector with the given faults.
+func New(faults []Fault) *Injector {
+	return &Injector{enabled: true, faults: faults}
+}
+
+// Pick returns the first fault that matches host and is sampled, or nil if
+// there is none or the injector is disabled.
+func (i *Injector) Pick(host string) *Fault {
+	i.mx.RLock()
+	defer i.mx.RUnlock()
+	if !i.enabled {
+		return nil
+	}
+	for n := range i.faults {
+		f := &i.faults[n]
+		if f.matches(host) && rand.Float64()*100 < f.Percent {
+			return f
+		}
+	}
+	return nil
+}
+
+// Faults returns the configured faults.
+func (i *Injector) Faults() []Fault {
+	i.mx.RLock()
+	defer i.mx.RUnlock()
+	return i.faults
+}
+
+// SetFaults replaces the configured faults.
+func (i *Injector) SetFaults(faults []Fault) {
+	i.mx.Lock()
+	i.faults = faults
+	i.mx.Unlock()
+}
+
+// Enabled checks whether faults are injected.
+func (i *Injector) Enabled() bool {
+	i.mx.RLock()
+	defer i.mx.RUnlock()
+	return i.enabled
+}
+
+// SetEnabled turns fault injection on or off without changing the faults.
+func (i *Injector) SetEnabled(enabled bool) {
+	i.mx.Lock()
+	i.enabled = enabled
+	i.mx.Unlock()
+}
+
+type status struct {
+	Enabled bool     `json:"enabled"`
+	Faults  []string `json:"faults"`
+}
+
+// ServeHTTP controls the injector. GET shows whether it's enabled and its
+// faults as JSON. PUT replaces the faults with those in the request body (see
+// ParseFaults). DELETE removes all faults. PUT and POST also take an "enabled"
+// query parameter to turn injection on or off.
+func (i *Injector) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		if enabled := req.URL.Query().Get("enabled"); enabled != "" {
+			value, err := strconv.ParseBool(enabled)
+			if err != nil {
+				http.Error(resp, "Invalid enabled parameter", http.StatusBadRequest)
+				return
+			}
+			i.SetEnabled(value)
+			log.Debugf("Fault injection enabled: %v", value)
+		}
+		if req.Method == http.MethodPut {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, maxRulesSize))
+			if err != nil {
+				http.Error(resp, "Unable to read faults", http.StatusBadRequest)
+				return
+			}
+			faults, err := ParseFaults(string(body))
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusBadRequest)
+				return
+			}
+			i.SetFaults(faults)
+			log.Debugf("Injecting faults: %v", strings.TrimSpace(string(body)))
+		}
+	case http.MethodDelete:
+		i.SetFaults(nil)
+		log.Debug("Cleared faults")
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		resp.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := &status{Enabled: i.Enabled(), Faults: []string{}}
+	for _, f := range i.Faults() {
+		s.Faults = append(s.Faults, f.String())
+	}
+	resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(resp).Encode(s)
+}
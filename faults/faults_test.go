@@ -0,0 +1,97 @@
+package faults
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFaults(t *testing.T) {
+	faults, err := ParseFaults("host=.Example.com,other.org latency=500ms percent=10; status=503 percent=1.5 ;host=api.example.com reset=1024; reset throttle=16384")
+	require.NoError(t, err)
+	assert.Equal(t, []Fault{
+		{Hosts: []string{".example.com", "other.org"}, Percent: 10, Latency: 500 * time.Millisecond},
+		{Percent: 1.5, Status: 503},
+		{Hosts: []string{"api.example.com"}, Percent: 100, Reset: true, ResetAfter: 1024},
+		{Percent: 100, Reset: true, Throttle: 16384},
+	}, faults)
+	for _, f := range faults {
+		parsed, err := ParseFaults(f.String())
+		require.NoError(t, err)
+		assert.Equal(t, []Fault{f}, parsed, "String should round trip")
+	}
+
+	for _, invalid := range []string{
+		"host=example.com",
+		"percent=50",
+		"latency",
+		"latency=soon",
+		"latency=-1s",
+		"status=200",
+		"status=abc",
+		"reset=-1",
+		"throttle=0",
+		"status=503 percent=101",
+		"status=503 drop=1",
+	} {
+		_, err := ParseFaults(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPick(t *testing.T) {
+	faults, err := ParseFaults("host=.example.com status=503 percent=0; host=.example.com status=502; status=500")
+	require.NoError(t, err)
+	i := New(faults)
+	assert.Equal(t, 502, i.Pick("www.Example.com").Status, "unsampled faults should be skipped")
+	assert.Equal(t, 500, i.Pick("other.org").Status)
+
+	i.SetEnabled(false)
+	assert.Nil(t, i.Pick("other.org"))
+	i.SetEnabled(true)
+	i.SetFaults(nil)
+	assert.Nil(t, i.Pick("other.org"))
+}
+
+func TestServeHTTP(t *testing.T) {
+	i := New(nil)
+	do := func(method, target, body string) (*httptest.ResponseRecorder, *status) {
+		rec := httptest.NewRecorder()
+		i.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		s := &status{}
+		json.Unmarshal(rec.Body.Bytes(), s)
+		return rec, s
+	}
+
+	rec, s := do(http.MethodPut, "/faults", "host=example.com status=503")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, &status{Enabled: true, Faults: []string{"host=example.com percent=100 status=503"}}, s)
+	assert.NotNil(t, i.Pick("example.com"))
+
+	rec, _ = do(http.MethodPut, "/faults", "status=200")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.NotNil(t, i.Pick("example.com"), "invalid faults should leave existing ones in place")
+
+	rec, s = do(http.MethodPost, "/faults?enabled=false", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.False(t, s.Enabled)
+	assert.Len(t, s.Faults, 1)
+	assert.Nil(t, i.Pick("example.com"))
+
+	rec, _ = do(http.MethodPost, "/faults?enabled=maybe", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec, _ = do(http.MethodDelete, "/faults", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	_, s = do(http.MethodGet, "/faults", "")
+	assert.Equal(t, &status{Enabled: false, Faults: []string{}}, s)
+
+	rec, _ = do(http.MethodPatch, "/faults", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
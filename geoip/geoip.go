@@ -0,0 +1,212 @@
+// Package geoip looks up the country and autonomous system (ASN) of IP
+// addresses in local MaxMind-format (MMDB) databases, like GeoLite2-Country
+// and GeoLite2-ASN, reloading them when they change on disk. See
+// proxyfilters.GeoIP for the filter that applies policies based on it.
+package geoip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+const (
+	defaultCheckInterval = time.Minute
+)
+
+const (
+	// Blocked is the errorpages.Reason for requests blocked by a GeoIP rule.
+	Blocked errorpages.Reason = "geo-blocked"
+
+	// Throttled is the errorpages.Reason for requests rejected by a GeoIP
+	// rule's throttle.
+	Throttled errorpages.Reason = "geo-throttled"
+)
+
+var log = golog.LoggerFor("geoip")
+
+// Opts configures a DB.
+type Opts struct {
+	// CountryFile is an MMDB file with country data, like GeoLite2-Country
+	// or GeoLite2-City.
+	CountryFile string
+
+	// ASNFile is an MMDB file with autonomous system data, like
+	// GeoLite2-ASN. It can be the same as CountryFile if that has both.
+	ASNFile string
+
+	// CheckInterval is how often the files are checked for changes. Defaults
+	// to a minute.
+	CheckInterval time.Duration
+}
+
+// Location is what we know about an IP address. Fields are empty if unknown.
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, like "US".
+	Country string
+
+	// ASN is the number of the autonomous system that announces the address.
+	ASN uint
+
+	// Organization is the name of the organization that owns the autonomous
+	// system.
+	Organization string
+}
+
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN          uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// DB looks up locations. It is safe for concurrent use.
+type DB struct {
+	opts      Opts
+	readers   atomic.Value // *readers
+	files     map[string]os.FileInfo
+	stop      chan interface{}
+	closeOnce sync.Once
+}
+
+type readers struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// Open opens the databases. Call Close to stop watching the files.
+func Open(opts *Opts) (*DB, error) {
+	db := &DB{
+		opts:  *opts,
+		files: make(map[string]os.FileInfo),
+		stop:  make(chan interface{}),
+	}
+	if db.opts.CheckInterval <= 0 {
+		db.opts.CheckInterval = defaultCheckInterval
+	}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	if len(db.files) > 0 {
+		go db.watch()
+	}
+	return db, nil
+}
+
+// Lookup looks up the given IP address.
+func (db *DB) Lookup(ip net.IP) *Location {
+	loc := &Location{}
+	if ip == nil {
+		return loc
+	}
+	r := db.readers.Load().(*readers)
+	if r.country != nil {
+		var rec record
+		if err := r.country.Lookup(ip, &rec); err != nil {
+			log.Tracef("Unable to look up country of %v: %v", ip, err)
+		}
+		loc.Country = strings.ToUpper(rec.Country.ISOCode)
+	}
+	if r.asn != nil {
+		var rec record
+		if err := r.asn.Lookup(ip, &rec); err != nil {
+			log.Tracef("Unable to look up ASN of %v: %v", ip, err)
+		}
+		loc.ASN = rec.ASN
+		loc.Organization = rec.Organization
+	}
+	return loc
+}
+
+// Close stops watching the database files.
+func (db *DB) Close() {
+	db.closeOnce.Do(func() {
+		close(db.stop)
+	})
+}
+
+func (db *DB) watch() {
+	ticker := time.NewTicker(db.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			if db.filesChanged() {
+				if err := db.load(); err != nil {
+					log.Errorf("Unable to reload GeoIP databases, keeping previous ones: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (db *DB) filesChanged() bool {
+	for path, prior := range db.files {
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Errorf("Unable to check %v: %v", path, err)
+			continue
+		}
+		if !fi.ModTime().Equal(prior.ModTime()) || fi.Size() != prior.Size() {
+			return true
+		}
+	}
+	return false
+}
+
+// load (re)loads the databases. It's only called from Open and the watch
+// loop. The files are read into memory rather than memory-mapped so that
+// lookups in progress can't be affected by a reload.
+func (db *DB) load() error {
+	files := make(map[string]os.FileInfo)
+	loaded := make(map[string]*maxminddb.Reader)
+	open := func(path string) (*maxminddb.Reader, error) {
+		if path == "" {
+			return nil, nil
+		}
+		if r, found := loaded[path]; found {
+			return r, nil
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, errors.New("Unable to open %v: %v", path, err)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.New("Unable to read %v: %v", path, err)
+		}
+		r, err := maxminddb.FromBytes(b)
+		if err != nil {
+			return nil, errors.New("Unable to parse %v: %v", path, err)
+		}
+		files[path] = fi
+		loaded[path] = r
+		log.Debugf("Loaded %v database from %v built %v", r.Metadata.DatabaseType, path, time.Unix(int64(r.Metadata.BuildEpoch), 0).UTC())
+		return r, nil
+	}
+
+	country, err := open(db.opts.CountryFile)
+	if err != nil {
+		return err
+	}
+	asn, err := open(db.opts.ASNFile)
+	if err != nil {
+		return err
+	}
+	db.readers.Store(&readers{country: country, asn: asn})
+	db.files = files
+	return nil
+}
@@ -0,0 +1,56 @@
+package geoip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/geoip/geoiptest"
+)
+
+func TestLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	countryFile := filepath.Join(dir, "country.mmdb")
+	asnFile := filepath.Join(dir, "asn.mmdb")
+	require.NoError(t, geoiptest.Write(countryFile,
+		geoiptest.Network{CIDR: "192.0.2.0/24", Country: "us"},
+		geoiptest.Network{CIDR: "198.51.100.128/25", Country: "DE"},
+	))
+	require.NoError(t, geoiptest.Write(asnFile,
+		geoiptest.Network{CIDR: "192.0.2.0/23", ASN: 64500, Organization: "Example Networks"},
+	))
+
+	db, err := Open(&Opts{CountryFile: countryFile, ASNFile: asnFile, CheckInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, &Location{Country: "US", ASN: 64500, Organization: "Example Networks"}, db.Lookup(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, &Location{Country: "DE"}, db.Lookup(net.ParseIP("198.51.100.200")))
+	assert.Equal(t, &Location{}, db.Lookup(net.ParseIP("198.51.100.1")))
+	assert.Equal(t, &Location{}, db.Lookup(net.ParseIP("2001:db8::1")), "IPv6 addresses are unknown to an IPv4 database")
+	assert.Equal(t, &Location{}, db.Lookup(nil))
+
+	// Broken files are ignored
+	require.NoError(t, ioutil.WriteFile(countryFile, []byte("garbage"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "US", db.Lookup(net.ParseIP("192.0.2.1")).Country)
+
+	require.NoError(t, geoiptest.Write(countryFile, geoiptest.Network{CIDR: "192.0.2.0/24", Country: "FR"}))
+	// Make sure the change is noticed even on file systems with coarse mtimes
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(countryFile, later, later))
+	assert.Eventually(t, func() bool {
+		return db.Lookup(net.ParseIP("192.0.2.1")).Country == "FR"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = Open(&Opts{CountryFile: filepath.Join(dir, "missing.mmdb")})
+	assert.Error(t, err)
+}
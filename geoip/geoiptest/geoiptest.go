@@ -0,0 +1,198 @@
+// Package geoiptest writes small MaxMind-format (MMDB) databases for use as
+// test fixtures.
+package geoiptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	recordSize = 24
+	maxRecord  = 1<<recordSize - 1
+
+	typeString = 2
+	typeUint16 = 5
+	typeUint32 = 6
+	typeMap    = 7
+	typeUint64 = 9
+	typeArray  = 11
+)
+
+// Network is an IPv4 network and what the database says about it.
+type Network struct {
+	CIDR         string
+	Country      string
+	ASN          uint32
+	Organization string
+}
+
+// Write writes an IPv4-only database with the given networks to path. Networks
+// must not overlap.
+func Write(path string, networks ...Network) error {
+	b, err := Build(networks...)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+const (
+	empty = iota
+	child
+	data
+)
+
+type record struct {
+	kind  int
+	value int
+}
+
+// Build builds an IPv4-only database with the given networks. Networks must
+// not overlap.
+func Build(networks ...Network) ([]byte, error) {
+	nodes := [][2]record{{}}
+	var dataSection bytes.Buffer
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.CIDR)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, errors.New("Invalid IPv4 network %v", n.CIDR)
+		}
+		ones, _ := ipNet.Mask.Size()
+		if ones == 0 {
+			return nil, errors.New("Network %v covers everything", n.CIDR)
+		}
+		offset := dataSection.Len()
+		fields := map[string]interface{}{}
+		if n.Country != "" {
+			fields["country"] = map[string]interface{}{"iso_code": n.Country}
+		}
+		if n.ASN != 0 {
+			fields["autonomous_system_number"] = n.ASN
+		}
+		if n.Organization != "" {
+			fields["autonomous_system_organization"] = n.Organization
+		}
+		encode(&dataSection, fields)
+
+		ip := ipNet.IP.To4()
+		node := 0
+		for depth := 0; depth < ones; depth++ {
+			bit := (ip[depth/8] >> uint(7-depth%8)) & 1
+			r := nodes[node][bit]
+			if depth == ones-1 {
+				if r.kind != empty {
+					return nil, errors.New("Network %v overlaps another one", n.CIDR)
+				}
+				nodes[node][bit] = record{kind: data, value: offset}
+				break
+			}
+			switch r.kind {
+			case data:
+				return nil, errors.New("Network %v overlaps another one", n.CIDR)
+			case empty:
+				nodes = append(nodes, [2]record{})
+				nodes[node][bit] = record{kind: child, value: len(nodes) - 1}
+			}
+			node = nodes[node][bit].value
+		}
+	}
+
+	nodeCount := len(nodes)
+	var out bytes.Buffer
+	for _, node := range nodes {
+		for _, r := range node {
+			value := nodeCount
+			switch r.kind {
+			case child:
+				value = r.value
+			case data:
+				value = nodeCount + 16 + r.value
+			}
+			if value > maxRecord {
+				return nil, errors.New("Database too large")
+			}
+			out.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(dataSection.Bytes())
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	encode(&out, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               "Test",
+		"description":                 map[string]interface{}{"en": "Test database"},
+		"ip_version":                  uint16(4),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	})
+	return out.Bytes(), nil
+}
+
+// encode encodes v in the MMDB data section format. Only the types used by
+// Build are supported and sizes are limited to 284.
+func encode(buf *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case string:
+		control(buf, typeString, len(value))
+		buf.WriteString(value)
+	case uint16:
+		encodeUint(buf, typeUint16, uint64(value))
+	case uint32:
+		encodeUint(buf, typeUint32, uint64(value))
+	case uint64:
+		encodeUint(buf, typeUint64, value)
+	case []interface{}:
+		control(buf, typeArray, len(value))
+		for _, item := range value {
+			encode(buf, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		control(buf, typeMap, len(keys))
+		for _, key := range keys {
+			encode(buf, key)
+			encode(buf, value[key])
+		}
+	default:
+		panic(errors.New("Unsupported type %T", v))
+	}
+}
+
+func encodeUint(buf *bytes.Buffer, typ int, value uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+	b = bytes.TrimLeft(b, "\x00")
+	control(buf, typ, len(b))
+	buf.Write(b)
+}
+
+func control(buf *bytes.Buffer, typ int, size int) {
+	sizeField, extra := size, []byte(nil)
+	switch {
+	case size >= 285:
+		panic(errors.New("Size %d not supported", size))
+	case size >= 29:
+		sizeField, extra = 29, []byte{byte(size - 29)}
+	}
+	if typ <= typeMap {
+		buf.WriteByte(byte(typ<<5 | sizeField))
+	} else {
+		buf.WriteByte(byte(sizeField))
+		buf.WriteByte(byte(typ - 7))
+	}
+	buf.Write(extra)
+}
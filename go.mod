@@ -5,7 +5,9 @@ go 1.12
 require (
 	github.com/getlantern/appdir v0.0.0-20160830121117-659a155d06e8
 	github.com/getlantern/errors v1.0.1
+	github.com/getlantern/fdcount v0.0.0-20190912142506-f89afd7367c4
 	github.com/getlantern/golog v0.0.0-20210606115803-bce9f9fe5a5f
+	github.com/getlantern/grtrack v0.0.0-20160824195228-cbf67d3fa0fd
 	github.com/getlantern/idletiming v0.0.0-20200228204104-10036786eac5
 	github.com/getlantern/iptool v0.0.0-20230112135223-c00e863b2696
 	github.com/getlantern/keyman v0.0.0-20180207174507-f55e7280e93a
@@ -16,5 +18,8 @@ require (
 	github.com/getlantern/rotator v0.0.0-20160829164113-013d4f8e36a2
 	github.com/getlantern/tlsdefaults v0.0.0-20171004213447-cf35cfd0b1b4
 	github.com/hashicorp/golang-lru v0.5.3
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/stretchr/testify v1.8.1
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
 )
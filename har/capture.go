@@ -0,0 +1,310 @@
+package har
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	defaultMaxDuration = time.Hour
+	defaultMaxEntries  = 1000
+	defaultMaxBodySize = 64 * 1024
+	defaultMaxCaptures = 20
+)
+
+var (
+	log = golog.LoggerFor("har")
+
+	// DefaultRedactedHeaders are redacted unless Opts.RedactHeaders says
+	// otherwise.
+	DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+)
+
+// Opts configures a Capturer.
+type Opts struct {
+	// Creator is the name of the application in HAR files.
+	Creator string
+
+	// CreatorVersion is the version of the application in HAR files.
+	CreatorVersion string
+
+	// RedactHeaders lists headers whose values are replaced with Redacted.
+	// Defaults to DefaultRedactedHeaders.
+	RedactHeaders []string
+
+	// MaxDuration caps how long a capture may run. Defaults to 1 hour.
+	MaxDuration time.Duration
+
+	// MaxEntries caps the number of entries of a capture, after which further
+	// requests aren't recorded. Defaults to 1000.
+	MaxEntries int
+
+	// MaxBodySize caps the size of request and response bodies recorded by
+	// captures that record bodies. Longer bodies are truncated. Defaults to 64
+	// KiB.
+	MaxBodySize int64
+
+	// MaxCaptures caps the number of captures kept. When it's reached, the
+	// oldest finished capture is dropped to make room. Defaults to 20.
+	MaxCaptures int
+}
+
+// Spec says what to capture.
+type Spec struct {
+	// Client is the IP address of the client to capture.
+	Client string `json:"client,omitempty"`
+
+	// User is the user to capture.
+	User string `json:"user,omitempty"`
+
+	// Duration is how long to capture for.
+	Duration time.Duration `json:"-"`
+
+	// Bodies says whether to record request and response bodies.
+	Bodies bool `json:"bodies"`
+}
+
+// Info describes a capture.
+type Info struct {
+	ID string `json:"id"`
+	Spec
+	Started time.Time `json:"started"`
+	Until   time.Time `json:"until"`
+	Active  bool      `json:"active"`
+	Entries int       `json:"entries"`
+	Dropped int       `json:"dropped"`
+}
+
+// Capture records the traffic of a client.
+type Capture struct {
+	c       *Capturer
+	id      string
+	spec    Spec
+	started time.Time
+	until   time.Time
+
+	mx      sync.Mutex
+	stopped bool
+	entries []*Entry
+	dropped int
+}
+
+// Capturer manages captures. It is safe for concurrent use.
+type Capturer struct {
+	opts   Opts
+	redact map[string]bool
+	now    func() time.Time
+
+	mx       sync.Mutex
+	captures map[string]*Capture
+}
+
+// New creates a Capturer.
+func New(opts *Opts) *Capturer {
+	c := &Capturer{opts: *opts, now: time.Now, captures: make(map[string]*Capture)}
+	if c.opts.Creator == "" {
+		c.opts.Creator = "http-proxy"
+	}
+	if c.opts.RedactHeaders == nil {
+		c.opts.RedactHeaders = DefaultRedactedHeaders
+	}
+	c.redact = make(map[string]bool, len(c.opts.RedactHeaders))
+	for _, header := range c.opts.RedactHeaders {
+		c.redact[http.CanonicalHeaderKey(header)] = true
+	}
+	if c.opts.MaxDuration <= 0 {
+		c.opts.MaxDuration = defaultMaxDuration
+	}
+	if c.opts.MaxEntries <= 0 {
+		c.opts.MaxEntries = defaultMaxEntries
+	}
+	if c.opts.MaxBodySize <= 0 {
+		c.opts.MaxBodySize = defaultMaxBodySize
+	}
+	if c.opts.MaxCaptures <= 0 {
+		c.opts.MaxCaptures = defaultMaxCaptures
+	}
+	return c
+}
+
+// Start starts capturing the traffic of the client with the given IP address
+// or user for the given duration, capped at Opts.MaxDuration.
+func (c *Capturer) Start(spec Spec) (*Info, error) {
+	if spec.Client == "" && spec.User == "" {
+		return nil, errors.New("Capture needs a client or user")
+	}
+	if spec.Duration <= 0 {
+		return nil, errors.New("Invalid capture duration %v", spec.Duration)
+	}
+	if spec.Duration > c.opts.MaxDuration {
+		spec.Duration = c.opts.MaxDuration
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := c.now()
+	capture := &Capture{c: c, id: id, spec: spec, started: now, until: now.Add(spec.Duration)}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if len(c.captures) >= c.opts.MaxCaptures && !c.evict(now) {
+		return nil, errors.New("Too many active captures")
+	}
+	c.captures[id] = capture
+	log.Debugf("Capturing traffic of client %q user %q until %v as %v", spec.Client, spec.User, capture.until, id)
+	return capture.info(now), nil
+}
+
+// evict drops the oldest finished capture, returning false if all are
+// active.
+func (c *Capturer) evict(now time.Time) bool {
+	var oldest *Capture
+	for _, capture := range c.captures {
+		if capture.active(now) {
+			continue
+		}
+		if oldest == nil || capture.started.Before(oldest.started) {
+			oldest = capture
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(c.captures, oldest.id)
+	return true
+}
+
+// Stop stops the capture with the given ID, keeping what it recorded.
+func (c *Capturer) Stop(id string) bool {
+	capture := c.get(id)
+	if capture == nil {
+		return false
+	}
+	capture.mx.Lock()
+	capture.stopped = true
+	capture.mx.Unlock()
+	return true
+}
+
+// Remove stops and deletes the capture with the given ID.
+func (c *Capturer) Remove(id string) bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if _, found := c.captures[id]; !found {
+		return false
+	}
+	delete(c.captures, id)
+	return true
+}
+
+// Captures lists the captures, oldest first.
+func (c *Capturer) Captures() []*Info {
+	now := c.now()
+	c.mx.Lock()
+	infos := make([]*Info, 0, len(c.captures))
+	for _, capture := range c.captures {
+		infos = append(infos, capture.info(now))
+	}
+	c.mx.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
+// HAR returns what the capture with the given ID recorded so far, or nil if
+// there is no such capture.
+func (c *Capturer) HAR(id string) *HAR {
+	capture := c.get(id)
+	if capture == nil {
+		return nil
+	}
+	capture.mx.Lock()
+	defer capture.mx.Unlock()
+	entries := make([]*Entry, len(capture.entries))
+	copy(entries, capture.entries)
+	l := &Log{
+		Version: Version,
+		Creator: &Creator{Name: c.opts.Creator, Version: c.opts.CreatorVersion},
+		Entries: entries,
+	}
+	if capture.dropped > 0 {
+		l.Comment = "Dropped entries beyond the limit"
+	}
+	return &HAR{Log: l}
+}
+
+func (c *Capturer) get(id string) *Capture {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.captures[id]
+}
+
+// Match returns the active captures for the client with the given IP address
+// and user.
+func (c *Capturer) Match(client string, user string) []*Capture {
+	now := c.now()
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	var matched []*Capture
+	for _, capture := range c.captures {
+		if !capture.active(now) {
+			continue
+		}
+		if (capture.spec.Client != "" && capture.spec.Client == client) || (capture.spec.User != "" && capture.spec.User == user) {
+			matched = append(matched, capture)
+		}
+	}
+	return matched
+}
+
+// Bodies checks whether the capture records bodies.
+func (capture *Capture) Bodies() bool {
+	return capture.spec.Bodies
+}
+
+func (capture *Capture) active(now time.Time) bool {
+	capture.mx.Lock()
+	defer capture.mx.Unlock()
+	return !capture.stopped && now.Before(capture.until)
+}
+
+func (capture *Capture) info(now time.Time) *Info {
+	capture.mx.Lock()
+	defer capture.mx.Unlock()
+	return &Info{
+		ID:      capture.id,
+		Spec:    capture.spec,
+		Started: capture.started,
+		Until:   capture.until,
+		Active:  !capture.stopped && now.Before(capture.until),
+		Entries: len(capture.entries),
+		Dropped: capture.dropped,
+	}
+}
+
+func (capture *Capture) add(entry *Entry) {
+	capture.mx.Lock()
+	defer capture.mx.Unlock()
+	if len(capture.entries) >= capture.c.opts.MaxEntries {
+		capture.dropped++
+		return
+	}
+	capture.entries = append(capture.entries, entry)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.New("Unable to generate capture ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
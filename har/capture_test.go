@@ -0,0 +1,121 @@
+package har
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptures(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	c := New(&Opts{MaxDuration: 10 * time.Minute, MaxCaptures: 2})
+	c.now = func() time.Time { return now }
+
+	_, err := c.Start(Spec{Duration: time.Minute})
+	assert.Error(t, err, "should require client or user")
+	_, err = c.Start(Spec{Client: "192.0.2.1"})
+	assert.Error(t, err, "should require duration")
+
+	byClient, err := c.Start(Spec{Client: "192.0.2.1", Duration: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(10*time.Minute), byClient.Until, "duration should be capped")
+	now = now.Add(time.Second)
+	byUser, err := c.Start(Spec{User: "alice", Duration: time.Minute, Bodies: true})
+	require.NoError(t, err)
+	_, err = c.Start(Spec{User: "bob", Duration: time.Minute})
+	assert.Error(t, err, "should not exceed MaxCaptures while all are active")
+
+	assert.Len(t, c.Match("192.0.2.1", ""), 1)
+	assert.Len(t, c.Match("192.0.2.1", "alice"), 2)
+	assert.Len(t, c.Match("192.0.2.2", "bob"), 0)
+
+	now = now.Add(2 * time.Minute)
+	assert.Len(t, c.Match("192.0.2.1", "alice"), 1, "capture should have expired")
+	third, err := c.Start(Spec{User: "bob", Duration: time.Minute})
+	require.NoError(t, err, "finished capture should make room")
+	infos := c.Captures()
+	require.Len(t, infos, 2)
+	assert.Equal(t, byClient.ID, infos[0].ID)
+	assert.Equal(t, third.ID, infos[1].ID)
+	assert.Nil(t, c.HAR(byUser.ID))
+
+	assert.True(t, c.Stop(byClient.ID))
+	assert.Empty(t, c.Match("192.0.2.1", ""))
+	assert.NotNil(t, c.HAR(byClient.ID), "stopped capture should be kept")
+	assert.True(t, c.Remove(byClient.ID))
+	assert.False(t, c.Remove(byClient.ID))
+	assert.Nil(t, c.HAR(byClient.ID))
+}
+
+func TestRecord(t *testing.T) {
+	c := New(&Opts{Creator: "test", CreatorVersion: "1.0", MaxBodySize: 8, MaxEntries: 2})
+	withBodies, err := c.Start(Spec{Client: "192.0.2.1", Duration: time.Minute, Bodies: true})
+	require.NoError(t, err)
+	withoutBodies, err := c.Start(Spec{User: "alice", Duration: time.Minute})
+	require.NoError(t, err)
+	captures := c.Match("192.0.2.1", "alice")
+	require.Len(t, captures, 2)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/path?b=2&a=1", strings.NewReader("request body"))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Content-Type", "text/plain")
+	r := c.Record(req, captures)
+	ioutil.ReadAll(req.Body)
+	resp := &http.Response{
+		StatusCode: http.StatusFound,
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{"Location": {"/elsewhere"}, "Set-Cookie": {"id=secret"}, "Content-Type": {"application/octet-stream"}},
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte{0xff, 0xfe, 0x00})),
+	}
+	r.Response(resp, nil)
+	assert.Empty(t, c.HAR(withBodies.ID).Log.Entries, "entry should wait for the response body")
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	h := c.HAR(withBodies.ID)
+	assert.Equal(t, "1.2", h.Log.Version)
+	assert.Equal(t, &Creator{Name: "test", Version: "1.0"}, h.Log.Creator)
+	require.Len(t, h.Log.Entries, 1)
+	entry := h.Log.Entries[0]
+	assert.Equal(t, "http://example.com/path?b=2&a=1", entry.Request.URL)
+	assert.Equal(t, []*NameValue{{"a", "1"}, {"b", "2"}}, entry.Request.QueryString)
+	assert.Equal(t, []*NameValue{
+		{"Authorization", Redacted},
+		{"Content-Type", "text/plain"},
+		{"Cookie", Redacted},
+	}, entry.Request.Headers)
+	assert.Equal(t, []*NameValue{{"session", Redacted}}, entry.Request.Cookies)
+	assert.Equal(t, int64(12), entry.Request.BodySize)
+	assert.Equal(t, "request ", entry.Request.PostData.Text)
+	assert.Equal(t, "truncated", entry.Request.PostData.Comment)
+	assert.Equal(t, http.StatusFound, entry.Response.Status)
+	assert.Equal(t, "/elsewhere", entry.Response.RedirectURL)
+	assert.Equal(t, []*NameValue{{"id", Redacted}}, entry.Response.Cookies)
+	assert.Equal(t, int64(3), entry.Response.Content.Size)
+	assert.Equal(t, "base64", entry.Response.Content.Encoding)
+	assert.Equal(t, "//4A", entry.Response.Content.Text)
+
+	entry = c.HAR(withoutBodies.ID).Log.Entries[0]
+	assert.Empty(t, entry.Request.PostData.Text)
+	assert.Empty(t, entry.Response.Content.Text)
+	assert.Equal(t, int64(3), entry.Response.Content.Size)
+
+	for i := 0; i < 2; i++ {
+		req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		c.Record(req, captures).Response(nil, errors.New("dial failed"))
+	}
+	h = c.HAR(withBodies.ID)
+	require.Len(t, h.Log.Entries, 2, "should not exceed MaxEntries")
+	assert.Equal(t, 0, h.Log.Entries[1].Response.Status)
+	assert.Equal(t, "dial failed", h.Log.Entries[1].Response.Comment)
+	assert.NotEmpty(t, h.Log.Comment)
+	assert.Equal(t, 1, c.Captures()[0].Dropped)
+}
@@ -0,0 +1,90 @@
+package har
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handler returns an http.Handler for managing captures, mounted at prefix
+// (like "/captures"). GET on prefix lists the captures as JSON and POST starts
+// a new one, taking the client's IP address ("client") or user ("user"), the
+// duration ("duration", like 10m) and whether to record bodies ("bodies") as
+// query or form parameters. GET on prefix/id downloads the HAR file of a
+// capture, POST on prefix/id/stop stops it and DELETE on prefix/id deletes it.
+func (c *Capturer) Handler(prefix string) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(req.URL.Path, prefix), "/")
+		if path == "" {
+			c.serveCaptures(resp, req)
+			return
+		}
+		parts := strings.Split(path, "/")
+		id := parts[0]
+		switch {
+		case len(parts) == 1 && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+			h := c.HAR(id)
+			if h == nil {
+				http.Error(resp, "Capture not found", http.StatusNotFound)
+				return
+			}
+			resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+			resp.Header().Set("Content-Disposition", "attachment; filename=\"capture-"+id+".har\"")
+			json.NewEncoder(resp).Encode(h)
+		case len(parts) == 1 && req.Method == http.MethodDelete:
+			if !c.Remove(id) {
+				http.Error(resp, "Capture not found", http.StatusNotFound)
+				return
+			}
+			log.Debugf("Deleted capture %v", id)
+			resp.WriteHeader(http.StatusNoContent)
+		case len(parts) == 2 && parts[1] == "stop" && req.Method == http.MethodPost:
+			if !c.Stop(id) {
+				http.Error(resp, "Capture not found", http.StatusNotFound)
+				return
+			}
+			log.Debugf("Stopped capture %v", id)
+			resp.WriteHeader(http.StatusNoContent)
+		case len(parts) > 2 || (len(parts) == 2 && parts[1] != "stop"):
+			http.NotFound(resp, req)
+		default:
+			resp.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+			http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (c *Capturer) serveCaptures(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(resp).Encode(c.Captures())
+	case http.MethodPost:
+		spec := Spec{Client: req.FormValue("client"), User: req.FormValue("user")}
+		var err error
+		if spec.Duration, err = time.ParseDuration(req.FormValue("duration")); err != nil {
+			http.Error(resp, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+		if bodies := req.FormValue("bodies"); bodies != "" {
+			if spec.Bodies, err = strconv.ParseBool(bodies); err != nil {
+				http.Error(resp, "Invalid bodies parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		info, err := c.Start(spec)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+		resp.WriteHeader(http.StatusCreated)
+		json.NewEncoder(resp).Encode(info)
+	default:
+		resp.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,57 @@
+package har
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	c := New(&Opts{})
+	h := c.Handler("/captures/")
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/captures", url.Values{"client": {"192.0.2.1"}, "duration": {"5m"}, "bodies": {"true"}})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	info := &Info{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), info))
+	assert.Equal(t, "192.0.2.1", info.Client)
+	assert.True(t, info.Bodies)
+	assert.True(t, info.Active)
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/captures?client=192.0.2.1&duration=soon", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/captures?duration=1m", nil).Code)
+
+	rec = do(http.MethodGet, "/captures", nil)
+	var infos []*Info
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	require.Len(t, infos, 1)
+
+	rec = do(http.MethodGet, "/captures/"+info.ID, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "capture-"+info.ID+".har")
+	har := &HAR{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), har))
+	assert.Equal(t, Version, har.Log.Version)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPost, "/captures/"+info.ID+"/stop", nil).Code)
+	assert.False(t, c.Captures()[0].Active)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/captures/"+info.ID, nil).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/captures/"+info.ID, nil).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/captures/"+info.ID+"/stop", nil).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPut, "/captures", nil).Code)
+}
@@ -0,0 +1,192 @@
+// Package har captures proxied plain HTTP traffic of selected clients for a
+// limited time and makes it available as HTTP Archive (HAR) 1.2 files, see
+// http://www.softwareishard.com/blog/har-12-spec/.
+package har
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Version is the HAR version of captures.
+	Version = "1.2"
+
+	// Redacted replaces the values of redacted headers.
+	Redacted = "[REDACTED]"
+)
+
+// HAR is the root of a HAR file.
+type HAR struct {
+	Log *Log `json:"log"`
+}
+
+// Log is the log of a capture.
+type Log struct {
+	Version string   `json:"version"`
+	Creator *Creator `json:"creator"`
+	Entries []*Entry `json:"entries"`
+	Comment string   `json:"comment,omitempty"`
+}
+
+// Creator identifies the application that created the log.
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry is a single request and its response.
+type Entry struct {
+	StartedDateTime string    `json:"startedDateTime"`
+	Time            float64   `json:"time"`
+	Request         *Request  `json:"request"`
+	Response        *Response `json:"response"`
+	Cache           struct{}  `json:"cache"`
+	Timings         *Timings  `json:"timings"`
+	ServerIPAddress string    `json:"serverIPAddress,omitempty"`
+	Connection      string    `json:"connection,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+}
+
+// Request is a captured request.
+type Request struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []*NameValue `json:"cookies"`
+	Headers     []*NameValue `json:"headers"`
+	QueryString []*NameValue `json:"queryString"`
+	PostData    *PostData    `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+// Response is a captured response.
+type Response struct {
+	Status      int          `json:"status"`
+	StatusText  string       `json:"statusText"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []*NameValue `json:"cookies"`
+	Headers     []*NameValue `json:"headers"`
+	Content     *Content     `json:"content"`
+	RedirectURL string       `json:"redirectURL"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+	Comment     string       `json:"comment,omitempty"`
+}
+
+// NameValue is a header, cookie or query parameter.
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PostData is a captured request body.
+type PostData struct {
+	MimeType string       `json:"mimeType"`
+	Params   []*NameValue `json:"params"`
+	Text     string       `json:"text"`
+	Comment  string       `json:"comment,omitempty"`
+}
+
+// Content is a captured response body.
+type Content struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// Timings break down the time of an entry in milliseconds, -1 meaning not
+// applicable.
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func formatTime(t time.Time) string {
+	return t.Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// headers converts headers to name/value pairs sorted by name, redacting the
+// values of the given (canonical) header names.
+func headers(h http.Header, redact map[string]bool) []*NameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*NameValue, 0, len(h))
+	for _, name := range names {
+		for _, value := range h[name] {
+			if redact[http.CanonicalHeaderKey(name)] {
+				value = Redacted
+			}
+			result = append(result, &NameValue{Name: name, Value: value})
+		}
+	}
+	return result
+}
+
+func cookies(cs []*http.Cookie, redacted bool) []*NameValue {
+	result := make([]*NameValue, 0, len(cs))
+	for _, c := range cs {
+		value := c.Value
+		if redacted {
+			value = Redacted
+		}
+		result = append(result, &NameValue{Name: c.Name, Value: value})
+	}
+	return result
+}
+
+func queryString(u *url.URL) []*NameValue {
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*NameValue, 0, len(query))
+	for _, name := range names {
+		for _, value := range query[name] {
+			result = append(result, &NameValue{Name: name, Value: value})
+		}
+	}
+	return result
+}
+
+// bodyText returns a captured body as text, base64 encoding it if it isn't
+// valid UTF-8.
+func bodyText(b []byte) (text string, encoding string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func httpVersion(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+func mimeType(h http.Header) string {
+	return strings.TrimSpace(h.Get("Content-Type"))
+}
@@ -0,0 +1,237 @@
+package har
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Recorder records a request and its response into captures.
+type Recorder struct {
+	c        *Capturer
+	captures []*Capture
+	started  time.Time
+	req      *http.Request
+	header   http.Header
+	reqBody  *body
+
+	respondedAt time.Time
+	resp        *http.Response
+	respHeader  http.Header
+	respBody    *body
+	err         error
+	finishOnce  sync.Once
+}
+
+// Record starts recording req into the given captures, wrapping its body to
+// see what's sent upstream. Call Response once the response is known.
+func (c *Capturer) Record(req *http.Request, captures []*Capture) *Recorder {
+	r := &Recorder{
+		c:        c,
+		captures: captures,
+		started:  c.now(),
+		req:      req,
+		header:   cloneHeader(req.Header),
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		r.reqBody = c.wrapBody(req.Body, r.bodies(), nil)
+		req.Body = r.reqBody
+	}
+	return r
+}
+
+// Response records resp, or err if there is no response, wrapping resp's body
+// to see what's sent to the client. The entry is added to the captures once
+// the body is read or closed.
+func (r *Recorder) Response(resp *http.Response, err error) {
+	r.respondedAt = r.c.now()
+	r.resp = resp
+	r.err = err
+	if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+		r.finish()
+		return
+	}
+	r.respHeader = cloneHeader(resp.Header)
+	r.respBody = r.c.wrapBody(resp.Body, r.bodies(), r.finish)
+	resp.Body = r.respBody
+}
+
+func (r *Recorder) bodies() bool {
+	for _, capture := range r.captures {
+		if capture.Bodies() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Recorder) finish() {
+	r.finishOnce.Do(func() {
+		finished := r.c.now()
+		for _, capture := range r.captures {
+			capture.add(r.entry(finished, capture.Bodies()))
+		}
+	})
+}
+
+func (r *Recorder) entry(finished time.Time, bodies bool) *Entry {
+	req := r.req
+	entry := &Entry{
+		StartedDateTime: formatTime(r.started),
+		Time:            millis(finished.Sub(r.started)),
+		Request: &Request{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: httpVersion(req.Proto),
+			Cookies:     cookies((&http.Request{Header: r.header}).Cookies(), r.c.redact["Cookie"]),
+			Headers:     headers(r.header, r.c.redact),
+			QueryString: queryString(req.URL),
+			HeadersSize: -1,
+		},
+		Timings: &Timings{
+			Blocked: -1,
+			DNS:     -1,
+			Connect: -1,
+			SSL:     -1,
+			Wait:    millis(r.respondedAt.Sub(r.started)),
+			Receive: millis(finished.Sub(r.respondedAt)),
+		},
+	}
+	if r.reqBody != nil {
+		entry.Request.BodySize = r.reqBody.size()
+		entry.Request.PostData = &PostData{MimeType: mimeType(r.header), Params: []*NameValue{}}
+		if bodies {
+			text, encoding := r.reqBody.text()
+			entry.Request.PostData.Text = text
+			if encoding != "" {
+				// HAR doesn't have an encoding for post data
+				entry.Request.PostData.Comment = "base64"
+			}
+			if r.reqBody.truncated() {
+				entry.Request.PostData.Comment = joinComment(entry.Request.PostData.Comment, "truncated")
+			}
+		}
+	}
+
+	resp := r.resp
+	if resp == nil {
+		entry.Response = &Response{
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []*NameValue{},
+			Headers:     []*NameValue{},
+			Content:     &Content{},
+			HeadersSize: -1,
+		}
+		if r.err != nil {
+			entry.Response.Comment = r.err.Error()
+		}
+		return entry
+	}
+	respHeader := r.respHeader
+	if respHeader == nil {
+		respHeader = resp.Header
+	}
+	entry.Response = &Response{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: httpVersion(resp.Proto),
+		Cookies:     cookies((&http.Response{Header: respHeader}).Cookies(), r.c.redact["Set-Cookie"]),
+		Headers:     headers(respHeader, r.c.redact),
+		Content:     &Content{MimeType: mimeType(respHeader)},
+		RedirectURL: respHeader.Get("Location"),
+		HeadersSize: -1,
+	}
+	if r.respBody != nil {
+		entry.Response.BodySize = r.respBody.size()
+		entry.Response.Content.Size = r.respBody.size()
+		if bodies {
+			entry.Response.Content.Text, entry.Response.Content.Encoding = r.respBody.text()
+			if r.respBody.truncated() {
+				entry.Response.Content.Comment = "truncated"
+			}
+		}
+	}
+	return entry
+}
+
+func joinComment(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + ", " + b
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// body observes a body as it's read, keeping up to max bytes of it if keep is
+// set, and calls onDone once it's been read or closed.
+type body struct {
+	io.ReadCloser
+	keep   bool
+	max    int64
+	onDone func()
+
+	mx   sync.Mutex
+	n    int64
+	kept []byte
+	once sync.Once
+}
+
+func (c *Capturer) wrapBody(rc io.ReadCloser, keep bool, onDone func()) *body {
+	return &body{ReadCloser: rc, keep: keep, max: c.opts.MaxBodySize, onDone: onDone}
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mx.Lock()
+	b.n += int64(n)
+	if b.keep && int64(len(b.kept)) < b.max {
+		remaining := b.max - int64(len(b.kept))
+		if int64(n) < remaining {
+			remaining = int64(n)
+		}
+		b.kept = append(b.kept, p[:remaining]...)
+	}
+	b.mx.Unlock()
+	if err != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+func (b *body) done() {
+	if b.onDone != nil {
+		b.once.Do(b.onDone)
+	}
+}
+
+func (b *body) size() int64 {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.n
+}
+
+func (b *body) text() (string, string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return bodyText(b.kept)
+}
+
+func (b *body) truncated() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.n > int64(len(b.kept))
+}
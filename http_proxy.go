@@ -1,29 +1,121 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy/v2/filters"
 
+	"github.com/getlantern/http-proxy/access"
+	"github.com/getlantern/http-proxy/circuitbreaker"
+	"github.com/getlantern/http-proxy/dialer"
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/faults"
+	"github.com/getlantern/http-proxy/geoip"
+	"github.com/getlantern/http-proxy/har"
 	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/loadshed"
 	"github.com/getlantern/http-proxy/logging"
+	"github.com/getlantern/http-proxy/metrics"
+	"github.com/getlantern/http-proxy/mirror"
+	"github.com/getlantern/http-proxy/pac"
 	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/resolver"
+	"github.com/getlantern/http-proxy/schedule"
 	"github.com/getlantern/http-proxy/server"
+	"github.com/getlantern/http-proxy/tracing"
+	"github.com/getlantern/http-proxy/upgrade"
+	"github.com/getlantern/http-proxy/websocket"
+)
+
+const (
+	wpadPath = "/wpad.dat"
 )
 
 var (
 	log = golog.LoggerFor("http-proxy")
 
-	help      = flag.Bool("help", false, "Get usage help")
-	keyfile   = flag.String("key", "", "Private key file name")
-	certfile  = flag.String("cert", "", "Certificate file name")
-	https     = flag.Bool("https", false, "Use TLS for client to proxy communication")
-	addr      = flag.String("addr", ":8080", "Address to listen")
-	maxConns  = flag.Uint64("maxconns", 0, "Max number of simultaneous connections allowed connections")
-	idleClose = flag.Uint64("idleclose", 30, "Time in seconds that an idle connection will be allowed before closing it")
+	help            = flag.Bool("help", false, "Get usage help")
+	keyfile         = flag.String("key", "", "Private key file name")
+	certfile        = flag.String("cert", "", "Certificate file name")
+	https           = flag.Bool("https", false, "Use TLS for client to proxy communication")
+	addr            = flag.String("addr", ":8080", "Address to listen, or unix:/path/to/socket for a Unix domain socket (unix:@name for the abstract namespace on Linux)")
+	unixMode        = flag.String("unixmode", "", "Octal file mode of the Unix domain socket, e.g. 0660")
+	unixGroup       = flag.String("unixgroup", "", "Group owning the Unix domain socket")
+	maxConns        = flag.Uint64("maxconns", 0, "Max number of simultaneous connections allowed connections")
+	acceptors       = flag.Int("acceptors", 1, "Number of listeners to accept connections on with SO_REUSEPORT (Linux only)")
+	idleClose       = flag.Uint64("idleclose", 30, "Time in seconds that an idle connection will be allowed before closing it")
+	dns             = flag.String("dns", "", "Comma separated list of upstream DNS servers (e.g. 8.8.8.8, tls://1.1.1.1, https://1.1.1.1/dns-query), defaults to the system resolver")
+	preferIPv4      = flag.Bool("preferipv4", false, "Try IPv4 addresses before IPv6 when dialing upstream")
+	fallbackDelay   = flag.Duration("fallbackdelay", dialer.DefaultFallbackDelay, "How long to wait for an upstream connection attempt before racing the next address")
+	sourceIPs       = flag.String("sourceips", "", "Comma separated list of local IPs to use for upstream connections")
+	sourceSelection = flag.String("sourceselection", "roundrobin", "How to pick source IPs: roundrobin, client or user")
+	routes          = flag.String("routes", "", "Semicolon separated list of named pools of source IPs that GeoIP and host rules can route through, e.g. eu=192.0.2.1,192.0.2.2;us=198.51.100.1")
+	cbThreshold     = flag.Int("cbthreshold", 5, "Number of consecutive dial failures to an origin after which requests to it fail fast")
+	brand           = flag.String("brand", "", "Name shown on error pages")
+	errorTemplate   = flag.String("errortemplate", "", "File containing an html/template for error pages")
+	exposeErrors    = flag.Bool("exposeerrors", false, "Include internal error details in error responses (for debugging only)")
+	otlpEndpoint    = flag.String("otlpendpoint", "", "OTLP/HTTP collector to export trace spans to, e.g. http://localhost:4318")
+	otlpHeaders     = flag.String("otlpheaders", "", "Comma separated list of key=value headers to send to the OTLP collector")
+	headerTimeout   = flag.Duration("headertimeout", 20*time.Second, "How long clients have to send a complete request head")
+	maxHeaderBytes  = flag.Int("maxheaderbytes", 64<<10, "Maximum size of a request head in bytes")
+	maxHeaders      = flag.Int("maxheaders", 100, "Maximum number of header fields in a request")
+	minBodyRate     = flag.Int("minbodyrate", 500, "Minimum rate in bytes per second at which clients have to send request bodies, 0 to disable")
+	maxRequests     = flag.Int("maxrequests", 1000, "Maximum number of requests per keep-alive connection, 0 for unlimited")
+	noSplice        = flag.Bool("nosplice", false, "Copy CONNECT tunnel data through user space instead of splicing it between sockets (Linux only)")
+	cbOpen          = flag.Duration("cbopen", 10*time.Second, "How long requests to a failing origin fail fast before dialing it again")
+	allowFile       = flag.String("allowfile", "", "File listing the IPs and CIDRs from which connections are allowed, one per line, reloaded on change")
+	denyFile        = flag.String("denyfile", "", "File listing the IPs and CIDRs from which connections are denied, one per line, reloaded on change")
+	connectPorts    = flag.String("connectports", "", "Comma separated list of ports and port ranges (e.g. 443,1024-65535) allowed for CONNECT requests, empty to allow all")
+	httpPorts       = flag.String("httpports", "", "Comma separated list of ports and port ranges allowed for plain HTTP requests with an explicit port, empty to allow all")
+	portExceptions  = flag.String("portexceptions", "", "Semicolon separated list of additional ports allowed to particular hosts, e.g. bastion.example.com=22;.example.org=8000-8999")
+	banThreshold    = flag.Int("banthreshold", 0, "Number of rejected requests within banwindow after which a client IP gets banned, for banrules that don't set failures, 0 to disable banning")
+	banWindow       = flag.Duration("banwindow", time.Minute, "Sliding window over which rejected requests count toward banthreshold, for banrules that don't set window")
+	banRules        = flag.String("banrules", "reasons=blocked-local,port-not-allowed,content-length-with-transfer-encoding,duplicate-content-length,obsolete-line-folding,duplicate-host,host-mismatch; reasons=rate-limited failures=100 window=10m", "Semicolon separated rules for which rejected requests count toward bans, e.g. reasons=blocked-local,port-not-allowed failures=5 window=1m")
+	banDuration     = flag.Duration("banduration", 10*time.Minute, "How long clients are banned the first time, doubling with every subsequent ban")
+	maxBanDuration  = flag.Duration("maxbanduration", 24*time.Hour, "Maximum duration of a ban")
+	wsOrigins       = flag.String("wsorigins", "", "Comma separated list of origins allowed to open WebSocket connections, e.g. https://example.com,https://*.example.org, empty to allow all")
+	wsSubprotocols  = flag.String("wssubprotocols", "", "Comma separated list of WebSocket subprotocols that may be negotiated, empty to allow all")
+	wsIdleTimeout   = flag.Duration("wsidletimeout", 0, "Close WebSocket connections on which no frames (including pings) were seen for this long, 0 to disable")
+	wsAudit         = flag.Bool("wsaudit", false, "Log every WebSocket message proxied over plain HTTP, including its payload (up to 4 KiB)")
+	geoCountryDB    = flag.String("geocountrydb", "", "MaxMind-format database of countries by IP, e.g. GeoLite2-Country.mmdb, reloaded on change")
+	geoASNDB        = flag.String("geoasndb", "", "MaxMind-format database of autonomous systems by IP, e.g. GeoLite2-ASN.mmdb, reloaded on change")
+	geoRules        = flag.String("georules", "", "Semicolon separated list of GeoIP rules like 'client country=US,CA allow; client country=* block; destination asn=64500 route=eu; client country=FR throttle=10/20 during=business'")
+	schedules       = flag.String("schedules", "", "Semicolon separated list of named schedules that rules can be limited to with during=name or outside=name, as day and time windows or cron expressions, e.g. 'business=TZ=Europe/Berlin Mon-Fri 09:00-17:00; night=22:00-06:00; maintenance=0-29 3 * * Sun'")
+	hostRules       = flag.String("hostrules", "", "Semicolon separated list of host rules like 'host=.internal.example.com allow during=business; host=.internal.example.com block; host=* throttle=5/10 during=night; host=.video.example.com throttle=256KB/s'")
+	mirrorTarget    = flag.String("mirrortarget", "", "Base URL of a shadow origin to mirror a sample of plain HTTP requests to, e.g. http://shadow.internal:8080. Its responses are discarded")
+	mirrorHosts     = flag.String("mirrorhosts", "", "Comma separated list of hosts and domain suffixes (.example.com) whose requests are mirrored, empty for all")
+	mirrorPaths     = flag.String("mirrorpaths", "", "Comma separated list of path prefixes whose requests are mirrored, empty for all")
+	mirrorPercent   = flag.Float64("mirrorpercent", 1, "Percentage of matching requests to mirror")
+	mirrorMaxBody   = flag.Int64("mirrormaxbody", 64*1024, "Largest request body in bytes to copy for mirroring, requests with larger bodies aren't mirrored")
+	faultInjection  = flag.Bool("faultinjection", false, "Enable fault injection for resilience testing, controlled at /faults on the admin address. Never use in production")
+	faultRules      = flag.String("faults", "", "Semicolon separated list of faults to inject from the start, like 'host=.example.com latency=500ms percent=10; status=503 percent=1; reset=1024; throttle=16384'. Implies -faultinjection")
+	captureRedact   = flag.String("captureredact", strings.Join(har.DefaultRedactedHeaders, ","), "Comma separated list of headers whose values are redacted in HAR captures")
+	captureMaxBody  = flag.Int64("capturemaxbody", 64*1024, "Largest request or response body in bytes recorded by HAR captures, longer bodies are truncated")
+	shedSoftMemory  = flag.Uint64("shedsoftmemory", 0, "Reject new plain HTTP requests with 503 while the process uses this many MiB of memory, 0 to disable")
+	shedHardMemory  = flag.Uint64("shedhardmemory", 0, "Stop accepting connections while the process uses this many MiB of memory, 0 to disable")
+	shedSoftGRs     = flag.Int("shedsoftgoroutines", 0, "Reject new plain HTTP requests with 503 while there are this many goroutines, 0 to disable")
+	shedHardGRs     = flag.Int("shedhardgoroutines", 0, "Stop accepting connections while there are this many goroutines, 0 to disable")
+	shedSoftFDs     = flag.Float64("shedsoftfds", 0, "Reject new plain HTTP requests with 503 while this percentage of the file descriptor limit (RLIMIT_NOFILE) is in use, 0 to disable")
+	shedHardFDs     = flag.Float64("shedhardfds", 0, "Stop accepting connections while this percentage of the file descriptor limit (RLIMIT_NOFILE) is in use, 0 to disable")
+	shedRecovery    = flag.Float64("shedrecovery", 90, "Percentage of a load shedding threshold below which usage has to drop before requests or connections are let through again")
+	allowLocal      = flag.String("allowlocal", "", "Comma separated list of local host:port destinations that clients may access anyway, e.g. stand-in origins for cmd/replay")
+	adminAddr       = flag.String("adminaddr", "", "Address to serve administrative endpoints (/metrics, /bans, /captures, /faults and the PAC file) on, e.g. localhost:8081")
+	pacPath         = flag.String("pacpath", "", "Path to serve a Proxy Auto-Config file at, e.g. /proxy.pac, both on the admin address and to clients asking the proxy itself. Also served at /wpad.dat for WPAD")
+	pacProxy        = flag.String("pacproxy", "", "Proxy address advertised in the PAC file, a template in which {{.Host}} is the host the client fetched the PAC file from. Defaults to that host with the port of addr")
+	pacDirect       = flag.String("pacdirect", "", "Comma separated list of hosts, domain suffixes (.example.com) and IPv4 CIDRs that the PAC file sends directly rather than through the proxy")
+	pacFallback     = flag.Bool("pacfallback", false, "Let clients using the PAC file connect directly when the proxy is unreachable")
+	pacMaxAge       = flag.Duration("pacmaxage", time.Hour, "How long clients may cache the PAC file")
+	drainTimeout    = flag.Duration("draintimeout", 5*time.Minute, "How long to wait for open connections to finish after handing over to an upgraded process on SIGUSR2")
 )
 
 func main() {
@@ -42,31 +134,420 @@ func main() {
 		log.Error(err)
 	}
 
+	// Tracing
+	if *otlpEndpoint != "" {
+		headers := make(map[string]string)
+		for _, header := range strings.Split(*otlpHeaders, ",") {
+			parts := strings.SplitN(header, "=", 2)
+			if len(parts) == 2 {
+				headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+			}
+		}
+		exporter, err := tracing.NewExporter(&tracing.Opts{
+			Endpoint: *otlpEndpoint,
+			Headers:  headers,
+		})
+		if err != nil {
+			log.Fatalf("Unable to configure tracing: %v", err)
+		}
+		defer exporter.Close()
+		ops.RegisterReporter(exporter.Report)
+	}
+
+	// Error pages
+	var htmlTemplate []byte
+	if *errorTemplate != "" {
+		htmlTemplate, err = ioutil.ReadFile(*errorTemplate)
+		if err != nil {
+			log.Fatalf("Unable to read error template: %v", err)
+		}
+	}
+	errorpages.Default, err = errorpages.New(&errorpages.Opts{
+		Brand:         *brand,
+		HTMLTemplate:  string(htmlTemplate),
+		ExposeDetails: *exposeErrors,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Resolver shared by dialer and filters
+	var dnsServers []string
+	if *dns != "" {
+		dnsServers = strings.Split(*dns, ",")
+	}
+	r, err := resolver.New(&resolver.Opts{Servers: dnsServers})
+	if err != nil {
+		log.Fatalf("Unable to configure resolver: %v", err)
+	}
+
+	// Dialer for upstream connections
+	selection, err := dialer.ParseSourceSelection(*sourceSelection)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var sources []string
+	if *sourceIPs != "" {
+		sources = strings.Split(*sourceIPs, ",")
+	}
+	dialRoutes, err := dialer.ParseRoutes(*routes)
+	if err != nil {
+		log.Fatalf("Invalid routes: %v", err)
+	}
+	d, err := dialer.New(&dialer.Opts{
+		Resolver:        r,
+		PreferIPv4:      *preferIPv4,
+		FallbackDelay:   *fallbackDelay,
+		SourceIPs:       sources,
+		SourceSelection: selection,
+		Routes:          dialRoutes,
+	})
+	if err != nil {
+		log.Fatalf("Unable to configure dialer: %v", err)
+	}
+
+	// Circuit breakers for failing origins
+	cb := circuitbreaker.New(&circuitbreaker.Opts{
+		FailureThreshold: *cbThreshold,
+		OpenDuration:     *cbOpen,
+	})
+
+	var socketMode uint64
+	if *unixMode != "" {
+		socketMode, err = strconv.ParseUint(*unixMode, 8, 32)
+		if err != nil {
+			log.Fatalf("Invalid unixmode %v: %v", *unixMode, err)
+		}
+	}
+
+	// Allow and deny connections by client IP and ban repeat offenders
+	ac, err := access.New(&access.Opts{AllowFile: *allowFile, DenyFile: *denyFile})
+	if err != nil {
+		log.Fatalf("Unable to load access lists: %v", err)
+	}
+	// By default, probing and smuggling attempts count toward bans and so do
+	// rate limits, though only when exceeded persistently since many users
+	// may share one address. Requests rejected by policy, like blocked hosts,
+	// are ordinary results.
+	jailRules, err := access.ParseRules(*banRules)
+	if err != nil {
+		log.Fatalf("Invalid banrules: %v", err)
+	}
+	for i := range jailRules {
+		if jailRules[i].MaxFailures == 0 {
+			jailRules[i].MaxFailures = *banThreshold
+		}
+		if jailRules[i].Window == 0 {
+			jailRules[i].Window = *banWindow
+		}
+	}
+	jail := access.NewJail(ac, &access.JailOpts{
+		Rules:          jailRules,
+		BanDuration:    *banDuration,
+		MaxBanDuration: *maxBanDuration,
+	})
+	portPolicy := &proxyfilters.PortPolicy{}
+	if portPolicy.ConnectPorts, err = proxyfilters.ParsePortRanges(*connectPorts); err != nil {
+		log.Fatalf("Invalid connectports: %v", err)
+	}
+	if portPolicy.HTTPPorts, err = proxyfilters.ParsePortRanges(*httpPorts); err != nil {
+		log.Fatalf("Invalid httpports: %v", err)
+	}
+	if portPolicy.Exceptions, err = proxyfilters.ParsePortExceptions(*portExceptions); err != nil {
+		log.Fatalf("Invalid portexceptions: %v", err)
+	}
+
+	wsOpts := &websocket.Opts{
+		AllowedOrigins:      splitList(*wsOrigins),
+		AllowedSubprotocols: splitList(*wsSubprotocols),
+		IdleTimeout:         *wsIdleTimeout,
+	}
+	if *wsAudit {
+		wsOpts.MaxMessageSize = 4096
+		wsOpts.OnMessage = func(msg *websocket.Message) {
+			log.Debugf("WebSocket %v %v message for %v from %v (%d bytes, truncated: %v, compressed: %v): %q",
+				msg.Direction, msg.Opcode, msg.Request.URL, msg.Request.RemoteAddr, msg.Size, msg.Truncated, msg.Compressed, msg.Payload)
+		}
+	}
+
+	// Administrative endpoints
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/metrics", metrics.Handler())
+	adminMux.Handle("/bans", access.BansHandler(ac))
+
+	filterChain := []filters.Filter{proxyfilters.RequestID}
+
+	// Shed load when running low on memory, goroutines or file descriptors
+	var shedder *loadshed.Controller
+	shedOpts := &loadshed.Opts{
+		Soft: loadshed.Thresholds{
+			Memory:     *shedSoftMemory * 1024 * 1024,
+			Goroutines: *shedSoftGRs,
+			FDs:        *shedSoftFDs / 100,
+		},
+		Hard: loadshed.Thresholds{
+			Memory:     *shedHardMemory * 1024 * 1024,
+			Goroutines: *shedHardGRs,
+			FDs:        *shedHardFDs / 100,
+		},
+		Recovery: *shedRecovery / 100,
+	}
+	if shedOpts.Soft != (loadshed.Thresholds{}) || shedOpts.Hard != (loadshed.Thresholds{}) {
+		shedder, err = loadshed.New(shedOpts)
+		if err != nil {
+			log.Fatalf("Unable to configure load shedding: %v", err)
+		}
+		filterChain = append(filterChain, proxyfilters.ShedLoad(shedder))
+	}
+
+	// HAR captures of selected clients, started on the admin address
+	if *adminAddr != "" {
+		redact := splitList(*captureRedact)
+		if redact == nil {
+			// Redact nothing rather than the defaults
+			redact = []string{}
+		}
+		capturer := har.New(&har.Opts{
+			RedactHeaders: redact,
+			MaxBodySize:   *captureMaxBody,
+		})
+		adminMux.Handle("/captures", capturer.Handler("/captures"))
+		adminMux.Handle("/captures/", capturer.Handler("/captures"))
+		filterChain = append(filterChain, proxyfilters.Capture(capturer))
+	}
+
+	// Proxy Auto-Config, served both on the admin address and by the proxy
+	// itself for clients that fetch it from there
+	if *pacPath != "" {
+		proxyAddr := *pacProxy
+		if proxyAddr == "" && !listeners.IsUnixAddr(*addr) {
+			_, port, err := net.SplitHostPort(*addr)
+			if err != nil {
+				log.Fatalf("Unable to determine port of %v for PAC file: %v", *addr, err)
+			}
+			proxyAddr = "{{.Host}}:" + port
+		}
+		pacHandler, err := pac.New(&pac.Opts{
+			ProxyAddr:      proxyAddr,
+			HTTPS:          *https,
+			Direct:         splitList(*pacDirect),
+			DirectLocal:    true,
+			Ports:          portPolicy,
+			FallbackDirect: *pacFallback,
+			MaxAge:         *pacMaxAge,
+		})
+		if err != nil {
+			log.Fatalf("Unable to configure PAC file: %v", err)
+		}
+		adminMux.Handle(*pacPath, pacHandler)
+		adminMux.Handle(wpadPath, pacHandler)
+		filterChain = append(filterChain, proxyfilters.ServeLocally(pacHandler, *pacPath, wpadPath))
+	}
+	if *banThreshold > 0 {
+		filterChain = append(filterChain, proxyfilters.BanOffenders(jail))
+	}
+	filterChain = append(filterChain,
+		proxyfilters.ValidateRequests,
+		proxyfilters.MaxRequestsPerConn(*maxRequests),
+		proxyfilters.RestrictPorts(portPolicy),
+		proxyfilters.BlockLocalWithResolver(splitList(*allowLocal), r),
+	)
+	namedSchedules, err := schedule.ParseSchedules(*schedules)
+	if err != nil {
+		log.Fatalf("Invalid schedules: %v", err)
+	}
+	scheduleEngine := schedule.New(&schedule.Opts{Schedules: namedSchedules})
+	if *hostRules != "" {
+		rules, err := proxyfilters.ParseHostRules(*hostRules)
+		if err != nil {
+			log.Fatalf("Invalid hostrules: %v", err)
+		}
+		for _, rule := range rules {
+			if err := scheduleEngine.Check(rule.Schedule); err != nil {
+				log.Fatalf("Invalid hostrules: %v", err)
+			}
+		}
+		filterChain = append(filterChain, proxyfilters.HostRules(scheduleEngine, rules))
+	}
+	if *geoCountryDB != "" || *geoASNDB != "" {
+		rules, err := proxyfilters.ParseGeoRules(*geoRules)
+		if err != nil {
+			log.Fatalf("Invalid georules: %v", err)
+		}
+		for _, rule := range rules {
+			if err := scheduleEngine.Check(rule.Schedule); err != nil {
+				log.Fatalf("Invalid georules: %v", err)
+			}
+		}
+		db, err := geoip.Open(&geoip.Opts{CountryFile: *geoCountryDB, ASNFile: *geoASNDB})
+		if err != nil {
+			log.Fatalf("Unable to open GeoIP databases: %v", err)
+		}
+		defer db.Close()
+		filterChain = append(filterChain, proxyfilters.GeoIP(db, r, scheduleEngine, rules))
+	} else if *geoRules != "" {
+		log.Fatal("georules require geocountrydb or geoasndb")
+	}
+	if *faultInjection || *faultRules != "" {
+		fs, err := faults.ParseFaults(*faultRules)
+		if err != nil {
+			log.Fatalf("Invalid faults: %v", err)
+		}
+		log.Debugf("Fault injection enabled with %d faults", len(fs))
+		injector := faults.New(fs)
+		adminMux.Handle("/faults", injector)
+		filterChain = append(filterChain, proxyfilters.InjectFaults(injector))
+	}
+	if *mirrorTarget != "" {
+		m, err := mirror.New(&mirror.Opts{
+			Target:      *mirrorTarget,
+			Hosts:       splitList(*mirrorHosts),
+			Paths:       splitList(*mirrorPaths),
+			Percent:     *mirrorPercent,
+			MaxBodySize: *mirrorMaxBody,
+		})
+		if err != nil {
+			log.Fatalf("Unable to configure mirroring: %v", err)
+		}
+		filterChain = append(filterChain, proxyfilters.Mirror(m))
+	}
+	filterChain = append(filterChain,
+		proxyfilters.WebSockets(cb.WrapDial(d.Dial), wsOpts),
+		proxyfilters.CircuitBreaker(r),
+	)
+
 	// Create server
 	srv := server.New(&server.Opts{
-		IdleTimeout: time.Duration(*idleClose),
-		Filter:      proxyfilters.BlockLocal([]string{}),
+		IdleTimeout:   time.Duration(*idleClose),
+		Filter:        filters.Join(filterChain...),
+		Dial:          cb.WrapDial(d.Dial),
+		DisableSplice: *noSplice,
+		Acceptors:     *acceptors,
+		UnixSocket: listeners.UnixOpts{
+			Mode:  os.FileMode(socketMode),
+			Group: *unixGroup,
+		},
 	})
 
-	// Add net.Listener wrappers for inbound connections
+	// Reject denied and banned clients before reading anything from them
+	srv.Allow = ac.Allow
+
+	// Add net.Listener wrappers for inbound connections. With multiple
+	// acceptors, each gets its own chain.
+	connLimit := listeners.NewConnLimit(*maxConns)
 	srv.AddListenerWrappers(
-		// Limit max number of simultaneous connections
+		// Limit max number of simultaneous connections across all acceptors
 		func(ls net.Listener) net.Listener {
-			return listeners.NewLimitedListener(ls, *maxConns)
+			return listeners.NewSharedLimitedListener(ls, connLimit)
 		},
 		// Close connections after 30 seconds of no activity
 		func(ls net.Listener) net.Listener {
 			return listeners.NewIdleConnListener(ls, time.Duration(*idleClose)*time.Second)
 		},
+		// Close connections from clients that send requests too slowly or
+		// send oversized request heads. This also records the raw request
+		// heads for ValidateRequests.
+		func(ls net.Listener) net.Listener {
+			return listeners.NewSlowlorisListener(ls, &listeners.SlowlorisOpts{
+				HeaderTimeout:       *headerTimeout,
+				MaxHeaderBytes:      *maxHeaderBytes,
+				MaxHeaderCount:      *maxHeaders,
+				MinBodyRate:         *minBodyRate,
+				BodyRateGracePeriod: 10 * time.Second,
+			})
+		},
 	)
+	if shedder != nil {
+		// Stop accepting connections while overloaded
+		srv.AddListenerWrappers(shedder.Listener)
+	}
+
+	// Use the listeners passed by systemd or by our predecessor during an
+	// upgrade, if any
+	ls, err := upgrade.Inherited()
+	if err != nil {
+		log.Fatalf("Unable to use inherited listeners: %v", err)
+	}
+	if len(ls) == 0 {
+		ls, err = srv.Listen(*addr)
+		if err != nil {
+			log.Fatalf("Unable to listen on %v: %v", *addr, err)
+		}
+	}
+
+	var adminSrv *http.Server
+	if *adminAddr != "" {
+		adminSrv = serveAdmin(*adminAddr, adminMux)
+	}
+
+	// On SIGUSR2, hand our listeners over to a new process and drain
+	drained := make(chan struct{})
+	upgrade.New(&upgrade.Opts{
+		Listeners: ls,
+		Drain: func(ctx context.Context) error {
+			if adminSrv != nil {
+				// Free the admin address for our successor
+				adminSrv.Close()
+			}
+			return srv.Shutdown(ctx)
+		},
+		DrainTimeout: *drainTimeout,
+	}).HandleSignals(func() {
+		close(drained)
+	})
+
+	ready := func(addr string) {
+		log.Debugf("Serving on %v", addr)
+		if err := upgrade.Ready(); err != nil {
+			log.Error(err)
+		}
+	}
 
 	// Serve HTTP/S
 	if *https {
-		err = srv.ListenAndServeHTTPS(*addr, *keyfile, *certfile, nil)
+		err = srv.ServeListenersTLS(ls, *keyfile, *certfile, ready)
 	} else {
-		err = srv.ListenAndServeHTTP(*addr, nil)
+		err = srv.ServeListeners(ls, ready)
+	}
+	if err == server.ErrServerClosed {
+		<-drained
+		return
 	}
 	if err != nil {
 		log.Errorf("Error serving: %v", err)
 	}
 }
+
+// splitList splits a comma separated flag value, ignoring blank entries.
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// serveAdmin serves the administrative endpoints on addr. During an upgrade,
+// our predecessor holds on to the address until we're ready, so we keep
+// trying to listen until it's free.
+func serveAdmin(addr string, handler http.Handler) *http.Server {
+	adminSrv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		for {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				log.Debugf("Unable to listen for admin requests on %v, will retry: %v", addr, err)
+				time.Sleep(time.Second)
+				continue
+			}
+			log.Debugf("Serving admin requests on %v", l.Addr())
+			if err := adminSrv.Serve(l); err != http.ErrServerClosed {
+				log.Errorf("Error serving admin requests: %v", err)
+			}
+			return
+		}
+	}()
+	return adminSrv
+}
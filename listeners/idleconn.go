@@ -3,6 +3,7 @@ package listeners
 import (
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/getlantern/idletiming"
@@ -39,6 +40,7 @@ func WrapIdleConn(conn net.Conn, idleTimeout time.Duration) net.Conn {
 	return &idleConn{
 		WrapConnEmbeddable: sac,
 		Conn:               iConn,
+		idleTimeout:        idleTimeout,
 	}
 }
 
@@ -46,6 +48,7 @@ func WrapIdleConn(conn net.Conn, idleTimeout time.Duration) net.Conn {
 type idleConn struct {
 	WrapConnEmbeddable
 	net.Conn
+	idleTimeout time.Duration
 }
 
 func (c *idleConn) OnState(s http.ConnState) {
@@ -64,3 +67,25 @@ func (c *idleConn) ControlMessage(msgType string, data interface{}) {
 func (c *idleConn) Wrapped() net.Conn {
 	return c.Conn
 }
+
+// BeginDirectTransfer implements DirectTransferObserver. Idle timing is paused
+// while data bypasses the connection and replaced by a timer that's reset on
+// every direct transfer.
+func (c *idleConn) BeginDirectTransfer() func(recv int, sent int, done bool) {
+	unpause := c.Conn.(*idletiming.IdleTimingConn).Pause()
+	timer := time.AfterFunc(c.idleTimeout, func() {
+		log.Debugf("Closing connection to %v after %v of inactivity", c.RemoteAddr(), c.idleTimeout)
+		c.Close()
+	})
+	var endOnce sync.Once
+	return func(recv int, sent int, done bool) {
+		if done {
+			endOnce.Do(func() {
+				timer.Stop()
+				unpause()
+			})
+			return
+		}
+		timer.Reset(c.idleTimeout)
+	}
+}
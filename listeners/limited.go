@@ -5,6 +5,7 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,52 +16,136 @@ var (
 	log = golog.LoggerFor("listeners")
 )
 
+// ConnLimit limits the number of simultaneous connections accepted by all of
+// the limited listeners sharing it.
+type ConnLimit struct {
+	maxConns uint64
+	numConns uint64
+
+	mx sync.Mutex
+	// resume is non-nil while accepting is stopped and gets closed on restart
+	resume chan struct{}
+}
+
+// NewConnLimit creates a ConnLimit allowing up to maxConns simultaneous
+// connections, 0 meaning unlimited.
+func NewConnLimit(maxConns uint64) *ConnLimit {
+	if maxConns <= 0 {
+		maxConns = math.MaxUint64
+	}
+	return &ConnLimit{maxConns: maxConns}
+}
+
+// NumConns returns the current number of connections.
+func (cl *ConnLimit) NumConns() uint64 {
+	return atomic.LoadUint64(&cl.numConns)
+}
+
+func (cl *ConnLimit) isStopped() bool {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	return cl.resume != nil
+}
+
+func (cl *ConnLimit) stop() {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	if cl.resume == nil {
+		cl.resume = make(chan struct{})
+	}
+}
+
+func (cl *ConnLimit) restart() {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	if cl.resume != nil {
+		close(cl.resume)
+		cl.resume = nil
+	}
+}
+
+// acquire counts a new connection, blocking until there's room for it. This
+// only blocks when several listeners raced for the last slots.
+func (cl *ConnLimit) acquire() uint64 {
+	for {
+		cl.mx.Lock()
+		if cl.numConns < cl.maxConns {
+			numConns := atomic.AddUint64(&cl.numConns, 1)
+			cl.mx.Unlock()
+			return numConns
+		}
+		if cl.resume == nil {
+			cl.resume = make(chan struct{})
+		}
+		resume := cl.resume
+		cl.mx.Unlock()
+		<-resume
+	}
+}
+
+// release discounts a closed connection, restarting accepting if stopped.
+func (cl *ConnLimit) release() uint64 {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	// Substract 1 by adding the two-complement of -1
+	numConns := atomic.AddUint64(&cl.numConns, ^uint64(0))
+	if numConns < cl.maxConns && cl.resume != nil {
+		log.Tracef("numConns %v < maxConns %v, accept new connections again", numConns, cl.maxConns)
+		close(cl.resume)
+		cl.resume = nil
+	}
+	return numConns
+}
+
+// wait blocks while accepting is stopped.
+func (cl *ConnLimit) wait() {
+	cl.mx.Lock()
+	resume := cl.resume
+	cl.mx.Unlock()
+	if resume != nil {
+		<-resume
+	}
+}
+
 type limitedListener struct {
 	net.Listener
 
-	maxConns    uint64
-	numConns    uint64
+	limit       *ConnLimit
 	idleTimeout time.Duration
-
-	stopped int32
-	stop    chan bool
-	restart chan bool
 }
 
+// NewLimitedListener wraps the given listener so that it stops accepting
+// connections while maxConns connections are open.
 func NewLimitedListener(l net.Listener, maxConns uint64) net.Listener {
-	if maxConns <= 0 {
-		maxConns = math.MaxUint64
-	}
+	return NewSharedLimitedListener(l, NewConnLimit(maxConns))
+}
 
+// NewSharedLimitedListener is like NewLimitedListener, except that the limit
+// applies to the connections of all listeners sharing it, which is useful
+// when accepting on several listeners for the same address.
+func NewSharedLimitedListener(l net.Listener, limit *ConnLimit) net.Listener {
 	return &limitedListener{
 		Listener:    l,
-		stopped:     0,
-		stop:        make(chan bool, 1),
-		restart:     make(chan bool),
-		maxConns:    maxConns,
+		limit:       limit,
 		idleTimeout: 30 * time.Second,
 	}
 }
 
 func (sl *limitedListener) Accept() (net.Conn, error) {
-	select {
-	case <-sl.stop:
-		<-sl.restart
-	default:
-	}
+	sl.limit.wait()
 
 	c, err := sl.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
 
-	atomic.AddUint64(&sl.numConns, 1)
+	numConns := sl.limit.acquire()
 
 	if log.IsTraceEnabled() {
-		if sl.maxConns == math.MaxUint64 {
-			log.Tracef("Accepted a new connection, %v in total now, of unlimited connections", sl.numConns)
+		if sl.limit.maxConns == math.MaxUint64 {
+			log.Tracef("Accepted a new connection, %v in total now, of unlimited connections", numConns)
 		} else {
-			log.Tracef("Accepted a new connection, %v in total now, %v max allowed", sl.numConns, sl.maxConns)
+			log.Tracef("Accepted a new connection, %v in total now, %v max allowed", numConns, sl.limit.maxConns)
 		}
 	}
 
@@ -73,21 +158,15 @@ func (sl *limitedListener) Accept() (net.Conn, error) {
 }
 
 func (sl *limitedListener) IsStopped() bool {
-	return atomic.LoadInt32(&sl.stopped) == 1
+	return sl.limit.isStopped()
 }
 
 func (sl *limitedListener) Stop() {
-	if !sl.IsStopped() {
-		sl.stop <- true
-		atomic.StoreInt32(&sl.stopped, 1)
-	}
+	sl.limit.stop()
 }
 
 func (sl *limitedListener) Restart() {
-	if sl.IsStopped() {
-		sl.restart <- true
-		atomic.StoreInt32(&sl.stopped, 0)
-	}
+	sl.limit.restart()
 }
 
 type limitedConn struct {
@@ -102,38 +181,39 @@ func (c *limitedConn) Close() (err error) {
 		return errors.New("network connection already closed")
 	}
 
-	// Substract 1 by adding the two-complement of -1
-	numConns := atomic.AddUint64(&c.listener.numConns, ^uint64(0))
+	numConns := c.listener.limit.release()
 	log.Tracef("Closed a connection and left %v remaining", numConns)
 	return c.Conn.Close()
 }
 
 func (c *limitedConn) OnState(s http.ConnState) {
 	l := c.listener
+	numConns := l.limit.NumConns()
+	maxConns := l.limit.maxConns
 	if log.IsTraceEnabled() {
-		if l.maxConns == math.MaxUint64 {
-			log.Tracef("OnState(%s), numConns = %v, of unlimited connections", s, l.numConns)
+		if maxConns == math.MaxUint64 {
+			log.Tracef("OnState(%s), numConns = %v, of unlimited connections", s, numConns)
 		} else {
-			log.Tracef("OnState(%s), numConns = %v, maxConns = %v", s, l.numConns, l.maxConns)
+			log.Tracef("OnState(%s), numConns = %v, maxConns = %v", s, numConns, maxConns)
 		}
 	}
 
 	if s == http.StateNew {
-		if atomic.LoadUint64(&l.numConns) >= l.maxConns {
+		if numConns >= maxConns {
 			if log.IsTraceEnabled() {
-				if l.maxConns == math.MaxUint64 {
-					log.Tracef("numConns %v (unlimited connections), stop accepting new connections", l.numConns)
+				if maxConns == math.MaxUint64 {
+					log.Tracef("numConns %v (unlimited connections), stop accepting new connections", numConns)
 				} else {
-					log.Tracef("numConns %v >= maxConns %v, stop accepting new connections", l.numConns, l.maxConns)
+					log.Tracef("numConns %v >= maxConns %v, stop accepting new connections", numConns, maxConns)
 				}
 			}
 			l.Stop()
 		} else if l.IsStopped() {
 			if log.IsTraceEnabled() {
-				if l.maxConns == math.MaxUint64 {
-					log.Tracef("numConns %v < maxConns (unlimited connections), accept new connections again", l.numConns)
+				if maxConns == math.MaxUint64 {
+					log.Tracef("numConns %v < maxConns (unlimited connections), accept new connections again", numConns)
 				} else {
-					log.Tracef("numConns %v < maxConns %v, accept new connections again", l.numConns, l.maxConns)
+					log.Tracef("numConns %v < maxConns %v, accept new connections again", numConns, maxConns)
 				}
 			}
 			l.Restart()
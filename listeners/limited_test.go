@@ -0,0 +1,57 @@
+package listeners
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedLimitedListener(t *testing.T) {
+	limit := NewConnLimit(2)
+	var ls []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		defer l.Close()
+		ls = append(ls, NewSharedLimitedListener(l, limit))
+	}
+
+	accept := func(l net.Listener) <-chan net.Conn {
+		_, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				conn.(WrapConn).OnState(http.StateNew)
+				accepted <- conn
+			}
+		}()
+		return accepted
+	}
+
+	first := <-accept(ls[0])
+	<-accept(ls[1])
+	assert.EqualValues(t, 2, limit.NumConns())
+
+	// The limit applies across both listeners
+	third := accept(ls[0])
+	select {
+	case <-third:
+		t.Fatal("shouldn't accept more than 2 connections")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case conn := <-third:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("should accept again after a connection closed")
+	}
+	assert.EqualValues(t, 2, limit.NumConns())
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/measured"
@@ -53,6 +54,11 @@ func (l *stateAwareMeasuredListener) Accept() (c net.Conn, err error) {
 
 // Wrapped MeasuredConn that supports OnState
 type wrapMeasuredConn struct {
+	// Bytes transferred directly on the underlying connection, see
+	// BeginDirectTransfer
+	directSent int64
+	directRecv int64
+
 	WrapConnEmbeddable
 	measured.Conn
 	ctx        map[string]interface{}
@@ -66,6 +72,8 @@ func (c *wrapMeasuredConn) track(reportInterval time.Duration, report MeasuredRe
 
 	var priorStats *measured.Stats
 	applyStats := func(stats *measured.Stats, final bool) {
+		stats.SentTotal += int(atomic.LoadInt64(&c.directSent))
+		stats.RecvTotal += int(atomic.LoadInt64(&c.directRecv))
 		deltaStats := &measured.Stats{}
 		// Copy stats
 		*deltaStats = *stats
@@ -124,3 +132,12 @@ func (c *wrapMeasuredConn) ControlMessage(msgType string, data interface{}) {
 func (c *wrapMeasuredConn) Wrapped() net.Conn {
 	return c.Conn
 }
+
+// BeginDirectTransfer implements DirectTransferObserver. Directly transferred
+// bytes are included in the reported totals, but not in the rates.
+func (c *wrapMeasuredConn) BeginDirectTransfer() func(recv int, sent int, done bool) {
+	return func(recv int, sent int, done bool) {
+		atomic.AddInt64(&c.directRecv, int64(recv))
+		atomic.AddInt64(&c.directSent, int64(sent))
+	}
+}
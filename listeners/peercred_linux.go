@@ -0,0 +1,22 @@
+package listeners
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	var ucred *unix.Ucred
+	var credErr error
+	err := rawControl(conn, func(fd uintptr) {
+		ucred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PeerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
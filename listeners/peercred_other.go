@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package listeners
+
+import (
+	"net"
+
+	"github.com/getlantern/errors"
+)
+
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, errors.New("Peer credentials are only supported on Linux")
+}
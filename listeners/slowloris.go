@@ -0,0 +1,571 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+const (
+	maxChunkLineLength = 4096
+	maxRecordedHeads   = 16
+
+	// maxPendingBytes caps how much a client may send while waiting for the
+	// response to a CONNECT or Upgrade request if MaxHeaderBytes isn't set
+	maxPendingBytes = 64 << 10
+
+	// statusLength is all we need of a status line to get the status code
+	statusLength = len("HTTP/1.1 101")
+)
+
+var (
+	// ClientViolations counts connections closed because the client misbehaved,
+	// broken down by reason.
+	ClientViolations = metrics.Map("client_violations")
+
+	errViolation = errors.New("connection closed due to client violation")
+)
+
+// Reasons for closing a client connection, as counted in ClientViolations.
+const (
+	ViolationHeaderTimeout  = "header_timeout"
+	ViolationHeaderTooLarge = "header_too_large"
+	ViolationTooManyHeaders = "too_many_headers"
+	ViolationSlowBody       = "slow_body"
+	ViolationMalformedChunk = "malformed_chunk"
+)
+
+// SlowlorisOpts configures the protections applied by NewSlowlorisListener.
+// Zero values disable the respective protection.
+type SlowlorisOpts struct {
+	// HeaderTimeout is how long a client has to send a complete request head,
+	// counting from when the connection was accepted for the first request and
+	// from the first byte of the request for subsequent keep-alive requests.
+	HeaderTimeout time.Duration
+
+	// MaxHeaderBytes caps the size of a request head, including the request
+	// line.
+	MaxHeaderBytes int
+
+	// MaxHeaderCount caps the number of header fields in a request head.
+	MaxHeaderCount int
+
+	// MinBodyRate is the minimum rate in bytes per second at which clients
+	// have to send request bodies. Only time spent waiting for the client
+	// counts, so slow upstreams don't penalize clients.
+	MinBodyRate int
+
+	// BodyRateGracePeriod is how long clients can wait before sending body
+	// data before MinBodyRate is enforced.
+	BodyRateGracePeriod time.Duration
+}
+
+type slowlorisListener struct {
+	net.Listener
+	opts SlowlorisOpts
+}
+
+// NewSlowlorisListener wraps the given listener so that its connections are
+// closed when clients trickle their requests in too slowly or send oversized
+// request heads. It inspects the HTTP/1.x request stream and stops doing so
+// once a connection turns into a tunnel, that is when the response written to
+// a CONNECT request is successful or the response to an Upgrade request is 101
+// Switching Protocols. Violations are counted in ClientViolations. Wrap this
+// outside of the idle listener so that the two don't interfere. The connections also record the raw request heads
+// they see, see RequestHead.
+func NewSlowlorisListener(l net.Listener, opts *SlowlorisOpts) net.Listener {
+	return &slowlorisListener{Listener: l, opts: *opts}
+}
+
+func (l *slowlorisListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	clientIP := ""
+	if addr := conn.RemoteAddr(); addr != nil {
+		clientIP, _, _ = net.SplitHostPort(addr.String())
+	}
+	sac, _ := conn.(WrapConnEmbeddable)
+	return &slowlorisConn{
+		WrapConnEmbeddable: sac,
+		Conn:               conn,
+		opts:               &l.opts,
+		clientIP:           clientIP,
+		state:              stateHead,
+		headStart:          time.Now(),
+	}, nil
+}
+
+// RequestHeadRecorder is implemented by connections that record the raw heads
+// of the HTTP requests read from them.
+type RequestHeadRecorder interface {
+	// RequestHead returns the raw head (request line and header fields) of the
+	// nth request on the connection, counting from 1, or nil if it's not
+	// available. Each head can only be retrieved once.
+	RequestHead(n int) []byte
+}
+
+// RequestHead finds the raw head of the nth request read from conn by walking
+// the chain of wrapped connections for a RequestHeadRecorder. It returns nil if
+// there is none or it doesn't have the head.
+func RequestHead(conn net.Conn, n int) []byte {
+	for conn != nil {
+		if recorder, ok := conn.(RequestHeadRecorder); ok {
+			return recorder.RequestHead(n)
+		}
+		wrapConn, ok := conn.(WrapConn)
+		if !ok {
+			return nil
+		}
+		conn = wrapConn.Wrapped()
+	}
+	return nil
+}
+
+type requestState int
+
+const (
+	// stateIdle is between requests on a keep-alive connection
+	stateIdle requestState = iota
+	// stateUpgrade is after a CONNECT or Upgrade request until the response
+	// tells whether the connection turns into a tunnel
+	stateUpgrade
+	stateHead
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateChunkEnd
+	stateTrailer
+	// stateTunnel means we've stopped inspecting the stream
+	stateTunnel
+)
+
+type slowlorisConn struct {
+	WrapConnEmbeddable
+	net.Conn
+	opts     *SlowlorisOpts
+	clientIP string
+
+	// The following track the request stream and, while a CONNECT or Upgrade
+	// request is pending, the response to it. Read doesn't hold mx while
+	// waiting for data.
+	mx          sync.Mutex
+	state       requestState
+	head        []byte
+	lineStart   int
+	headStart   time.Time
+	headerCount int
+	line        []byte
+	remaining   int64
+	bodyBytes   int64
+	bodyWaited  time.Duration
+	upgrade     bool
+	pending     []byte
+	awaiting    bool
+	connect     bool
+	status      []byte
+	interim     bool
+	upgraded    responseResult
+
+	violationMx sync.Mutex
+	violation   string
+
+	headsMx  sync.Mutex
+	heads    map[int][]byte
+	numHeads int
+}
+
+type responseResult int
+
+const (
+	responsePending responseResult = iota
+	responseUpgraded
+	responseRejected
+)
+
+func (c *slowlorisConn) Read(b []byte) (int, error) {
+	c.mx.Lock()
+	if c.state == stateTunnel {
+		c.mx.Unlock()
+		return c.Conn.Read(b)
+	}
+	start := time.Now()
+	inBody := c.state > stateHead
+	limit, reason := c.limit(start)
+	c.mx.Unlock()
+
+	var timer *time.Timer
+	if reason != "" {
+		if limit <= 0 {
+			c.violate(reason)
+			return 0, errViolation
+		}
+		timer = time.AfterFunc(limit, func() {
+			c.violate(reason)
+		})
+	}
+	n, err := c.Conn.Read(b)
+	if timer != nil {
+		timer.Stop()
+	}
+	if c.violated() {
+		return 0, errViolation
+	}
+	c.mx.Lock()
+	if inBody {
+		c.bodyWaited += time.Since(start)
+	}
+	reason = ""
+	if n > 0 {
+		reason = c.consume(b[:n])
+	}
+	c.mx.Unlock()
+	if reason != "" {
+		c.violate(reason)
+		return 0, errViolation
+	}
+	return n, err
+}
+
+// limit returns how long the next read may block before the connection
+// violates one of our limits, along with the reason for the violation. If
+// reason is empty, there is no limit.
+func (c *slowlorisConn) limit(now time.Time) (time.Duration, string) {
+	switch c.state {
+	case stateIdle, stateUpgrade:
+		return 0, ""
+	case stateHead:
+		if c.opts.HeaderTimeout <= 0 {
+			return 0, ""
+		}
+		return c.headStart.Add(c.opts.HeaderTimeout).Sub(now), ViolationHeaderTimeout
+	default:
+		if c.opts.MinBodyRate <= 0 {
+			return 0, ""
+		}
+		allowed := time.Duration(c.bodyBytes) * time.Second / time.Duration(c.opts.MinBodyRate)
+		if allowed < c.opts.BodyRateGracePeriod {
+			allowed = c.opts.BodyRateGracePeriod
+		}
+		return allowed - c.bodyWaited, ViolationSlowBody
+	}
+}
+
+// consume tracks the position in the request stream, returning a violation
+// reason if the client exceeded one of our limits.
+func (c *slowlorisConn) consume(p []byte) string {
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		switch c.state {
+		case stateIdle:
+			if b == '\r' || b == '\n' {
+				// Tolerate empty lines preceding a request (RFC 7230 section 3.5)
+				continue
+			}
+			c.state = stateHead
+			c.headStart = time.Now()
+			c.head = c.head[:0]
+			c.lineStart = 0
+			c.headerCount = 0
+			fallthrough
+		case stateHead:
+			if c.opts.MaxHeaderBytes > 0 && len(c.head) >= c.opts.MaxHeaderBytes {
+				return ViolationHeaderTooLarge
+			}
+			c.head = append(c.head, b)
+			if b != '\n' {
+				continue
+			}
+			line := bytes.TrimRight(c.head[c.lineStart:], "\r\n")
+			if len(line) == 0 {
+				if c.lineStart == 0 {
+					// Empty line preceding the first request
+					c.head = c.head[:0]
+					continue
+				}
+				c.onHead()
+				continue
+			}
+			if c.lineStart > 0 {
+				c.headerCount++
+				if c.opts.MaxHeaderCount > 0 && c.headerCount > c.opts.MaxHeaderCount {
+					return ViolationTooManyHeaders
+				}
+			}
+			c.lineStart = len(c.head)
+		case stateBody, stateChunkData:
+			n := int64(len(p) - i)
+			if n > c.remaining {
+				n = c.remaining
+			}
+			c.remaining -= n
+			c.bodyBytes += n
+			i += int(n) - 1
+			if c.remaining == 0 {
+				if c.state == stateBody {
+					c.endRequest()
+				} else {
+					c.state = stateChunkEnd
+				}
+			}
+		case stateChunkSize:
+			c.bodyBytes++
+			if b != '\n' {
+				if len(c.line) >= maxChunkLineLength {
+					return ViolationMalformedChunk
+				}
+				c.line = append(c.line, b)
+				continue
+			}
+			sizeString := strings.TrimSpace(strings.SplitN(string(c.line), ";", 2)[0])
+			c.line = c.line[:0]
+			size, err := strconv.ParseInt(sizeString, 16, 64)
+			if err != nil || size < 0 {
+				return ViolationMalformedChunk
+			}
+			if size == 0 {
+				c.state = stateTrailer
+			} else {
+				c.remaining = size
+				c.state = stateChunkData
+			}
+		case stateChunkEnd:
+			c.bodyBytes++
+			if b == '\n' {
+				c.state = stateChunkSize
+			}
+		case stateTrailer:
+			c.bodyBytes++
+			if b != '\n' {
+				if b != '\r' {
+					c.line = append(c.line[:0], b)
+				}
+				continue
+			}
+			if len(c.line) == 0 {
+				c.endRequest()
+			}
+			c.line = c.line[:0]
+		case stateUpgrade:
+			// Keep what the client sends until we know whether it's the
+			// next request or tunneled data
+			max := c.opts.MaxHeaderBytes
+			if max <= 0 {
+				max = maxPendingBytes
+			}
+			if len(c.pending)+len(p)-i > max {
+				return ViolationHeaderTooLarge
+			}
+			c.pending = append(c.pending, p[i:]...)
+			return ""
+		case stateTunnel:
+			return ""
+		}
+	}
+	return ""
+}
+
+// onHead figures out what follows a complete request head.
+func (c *slowlorisConn) onHead() {
+	c.bodyBytes = 0
+	c.bodyWaited = 0
+	c.recordHead()
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(c.head)))
+	if err != nil {
+		// Leave it to the proxy to reject this and keep parsing in case it
+		// doesn't close the connection
+		c.upgrade = false
+		c.state = stateIdle
+		return
+	}
+	c.upgrade = req.Method == http.MethodConnect || req.Header.Get("Upgrade") != ""
+	if c.upgrade {
+		c.awaiting = true
+		c.connect = req.Method == http.MethodConnect
+		c.status = c.status[:0]
+		c.interim = false
+		c.upgraded = responsePending
+	}
+	switch {
+	case len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked":
+		c.state = stateChunkSize
+	case req.ContentLength > 0:
+		c.state = stateBody
+		c.remaining = req.ContentLength
+	default:
+		c.endRequest()
+	}
+}
+
+// endRequest is called once a request has been read completely.
+func (c *slowlorisConn) endRequest() {
+	if !c.upgrade {
+		c.state = stateIdle
+		return
+	}
+	c.state = stateUpgrade
+	// The response may have been written before the request was read
+	// completely, nothing is pending yet
+	c.onResponse()
+}
+
+// onResponse applies the response to a CONNECT or Upgrade request once it's
+// been written, turning the connection into a tunnel or going on with what
+// the client sent in the meantime as the next request.
+func (c *slowlorisConn) onResponse() string {
+	if c.state != stateUpgrade {
+		return ""
+	}
+	switch c.upgraded {
+	case responseUpgraded:
+		c.state = stateTunnel
+		c.pending = nil
+	case responseRejected:
+		c.upgrade = false
+		c.state = stateIdle
+		pending := c.pending
+		c.pending = nil
+		return c.consume(pending)
+	}
+	return ""
+}
+
+// Write implements net.Conn, looking for the status of the response to a
+// pending CONNECT or Upgrade request. Responses to pipelined requests that
+// precede it are taken for its response, so that we keep inspecting the
+// stream, like when the request fails.
+func (c *slowlorisConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.mx.Lock()
+	reason := ""
+	if c.awaiting {
+		c.observeResponse(b[:n])
+		reason = c.onResponse()
+	}
+	c.mx.Unlock()
+	if reason != "" {
+		c.violate(reason)
+	}
+	return n, err
+}
+
+func (c *slowlorisConn) observeResponse(b []byte) {
+	for _, ch := range b {
+		if ch != '\n' {
+			if len(c.status) < statusLength {
+				c.status = append(c.status, ch)
+			}
+			continue
+		}
+		line := bytes.TrimRight(c.status, "\r")
+		c.status = c.status[:0]
+		if c.interim {
+			// Skip the header fields of an interim response
+			c.interim = len(line) > 0
+			continue
+		}
+		code := 0
+		if len(line) == statusLength && bytes.HasPrefix(line, []byte("HTTP/1.")) {
+			code, _ = strconv.Atoi(string(line[len("HTTP/1.1 "):]))
+		}
+		switch {
+		case code == http.StatusSwitchingProtocols, c.connect && code >= 200 && code < 300:
+			c.upgraded = responseUpgraded
+		case code >= 100 && code < 200:
+			c.interim = true
+			continue
+		default:
+			c.upgraded = responseRejected
+		}
+		c.awaiting = false
+		return
+	}
+}
+
+func (c *slowlorisConn) recordHead() {
+	head := make([]byte, len(c.head))
+	copy(head, c.head)
+
+	c.headsMx.Lock()
+	defer c.headsMx.Unlock()
+	if c.heads == nil {
+		c.heads = make(map[int][]byte)
+	}
+	c.numHeads++
+	c.heads[c.numHeads] = head
+	delete(c.heads, c.numHeads-maxRecordedHeads)
+}
+
+// RequestHead implements RequestHeadRecorder.
+func (c *slowlorisConn) RequestHead(n int) []byte {
+	c.headsMx.Lock()
+	defer c.headsMx.Unlock()
+	head := c.heads[n]
+	// Requests are processed in order, so we won't need earlier heads
+	for i := n; i > n-maxRecordedHeads && i > 0; i-- {
+		delete(c.heads, i)
+	}
+	return head
+}
+
+func (c *slowlorisConn) violated() bool {
+	c.violationMx.Lock()
+	defer c.violationMx.Unlock()
+	return c.violation != ""
+}
+
+// violate closes the connection for the given reason, responding with an
+// error first if the client was still sending the request head.
+func (c *slowlorisConn) violate(reason string) {
+	c.violationMx.Lock()
+	if c.violation != "" {
+		c.violationMx.Unlock()
+		return
+	}
+	c.violation = reason
+	c.violationMx.Unlock()
+
+	ClientViolations.Add(reason, 1)
+	log.Debugf("Closing connection from %v: %v", c.clientIP, reason)
+
+	status := 0
+	switch reason {
+	case ViolationHeaderTimeout:
+		status = http.StatusRequestTimeout
+	case ViolationHeaderTooLarge, ViolationTooManyHeaders:
+		status = http.StatusRequestHeaderFieldsTooLarge
+	}
+	if status > 0 {
+		resp := errorpages.Default.Response(nil, status, "", nil)
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		resp.Write(c.Conn)
+	}
+	c.Conn.Close()
+}
+
+func (c *slowlorisConn) OnState(s http.ConnState) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+func (c *slowlorisConn) ControlMessage(msgType string, data interface{}) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+func (c *slowlorisConn) Wrapped() net.Conn {
+	return c.Conn
+}
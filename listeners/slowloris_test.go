@@ -0,0 +1,248 @@
+package listeners
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startSlowlorisServer(t *testing.T, opts *SlowlorisOpts) (string, func()) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodConnect || req.Header.Get("Upgrade") == "echo" {
+			// Turn the connection into a tunnel that echoes what it gets
+			conn, brw, err := resp.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			status := "101 Switching Protocols"
+			if req.Method == http.MethodConnect {
+				status = "200 OK"
+			}
+			fmt.Fprintf(conn, "HTTP/1.1 %v\r\n\r\n", status)
+			io.Copy(conn, brw)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(resp, "%s %d", req.Method, len(b))
+	})}
+	go srv.Serve(NewSlowlorisListener(l, opts))
+	return l.Addr().String(), func() { srv.Close() }
+}
+
+func violations(reason string) int64 {
+	if v, ok := ClientViolations.Get(reason).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// expectClosedWith reads from conn until it's closed and checks for the
+// given status code, or no response at all if status is 0.
+func expectClosedWith(t *testing.T, conn net.Conn, status int) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	if status > 0 {
+		resp, err := http.ReadResponse(br, nil)
+		if assert.NoError(t, err) {
+			assert.Equal(t, status, resp.StatusCode)
+			ioutil.ReadAll(resp.Body)
+		}
+	}
+	_, err := br.ReadByte()
+	assert.Equal(t, io.EOF, err, "connection should have been closed")
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	addr, stop := startSlowlorisServer(t, &SlowlorisOpts{HeaderTimeout: 250 * time.Millisecond})
+	defer stop()
+	before := violations(ViolationHeaderTimeout)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	for _, part := range []string{"GET / HTTP/1.1\r\n", "Host: ", "example.com\r\n", "X-Trickle: 1\r\n"} {
+		_, err = conn.Write([]byte(part))
+		require.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+	}
+	expectClosedWith(t, conn, http.StatusRequestTimeout)
+	assert.True(t, time.Since(start) < 2*time.Second)
+	assert.Equal(t, before+1, violations(ViolationHeaderTimeout))
+}
+
+func TestHeaderLimits(t *testing.T) {
+	addr, stop := startSlowlorisServer(t, &SlowlorisOpts{MaxHeaderBytes: 200, MaxHeaderCount: 3})
+	defer stop()
+
+	for reason, head := range map[string]string{
+		ViolationHeaderTooLarge: "GET / HTTP/1.1\r\nHost: example.com\r\nX-Big: " + strings.Repeat("a", 200) + "\r\n\r\n",
+		ViolationTooManyHeaders: "GET / HTTP/1.1\r\nHost: example.com\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+	} {
+		before := violations(reason)
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(head))
+		require.NoError(t, err)
+		expectClosedWith(t, conn, http.StatusRequestHeaderFieldsTooLarge)
+		assert.Equal(t, before+1, violations(reason), reason)
+		conn.Close()
+	}
+}
+
+func TestSlowBody(t *testing.T) {
+	addr, stop := startSlowlorisServer(t, &SlowlorisOpts{MinBodyRate: 1000, BodyRateGracePeriod: 200 * time.Millisecond})
+	defer stop()
+	before := violations(ViolationSlowBody)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10000\r\n\r\n0123456789"))
+	require.NoError(t, err)
+	expectClosedWith(t, conn, 0)
+	assert.Equal(t, before+1, violations(ViolationSlowBody))
+}
+
+func TestKeepAliveRequests(t *testing.T) {
+	addr, stop := startSlowlorisServer(t, &SlowlorisOpts{
+		HeaderTimeout:       200 * time.Millisecond,
+		MaxHeaderCount:      5,
+		MinBodyRate:         1000,
+		BodyRateGracePeriod: 200 * time.Millisecond,
+	})
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	roundTrip := func(req string, expected string) {
+		_, err := conn.Write([]byte(req))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, expected, string(b))
+	}
+
+	roundTrip("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello", "POST 5")
+	// Idling between requests for longer than the header timeout is fine
+	time.Sleep(300 * time.Millisecond)
+	roundTrip("\r\nPOST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: 1\r\n\r\n", "POST 11")
+	time.Sleep(300 * time.Millisecond)
+	roundTrip("GET / HTTP/1.1\r\nHost: example.com\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n", "GET 0")
+}
+
+func TestMalformedChunk(t *testing.T) {
+	addr, stop := startSlowlorisServer(t, &SlowlorisOpts{})
+	defer stop()
+	before := violations(ViolationMalformedChunk)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"))
+	require.NoError(t, err)
+	expectClosedWith(t, conn, 0)
+	assert.Equal(t, before+1, violations(ViolationMalformedChunk))
+}
+
+func TestTunnels(t *testing.T) {
+	addr, stop := startSlowlorisServer(t, &SlowlorisOpts{HeaderTimeout: 200 * time.Millisecond, MaxHeaderCount: 3})
+	defer stop()
+
+	for _, req := range []string{
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		// Tunneled data may follow the request right away
+		_, err = conn.Write([]byte(req + "early\n"))
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		assert.True(t, resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusSwitchingProtocols)
+
+		// Idle tunnels and data that isn't HTTP are fine
+		time.Sleep(300 * time.Millisecond)
+		_, err = conn.Write([]byte("a\nb\nc\nd\n\n"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		echoed := make([]byte, len("early\na\nb\nc\nd\n\n"))
+		_, err = io.ReadFull(br, echoed)
+		require.NoError(t, err)
+		assert.Equal(t, "early\na\nb\nc\nd\n\n", string(echoed))
+		conn.Close()
+	}
+
+	// Upgrades that don't happen leave the limits in place for the requests
+	// that follow
+	before := violations(ViolationHeaderTimeout)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: other\r\n\r\nGET / HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "GET 0", string(b))
+	for _, part := range []string{"Host: ", "example.com\r\n"} {
+		_, err = conn.Write([]byte(part))
+		require.NoError(t, err)
+		time.Sleep(150 * time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err = http.ReadResponse(br, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	}
+	assert.Equal(t, before+1, violations(ViolationHeaderTimeout))
+}
+
+func TestRequestHead(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	sl := NewSlowlorisListener(l, &SlowlorisOpts{})
+	defer sl.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := sl.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	first := "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\n"
+	second := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	_, err = client.Write([]byte(first + "hello" + second))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		req, err := http.ReadRequest(br)
+		require.NoError(t, err)
+		ioutil.ReadAll(req.Body)
+	}
+
+	assert.Equal(t, second, string(RequestHead(conn, 2)))
+	assert.Nil(t, RequestHead(conn, 1), "earlier heads should have been discarded")
+	assert.Nil(t, RequestHead(conn, 2), "heads should only be retrievable once")
+	assert.Nil(t, RequestHead(client, 1))
+}
@@ -0,0 +1,260 @@
+package listeners
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// UnixPrefix marks listen addresses that refer to Unix domain sockets, as
+	// in "unix:/run/http-proxy.sock". A path starting with @ refers to a
+	// socket in the abstract namespace (Linux only), as in "unix:@http-proxy".
+	UnixPrefix = "unix:"
+
+	staleSocketDialTimeout = time.Second
+)
+
+// UnixOpts configures Unix domain sockets opened by ListenUnix.
+type UnixOpts struct {
+	// Mode is the file mode of the socket, for example 0660. If zero, the mode
+	// is determined by the umask. Ignored for abstract sockets, which have no
+	// permissions.
+	Mode os.FileMode
+
+	// Group is the name or numeric ID of the group that owns the socket. If
+	// empty, the group is left as is. Ignored for abstract sockets.
+	Group string
+}
+
+// IsUnixAddr checks whether the given listen address refers to a Unix domain
+// socket.
+func IsUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, UnixPrefix)
+}
+
+// ListenUnix listens on the Unix domain socket at the given address, with or
+// without UnixPrefix. Stale socket files left behind by a process that's no
+// longer listening are replaced.
+//
+// The socket file is not removed when the listener is closed, so that it
+// keeps working when the listener is handed over to another process, see
+// package upgrade.
+//
+// The mode and group are applied after the socket is created, so the
+// directory containing it should not be accessible to untrusted users.
+func ListenUnix(addr string, opts *UnixOpts) (net.Listener, error) {
+	if opts == nil {
+		opts = &UnixOpts{}
+	}
+	path := strings.TrimPrefix(addr, UnixPrefix)
+	if path == "" {
+		return nil, errors.New("Missing path for Unix domain socket")
+	}
+	abstract := path[0] == '@'
+	if !abstract {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, errors.New("Unable to listen on %v: %v", path, err)
+	}
+	l.SetUnlinkOnClose(false)
+	if abstract {
+		return l, nil
+	}
+
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			l.Close()
+			return nil, errors.New("Unable to set mode of %v: %v", path, err)
+		}
+	}
+	if opts.Group != "" {
+		gid, err := lookupGroup(opts.Group)
+		if err == nil {
+			err = os.Chown(path, -1, gid)
+		}
+		if err != nil {
+			l.Close()
+			return nil, errors.New("Unable to set group of %v to %v: %v", path, opts.Group, err)
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file at path if nobody is listening on
+// it anymore.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("Unable to check %v: %v", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New("%v exists and isn't a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, staleSocketDialTimeout)
+	if err == nil {
+		conn.Close()
+		return errors.New("%v is in use", path)
+	}
+	log.Debugf("Removing stale socket %v", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.New("Unable to remove stale socket %v: %v", path, err)
+	}
+	return nil
+}
+
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// PeerCred holds the credentials of the process on the other end of a Unix
+// domain socket connection, as reported by the kernel when it connected.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// String formats the credentials as "uid=1000/gid=1000/pid=4242". This is
+// what the server uses as the client's identity in place of an IP address,
+// see ParsePeerCred.
+func (c *PeerCred) String() string {
+	return fmt.Sprintf("uid=%d/gid=%d/pid=%d", c.UID, c.GID, c.PID)
+}
+
+// ParsePeerCred parses credentials formatted by PeerCred.String, returning nil
+// if s isn't in that format (like when it's an IP address).
+func ParsePeerCred(s string) *PeerCred {
+	var uid, gid uint32
+	var pid int32
+	if n, err := fmt.Sscanf(s, "uid=%d/gid=%d/pid=%d", &uid, &gid, &pid); err != nil || n != 3 {
+		return nil
+	}
+	c := &PeerCred{PID: pid, UID: uid, GID: gid}
+	if c.String() != s {
+		return nil
+	}
+	return c
+}
+
+// PeerAddr is the remote address of connections accepted by a
+// NewUnixPeerListener. Unlike the addresses of Unix domain socket peers,
+// which are usually empty, it's unique per connection and identifies the peer
+// process.
+type PeerAddr struct {
+	// Cred is nil if the peer credentials couldn't be determined.
+	Cred *PeerCred
+	seq  uint64
+}
+
+// Network implements net.Addr.
+func (a *PeerAddr) Network() string {
+	return "unix"
+}
+
+// String returns the peer's credentials and a sequence number in host:port
+// form, so that code expecting an IP address and port works unchanged.
+func (a *PeerAddr) String() string {
+	host := "unix"
+	if a.Cred != nil {
+		host = a.Cred.String()
+	}
+	return host + ":" + strconv.FormatUint(a.seq, 10)
+}
+
+// PeerCredentials returns the credentials of the peer of the given connection
+// (or of the connection it wraps) if it's a Unix domain socket connection and
+// the platform supports it, or nil.
+func PeerCredentials(conn net.Conn) *PeerCred {
+	for conn != nil {
+		if addr, ok := conn.RemoteAddr().(*PeerAddr); ok {
+			return addr.Cred
+		}
+		if uc, ok := conn.(*net.UnixConn); ok {
+			cred, _ := peerCred(uc)
+			return cred
+		}
+		wrapConn, ok := conn.(WrapConn)
+		if !ok {
+			return nil
+		}
+		conn = wrapConn.Wrapped()
+	}
+	return nil
+}
+
+type unixPeerListener struct {
+	net.Listener
+	seq uint64
+}
+
+// NewUnixPeerListener wraps a Unix domain socket listener so that the remote
+// address of its connections is a *PeerAddr identifying the peer process.
+func NewUnixPeerListener(l net.Listener) net.Listener {
+	return &unixPeerListener{Listener: l}
+}
+
+func (l *unixPeerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn, nil
+	}
+	cred, err := peerCred(uc)
+	if err != nil {
+		log.Debugf("Unable to get peer credentials: %v", err)
+	}
+	addr := &PeerAddr{Cred: cred, seq: atomic.AddUint64(&l.seq, 1)}
+	return &unixPeerConn{Conn: conn, addr: addr}, nil
+}
+
+type unixPeerConn struct {
+	net.Conn
+	addr *PeerAddr
+}
+
+func (c *unixPeerConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *unixPeerConn) OnState(s http.ConnState) {}
+
+func (c *unixPeerConn) ControlMessage(msgType string, data interface{}) {}
+
+func (c *unixPeerConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+func rawControl(conn *net.UnixConn, fn func(fd uintptr)) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return raw.Control(fn)
+}
@@ -0,0 +1,100 @@
+package listeners
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+
+	l, err := ListenUnix(UnixPrefix+path, &UnixOpts{Mode: 0600, Group: strconv.Itoa(os.Getgid())})
+	require.NoError(t, err)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	_, err = ListenUnix(path, nil)
+	assert.Error(t, err, "should not replace a socket that's in use")
+
+	l.Close()
+	_, err = os.Stat(path)
+	assert.NoError(t, err, "socket file should be left in place on close")
+	l, err = ListenUnix(path, nil)
+	require.NoError(t, err, "should replace stale socket")
+	l.Close()
+
+	regular := filepath.Join(dir, "regular")
+	require.NoError(t, ioutil.WriteFile(regular, []byte("data"), 0644))
+	_, err = ListenUnix(regular, nil)
+	assert.Error(t, err, "should not replace a file that isn't a socket")
+}
+
+func TestUnixPeerListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Abstract sockets and peer credentials are only supported on Linux")
+	}
+	path := "@http-proxy-test-" + strconv.Itoa(os.Getpid())
+	ul, err := ListenUnix(UnixPrefix+path, &UnixOpts{Mode: 0600})
+	require.NoError(t, err)
+	l := NewDefaultListener(NewUnixPeerListener(ul))
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		defer client.Close()
+		var conn net.Conn
+		select {
+		case conn = <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not accepted")
+		}
+		defer conn.Close()
+
+		cred := PeerCredentials(conn)
+		require.NotNil(t, cred)
+		assert.EqualValues(t, os.Getpid(), cred.PID)
+		assert.EqualValues(t, os.Getuid(), cred.UID)
+		assert.EqualValues(t, os.Getgid(), cred.GID)
+
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		require.NoError(t, err)
+		assert.Equal(t, cred, ParsePeerCred(host))
+		addrs = append(addrs, conn.RemoteAddr().String())
+	}
+	assert.NotEqual(t, addrs[0], addrs[1], "remote addresses should be unique per connection")
+}
+
+func TestParsePeerCred(t *testing.T) {
+	cred := &PeerCred{PID: 4242, UID: 1000, GID: 100}
+	assert.Equal(t, "uid=1000/gid=100/pid=4242", cred.String())
+	assert.Equal(t, cred, ParsePeerCred(cred.String()))
+	assert.Nil(t, ParsePeerCred("127.0.0.1"))
+	assert.Nil(t, ParsePeerCred("uid=1000/gid=100/pid=4242x"))
+	assert.Nil(t, ParsePeerCred("uid=1000/gid=100"))
+}
@@ -25,3 +25,15 @@ type WrapConn interface {
 	ControlMessage(msgType string, data interface{})
 	Wrapped() net.Conn
 }
+
+// DirectTransferObserver is implemented by connection wrappers that keep track
+// of the data passing through them and therefore need to be told about data
+// that's transferred directly on the underlying socket, bypassing their Read
+// and Write, like when tunneling with splice.
+type DirectTransferObserver interface {
+	// BeginDirectTransfer is called before data starts bypassing the wrapper.
+	// The returned function is called with the number of bytes received from
+	// and sent to the peer after every direct transfer, and once with done set
+	// when direct transfer has ended. It may be called concurrently.
+	BeginDirectTransfer() func(recv int, sent int, done bool)
+}
@@ -0,0 +1,28 @@
+package loadshed
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFDs returns the number of open file descriptors and RLIMIT_NOFILE.
+func openFDs() (int, int) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		log.Debugf("Unable to get RLIMIT_NOFILE: %v", err)
+		return 0, 0
+	}
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		log.Debugf("Unable to count file descriptors: %v", err)
+		return 0, 0
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		log.Debugf("Unable to count file descriptors: %v", err)
+		return 0, 0
+	}
+	// Don't count the descriptor for reading the directory
+	return len(names) - 1, int(limit.Cur)
+}
@@ -0,0 +1,43 @@
+package loadshed
+
+import (
+	"net"
+	"sync"
+)
+
+type listener struct {
+	net.Listener
+	c *Controller
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listener wraps l so that it stops accepting connections while the level is
+// Hard. Add it to the server's listener chain.
+func (c *Controller) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, c: c, closed: make(chan struct{})}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		resume := l.c.paused()
+		if resume == nil {
+			break
+		}
+		select {
+		case <-resume:
+		case <-l.closed:
+			// Let the wrapped listener return its error
+			return l.Listener.Accept()
+		}
+	}
+	return l.Listener.Accept()
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
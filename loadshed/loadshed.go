@@ -0,0 +1,278 @@
+// Package loadshed protects the proxy from overload. A Controller samples the
+// process' memory, goroutines and open file descriptors and raises its Level
+// when they cross configured thresholds: at Soft, proxyfilters.ShedLoad
+// rejects new plain HTTP requests, and at Hard, listeners wrapped with
+// Controller.Listener stop accepting connections, leaving them in the
+// kernel's backlog. The level only drops again once all resources are
+// comfortably below the thresholds, so that it doesn't flap.
+package loadshed
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+const (
+	// Overloaded is the reason given on responses to shed requests.
+	Overloaded errorpages.Reason = "overloaded"
+
+	defaultInterval   = time.Second
+	defaultRecovery   = 0.9
+	defaultRetryAfter = 5 * time.Second
+)
+
+var (
+	log = golog.LoggerFor("loadshed")
+
+	transitions = metrics.Map("load_shed_transitions")
+)
+
+// Level is how overloaded the process is.
+type Level int32
+
+const (
+	// Normal means that no threshold is exceeded.
+	Normal Level = iota
+	// Soft means that a soft threshold is exceeded and new requests should be
+	// rejected.
+	Soft
+	// Hard means that a hard threshold is exceeded and new connections
+	// shouldn't be accepted.
+	Hard
+)
+
+func (l Level) String() string {
+	switch l {
+	case Normal:
+		return "normal"
+	case Soft:
+		return "soft"
+	case Hard:
+		return "hard"
+	}
+	return "unknown"
+}
+
+// Sample is a measurement of the resources used by the process.
+type Sample struct {
+	// Memory is the number of bytes obtained from the OS and not released.
+	Memory uint64
+
+	// Goroutines is the number of goroutines.
+	Goroutines int
+
+	// FDs is the number of open file descriptors and MaxFDs the limit on
+	// them (RLIMIT_NOFILE). Both are 0 where they can't be determined.
+	FDs    int
+	MaxFDs int
+}
+
+// ReadSample samples the resources used by the current process.
+func ReadSample() *Sample {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s := &Sample{
+		Memory:     ms.Sys - ms.HeapReleased,
+		Goroutines: runtime.NumGoroutine(),
+	}
+	s.FDs, s.MaxFDs = openFDs()
+	return s
+}
+
+// Thresholds are the resource usage at which a level is reached. Zero values
+// aren't checked.
+type Thresholds struct {
+	// Memory is in bytes, see Sample.Memory.
+	Memory uint64
+
+	Goroutines int
+
+	// FDs is a fraction of RLIMIT_NOFILE, like 0.8.
+	FDs float64
+}
+
+// exceeded checks whether any of the thresholds, scaled by scale, is reached
+// by s.
+func (t *Thresholds) exceeded(s *Sample, scale float64) bool {
+	if t.Memory > 0 && float64(s.Memory) >= float64(t.Memory)*scale {
+		return true
+	}
+	if t.Goroutines > 0 && float64(s.Goroutines) >= float64(t.Goroutines)*scale {
+		return true
+	}
+	return t.FDs > 0 && s.MaxFDs > 0 && float64(s.FDs) >= t.FDs*float64(s.MaxFDs)*scale
+}
+
+func (t *Thresholds) isZero() bool {
+	return t.Memory == 0 && t.Goroutines == 0 && t.FDs == 0
+}
+
+// Opts configures a Controller.
+type Opts struct {
+	// Soft are the thresholds above which new requests are rejected.
+	Soft Thresholds
+
+	// Hard are the thresholds above which new connections aren't accepted.
+	Hard Thresholds
+
+	// Recovery is the fraction of a threshold below which usage has to drop
+	// for the level to go back down, like 0.9 for 90%. Defaults to 0.9.
+	Recovery float64
+
+	// Interval is how often resources are sampled. Defaults to a second.
+	Interval time.Duration
+
+	// RetryAfter is what clients are told to wait before retrying rejected
+	// requests. Defaults to 5 seconds.
+	RetryAfter time.Duration
+
+	// Sample samples resources. Defaults to ReadSample.
+	Sample func() *Sample
+}
+
+// Controller tracks the load level. It is safe for concurrent use.
+type Controller struct {
+	opts  Opts
+	level int32
+
+	mx sync.Mutex
+	// resume is non-nil while accepting is paused and gets closed on resume
+	resume chan struct{}
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// New constructs a Controller and starts sampling, taking the first sample
+// right away. Call Close to stop.
+func New(opts *Opts) (*Controller, error) {
+	c := &Controller{opts: *opts, stop: make(chan struct{})}
+	if c.opts.Recovery == 0 {
+		c.opts.Recovery = defaultRecovery
+	}
+	if c.opts.Recovery < 0 || c.opts.Recovery > 1 {
+		return nil, errors.New("Invalid recovery %v, expected a fraction between 0 and 1", c.opts.Recovery)
+	}
+	if c.opts.Soft.FDs < 0 || c.opts.Soft.FDs > 1 || c.opts.Hard.FDs < 0 || c.opts.Hard.FDs > 1 {
+		return nil, errors.New("Invalid file descriptor thresholds, expected fractions between 0 and 1")
+	}
+	if c.opts.Soft.isZero() && c.opts.Hard.isZero() {
+		return nil, errors.New("No thresholds given")
+	}
+	if c.opts.Interval <= 0 {
+		c.opts.Interval = defaultInterval
+	}
+	if c.opts.RetryAfter <= 0 {
+		c.opts.RetryAfter = defaultRetryAfter
+	}
+	if c.opts.Sample == nil {
+		c.opts.Sample = ReadSample
+	}
+
+	metrics.Func("load_shed_level", func() interface{} {
+		return c.Level().String()
+	})
+	c.update(c.opts.Sample())
+	go c.run()
+	return c, nil
+}
+
+// Level returns the current level.
+func (c *Controller) Level() Level {
+	return Level(atomic.LoadInt32(&c.level))
+}
+
+// RetryAfter is how long clients should wait before retrying rejected
+// requests.
+func (c *Controller) RetryAfter() time.Duration {
+	return c.opts.RetryAfter
+}
+
+// Close stops sampling and resumes accepting connections.
+func (c *Controller) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		c.setPaused(false)
+	})
+}
+
+func (c *Controller) run() {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.update(c.opts.Sample())
+		}
+	}
+}
+
+// levelFor determines the level for s with thresholds scaled by scale.
+func (c *Controller) levelFor(s *Sample, scale float64) Level {
+	if c.opts.Hard.exceeded(s, scale) {
+		return Hard
+	}
+	if c.opts.Soft.exceeded(s, scale) {
+		return Soft
+	}
+	return Normal
+}
+
+// update sets the level according to s. The level rises as soon as a
+// threshold is reached but only drops once usage is below the thresholds
+// scaled by Recovery.
+func (c *Controller) update(s *Sample) Level {
+	current := c.Level()
+	level := c.levelFor(s, 1)
+	if level < current {
+		if recovered := c.levelFor(s, c.opts.Recovery); recovered < current {
+			level = recovered
+		} else {
+			level = current
+		}
+	}
+	if level == current {
+		return level
+	}
+
+	atomic.StoreInt32(&c.level, int32(level))
+	transitions.Add(current.String()+" "+level.String(), 1)
+	if level > current {
+		log.Errorf("Load level rose from %v to %v with %d MiB of memory, %d goroutines and %d/%d file descriptors in use",
+			current, level, s.Memory/1024/1024, s.Goroutines, s.FDs, s.MaxFDs)
+	} else {
+		log.Debugf("Load level dropped from %v to %v with %d MiB of memory, %d goroutines and %d/%d file descriptors in use",
+			current, level, s.Memory/1024/1024, s.Goroutines, s.FDs, s.MaxFDs)
+	}
+	c.setPaused(level >= Hard)
+	return level
+}
+
+func (c *Controller) setPaused(paused bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if paused && c.resume == nil {
+		c.resume = make(chan struct{})
+	} else if !paused && c.resume != nil {
+		close(c.resume)
+		c.resume = nil
+	}
+}
+
+// paused returns a channel that's closed once accepting resumes, or nil if
+// accepting isn't paused.
+func (c *Controller) paused() chan struct{} {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.resume
+}
@@ -0,0 +1,142 @@
+package loadshed
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestController(t *testing.T) *Controller {
+	c, err := New(&Opts{
+		Soft:     Thresholds{Memory: 1000, Goroutines: 100, FDs: 0.5},
+		Hard:     Thresholds{Memory: 2000, Goroutines: 200, FDs: 0.8},
+		Interval: time.Hour,
+		Sample: func() *Sample {
+			return &Sample{}
+		},
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestHysteresis(t *testing.T) {
+	c := newTestController(t)
+	defer c.Close()
+	assert.Equal(t, Normal, c.Level())
+
+	steps := []struct {
+		sample   Sample
+		expected Level
+	}{
+		{Sample{Goroutines: 99}, Normal},
+		{Sample{Goroutines: 100}, Soft},
+		{Sample{Goroutines: 95}, Soft},
+		{Sample{Goroutines: 89}, Normal},
+		{Sample{Memory: 2500}, Hard},
+		{Sample{Memory: 1900}, Hard},
+		{Sample{Memory: 1700}, Soft},
+		{Sample{Memory: 1700, FDs: 80, MaxFDs: 100}, Hard},
+		{Sample{FDs: 50, MaxFDs: 100}, Soft},
+		{Sample{FDs: 44, MaxFDs: 100}, Normal},
+		{Sample{FDs: 1000}, Normal},
+		{Sample{Goroutines: 10, Memory: 100}, Normal},
+	}
+	for i, step := range steps {
+		sample := step.sample
+		assert.Equal(t, step.expected, c.update(&sample), "step %d: %+v", i, step.sample)
+	}
+}
+
+func TestListener(t *testing.T) {
+	c := newTestController(t)
+	defer c.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	sl := c.Listener(l)
+	defer sl.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dial := func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+
+	dial()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Connection should have been accepted")
+	}
+
+	// Let the accept loop wait for the next connection before pausing
+	time.Sleep(50 * time.Millisecond)
+	c.update(&Sample{Goroutines: 300})
+	dial()
+	// The paused accept loop takes another turn after the pending Accept
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Pending accept should have completed")
+	}
+	dial()
+	select {
+	case <-accepted:
+		t.Fatal("Connection shouldn't have been accepted at the hard level")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.update(&Sample{Goroutines: 150})
+	assert.Equal(t, Soft, c.Level())
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Accepting should have resumed below the hard level")
+	}
+
+	c.update(&Sample{Goroutines: 300})
+	sl.Close()
+	select {
+	case _, open := <-accepted:
+		assert.False(t, open, "closing the listener should end a paused accept loop")
+	case <-time.After(time.Second):
+		t.Fatal("Closing the listener should end a paused accept loop")
+	}
+}
+
+func TestInvalidOpts(t *testing.T) {
+	for _, opts := range []*Opts{
+		{},
+		{Soft: Thresholds{Goroutines: 100}, Recovery: 1.5},
+		{Hard: Thresholds{FDs: 95}},
+	} {
+		_, err := New(opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+}
+
+func TestReadSample(t *testing.T) {
+	s := ReadSample()
+	assert.True(t, s.Memory > 0)
+	assert.True(t, s.Goroutines > 0)
+	if s.MaxFDs > 0 {
+		assert.True(t, s.FDs > 0)
+		assert.True(t, s.FDs < s.MaxFDs)
+	}
+}
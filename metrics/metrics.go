@@ -0,0 +1,89 @@
+// Package metrics provides process-wide counters and gauges that are exported
+// through expvar under the "http-proxy" variable (see Handler).
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var (
+	vars   = make(map[string]expvar.Var)
+	varsMx sync.RWMutex
+)
+
+func init() {
+	expvar.Publish("http-proxy", expvar.Func(func() interface{} {
+		return Snapshot()
+	}))
+}
+
+// Counter returns the counter with the given name, creating it if necessary.
+// Counters are also suitable for use as integer gauges.
+func Counter(name string) *expvar.Int {
+	return getOrCreate(name, func() expvar.Var { return new(expvar.Int) }).(*expvar.Int)
+}
+
+// Map returns the map with the given name, creating it if necessary. Maps are
+// useful for counters broken down by some dimension like a reason code.
+func Map(name string) *expvar.Map {
+	return getOrCreate(name, func() expvar.Var { return new(expvar.Map).Init() }).(*expvar.Map)
+}
+
+// Func registers a function that computes the value of the named metric at
+// read time, replacing any prior registration with the same name.
+func Func(name string, fn func() interface{}) {
+	varsMx.Lock()
+	vars[name] = expvar.Func(fn)
+	varsMx.Unlock()
+}
+
+// Snapshot returns the current value of all metrics.
+func Snapshot() map[string]interface{} {
+	varsMx.RLock()
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	varsMx.RUnlock()
+	sort.Strings(names)
+
+	result := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		varsMx.RLock()
+		v := vars[name]
+		varsMx.RUnlock()
+		var value interface{}
+		if err := json.Unmarshal([]byte(v.String()), &value); err == nil {
+			result[name] = value
+		}
+	}
+	return result
+}
+
+// Handler returns an http.Handler that serves all expvar variables, including
+// our metrics, as JSON.
+func Handler() http.Handler {
+	return expvar.Handler()
+}
+
+func getOrCreate(name string, create func() expvar.Var) expvar.Var {
+	varsMx.RLock()
+	v, found := vars[name]
+	varsMx.RUnlock()
+	if found {
+		return v
+	}
+
+	varsMx.Lock()
+	defer varsMx.Unlock()
+	v, found = vars[name]
+	if !found {
+		v = create()
+		vars[name] = v
+	}
+	return v
+}
@@ -0,0 +1,388 @@
+// Package mirror sends copies of a sample of live requests to a shadow origin,
+// for testing a new backend with real traffic without affecting clients. The
+// shadow's responses are discarded, only their status codes are compared with
+// those of the primary origin.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+const (
+	// Header is added to mirrored requests so that the shadow origin can tell
+	// them apart from live traffic.
+	Header = "X-Mirrored"
+
+	defaultMaxBodySize = 64 * 1024
+	defaultTimeout     = 10 * time.Second
+	defaultMaxInFlight = 100
+
+	// maxDiscardedBodySize caps how much of a shadow response is read before
+	// closing it.
+	maxDiscardedBodySize = 1024 * 1024
+)
+
+var (
+	log = golog.LoggerFor("mirror")
+
+	requestCount = metrics.Map("mirror_requests")
+	resultCount  = metrics.Map("mirror_results")
+	divergences  = metrics.Map("mirror_divergences")
+
+	// headers that apply to the connection to the proxy rather than the
+	// request and aren't mirrored.
+	hopByHopHeaders = []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Proxy-Connection",
+		"Te",
+		"Trailer",
+		"Transfer-Encoding",
+		"Upgrade",
+	}
+)
+
+// Opts configures a Mirror.
+type Opts struct {
+	// Target is the base URL of the shadow origin, like
+	// "http://shadow.internal:8080". Mirrored requests keep their path (below
+	// the target's path, if any), query and Host header.
+	Target string
+
+	// Hosts limits mirroring to requests for these hosts, given as names like
+	// "example.com" or suffixes like ".example.com". Empty mirrors requests for
+	// all hosts.
+	Hosts []string
+
+	// Paths limits mirroring to requests whose path starts with one of these
+	// prefixes. Empty mirrors requests for all paths.
+	Paths []string
+
+	// Percent is the percentage of matching requests that are mirrored.
+	Percent float64
+
+	// MaxBodySize is the largest request body that is copied for mirroring.
+	// Requests with larger bodies aren't mirrored. Defaults to 64 KiB.
+	MaxBodySize int64
+
+	// Timeout limits how long a mirrored request may take. Defaults to 10
+	// seconds.
+	Timeout time.Duration
+
+	// MaxInFlight caps the number of mirrored requests in flight. Requests
+	// beyond that aren't mirrored. Defaults to 100.
+	MaxInFlight int
+
+	// Transport sends mirrored requests. Defaults to a dedicated
+	// http.Transport.
+	Transport http.RoundTripper
+
+	// OnResult, if set, is called with the result of every mirrored request.
+	OnResult func(*Result)
+}
+
+// Result compares the responses of the primary and shadow origins to a
+// mirrored request.
+type Result struct {
+	Method string
+	URL    string
+
+	// PrimaryStatus is the status code of the primary's response, or 0 if the
+	// request failed.
+	PrimaryStatus int
+
+	// ShadowStatus is the status code of the shadow's response, or 0 if the
+	// request failed with Err.
+	ShadowStatus int
+	Err          error
+
+	// Elapsed is how long the shadow took to respond.
+	Elapsed time.Duration
+}
+
+// Diverged checks whether the primary and the shadow responded with different
+// status codes.
+func (r *Result) Diverged() bool {
+	return r.PrimaryStatus != r.ShadowStatus
+}
+
+// Mirror mirrors requests. It is safe for concurrent use.
+type Mirror struct {
+	opts     Opts
+	target   *url.URL
+	inFlight int64
+}
+
+// New creates a Mirror.
+func New(opts *Opts) (*Mirror, error) {
+	m := &Mirror{opts: *opts}
+	target, err := url.Parse(opts.Target)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, errors.New("Invalid mirror target %q, expected http(s)://host[:port]", opts.Target)
+	}
+	m.target = target
+	if opts.Percent < 0 || opts.Percent > 100 {
+		return nil, errors.New("Invalid mirror percentage %v", opts.Percent)
+	}
+	m.opts.Hosts = make([]string, 0, len(opts.Hosts))
+	for _, host := range opts.Hosts {
+		m.opts.Hosts = append(m.opts.Hosts, strings.ToLower(host))
+	}
+	if m.opts.MaxBodySize <= 0 {
+		m.opts.MaxBodySize = defaultMaxBodySize
+	}
+	if m.opts.Timeout <= 0 {
+		m.opts.Timeout = defaultTimeout
+	}
+	if m.opts.MaxInFlight <= 0 {
+		m.opts.MaxInFlight = defaultMaxInFlight
+	}
+	if m.opts.Transport == nil {
+		m.opts.Transport = &http.Transport{
+			MaxIdleConnsPerHost: m.opts.MaxInFlight,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+	return m, nil
+}
+
+// Start mirrors req in the background if it matches and is sampled. Its body
+// is copied while the primary reads it and the shadow request is only sent
+// once the body has been read completely, so mirroring doesn't delay the
+// primary. Requests whose bodies turn out larger than MaxBodySize or aren't
+// read completely aren't mirrored after all. The caller must call the
+// returned function with the status code of the primary's response (or 0 if
+// the request failed) once known. Start returns nil if req isn't mirrored.
+func (m *Mirror) Start(req *http.Request) func(primaryStatus int) {
+	if !m.matches(req) || rand.Float64()*100 >= m.opts.Percent {
+		return nil
+	}
+	if req.ContentLength > m.opts.MaxBodySize {
+		requestCount.Add("body_too_large", 1)
+		return nil
+	}
+	if atomic.AddInt64(&m.inFlight, 1) > int64(m.opts.MaxInFlight) {
+		atomic.AddInt64(&m.inFlight, -1)
+		requestCount.Add("dropped", 1)
+		return nil
+	}
+
+	// Build the shadow request now, before the filters after us modify req
+	shadow := m.shadowRequest(req)
+	primary := make(chan int, 1)
+	send := func(body []byte, failure string) {
+		if failure != "" {
+			atomic.AddInt64(&m.inFlight, -1)
+			requestCount.Add(failure, 1)
+			return
+		}
+		requestCount.Add("mirrored", 1)
+		shadow.ContentLength = int64(len(body))
+		if len(body) > 0 {
+			shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		go func() {
+			defer atomic.AddInt64(&m.inFlight, -1)
+			result := m.send(shadow)
+			result.PrimaryStatus = <-primary
+			m.record(result)
+		}()
+	}
+
+	var body *teeBody
+	if req.Body == nil || req.Body == http.NoBody {
+		send(nil, "")
+	} else {
+		body = &teeBody{ReadCloser: req.Body, max: m.opts.MaxBodySize, size: req.ContentLength, onEnd: send}
+		req.Body = body
+	}
+	return func(primaryStatus int) {
+		if body != nil {
+			// The primary is done with the body, whether it read all of it or
+			// not
+			body.finish()
+		}
+		primary <- primaryStatus
+	}
+}
+
+func (m *Mirror) matches(req *http.Request) bool {
+	if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if req.Header.Get("Expect") != "" {
+		// Leave requests waiting for 100 Continue to the primary
+		return false
+	}
+	if len(m.opts.Hosts) > 0 {
+		host := strings.ToLower(req.URL.Hostname())
+		if host == "" {
+			host = strings.ToLower(req.Host)
+		}
+		matched := false
+		for _, h := range m.opts.Hosts {
+			if h == host || (strings.HasPrefix(h, ".") && strings.HasSuffix(host, h)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(m.opts.Paths) > 0 {
+		for _, prefix := range m.opts.Paths {
+			if strings.HasPrefix(req.URL.Path, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// teeBody copies what is read from a request body, up to max bytes, and calls
+// onEnd once, either with the copy when the body has been read completely or
+// with the reason why it can't be mirrored.
+type teeBody struct {
+	io.ReadCloser
+	max   int64
+	size  int64
+	onEnd func(body []byte, failure string)
+
+	mx    sync.Mutex
+	buf   []byte
+	ended bool
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mx.Lock()
+	if !b.ended {
+		if int64(len(b.buf)+n) > b.max {
+			b.end("body_too_large")
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+			if err == io.EOF {
+				b.end("")
+			}
+		}
+	}
+	b.mx.Unlock()
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+// finish ends the copy if the body hasn't been read until EOF. That's fine
+// as long as all of its declared length has been read.
+func (b *teeBody) finish() {
+	b.mx.Lock()
+	if !b.ended {
+		if b.size >= 0 && int64(len(b.buf)) == b.size {
+			b.end("")
+		} else {
+			b.end("body_incomplete")
+		}
+	}
+	b.mx.Unlock()
+}
+
+func (b *teeBody) end(failure string) {
+	b.ended = true
+	body := b.buf
+	b.buf = nil
+	if failure != "" {
+		body = nil
+	}
+	b.onEnd(body, failure)
+}
+
+func (m *Mirror) shadowRequest(req *http.Request) *http.Request {
+	u := *m.target
+	u.Path = strings.TrimSuffix(m.target.Path, "/") + req.URL.Path
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+	u.Fragment = ""
+
+	shadow := &http.Request{
+		Method:     req.Method,
+		URL:        &u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header, len(req.Header)),
+		Host:       req.Host,
+		Body:       http.NoBody,
+	}
+	for key, values := range req.Header {
+		shadow.Header[key] = append([]string(nil), values...)
+	}
+	if shadow.Host == "" {
+		shadow.Host = req.URL.Host
+	}
+	for _, header := range hopByHopHeaders {
+		shadow.Header.Del(header)
+	}
+	shadow.Header.Set(Header, "true")
+	return shadow
+}
+
+func (m *Mirror) send(shadow *http.Request) *Result {
+	result := &Result{Method: shadow.Method, URL: shadow.URL.String()}
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := m.opts.Transport.RoundTrip(shadow.WithContext(ctx))
+	if err != nil {
+		result.Err = err
+		result.Elapsed = time.Since(start)
+		return result
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDiscardedBodySize))
+	resp.Body.Close()
+	result.ShadowStatus = resp.StatusCode
+	result.Elapsed = time.Since(start)
+	return result
+}
+
+func (m *Mirror) record(result *Result) {
+	switch {
+	case result.PrimaryStatus == 0:
+		resultCount.Add("primary_error", 1)
+	case result.Err != nil:
+		resultCount.Add("shadow_error", 1)
+		log.Debugf("Mirrored %v %v failed: %v", result.Method, result.URL, result.Err)
+	case result.Diverged():
+		resultCount.Add("diverged", 1)
+		divergences.Add(strconv.Itoa(result.PrimaryStatus)+" "+strconv.Itoa(result.ShadowStatus), 1)
+		log.Debugf("Mirrored %v %v diverged: primary %d, shadow %d", result.Method, result.URL, result.PrimaryStatus, result.ShadowStatus)
+	default:
+		resultCount.Add("matched", 1)
+	}
+	if m.opts.OnResult != nil {
+		m.opts.OnResult(result)
+	}
+}
@@ -0,0 +1,170 @@
+package mirror
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type shadowRequest struct {
+	method, uri, host, body string
+	header                  http.Header
+}
+
+func newShadow(status int) (*httptest.Server, chan *shadowRequest) {
+	received := make(chan *shadowRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- &shadowRequest{req.Method, req.RequestURI, req.Host, string(body), req.Header}
+		w.WriteHeader(status)
+		w.Write([]byte("discarded"))
+	}))
+	return srv, received
+}
+
+func TestNew(t *testing.T) {
+	for _, target := range []string{"", "shadow:8080", "ftp://shadow", "http://"} {
+		_, err := New(&Opts{Target: target, Percent: 100})
+		assert.Error(t, err, target)
+	}
+	_, err := New(&Opts{Target: "http://shadow", Percent: 101})
+	assert.Error(t, err)
+	_, err = New(&Opts{Target: "https://shadow/base", Percent: 0})
+	assert.NoError(t, err)
+}
+
+func TestMirror(t *testing.T) {
+	shadow, received := newShadow(http.StatusServiceUnavailable)
+	defer shadow.Close()
+	results := make(chan *Result, 10)
+	m, err := New(&Opts{Target: shadow.URL + "/shadow/", Percent: 100, OnResult: func(r *Result) { results <- r }})
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://Example.com/api/items?id=1", strings.NewReader("hello"))
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("X-Custom", "value")
+	done := m.Start(req)
+	require.NotNil(t, done)
+	select {
+	case <-received:
+		t.Fatal("shadow request should wait for the body")
+	case <-time.After(50 * time.Millisecond):
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body), "primary should still get the whole body")
+
+	got := <-received
+	assert.Equal(t, http.MethodPost, got.method)
+	assert.Equal(t, "/shadow/api/items?id=1", got.uri)
+	assert.Equal(t, "Example.com", got.host)
+	assert.Equal(t, "hello", got.body)
+	assert.Equal(t, "value", got.header.Get("X-Custom"))
+	assert.Equal(t, "true", got.header.Get(Header))
+	assert.Empty(t, got.header.Get("Proxy-Authorization"))
+
+	select {
+	case <-results:
+		t.Fatal("result should wait for the primary's status")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done(http.StatusOK)
+	result := <-results
+	assert.Equal(t, http.StatusOK, result.PrimaryStatus)
+	assert.Equal(t, http.StatusServiceUnavailable, result.ShadowStatus)
+	assert.NoError(t, result.Err)
+	assert.True(t, result.Diverged())
+	assert.Equal(t, int64(1), divergences.Get("200 503").(*expvar.Int).Value())
+
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	m.Start(req)(http.StatusServiceUnavailable)
+	<-received
+	result = <-results
+	assert.False(t, result.Diverged())
+}
+
+func TestShadowError(t *testing.T) {
+	shadow, _ := newShadow(http.StatusOK)
+	shadow.Close()
+	results := make(chan *Result, 1)
+	m, err := New(&Opts{Target: shadow.URL, Percent: 100, OnResult: func(r *Result) { results <- r }})
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	m.Start(req)(http.StatusOK)
+	result := <-results
+	assert.Error(t, result.Err)
+	assert.Equal(t, 0, result.ShadowStatus)
+}
+
+func TestMatches(t *testing.T) {
+	m, err := New(&Opts{Target: "http://shadow", Percent: 100, Hosts: []string{".Example.com", "other.org"}, Paths: []string{"/api/", "/v2"}})
+	require.NoError(t, err)
+	for url, expected := range map[string]bool{
+		"http://www.example.com/api/items": true,
+		"http://other.org/v2":              true,
+		"http://example.com/api/":          false,
+		"http://sub.other.org/api/":        false,
+		"http://www.example.com/static":    false,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		assert.Equal(t, expected, m.matches(req), url)
+	}
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://www.example.com:443", nil)
+	assert.False(t, m.matches(req))
+	req, _ = http.NewRequest(http.MethodGet, "http://www.example.com/api/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	assert.False(t, m.matches(req))
+	req, _ = http.NewRequest(http.MethodPost, "http://www.example.com/api/items", strings.NewReader("body"))
+	req.Header.Set("Expect", "100-continue")
+	assert.False(t, m.matches(req))
+
+	m, err = New(&Opts{Target: "http://shadow", Percent: 0})
+	require.NoError(t, err)
+	req, _ = http.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	assert.Nil(t, m.Start(req))
+}
+
+func TestLimits(t *testing.T) {
+	shadow, received := newShadow(http.StatusOK)
+	defer shadow.Close()
+	m, err := New(&Opts{Target: shadow.URL, Percent: 100, MaxBodySize: 4, MaxInFlight: 1})
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("too large"))
+	assert.Nil(t, m.Start(req), "declared body size should be checked upfront")
+
+	req, _ = http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("too large"))
+	req.ContentLength = -1
+	done := m.Start(req)
+	require.NotNil(t, done)
+	body, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, "too large", string(body), "body should be intact when not mirrored")
+	done(http.StatusOK)
+
+	req, _ = http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("ok"))
+	req.ContentLength = -1
+	done = m.Start(req)
+	require.NotNil(t, done, "should not count abandoned requests as in flight")
+	req.Body.Read(make([]byte, 1))
+	req.Body.Close()
+	done(http.StatusOK)
+
+	req, _ = http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("ok"))
+	done = m.Start(req)
+	require.NotNil(t, done)
+	ioutil.ReadAll(req.Body)
+	got := <-received
+	assert.Equal(t, "ok", got.body)
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	assert.Nil(t, m.Start(req), "should not exceed MaxInFlight until the primary responded")
+	done(http.StatusOK)
+}
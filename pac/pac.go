@@ -0,0 +1,345 @@
+// Package pac serves Proxy Auto-Config files, which browsers and operating
+// systems use to discover the proxy, either from a configured URL or through
+// WPAD (which looks for /wpad.dat). The generated file sends requests through
+// the proxy except for those that the proxy wouldn't serve or that are
+// configured to go direct.
+package pac
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+)
+
+const (
+	// ContentType is the MIME type of PAC files.
+	ContentType = "application/x-ns-proxy-autoconfig"
+
+	defaultMaxAge = time.Hour
+)
+
+var log = golog.LoggerFor("pac")
+
+// Opts configures a Handler.
+type Opts struct {
+	// ProxyAddr is a text/template for the address of the proxy as advertised
+	// in the PAC file. It's executed with the request for the PAC file, so
+	// {{.Host}} is the host that the client reached us at (without port) and
+	// {{.Port}} the port, which may be empty. Defaults to "{{.Host}}:{{.Port}}"
+	// which only makes sense when served by the proxy itself.
+	ProxyAddr string
+
+	// HTTPS advertises the proxy as an HTTPS proxy, for when clients connect
+	// to it with TLS.
+	HTTPS bool
+
+	// Direct lists the destinations that clients should access directly
+	// rather than through the proxy. Entries can be host names, domain
+	// suffixes starting with a dot like ".example.com" that match all
+	// subdomains, or IPv4 networks in CIDR notation like 192.0.2.0/24.
+	Direct []string
+
+	// DirectLocal sends requests for plain host names (without dots) and for
+	// hosts in private and loopback networks directly, which is what clients
+	// should do if the proxy blocks local addresses (see
+	// proxyfilters.BlockLocal).
+	DirectLocal bool
+
+	// Ports, if specified, sends requests to ports that the proxy wouldn't
+	// allow directly.
+	Ports *proxyfilters.PortPolicy
+
+	// FallbackDirect lets clients connect directly if the proxy is
+	// unreachable.
+	FallbackDirect bool
+
+	// MaxAge is how long clients may cache the PAC file. Defaults to an hour.
+	MaxAge time.Duration
+}
+
+// privateNetworks are the IPv4 networks that DirectLocal sends directly.
+var privateNetworks = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"100.64.0.0/10",
+}
+
+// Handler serves a PAC file.
+type Handler struct {
+	opts      *Opts
+	proxyAddr *template.Template
+	modTime   time.Time
+	script    *template.Template
+	data      *scriptData
+}
+
+type scriptData struct {
+	Hosts          string
+	Suffixes       string
+	Networks       string
+	DirectLocal    bool
+	LocalNetworks  string
+	Resolve        bool
+	Ports          bool
+	ConnectPorts   string
+	HTTPPorts      string
+	PortExceptions string
+}
+
+// AddrData is what Opts.ProxyAddr is executed with.
+type AddrData struct {
+	Host string
+	Port string
+}
+
+// New creates a new Handler.
+func New(opts *Opts) (*Handler, error) {
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = defaultMaxAge
+	}
+	proxyAddr := opts.ProxyAddr
+	if proxyAddr == "" {
+		proxyAddr = "{{.Host}}:{{.Port}}"
+	}
+	addrTemplate, err := template.New("proxyaddr").Parse(proxyAddr)
+	if err != nil {
+		return nil, errors.New("Unable to parse proxy address template %q: %v", proxyAddr, err)
+	}
+
+	hosts := []string{}
+	suffixes := []string{}
+	networks := [][2]string{}
+	for _, entry := range opts.Direct {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			network, err := ipv4Network(entry)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network)
+		case strings.HasPrefix(entry, "."):
+			suffixes = append(suffixes, entry)
+		default:
+			hosts = append(hosts, entry)
+		}
+	}
+	localNetworks := make([][2]string, 0, len(privateNetworks))
+	for _, cidr := range privateNetworks {
+		network, _ := ipv4Network(cidr)
+		localNetworks = append(localNetworks, network)
+	}
+
+	data := &scriptData{
+		Hosts:         toJS(hosts),
+		Suffixes:      toJS(suffixes),
+		Networks:      toJS(networks),
+		DirectLocal:   opts.DirectLocal,
+		LocalNetworks: toJS(localNetworks),
+		Resolve:       len(networks) > 0 || opts.DirectLocal,
+	}
+	if opts.Ports != nil {
+		exceptions := make([]jsException, 0, len(opts.Ports.Exceptions))
+		for _, e := range opts.Ports.Exceptions {
+			exceptions = append(exceptions, jsException{Host: strings.ToLower(e.Host), Ports: jsRanges(e.Ports)})
+		}
+		data.Ports = true
+		data.ConnectPorts = toJS(jsRanges(opts.Ports.ConnectPorts))
+		data.HTTPPorts = toJS(jsRanges(opts.Ports.HTTPPorts))
+		data.PortExceptions = toJS(exceptions)
+	}
+
+	return &Handler{
+		opts:      opts,
+		proxyAddr: addrTemplate,
+		modTime:   time.Now(),
+		script:    scriptTemplate,
+		data:      data,
+	}, nil
+}
+
+// Script renders the PAC file for the given request.
+func (h *Handler) Script(req *http.Request) ([]byte, error) {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	var addr bytes.Buffer
+	if err := h.proxyAddr.Execute(&addr, &AddrData{Host: strings.Trim(host, "[]"), Port: port}); err != nil {
+		return nil, errors.New("Unable to render proxy address: %v", err)
+	}
+	route := "PROXY "
+	if h.opts.HTTPS {
+		route = "HTTPS "
+	}
+	route += addr.String()
+	if h.opts.FallbackDirect {
+		route += "; DIRECT"
+	}
+
+	var script bytes.Buffer
+	err = h.script.Execute(&script, struct {
+		*scriptData
+		Route string
+	}{h.data, toJS(route)})
+	if err != nil {
+		return nil, errors.New("Unable to render PAC file: %v", err)
+	}
+	return script.Bytes(), nil
+}
+
+// ServeHTTP serves the PAC file with caching headers. Conditional requests
+// are answered with 304 Not Modified when the file hasn't changed.
+func (h *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp.Header().Set("Allow", "GET, HEAD")
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	script, err := h.Script(req)
+	if err != nil {
+		log.Error(err)
+		http.Error(resp, "Unable to render PAC file", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(script)
+	header := resp.Header()
+	header.Set("Content-Type", ContentType)
+	header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.opts.MaxAge.Seconds())))
+	header.Set("Etag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	// The script depends on the Host the client asked for
+	header.Set("Vary", "Host")
+	http.ServeContent(resp, req, "", h.modTime, bytes.NewReader(script))
+}
+
+type jsException struct {
+	Host  string   `json:"host"`
+	Ports [][2]int `json:"ports"`
+}
+
+func jsRanges(ranges []proxyfilters.PortRange) [][2]int {
+	result := make([][2]int, 0, len(ranges))
+	for _, r := range ranges {
+		result = append(result, [2]int{r.From, r.To})
+	}
+	return result
+}
+
+// ipv4Network returns the address and mask of the given CIDR in the dotted
+// form that isInNet expects.
+func ipv4Network(cidr string) ([2]string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil || network.IP.To4() == nil || len(network.Mask) != net.IPv4len {
+		return [2]string{}, errors.New("Invalid IPv4 network %q", cidr)
+	}
+	return [2]string{network.IP.String(), net.IP(network.Mask).String()}, nil
+}
+
+// toJS encodes v as a JavaScript literal. JSON is valid JavaScript, and
+// json.Marshal escapes <, > and & so nothing can break out of the script.
+func toJS(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+var scriptTemplate = template.Must(template.New("pac").Parse(`// Generated by http-proxy
+var directHosts = {{.Hosts}};
+var directSuffixes = {{.Suffixes}};
+var directNetworks = {{.Networks}};
+{{- if .DirectLocal}}
+var localNetworks = {{.LocalNetworks}};
+{{- end}}
+{{- if .Ports}}
+var connectPorts = {{.ConnectPorts}};
+var httpPorts = {{.HTTPPorts}};
+var portExceptions = {{.PortExceptions}};
+{{- end}}
+
+function inNetworks(ip, networks) {
+  for (var i = 0; i < networks.length; i++) {
+    if (isInNet(ip, networks[i][0], networks[i][1])) {
+      return true;
+    }
+  }
+  return false;
+}
+{{- if .Ports}}
+
+function inRanges(port, ranges) {
+  for (var i = 0; i < ranges.length; i++) {
+    if (port >= ranges[i][0] && port <= ranges[i][1]) {
+      return true;
+    }
+  }
+  return false;
+}
+
+function portAllowed(url, host) {
+  var m = url.match(/^([a-z][a-z0-9+.-]*):\/\/(?:[^\/?#@]*@)?(?:\[[^\]]*\]|[^\/?#:]*)(?::(\d+))?/i);
+  if (!m) {
+    return true;
+  }
+  var plainHTTP = m[1].toLowerCase() == "http";
+  var ranges = plainHTTP ? httpPorts : connectPorts;
+  var port = m[2] ? parseInt(m[2], 10) : (plainHTTP ? 80 : 443);
+  if (ranges.length == 0 || (plainHTTP && (!m[2] || port == 80)) || inRanges(port, ranges)) {
+    return true;
+  }
+  for (var i = 0; i < portExceptions.length; i++) {
+    var e = portExceptions[i];
+    var matches = e.host.charAt(0) == "." ? dnsDomainIs(host, e.host) : host == e.host;
+    if (matches && inRanges(port, e.ports)) {
+      return true;
+    }
+  }
+  return false;
+}
+{{- end}}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  for (var i = 0; i < directHosts.length; i++) {
+    if (host == directHosts[i]) {
+      return "DIRECT";
+    }
+  }
+  for (var j = 0; j < directSuffixes.length; j++) {
+    if (dnsDomainIs(host, directSuffixes[j])) {
+      return "DIRECT";
+    }
+  }
+{{- if .DirectLocal}}
+  if (isPlainHostName(host) || host == "localhost" || dnsDomainIs(host, ".localhost")) {
+    return "DIRECT";
+  }
+{{- end}}
+{{- if .Ports}}
+  if (!portAllowed(url, host)) {
+    return "DIRECT";
+  }
+{{- end}}
+{{- if .Resolve}}
+  var ip = dnsResolve(host);
+  if (ip && (inNetworks(ip, directNetworks){{if .DirectLocal}} || inNetworks(ip, localNetworks){{end}})) {
+    return "DIRECT";
+  }
+{{- end}}
+  return {{.Route}};
+}
+`))
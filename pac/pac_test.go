@@ -0,0 +1,83 @@
+package pac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+)
+
+func TestScript(t *testing.T) {
+	h, err := New(&Opts{
+		ProxyAddr:      "{{.Host}}:8080",
+		Direct:         []string{"intranet.example.com", ".corp.example.com", "192.0.2.0/24"},
+		DirectLocal:    true,
+		Ports:          &proxyfilters.PortPolicy{ConnectPorts: []proxyfilters.PortRange{{From: 443, To: 443}}},
+		FallbackDirect: true,
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com:9000/proxy.pac", nil)
+	b, err := h.Script(req)
+	require.NoError(t, err)
+	script := string(b)
+	assert.Contains(t, script, `return "PROXY proxy.example.com:8080; DIRECT";`)
+	assert.Contains(t, script, `var directHosts = ["intranet.example.com"];`)
+	assert.Contains(t, script, `var directSuffixes = [".corp.example.com"];`)
+	assert.Contains(t, script, `var directNetworks = [["192.0.2.0","255.255.255.0"]];`)
+	assert.Contains(t, script, `["10.0.0.0","255.0.0.0"]`)
+	assert.Contains(t, script, `var connectPorts = [[443,443]];`)
+	assert.Contains(t, script, "isPlainHostName(host)")
+
+	h, err = New(&Opts{HTTPS: true})
+	require.NoError(t, err)
+	b, err = h.Script(req)
+	require.NoError(t, err)
+	script = string(b)
+	assert.Contains(t, script, `return "HTTPS proxy.example.com:9000";`, "should default to the address the PAC file was requested from")
+	assert.NotContains(t, script, "dnsResolve", "should not resolve hosts unless necessary")
+	assert.NotContains(t, script, "portAllowed")
+
+	_, err = New(&Opts{Direct: []string{"2001:db8::/32"}})
+	assert.Error(t, err, "IPv6 networks are not supported by isInNet")
+	_, err = New(&Opts{ProxyAddr: "{{.Host"})
+	assert.Error(t, err)
+}
+
+func TestServeHTTP(t *testing.T) {
+	h, err := New(&Opts{ProxyAddr: "{{.Host}}:8080", MaxAge: 10 * time.Minute})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://proxy.example.com/wpad.dat", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=600", rec.Header().Get("Cache-Control"))
+	assert.Contains(t, rec.Body.String(), "FindProxyForURL")
+	etag := rec.Header().Get("Etag")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, rec.Header().Get("Last-Modified"))
+
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/wpad.dat", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	// Different host, different script
+	req = httptest.NewRequest(http.MethodGet, "http://other.example.com/wpad.dat", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"PROXY other.example.com:8080"`)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://proxy.example.com/wpad.dat", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
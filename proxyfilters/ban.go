@@ -0,0 +1,29 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/access"
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+// BanOffenders records requests that the downstream filters reject with an
+// errorpages reason, like BlockLocal probing or disallowed ports, as failures
+// of the requesting client in the given Jail, which bans repeat offenders.
+// Add it before the filters whose failures should count.
+func BanOffenders(jail *access.Jail) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		resp, nextCS, err := next(cs, req)
+		if reason := errorpages.ReasonOf(err); reason != "" {
+			client, _, splitErr := net.SplitHostPort(req.RemoteAddr)
+			if splitErr != nil {
+				client = req.RemoteAddr
+			}
+			jail.Failure(client, reason)
+		}
+		return resp, nextCS, err
+	})
+}
@@ -0,0 +1,48 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/access"
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+func TestBanOffenders(t *testing.T) {
+	c, err := access.New(&access.Opts{})
+	require.NoError(t, err)
+	defer c.Close()
+	jail := access.NewJail(c, &access.JailOpts{
+		Rules: []access.Rule{{Reasons: []errorpages.Reason{errorpages.PortNotAllowed}, MaxFailures: 2, Window: time.Minute}},
+	})
+
+	// Failed requests close the connection, so each one gets its own
+	for i := 0; i < 2; i++ {
+		assert.True(t, c.Allow("127.0.0.1"), "should not be banned before reaching the threshold")
+		doTestFilter(t,
+			filters.Join(BanOffenders(jail), RestrictConnectPorts([]int{443})),
+			func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+				if !assert.NoError(t, send(http.MethodConnect, nil, "")) {
+					return
+				}
+				resp, _, err := recv()
+				if assert.NoError(t, err) {
+					assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+				}
+			})
+	}
+
+	bans := c.Bans()
+	if assert.Len(t, bans, 1) {
+		for client, ban := range bans {
+			assert.Equal(t, "127.0.0.1", client)
+			assert.Equal(t, string(errorpages.PortNotAllowed), ban.Reason)
+		}
+	}
+	assert.False(t, c.Allow("127.0.0.1"))
+}
@@ -7,11 +7,23 @@ import (
 
 	"github.com/getlantern/iptool"
 	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/resolver"
 )
 
 // BlockLocal blocks attempted accesses to localhost unless they're one of the
 // listed exceptions.
 func BlockLocal(exceptions []string) filters.Filter {
+	return BlockLocalWithResolver(exceptions, nil)
+}
+
+// BlockLocalWithResolver is like BlockLocal but resolves hosts using the given
+// Resolver, which is typically shared with the dialer so that the address we
+// check is the same one we end up dialing. If any of the resolved addresses is
+// private, the request is blocked. If r is nil, the system resolver is used on
+// every request.
+func BlockLocalWithResolver(exceptions []string, r *resolver.Resolver) filters.Filter {
 	ipt, _ := iptool.New()
 	isException := func(host string) bool {
 		for _, exception := range exceptions {
@@ -34,13 +46,25 @@ func BlockLocal(exceptions []string) filters.Filter {
 			host = req.URL.Host
 		}
 
-		ipAddr, err := net.ResolveIPAddr("ip", host)
+		if r == nil {
+			ipAddr, err := net.ResolveIPAddr("ip", host)
+
+			// If there was an error resolving is probably because it wasn't an address
+			// in the form host or host:port
+			if err == nil {
+				if ipt.IsPrivate(ipAddr) {
+					return fail(cs, req, http.StatusForbidden, errorpages.BlockedLocal, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ipAddr)
+				}
+			}
+			return next(cs, req)
+		}
 
-		// If there was an error resolving is probably because it wasn't an address
-		// in the form host or host:port
+		ipAddrs, err := r.LookupIPAddr(req.Context(), host)
 		if err == nil {
-			if ipt.IsPrivate(ipAddr) {
-				return fail(cs, req, http.StatusForbidden, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ipAddr)
+			for i := range ipAddrs {
+				if ipt.IsPrivate(&ipAddrs[i]) {
+					return fail(cs, req, http.StatusForbidden, errorpages.BlockedLocal, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, &ipAddrs[i])
+				}
 			}
 		}
 
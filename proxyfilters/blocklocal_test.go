@@ -7,6 +7,8 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/resolver"
 )
 
 func TestBlockLocalBlocked(t *testing.T) {
@@ -43,3 +45,35 @@ func doTestBlockLocal(t *testing.T, exceptions []string, urlStr string, expected
 	resp, _, _ := filter.Apply(cs, req, next)
 	assert.Equal(t, expectedStatus, resp.StatusCode)
 }
+
+func TestBlockLocalWithResolver(t *testing.T) {
+	r, err := resolver.New(&resolver.Opts{
+		Hosts: map[string][]string{
+			"intranet.example.com": {"93.184.216.34", "10.0.0.5"},
+			"public.example.com":   {"93.184.216.34"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+		}, cs, nil
+	}
+	filter := BlockLocalWithResolver([]string{"localhost"}, r)
+	for urlStr, expectedStatus := range map[string]int{
+		"http://intranet.example.com/index.html":    http.StatusForbidden,
+		"http://public.example.com:8080/index.html": http.StatusOK,
+		"http://127.0.0.1/index.html":               http.StatusForbidden,
+		"http://localhost/index.html":               http.StatusOK,
+		"http://[::1]:80/index.html":                http.StatusForbidden,
+		"http://doesnotexist.invalid/index.html":    http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, urlStr, nil)
+		cs := filters.NewConnectionState(req, nil, nil)
+		resp, _, _ := filter.Apply(cs, req, next)
+		assert.Equal(t, expectedStatus, resp.StatusCode, urlStr)
+	}
+}
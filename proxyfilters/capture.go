@@ -0,0 +1,39 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/dialer"
+	"github.com/getlantern/http-proxy/har"
+)
+
+// Capture records plain HTTP requests and responses of clients for which
+// capturer has active captures (see har.Capturer). CONNECT tunnels are opaque
+// and aren't recorded.
+func Capture(capturer *har.Capturer) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method == http.MethodConnect {
+			return next(cs, req)
+		}
+		client, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			client = req.RemoteAddr
+		}
+		user := ""
+		if info := dialer.ClientInfoFrom(req.Context()); info != nil {
+			client, user = info.IP, info.User
+		}
+		captures := capturer.Match(client, user)
+		if len(captures) == 0 {
+			return next(cs, req)
+		}
+
+		recorder := capturer.Record(req, captures)
+		resp, nextCS, err := next(cs, req)
+		recorder.Response(resp, err)
+		return resp, nextCS, err
+	})
+}
@@ -0,0 +1,33 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/har"
+)
+
+func TestCapture(t *testing.T) {
+	capturer := har.New(&har.Opts{})
+	info, err := capturer.Start(har.Spec{Client: "127.0.0.1", Duration: time.Minute, Bodies: true})
+	require.NoError(t, err)
+
+	doTestFilter(t, Capture(capturer), func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+		require.NoError(t, send(http.MethodPost, http.Header{"X-Test": {"yes"}}, expectedBody))
+		_, body, err := recv()
+		require.NoError(t, err)
+		assert.Equal(t, expectedBody, body)
+	})
+
+	entries := capturer.HAR(info.ID).Log.Entries
+	require.Len(t, entries, 1)
+	assert.Equal(t, http.MethodPost, entries[0].Request.Method)
+	assert.Equal(t, expectedBody, entries[0].Request.PostData.Text)
+	assert.Equal(t, http.StatusOK, entries[0].Response.Status)
+	assert.Equal(t, expectedBody, entries[0].Response.Content.Text)
+	assert.Contains(t, entries[0].Response.Headers, &har.NameValue{Name: "Reflected-X-Test", Value: "yes"})
+}
@@ -0,0 +1,85 @@
+package proxyfilters
+
+import (
+	stderrors "errors"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/circuitbreaker"
+	"github.com/getlantern/http-proxy/metrics"
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+const (
+	maxAttempts = 3
+)
+
+var (
+	retryCount = metrics.Counter("circuitbreaker_retries")
+)
+
+// CircuitBreaker responds with 503 Service Unavailable and a Retry-After header
+// whenever the upstream dial was rejected because the destination's circuit is
+// open (see circuitbreaker.Breakers.WrapDial). Idempotent plain HTTP requests
+// without a body that fail upstream are retried on the destination's other
+// resolved IP addresses, if it has any.
+func CircuitBreaker(r *resolver.Resolver) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if req.Method == http.MethodConnect || !isRetryable(req) {
+			return circuitOpenResponse(req)(next(cs, req))
+		}
+
+		host, _, err := net.SplitHostPort(req.URL.Host)
+		if err != nil {
+			host = req.URL.Host
+		}
+		ips, err := r.LookupIP(req.Context(), host)
+		if err != nil || len(ips) < 2 {
+			return circuitOpenResponse(req)(next(cs, req))
+		}
+
+		var resp *http.Response
+		var nextCS *filters.ConnectionState
+		for i := 0; i < len(ips) && i < maxAttempts; i++ {
+			if i > 0 {
+				log.Debugf("Retrying %v %v on %v after error: %v", req.Method, req.URL, ips[i], err)
+				retryCount.Add(1)
+			}
+			attempt := req.WithContext(circuitbreaker.WithIP(req.Context(), ips[i]))
+			resp, nextCS, err = next(cs, attempt)
+			if err == nil || resp != nil || isCircuitOpen(err) {
+				break
+			}
+		}
+		return circuitOpenResponse(req)(resp, nextCS, err)
+	})
+}
+
+// circuitOpenResponse replaces the response to req with a 503 if err indicates
+// that the destination's circuit is open.
+func circuitOpenResponse(req *http.Request) func(*http.Response, *filters.ConnectionState, error) (*http.Response, *filters.ConnectionState, error) {
+	return func(resp *http.Response, cs *filters.ConnectionState, err error) (*http.Response, *filters.ConnectionState, error) {
+		if unavailable := circuitbreaker.ServiceUnavailable(req, err); unavailable != nil {
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+			return unavailable, cs, err
+		}
+		return resp, cs, err
+	}
+}
+
+func isCircuitOpen(err error) bool {
+	var openErr *circuitbreaker.OpenError
+	return stderrors.As(err, &openErr)
+}
+
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 && len(req.TransferEncoding) == 0
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/proxy/v2"
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/circuitbreaker"
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(expectedBody))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	// 127.0.0.2 accepts connections but immediately closes them
+	bad, err := net.Listen("tcp", "127.0.0.2:"+port)
+	require.NoError(t, err)
+	defer bad.Close()
+	go func() {
+		for {
+			conn, err := bad.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Nothing listens on 127.0.0.3, so dials to it get refused
+	r, err := resolver.New(&resolver.Opts{
+		Hosts: map[string][]string{
+			"multi.test": {"127.0.0.2", "127.0.0.1"},
+			"down.test":  {"127.0.0.3"},
+		},
+	})
+	require.NoError(t, err)
+	b := circuitbreaker.New(&circuitbreaker.Opts{FailureThreshold: 2})
+
+	pl, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer pl.Close()
+	p, _ := proxy.New(&proxy.Opts{
+		Filter:             CircuitBreaker(r),
+		OKWaitsForUpstream: true,
+		OnError: func(cs *filters.ConnectionState, req *http.Request, read bool, err error) *http.Response {
+			return &http.Response{StatusCode: http.StatusBadGateway}
+		},
+		Dial: b.WrapDial(func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return r.Dial(ctx, network, addr)
+		}),
+	})
+	go p.Serve(pl)
+
+	roundTrip := func(method, host string) *http.Response {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		target := "http://" + host + "/"
+		if method == http.MethodConnect {
+			target = host
+		}
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", method, target, host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		if method != http.MethodConnect {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body = ioutil.NopCloser(nil)
+			resp.Header.Set("X-Body", string(body))
+		}
+		return resp
+	}
+
+	// Idempotent request gets retried on the other IP
+	resp := roundTrip(http.MethodGet, "multi.test:"+port)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, expectedBody, resp.Header.Get("X-Body"))
+	assert.Equal(t, circuitbreaker.Closed, b.State("multi.test:"+port))
+
+	// Non-idempotent requests aren't retried
+	resp = roundTrip(http.MethodPost, "multi.test:"+port)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// Once the circuit opens, requests fail fast with a 503
+	resp = roundTrip(http.MethodGet, "down.test:"+port)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	resp = roundTrip(http.MethodConnect, "down.test:"+port)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, circuitbreaker.Open, b.State("down.test:"+port))
+	for _, method := range []string{http.MethodGet, http.MethodConnect} {
+		resp = roundTrip(method, "down.test:"+port)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, method)
+		assert.Equal(t, "10", resp.Header.Get("Retry-After"), method)
+	}
+}
@@ -5,37 +5,211 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/getlantern/errors"
 	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/errorpages"
 )
 
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From int
+	To   int
+}
+
+func (r PortRange) contains(port int) bool {
+	return port >= r.From && port <= r.To
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(r.From)
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// ParsePortRanges parses a comma separated list of ports and port ranges
+// like "80,443,1024-65535".
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := parsePort(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = parsePort(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if to < from {
+			return nil, errors.New("Invalid port range %v", part)
+		}
+		ranges = append(ranges, PortRange{From: from, To: to})
+	}
+	return ranges, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, errors.New("Invalid port %q", s)
+	}
+	return port, nil
+}
+
+func portsToRanges(ports []int) []PortRange {
+	ranges := make([]PortRange, 0, len(ports))
+	for _, port := range ports {
+		ranges = append(ranges, PortRange{From: port, To: port})
+	}
+	return ranges
+}
+
+// PortException allows additional ports to a particular host.
+type PortException struct {
+	// Host is a host name or IP address, or a domain suffix starting with a
+	// dot like ".example.com" that matches all of its subdomains.
+	Host  string
+	Ports []PortRange
+}
+
+func (e *PortException) matches(host string) bool {
+	if strings.HasPrefix(e.Host, ".") {
+		return strings.HasSuffix(host, strings.ToLower(e.Host))
+	}
+	return strings.EqualFold(host, e.Host)
+}
+
+// ParsePortExceptions parses a semicolon separated list of exceptions of the
+// form host=ports, like "bastion.example.com=22;.example.org=8000-8999".
+func ParsePortExceptions(s string) ([]PortException, error) {
+	var exceptions []PortException
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		hostAndPorts := strings.SplitN(part, "=", 2)
+		if len(hostAndPorts) != 2 || strings.TrimSpace(hostAndPorts[0]) == "" {
+			return nil, errors.New("Invalid port exception %q, expected host=ports", part)
+		}
+		ports, err := ParsePortRanges(hostAndPorts[1])
+		if err != nil {
+			return nil, err
+		}
+		exceptions = append(exceptions, PortException{Host: strings.TrimSpace(hostAndPorts[0]), Ports: ports})
+	}
+	return exceptions, nil
+}
+
+// PortPolicy determines which ports clients may reach.
+type PortPolicy struct {
+	// ConnectPorts are the ports allowed for CONNECT requests. If empty,
+	// CONNECT requests may target any port.
+	ConnectPorts []PortRange
+
+	// HTTPPorts are the ports allowed for plain HTTP requests that explicitly
+	// specify a port in their target, like http://example.com:8080/. If empty,
+	// plain HTTP requests may target any port. Requests to the scheme's
+	// default port are always allowed.
+	HTTPPorts []PortRange
+
+	// Exceptions allow additional ports to particular hosts, for both CONNECT
+	// and plain HTTP requests.
+	Exceptions []PortException
+}
+
+func (p *PortPolicy) allows(host string, port int, ranges []PortRange) bool {
+	for _, r := range ranges {
+		if r.contains(port) {
+			return true
+		}
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	for i := range p.Exceptions {
+		e := &p.Exceptions[i]
+		if !e.matches(host) {
+			continue
+		}
+		for _, r := range e.Ports {
+			if r.contains(port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // RestrictConnectPorts restricts CONNECT requests to the given list of allowed
 // ports and returns either a 400 error if the request is missing a port or a
 // 403 error if the port is not allowed.
 func RestrictConnectPorts(allowedPorts []int) filters.Filter {
+	return RestrictPorts(&PortPolicy{ConnectPorts: portsToRanges(allowedPorts)})
+}
+
+// RestrictPorts enforces the given PortPolicy. Like RestrictConnectPorts, it
+// returns a 400 error if a CONNECT request is missing a port or a 403 error if
+// the port is not allowed.
+func RestrictPorts(policy *PortPolicy) filters.Filter {
 	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
-		if req.Method != http.MethodConnect || len(allowedPorts) == 0 {
-			return next(cs, req)
+		if req.Method == http.MethodConnect {
+			if len(policy.ConnectPorts) == 0 {
+				return next(cs, req)
+			}
+			log.Tracef("Checking CONNECT tunnel to %s against allowed ports %v", req.Host, policy.ConnectPorts)
+			host, portString, err := net.SplitHostPort(req.Host)
+			if err != nil {
+				// CONNECT request should always include port in req.Host.
+				// Ref https://tools.ietf.org/html/rfc2817#section-5.2.
+				return fail(cs, req, http.StatusBadRequest, errorpages.BadRequest, "No port field in Request-URI / Host header")
+			}
+			return checkPort(cs, req, next, policy, host, portString, policy.ConnectPorts)
 		}
 
-		log.Tracef("Checking CONNECT tunnel to %s against allowed ports %v", req.Host, allowedPorts)
-		_, portString, err := net.SplitHostPort(req.Host)
-		if err != nil {
-			// CONNECT request should always include port in req.Host.
-			// Ref https://tools.ietf.org/html/rfc2817#section-5.2.
-			return fail(cs, req, http.StatusBadRequest, "No port field in Request-URI / Host header")
+		if len(policy.HTTPPorts) == 0 {
+			return next(cs, req)
 		}
-
-		port, err := strconv.Atoi(portString)
+		target := req.URL.Host
+		if target == "" {
+			target = req.Host
+		}
+		host, portString, err := net.SplitHostPort(target)
 		if err != nil {
-			return fail(cs, req, http.StatusBadRequest, fmt.Sprintf("Invalid port for %v: %v", req.Host, portString))
+			// No explicit port
+			return next(cs, req)
 		}
-
-		for _, p := range allowedPorts {
-			if port == p {
-				return next(cs, req)
-			}
+		if portString == defaultPortFor(req.URL.Scheme) {
+			return next(cs, req)
 		}
-		return fail(cs, req, http.StatusForbidden, fmt.Sprintf("Port not allowed for %v: %d", req.Host, port))
+		log.Tracef("Checking request to %s against allowed ports %v", target, policy.HTTPPorts)
+		return checkPort(cs, req, next, policy, host, portString, policy.HTTPPorts)
 	})
 }
+
+func checkPort(cs *filters.ConnectionState, req *http.Request, next filters.Next, policy *PortPolicy, host string, portString string, ranges []PortRange) (*http.Response, *filters.ConnectionState, error) {
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return fail(cs, req, http.StatusBadRequest, errorpages.BadRequest, "Invalid port for %v: %v", req.Host, portString)
+	}
+	if !policy.allows(host, port, ranges) {
+		return fail(cs, req, http.StatusForbidden, errorpages.PortNotAllowed, "Port not allowed for %v: %d", req.Host, port)
+	}
+	return next(cs, req)
+}
+
+func defaultPortFor(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
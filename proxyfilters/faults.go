@@ -0,0 +1,68 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/faults"
+	"github.com/getlantern/http-proxy/metrics"
+	"github.com/getlantern/http-proxy/tunnel"
+)
+
+var (
+	faultsInjected = metrics.Map("faults_injected")
+)
+
+// InjectFaults injects the faults picked by injector into requests (see
+// faults.Fault). Latency is added before the request is sent upstream, synthetic
+// error statuses replace the upstream response, and resets and throttling apply
+// to response bodies and, for CONNECT requests, to the tunnel.
+func InjectFaults(injector *faults.Injector) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		f := injector.Pick(hostOf(req))
+		if f == nil {
+			return next(cs, req)
+		}
+
+		if f.Latency > 0 {
+			faultsInjected.Add("latency", 1)
+			timer := time.NewTimer(f.Latency)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, cs, req.Context().Err()
+			}
+		}
+		if f.Status > 0 {
+			faultsInjected.Add("status", 1)
+			log.Debugf("Injecting %d for %v %v", f.Status, req.Method, req.URL.Host)
+			err := errorpages.NewError(f.Status, faults.Injected, "Injected fault")
+			return errorpages.Default.Response(req, f.Status, faults.Injected, err), cs, nil
+		}
+		if f.Reset {
+			faultsInjected.Add("reset", 1)
+		}
+		if f.Throttle > 0 {
+			faultsInjected.Add("throttle", 1)
+		}
+
+		if req.Method == http.MethodConnect {
+			// Spliced tunnels bypass the wrapped upstream connection
+			tunnel.DisableSplicing(cs.Downstream())
+		}
+		resp, nextCS, err := next(cs, req)
+		if err != nil {
+			return resp, nextCS, err
+		}
+		if upstream := nextCS.Upstream(); upstream != nil {
+			nextCS.SetUpstream(faults.WrapConn(upstream, cs.Downstream(), f))
+		} else if resp != nil && resp.Body != nil && req.Method != http.MethodConnect {
+			resp.Body = faults.WrapBody(resp.Body, cs.Downstream(), f)
+		}
+		return resp, nextCS, err
+	})
+}
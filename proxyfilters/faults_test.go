@@ -0,0 +1,44 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/faults"
+)
+
+func TestInjectFaults(t *testing.T) {
+	injector := faults.New(nil)
+	doTestFilter(t, InjectFaults(injector), func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+		require.NoError(t, send(http.MethodPost, nil, expectedBody))
+		resp, body, err := recv()
+		require.NoError(t, err)
+		assert.Equal(t, expectedBody, body, "nothing should be injected without faults")
+
+		fs, err := faults.ParseFaults("latency=200ms status=503")
+		require.NoError(t, err)
+		injector.SetFaults(fs)
+		start := time.Now()
+		require.NoError(t, send(http.MethodPost, nil, expectedBody))
+		resp, _, err = recv()
+		require.NoError(t, err)
+		assert.True(t, time.Since(start) >= 200*time.Millisecond, "latency should have been added")
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, string(faults.Injected), resp.Header.Get(errorpages.ReasonHeader))
+	})
+
+	fs, err := faults.ParseFaults("reset=100")
+	require.NoError(t, err)
+	injector.SetFaults(fs)
+	doTestFilter(t, InjectFaults(injector), func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+		require.NoError(t, send(http.MethodPost, nil, strings.Repeat("x", 10000)))
+		_, _, err := recv()
+		assert.Error(t, err, "body should have been cut off")
+	})
+}
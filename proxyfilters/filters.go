@@ -3,14 +3,19 @@ package proxyfilters
 import (
 	"net/http"
 
-	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/errorpages"
 )
 
 var log = golog.LoggerFor("http-proxy.filters")
 
-func fail(cs *filters.ConnectionState, req *http.Request, statusCode int, description string, params ...interface{}) (*http.Response, *filters.ConnectionState, error) {
+// fail responds with an error page rendered by errorpages.Default. The
+// description is logged and returned as the error, but isn't shown to the
+// client unless the renderer is configured to expose details.
+func fail(cs *filters.ConnectionState, req *http.Request, statusCode int, reason errorpages.Reason, description string, params ...interface{}) (*http.Response, *filters.ConnectionState, error) {
 	log.Errorf("Filter fail: "+description, params...)
-	return filters.Fail(cs, req, statusCode, errors.New(description, params...))
+	err := errorpages.NewError(statusCode, reason, description, params...)
+	return errorpages.Default.Response(req, statusCode, reason, err), cs, err
 }
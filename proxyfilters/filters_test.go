@@ -7,12 +7,15 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
 	"github.com/getlantern/proxy/v2"
 	"github.com/getlantern/proxy/v2/filters"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/errorpages"
 )
 
 const (
@@ -138,3 +141,90 @@ func doTestFilter(t *testing.T, filter filters.Filter, run func(send func(method
 
 	run(send, recv)
 }
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	doTestFilter(t,
+		MaxRequestsPerConn(2),
+		func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+			for i := 1; i <= 2; i++ {
+				if !assert.NoError(t, send(http.MethodGet, nil, "")) {
+					return
+				}
+				resp, _, err := recv()
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, i == 2, resp.Close, "only response %d should close connection", i)
+			}
+		})
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := ParsePortRanges("80, 443,1024-65535,")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []PortRange{{80, 80}, {443, 443}, {1024, 65535}}, ranges)
+	}
+	for _, invalid := range []string{"0", "65536", "http", "100-50", "1-2-3"} {
+		_, err := ParsePortRanges(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	exceptions, err := ParsePortExceptions("bastion.example.com=22; .example.org=8000-8999,9000")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []PortException{
+			{Host: "bastion.example.com", Ports: []PortRange{{22, 22}}},
+			{Host: ".example.org", Ports: []PortRange{{8000, 8999}, {9000, 9000}}},
+		}, exceptions)
+	}
+	_, err = ParsePortExceptions("bastion.example.com")
+	assert.Error(t, err)
+}
+
+func TestRestrictPorts(t *testing.T) {
+	filter := RestrictPorts(&PortPolicy{
+		ConnectPorts: []PortRange{{443, 443}, {8000, 8999}},
+		HTTPPorts:    []PortRange{{8080, 8080}},
+		Exceptions: []PortException{
+			{Host: "bastion.example.com", Ports: []PortRange{{22, 22}}},
+			{Host: ".example.org", Ports: []PortRange{{9000, 9000}}},
+		},
+	})
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+	for _, tc := range []struct {
+		method   string
+		target   string
+		expected int
+	}{
+		{http.MethodConnect, "example.com:443", http.StatusOK},
+		{http.MethodConnect, "example.com:8500", http.StatusOK},
+		{http.MethodConnect, "example.com:22", http.StatusForbidden},
+		{http.MethodConnect, "bastion.example.com:22", http.StatusOK},
+		{http.MethodConnect, "BASTION.example.com:22", http.StatusOK},
+		{http.MethodConnect, "other.example.com:22", http.StatusForbidden},
+		{http.MethodConnect, "www.example.org:9000", http.StatusOK},
+		{http.MethodConnect, "example.org:9000", http.StatusForbidden},
+		{http.MethodConnect, "example.com", http.StatusBadRequest},
+		{http.MethodGet, "http://example.com/", http.StatusOK},
+		{http.MethodGet, "http://example.com:80/", http.StatusOK},
+		{http.MethodGet, "https://example.com:443/", http.StatusOK},
+		{http.MethodGet, "http://example.com:8080/", http.StatusOK},
+		{http.MethodGet, "http://example.com:25/", http.StatusForbidden},
+		{http.MethodGet, "http://bastion.example.com:22/", http.StatusOK},
+	} {
+		var req *http.Request
+		if tc.method == http.MethodConnect {
+			req = &http.Request{Method: tc.method, Host: tc.target, URL: &url.URL{Host: tc.target}, Header: make(http.Header)}
+		} else {
+			req, _ = http.NewRequest(tc.method, tc.target, nil)
+		}
+		resp, _, _ := filter.Apply(nil, req, next)
+		if assert.NotNil(t, resp, tc.target) {
+			assert.Equal(t, tc.expected, resp.StatusCode, "%v %v", tc.method, tc.target)
+			if tc.expected == http.StatusForbidden {
+				assert.Equal(t, errorpages.PortNotAllowed, errorpages.Reason(resp.Header.Get(errorpages.ReasonHeader)), tc.target)
+			}
+		}
+	}
+}
@@ -13,10 +13,11 @@ const (
 )
 
 // AddForwardedFor adds an X-Forwarded-For header based on the request's
-// RemoteAddr.
+// RemoteAddr. Clients that aren't identified by IP address, like those
+// connected over Unix domain sockets, are left out.
 var AddForwardedFor = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
 	if req.Method != http.MethodConnect {
-		if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil && net.ParseIP(clientIP) != nil {
 			if prior, ok := req.Header[xForwardedFor]; ok {
 				clientIP = strings.Join(prior, ", ") + ", " + clientIP
 			}
@@ -0,0 +1,183 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/geoip"
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/metrics"
+	"github.com/getlantern/http-proxy/resolver"
+	"github.com/getlantern/http-proxy/schedule"
+)
+
+var (
+	// GeoActions counts the actions taken by GeoIP rules.
+	GeoActions = metrics.Map("geoip_actions")
+)
+
+// GeoTarget is the address that a GeoRule looks at.
+type GeoTarget int
+
+const (
+	// GeoClient matches the client's IP address.
+	GeoClient GeoTarget = iota
+	// GeoDestination matches the resolved IP address of the requested host.
+	GeoDestination
+)
+
+// GeoRule applies a Policy to requests whose client or destination is in one
+// of the given countries or autonomous systems.
+type GeoRule struct {
+	Target GeoTarget
+
+	// Countries are ISO 3166-1 alpha-2 codes like "US". "*" matches all
+	// addresses, including those whose country is unknown.
+	Countries []string
+
+	// ASNs are autonomous system numbers.
+	ASNs []uint
+
+	Policy
+}
+
+func (r *GeoRule) matches(loc *geoip.Location) bool {
+	for _, country := range r.Countries {
+		if country == "*" || (loc.Country != "" && strings.EqualFold(country, loc.Country)) {
+			return true
+		}
+	}
+	for _, asn := range r.ASNs {
+		if loc.ASN != 0 && asn == loc.ASN {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseGeoRules parses a semicolon separated list of rules of the form
+// "target match action [schedule]", where target is client or destination,
+// match is country=codes or asn=numbers (comma separated) and action and
+// schedule are as described in Policy. For example:
+//
+//	client country=US,CA allow; client country=* block; destination asn=64500 route=eu during=business
+func ParseGeoRules(s string) ([]GeoRule, error) {
+	var rules []GeoRule
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, errors.New("Invalid GeoIP rule %q, expected target, match, action and optional schedule", strings.TrimSpace(part))
+		}
+		rule := GeoRule{}
+		switch strings.ToLower(fields[0]) {
+		case "client":
+			rule.Target = GeoClient
+		case "destination", "dest":
+			rule.Target = GeoDestination
+		default:
+			return nil, errors.New("Invalid GeoIP rule target %q", fields[0])
+		}
+
+		match := strings.SplitN(fields[1], "=", 2)
+		if len(match) != 2 {
+			return nil, errors.New("Invalid GeoIP rule match %q", fields[1])
+		}
+		for _, value := range strings.Split(match[1], ",") {
+			if value == "" {
+				continue
+			}
+			switch strings.ToLower(match[0]) {
+			case "country":
+				rule.Countries = append(rule.Countries, strings.ToUpper(value))
+			case "asn":
+				asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32)
+				if err != nil {
+					return nil, errors.New("Invalid ASN %q", value)
+				}
+				rule.ASNs = append(rule.ASNs, uint(asn))
+			default:
+				return nil, errors.New("Invalid GeoIP rule match %q", fields[1])
+			}
+		}
+
+		if err := rule.Policy.parse(fields[2:]); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// GeoIP applies GeoIP rules to requests, looking up client and destination IPs
+// in db. Destinations are resolved using r, which is typically shared with the
+// dialer, or the system resolver if r is nil. Blocked requests are rejected
+// with 403 Forbidden and geoip.Blocked, throttled ones with 429 Too Many
+// Requests and geoip.Throttled. Rules with a schedule are looked up in
+// schedules. It also adds the client's country and ASN to the measured
+// context of the connection (see listeners.NewMeasuredListener) as
+// client_country and client_asn.
+func GeoIP(db *geoip.DB, r *resolver.Resolver, schedules *schedule.Engine, rules []GeoRule) filters.Filter {
+	if r == nil {
+		r, _ = resolver.New(nil)
+	}
+	needsDestination := false
+	policies := make([]*Policy, 0, len(rules))
+	for i := range rules {
+		if rules[i].Target == GeoDestination {
+			needsDestination = true
+		}
+		policies = append(policies, &rules[i].Policy)
+	}
+	eval := newEvaluator(schedules, policies, GeoActions, geoip.Throttled)
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		client, info := clientOf(req)
+		clientLoc := db.Lookup(net.ParseIP(client))
+		if cs.RequestNumber() == 1 {
+			addToMeasuredContext(cs.Downstream(), clientLoc)
+		}
+
+		destLoc := &geoip.Location{}
+		if needsDestination {
+			if ips, err := r.LookupIP(req.Context(), hostOf(req)); err == nil && len(ips) > 0 {
+				destLoc = db.Lookup(ips[0])
+			}
+		}
+
+		return eval.apply(cs, req, next, client, info, func(i int) bool {
+			loc := clientLoc
+			if rules[i].Target == GeoDestination {
+				loc = destLoc
+			}
+			return rules[i].matches(loc)
+		}, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return fail(cs, req, http.StatusForbidden, geoip.Blocked, "Blocking request from %v (%v/AS%d) to %v (%v/AS%d)",
+				client, clientLoc.Country, clientLoc.ASN, req.URL.Host, destLoc.Country, destLoc.ASN)
+		})
+	})
+}
+
+func addToMeasuredContext(conn net.Conn, loc *geoip.Location) {
+	wc, ok := conn.(listeners.WrapConn)
+	if !ok {
+		return
+	}
+	ctx := make(map[string]interface{}, 2)
+	if loc.Country != "" {
+		ctx["client_country"] = loc.Country
+	}
+	if loc.ASN != 0 {
+		ctx["client_asn"] = loc.ASN
+	}
+	if len(ctx) > 0 {
+		wc.ControlMessage("measured", ctx)
+	}
+}
@@ -0,0 +1,172 @@
+package proxyfilters
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/dialer"
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/geoip"
+	"github.com/getlantern/http-proxy/geoip/geoiptest"
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+func TestParseGeoRules(t *testing.T) {
+	rules, err := ParseGeoRules("client country=us,CA allow during=business; dest asn=AS64500,64501 route=eu ;client country=* throttle=2.5/10 outside=business; destination country=KP block")
+	require.NoError(t, err)
+	assert.Equal(t, []GeoRule{
+		{Target: GeoClient, Countries: []string{"US", "CA"}, Policy: Policy{Action: ActionAllow, Schedule: "business"}},
+		{Target: GeoDestination, ASNs: []uint{64500, 64501}, Policy: Policy{Action: ActionRoute, Route: "eu"}},
+		{Target: GeoClient, Countries: []string{"*"}, Policy: Policy{Action: ActionThrottle, Rate: 2.5, Burst: 10, Schedule: "!business"}},
+		{Target: GeoDestination, Countries: []string{"KP"}, Policy: Policy{Action: ActionBlock}},
+	}, rules)
+
+	for _, invalid := range []string{
+		"client country=US",
+		"server country=US block",
+		"client city=Paris block",
+		"client asn=abc block",
+		"client country=US throttle",
+		"client country=US throttle=0",
+		"client country=US route=",
+		"client country=US redirect",
+		"client country=US block sometimes",
+		"client country=US block during=",
+		"client country=US block outside=!business",
+		"client country=US block during=business extra",
+	} {
+		_, err := ParseGeoRules(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+type measuredConn struct {
+	net.Conn
+	ctx map[string]interface{}
+}
+
+func (c *measuredConn) OnState(s http.ConnState) {}
+
+func (c *measuredConn) ControlMessage(msgType string, data interface{}) {
+	if msgType == "measured" {
+		c.ctx = data.(map[string]interface{})
+	}
+}
+
+func (c *measuredConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// openTestGeo opens a GeoIP database and a resolver for the tests. The
+// returned function cleans up after them.
+func openTestGeo(t *testing.T) (*geoip.DB, *resolver.Resolver, func()) {
+	dir, err := ioutil.TempDir("", "geoip")
+	require.NoError(t, err)
+	dbFile := filepath.Join(dir, "geo.mmdb")
+	require.NoError(t, geoiptest.Write(dbFile,
+		geoiptest.Network{CIDR: "192.0.2.0/24", Country: "US", ASN: 64500},
+		geoiptest.Network{CIDR: "198.51.100.0/24", Country: "FR", ASN: 64501},
+		geoiptest.Network{CIDR: "203.0.113.0/24", Country: "KP", ASN: 64502},
+	))
+	db, err := geoip.Open(&geoip.Opts{CountryFile: dbFile, ASNFile: dbFile})
+	require.NoError(t, err)
+	r, err := resolver.New(&resolver.Opts{Hosts: map[string][]string{
+		"blocked.test": {"203.0.113.1"},
+		"eu.test":      {"198.51.100.1"},
+		"us.test":      {"192.0.2.1"},
+	}})
+	require.NoError(t, err)
+	return db, r, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	db, r, cleanup := openTestGeo(t)
+	defer cleanup()
+
+	rules, err := ParseGeoRules("client asn=64500 allow; destination country=KP block; destination country=FR route=eu; client country=FR throttle=0.001/2")
+	require.NoError(t, err)
+	filter := GeoIP(db, r, nil, rules)
+
+	var reason string
+	do := func(client string, url string) (int, *dialer.ClientInfo, *measuredConn) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.RemoteAddr = client + ":1234"
+		info := &dialer.ClientInfo{IP: client}
+		req = req.WithContext(dialer.WithClientInfo(context.Background(), info))
+		conn := &measuredConn{}
+		cs := filters.NewConnectionState(req, nil, conn)
+		resp, _, _ := filter.Apply(cs, req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		})
+		reason = resp.Header.Get(errorpages.ReasonHeader)
+		return resp.StatusCode, info, conn
+	}
+
+	status, info, conn := do("192.0.2.10", "http://blocked.test/")
+	assert.Equal(t, http.StatusOK, status, "allowed client should bypass later rules")
+	assert.Equal(t, map[string]interface{}{"client_country": "US", "client_asn": uint(64500)}, conn.ctx)
+	assert.Empty(t, info.Route)
+
+	status, _, conn = do("198.51.100.10", "http://blocked.test/")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, string(geoip.Blocked), reason)
+	assert.Equal(t, "FR", conn.ctx["client_country"])
+
+	status, info, _ = do("198.51.100.10", "http://eu.test/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "eu", info.Route)
+
+	status, info, _ = do("198.51.100.10", "http://us.test/")
+	assert.Equal(t, http.StatusOK, status, "should be within burst")
+	assert.Empty(t, info.Route)
+	status, _, _ = do("198.51.100.10", "http://us.test/")
+	assert.Equal(t, http.StatusTooManyRequests, status, "should be throttled after burst")
+	assert.Equal(t, string(geoip.Throttled), reason)
+	status, _, _ = do("198.51.100.11", "http://us.test/")
+	assert.Equal(t, http.StatusOK, status, "other clients should not be throttled")
+
+	status, _, conn = do("10.0.0.1", "http://us.test/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, conn.ctx, "unknown locations should not be added to measured context")
+}
+
+func TestHostRulesAndGeoIP(t *testing.T) {
+	db, r, cleanup := openTestGeo(t)
+	defer cleanup()
+
+	hostRules, err := ParseHostRules("host=.video.test route=video")
+	require.NoError(t, err)
+	geoRules, err := ParseGeoRules("destination country=FR route=eu; client country=* allow")
+	require.NoError(t, err)
+	filter := filters.Join(HostRules(nil, hostRules), GeoIP(db, r, nil, geoRules))
+
+	route := func(url string) string {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.RemoteAddr = "192.0.2.10:1234"
+		req = req.WithContext(dialer.WithClientInfo(context.Background(), &dialer.ClientInfo{IP: "192.0.2.10"}))
+		cs := filters.NewConnectionState(req, nil, nil)
+		var dialed string
+		filter.Apply(cs, req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			// This is what the dialer picks its sources from
+			dialed = dialer.ClientInfoFrom(req.Context()).Route
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		})
+		return dialed
+	}
+
+	assert.Equal(t, "video", route("http://www.video.test/"), "GeoIP should keep the route chosen by the host rules")
+	assert.Equal(t, "eu", route("http://eu.test/"))
+	assert.Empty(t, route("http://us.test/"))
+}
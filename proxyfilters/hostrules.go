@@ -0,0 +1,94 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/metrics"
+	"github.com/getlantern/http-proxy/schedule"
+)
+
+var (
+	// HostRuleActions counts the actions taken by host rules.
+	HostRuleActions = metrics.Map("host_rule_actions")
+)
+
+// HostRule applies a Policy to requests for the given hosts.
+type HostRule struct {
+	// Hosts are host names like "example.com", or suffixes like
+	// ".example.com" matching all of its subdomains. "*" matches all hosts.
+	Hosts []string
+
+	Policy
+}
+
+func (r *HostRule) matches(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range r.Hosts {
+		if h == "*" || h == host || (strings.HasPrefix(h, ".") && strings.HasSuffix(host, h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHostRules parses a semicolon separated list of rules of the form
+// "host=names action [schedule]", where names are comma separated and action
+// and schedule are as described in Policy. For example:
+//
+//	host=.internal.example.com allow during=business; host=.internal.example.com block; host=* throttle=5/10 during=night; host=.video.example.com throttle=256KB/s
+func ParseHostRules(s string) ([]HostRule, error) {
+	var rules []HostRule
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, errors.New("Invalid host rule %q, expected hosts, action and optional schedule", strings.TrimSpace(part))
+		}
+		match := strings.SplitN(fields[0], "=", 2)
+		if len(match) != 2 || strings.ToLower(match[0]) != "host" {
+			return nil, errors.New("Invalid host rule match %q", fields[0])
+		}
+		rule := HostRule{}
+		for _, host := range strings.Split(match[1], ",") {
+			if host != "" {
+				rule.Hosts = append(rule.Hosts, strings.ToLower(host))
+			}
+		}
+		if len(rule.Hosts) == 0 {
+			return nil, errors.New("Missing hosts in %q", fields[0])
+		}
+		if err := rule.Policy.parse(fields[1:]); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// HostRules applies host rules to requests. Blocked requests are rejected with
+// 403 Forbidden and schedule.Blocked, throttled ones with 429 Too Many
+// Requests and schedule.Throttled. Rules with a schedule are looked up in
+// schedules.
+func HostRules(schedules *schedule.Engine, rules []HostRule) filters.Filter {
+	policies := make([]*Policy, 0, len(rules))
+	for i := range rules {
+		policies = append(policies, &rules[i].Policy)
+	}
+	eval := newEvaluator(schedules, policies, HostRuleActions, schedule.Throttled)
+
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		client, info := clientOf(req)
+		host := hostOf(req)
+		return eval.apply(cs, req, next, client, info, func(i int) bool {
+			return rules[i].matches(host)
+		}, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return fail(cs, req, http.StatusForbidden, schedule.Blocked, "Blocking request from %v to %v", client, req.URL.Host)
+		})
+	})
+}
@@ -0,0 +1,134 @@
+package proxyfilters
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/dialer"
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/faults"
+	"github.com/getlantern/http-proxy/schedule"
+)
+
+func TestParseHostRules(t *testing.T) {
+	rules, err := ParseHostRules("host=.Internal.example.com,intranet allow during=business; host=* route=eu outside=business ; host=example.com throttle=1; host=.video.example.com throttle=1.5MB/s during=night")
+	require.NoError(t, err)
+	assert.Equal(t, []HostRule{
+		{Hosts: []string{".internal.example.com", "intranet"}, Policy: Policy{Action: ActionAllow, Schedule: "business"}},
+		{Hosts: []string{"*"}, Policy: Policy{Action: ActionRoute, Route: "eu", Schedule: "!business"}},
+		{Hosts: []string{"example.com"}, Policy: Policy{Action: ActionThrottle, Rate: 1}},
+		{Hosts: []string{".video.example.com"}, Policy: Policy{Action: ActionThrottle, Bandwidth: 1536 * 1024, Schedule: "night"}},
+	}, rules)
+
+	for _, invalid := range []string{
+		"host=example.com",
+		"host= block",
+		"domain=example.com block",
+		"host=example.com deny",
+		"host=example.com block when=business",
+		"host=example.com throttle=0B/s",
+		"host=example.com throttle=fastKB/s",
+	} {
+		_, err := ParseHostRules(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHostRules(t *testing.T) {
+	schedules, err := schedule.ParseSchedules("business=Mon-Fri 09:00-17:00")
+	require.NoError(t, err)
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC) // Monday
+	engine := schedule.New(&schedule.Opts{Schedules: schedules, Now: func() time.Time { return now }})
+	require.NoError(t, engine.Check("business", "!business"))
+	assert.Error(t, engine.Check("weekend"))
+
+	rules, err := ParseHostRules("host=.internal.example.com allow during=business; host=.internal.example.com block; host=* route=offhours outside=business")
+	require.NoError(t, err)
+	filter := HostRules(engine, rules)
+
+	do := func(url string) (*http.Response, *dialer.ClientInfo) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		info := &dialer.ClientInfo{IP: "127.0.0.1"}
+		req = req.WithContext(dialer.WithClientInfo(context.Background(), info))
+		cs := filters.NewConnectionState(req, nil, nil)
+		resp, _, _ := filter.Apply(cs, req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		})
+		return resp, info
+	}
+
+	resp, info := do("http://wiki.internal.example.com:8080/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "should be allowed during business hours")
+	assert.Empty(t, info.Route)
+	resp, info = do("http://example.com/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, info.Route, "should not be routed during business hours")
+
+	now = time.Date(2021, 3, 1, 18, 0, 0, 0, time.UTC)
+	resp, _ = do("http://wiki.internal.example.com/")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "should be blocked after business hours")
+	assert.Equal(t, string(schedule.Blocked), resp.Header.Get(errorpages.ReasonHeader))
+	resp, info = do("http://example.com/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "offhours", info.Route)
+
+	filter = HostRules(nil, rules)
+	resp, _ = do("http://wiki.internal.example.com/")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "scheduled rules should never apply without schedules")
+
+	rules, err = ParseHostRules("host=slow.example.com throttle=0.001/1")
+	require.NoError(t, err)
+	filter = HostRules(nil, rules)
+	resp, _ = do("http://slow.example.com/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do("http://slow.example.com/")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "should be throttled after burst")
+	assert.Equal(t, string(schedule.Throttled), resp.Header.Get(errorpages.ReasonHeader))
+}
+
+func TestHostRulesBandwidth(t *testing.T) {
+	rules, err := ParseHostRules("host=* throttle=2KB/s; host=* throttle=1KB/s; host=* allow")
+	require.NoError(t, err)
+	filter := HostRules(nil, rules)
+	doTestFilter(t, filter, func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+		require.NoError(t, send(http.MethodPost, nil, expectedBody))
+		_, body, err := recv()
+		require.NoError(t, err)
+		assert.Equal(t, expectedBody, body)
+	})
+
+	// Response bodies are paced at the lowest bandwidth
+	body := strings.Repeat("x", 1024)
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	resp, _, err := filter.Apply(filters.NewConnectionState(req, nil, nil), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, cs, nil
+	})
+	require.NoError(t, err)
+	start := time.Now()
+	received, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(received))
+	assert.True(t, time.Since(start) >= 900*time.Millisecond, "response should be paced at the lowest bandwidth, took %v", time.Since(start))
+
+	// Tunnels are paced by wrapping the upstream connection
+	upstream, _ := net.Pipe()
+	defer upstream.Close()
+	req, _ = http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	cs := filters.NewConnectionState(req, nil, nil)
+	_, nextCS, err := filter.Apply(cs, req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		cs.SetUpstream(upstream)
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	})
+	require.NoError(t, err)
+	assert.IsType(t, &faults.Conn{}, nextCS.Upstream())
+}
@@ -0,0 +1,36 @@
+package proxyfilters
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/loadshed"
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+var (
+	shedRequests = metrics.Counter("load_shed_requests")
+)
+
+// ShedLoad responds with 503 Service Unavailable and a Retry-After header to
+// plain HTTP requests while c is at loadshed.Soft or above. CONNECT requests
+// are let through, see Controller.Listener for refusing new connections.
+func ShedLoad(c *loadshed.Controller) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		level := c.Level()
+		if req.Method == http.MethodConnect || level < loadshed.Soft {
+			return next(cs, req)
+		}
+		shedRequests.Add(1)
+		// Don't log errors, there may be lots of these
+		log.Tracef("Shedding %v %v from %v at load level %v", req.Method, req.URL, req.RemoteAddr, level)
+		err := errorpages.NewError(http.StatusServiceUnavailable, loadshed.Overloaded, "Load level %v", level)
+		resp := errorpages.Default.Response(req, http.StatusServiceUnavailable, loadshed.Overloaded, err)
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(c.RetryAfter().Seconds()))))
+		return resp, cs, err
+	})
+}
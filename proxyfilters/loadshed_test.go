@@ -0,0 +1,48 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/loadshed"
+)
+
+func TestShedLoad(t *testing.T) {
+	c, err := loadshed.New(&loadshed.Opts{
+		Soft: loadshed.Thresholds{Goroutines: 100},
+		Sample: func() *loadshed.Sample {
+			return &loadshed.Sample{Goroutines: 10}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	doTestFilter(t, ShedLoad(c), func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+		require.NoError(t, send(http.MethodPost, nil, expectedBody))
+		_, body, err := recv()
+		require.NoError(t, err)
+		assert.Equal(t, expectedBody, body, "requests should pass under normal load")
+	})
+
+	c, err = loadshed.New(&loadshed.Opts{
+		Soft:       loadshed.Thresholds{Goroutines: 100},
+		RetryAfter: 1500 * time.Millisecond,
+		Sample: func() *loadshed.Sample {
+			return &loadshed.Sample{Goroutines: 100}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	doTestFilter(t, ShedLoad(c), func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+		require.NoError(t, send(http.MethodGet, nil, ""))
+		resp, _, err := recv()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, string(loadshed.Overloaded), resp.Header.Get(errorpages.ReasonHeader))
+		assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	})
+}
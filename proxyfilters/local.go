@@ -0,0 +1,81 @@
+package proxyfilters
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/proxy/v2/filters"
+)
+
+// ServeLocally answers requests for the given paths that are addressed to the
+// proxy itself, like "GET /proxy.pac", with handler instead of proxying them.
+// Requests for the same paths on an origin, like
+// "GET http://example.com/proxy.pac", are proxied as usual.
+func ServeLocally(handler http.Handler, paths ...string) filters.Filter {
+	served := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		served[path] = true
+	}
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if !strings.HasPrefix(req.RequestURI, "/") || !served[req.URL.Path] {
+			return next(cs, req)
+		}
+		log.Tracef("Serving %v locally", req.URL.Path)
+		rw := &localResponseWriter{header: make(http.Header)}
+		handler.ServeHTTP(rw, req)
+		return rw.response(req), cs, nil
+	})
+}
+
+// localResponseWriter buffers the response of an http.Handler so that it can
+// be returned from a filter.
+type localResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *localResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *localResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *localResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func (w *localResponseWriter) response(req *http.Request) *http.Response {
+	w.WriteHeader(http.StatusOK)
+	body := w.body.Bytes()
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	if w.header.Get("Date") == "" {
+		w.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	bodyAllowed := w.statusCode >= http.StatusOK && w.statusCode != http.StatusNoContent && w.statusCode != http.StatusNotModified
+	if bodyAllowed && w.header.Get("Content-Length") == "" {
+		w.header.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(w.statusCode) + " " + http.StatusText(w.statusCode),
+		StatusCode:    w.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}
+}
@@ -0,0 +1,58 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/proxy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeLocally(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	pl, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer pl.Close()
+	p, _ := proxy.New(&proxy.Opts{
+		Filter: ServeLocally(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "text/plain")
+			resp.Write([]byte("local " + req.URL.Path))
+		}), "/proxy.pac", "/wpad.dat"),
+	})
+	go p.Serve(pl)
+
+	conn, err := net.Dial("tcp", pl.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	get := func(rawRequest string) (*http.Response, string) {
+		_, err := conn.Write([]byte(rawRequest))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get("GET /wpad.dat HTTP/1.1\r\nHost: wpad.example.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "local /wpad.dat", body)
+
+	_, body = get("GET " + origin.URL + "/proxy.pac HTTP/1.1\r\nHost: " + origin.Listener.Addr().String() + "\r\n\r\n")
+	assert.Equal(t, "origin", body, "requests for origins should be proxied")
+
+	_, body = get("GET /proxy.pac HTTP/1.1\r\nHost: proxy.example.com\r\n\r\n")
+	assert.Equal(t, "local /proxy.pac", body, "connection should be kept alive")
+}
@@ -0,0 +1,30 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+// ViolationMaxRequests is the reason counted in listeners.ClientViolations
+// when a keep-alive connection reaches its request limit.
+const ViolationMaxRequests = "max_requests"
+
+// MaxRequestsPerConn closes keep-alive connections after they've served the
+// given number of requests by marking the last response with
+// "Connection: close".
+func MaxRequestsPerConn(max int) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		resp, nextCS, err := next(cs, req)
+		if max > 0 && resp != nil && req.Method != http.MethodConnect && cs.RequestNumber() >= max && !resp.Close {
+			resp.Close = true
+			listeners.ClientViolations.Add(ViolationMaxRequests, 1)
+			clientIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+			log.Debugf("Closing connection from %v after %d requests", clientIP, cs.RequestNumber())
+		}
+		return resp, nextCS, err
+	})
+}
@@ -0,0 +1,29 @@
+package proxyfilters
+
+import (
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/mirror"
+)
+
+// Mirror sends a sample of plain HTTP requests to a shadow origin in the
+// background (see mirror.Mirror) and compares the status codes of its
+// responses with those of the primary origin. Clients only ever get the
+// primary's responses.
+func Mirror(m *mirror.Mirror) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		done := m.Start(req)
+		if done == nil {
+			return next(cs, req)
+		}
+		resp, nextCS, err := next(cs, req)
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		done(status)
+		return resp, nextCS, err
+	})
+}
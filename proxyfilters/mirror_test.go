@@ -0,0 +1,35 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/proxy/v2/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/mirror"
+)
+
+func TestMirror(t *testing.T) {
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	results := make(chan *mirror.Result, 1)
+	m, err := mirror.New(&mirror.Opts{Target: shadow.URL, Percent: 100, OnResult: func(r *mirror.Result) { results <- r }})
+	require.NoError(t, err)
+	filter := Mirror(m)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	cs := filters.NewConnectionState(req, nil, nil)
+	resp, _, err := filter.Apply(cs, req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusNotFound}, cs, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "client should get the primary's response")
+	result := <-results
+	assert.Equal(t, http.StatusNotFound, result.PrimaryStatus)
+	assert.Equal(t, http.StatusInternalServerError, result.ShadowStatus)
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/getlantern/errors"
 	"github.com/getlantern/ops"
 	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/tracing"
 )
 
 // RecordOp records the proxy_http op.
@@ -17,6 +19,7 @@ var RecordOp = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Re
 		name += "s"
 	}
 	op := ops.Begin(name)
+	tracing.Start(op, tracing.Internal)
 	resp, nextCtx, err := next(cs, req)
 	if err != nil {
 		op.FailIf(err)
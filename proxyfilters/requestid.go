@@ -0,0 +1,119 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/tracing"
+)
+
+const (
+	traceParent = "Traceparent"
+	traceState  = "Tracestate"
+
+	maxRequestIDLength = 128
+
+	// sampled is the trace-flags value we use when starting a new trace, see
+	// https://www.w3.org/TR/trace-context/#trace-flags.
+	sampled = "01"
+)
+
+// RequestID assigns every request an ID and W3C trace context. A valid
+// X-Request-Id supplied by the client is kept, otherwise a new one is
+// generated. Likewise, a valid traceparent continues the client's trace with a
+// new span for the proxy, otherwise the request becomes a child of the
+// connection's span (see tracing.Start). The IDs are attached to the ops
+// context as request_id, trace_id, span_id and parent_span_id so that they
+// show up in logs and ops reports, are forwarded upstream on plain HTTP
+// requests and the request ID is echoed back to the client on the response.
+// This filter should come first in the chain.
+var RequestID = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	requestID := req.Header.Get(errorpages.RequestIDHeader)
+	if !validRequestID(requestID) {
+		requestID = errorpages.NewRequestID()
+	}
+	req.Header.Set(errorpages.RequestIDHeader, requestID)
+
+	op := ops.Begin("proxy_request").Set("request_id", requestID)
+	defer op.End()
+
+	var sc tracing.SpanContext
+	traceID, parentSpanID, flags, ok := parseTraceParent(req.Header.Get(traceParent))
+	if ok {
+		sc = tracing.StartRemote(op, traceID, parentSpanID, tracing.Server)
+	} else {
+		sc = tracing.Start(op, tracing.Server)
+		flags = sampled
+		// tracestate is meaningless without the traceparent it belongs to
+		req.Header.Del(traceState)
+	}
+	if req.Method != http.MethodConnect {
+		req.Header.Set(traceParent, "00-"+sc.TraceID+"-"+sc.SpanID+"-"+flags)
+	}
+	req = req.WithContext(tracing.WithSpanContext(req.Context(), sc))
+
+	resp, nextCS, err := next(cs, req)
+	if resp != nil {
+		if resp.Header == nil {
+			resp.Header = make(http.Header)
+		}
+		if resp.Header.Get(errorpages.RequestIDHeader) == "" {
+			resp.Header.Set(errorpages.RequestIDHeader, requestID)
+		}
+	}
+	return resp, nextCS, err
+})
+
+// validRequestID only accepts IDs that are safe to log and echo back.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseTraceParent parses a version 00 traceparent header as specified at
+// https://www.w3.org/TR/trace-context/#traceparent-header. Headers with a
+// higher version are parsed as far as version 00 is understood.
+func parseTraceParent(header string) (traceID string, spanID string, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return "", "", "", false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return "", "", "", false
+	}
+	if !isLowerHex(traceID, 32) || isZero(traceID) || !isLowerHex(spanID, 16) || isZero(spanID) || !isLowerHex(flags, 2) {
+		return "", "", "", false
+	}
+	return traceID, spanID, flags, true
+}
+
+func isLowerHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
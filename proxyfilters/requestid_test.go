@@ -0,0 +1,96 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/ops"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, spanID, flags, ok := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	assert.Equal(t, "00f067aa0ba902b7", spanID)
+	assert.Equal(t, "01", flags)
+
+	_, _, _, ok = parseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future")
+	assert.True(t, ok, "should accept future versions with extra fields")
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+	} {
+		_, _, _, ok = parseTraceParent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var mx sync.Mutex
+	var reported []map[string]interface{}
+	ops.RegisterReporter(func(failure error, ctx map[string]interface{}) {
+		if ctx["op"] == "proxy_request" {
+			mx.Lock()
+			reported = append(reported, ctx)
+			mx.Unlock()
+		}
+	})
+
+	doTestFilter(t,
+		RequestID,
+		func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+			// New request ID and trace
+			require.NoError(t, send(http.MethodGet, http.Header{"Tracestate": {"vendor=value"}, "X-Request-Id": {"bad id\r\n"}}, ""))
+			resp, _, err := recv()
+			require.NoError(t, err)
+			requestID := resp.Header.Get("Reflected-X-Request-Id")
+			assert.Len(t, requestID, 32)
+			assert.Equal(t, requestID, resp.Header.Get("X-Request-Id"), "should echo request ID to client")
+			traceID, spanID, flags, ok := parseTraceParent(resp.Header.Get("Reflected-Traceparent"))
+			assert.True(t, ok, "should forward valid traceparent upstream")
+			assert.Equal(t, "01", flags)
+			assert.Empty(t, resp.Header.Get("Reflected-Tracestate"), "should drop orphaned tracestate")
+
+			mx.Lock()
+			if assert.Len(t, reported, 1) {
+				assert.Equal(t, requestID, reported[0]["request_id"])
+				assert.Equal(t, traceID, reported[0]["trace_id"])
+				assert.Equal(t, spanID, reported[0]["span_id"])
+				assert.Nil(t, reported[0]["parent_span_id"])
+			}
+			mx.Unlock()
+
+			// Continue client's trace
+			require.NoError(t, send(http.MethodGet, http.Header{
+				"X-Request-Id": {"client-id-1"},
+				"Traceparent":  {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+				"Tracestate":   {"vendor=value"},
+			}, ""))
+			resp, _, err = recv()
+			require.NoError(t, err)
+			assert.Equal(t, "client-id-1", resp.Header.Get("Reflected-X-Request-Id"))
+			assert.Equal(t, "client-id-1", resp.Header.Get("X-Request-Id"))
+			traceparent := resp.Header.Get("Reflected-Traceparent")
+			assert.True(t, strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-"), traceparent)
+			assert.True(t, strings.HasSuffix(traceparent, "-00"), "should keep client's flags")
+			assert.NotContains(t, traceparent, "00f067aa0ba902b7", "should use our own span ID")
+			assert.Equal(t, "vendor=value", resp.Header.Get("Reflected-Tracestate"))
+
+			mx.Lock()
+			if assert.Len(t, reported, 2) {
+				assert.Equal(t, "00f067aa0ba902b7", reported[1]["parent_span_id"])
+			}
+			mx.Unlock()
+		})
+}
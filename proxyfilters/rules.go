@@ -0,0 +1,323 @@
+package proxyfilters
+
+import (
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v2/filters"
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/getlantern/http-proxy/dialer"
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/faults"
+	"github.com/getlantern/http-proxy/schedule"
+	"github.com/getlantern/http-proxy/tunnel"
+)
+
+const (
+	maxThrottledClients = 100000
+)
+
+// Action is what a rule does to matching requests.
+type Action int
+
+const (
+	// ActionAllow lets the request through without evaluating further rules.
+	ActionAllow Action = iota
+	// ActionBlock rejects the request.
+	ActionBlock
+	// ActionThrottle limits the rate of requests per client, rejecting
+	// requests exceeding it with 429 Too Many Requests, or the bandwidth of
+	// responses and tunnels.
+	ActionThrottle
+	// ActionRoute sends the request's upstream connections through one of the
+	// dialer's routes (see dialer.Opts.Routes).
+	ActionRoute
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionAllow:
+		return "allow"
+	case ActionBlock:
+		return "block"
+	case ActionThrottle:
+		return "throttle"
+	default:
+		return "route"
+	}
+}
+
+// Policy is the part of a rule that says what to do with matching requests,
+// and when. Rules are evaluated in order. Allow and block end the evaluation,
+// throttle and route don't, so a later rule can still block a throttled
+// request. The last matching route wins.
+//
+// In rule strings, the action is written as allow, block,
+// throttle=rate[/burst] (requests per second), throttle=sizeB/s (bandwidth,
+// like 512KB/s or 2MB/s) or route=name, optionally followed by
+// during=schedule or outside=schedule.
+type Policy struct {
+	Action Action
+
+	// Rate is the number of requests per second each client may make, for
+	// ActionThrottle.
+	Rate float64
+
+	// Burst is the number of requests a client may make in a burst, for
+	// ActionThrottle. Defaults to 1.
+	Burst int
+
+	// Bandwidth, if set instead of Rate, limits ActionThrottle to pacing
+	// response bodies and CONNECT tunnels to this many bytes per second, in
+	// each direction and per request or tunnel.
+	Bandwidth int64
+
+	// Route is the name of the route, for ActionRoute.
+	Route string
+
+	// Schedule limits the rule to the times when the named schedule is active,
+	// or inactive if prefixed with "!" (see schedule.Engine.Active). Rules
+	// without a schedule always apply.
+	Schedule string
+}
+
+// parse parses an action and an optional schedule.
+func (p *Policy) parse(fields []string) error {
+	action := strings.SplitN(fields[0], "=", 2)
+	switch strings.ToLower(action[0]) {
+	case "allow":
+		p.Action = ActionAllow
+	case "block":
+		p.Action = ActionBlock
+	case "throttle":
+		p.Action = ActionThrottle
+		if len(action) != 2 {
+			return errors.New("Missing rate in %q", fields[0])
+		}
+		if bandwidth, isBandwidth := parseBandwidth(action[1]); isBandwidth {
+			if bandwidth <= 0 {
+				return errors.New("Invalid bandwidth in %q", fields[0])
+			}
+			p.Bandwidth = bandwidth
+			break
+		}
+		rateAndBurst := strings.SplitN(action[1], "/", 2)
+		rate, err := strconv.ParseFloat(rateAndBurst[0], 64)
+		if err != nil || rate <= 0 {
+			return errors.New("Invalid rate in %q", fields[0])
+		}
+		p.Rate = rate
+		if len(rateAndBurst) == 2 {
+			p.Burst, err = strconv.Atoi(rateAndBurst[1])
+			if err != nil || p.Burst <= 0 {
+				return errors.New("Invalid burst in %q", fields[0])
+			}
+		}
+	case "route":
+		p.Action = ActionRoute
+		if len(action) != 2 || action[1] == "" {
+			return errors.New("Missing route name in %q", fields[0])
+		}
+		p.Route = action[1]
+	default:
+		return errors.New("Invalid rule action %q", fields[0])
+	}
+
+	if len(fields) < 2 {
+		return nil
+	}
+	when := strings.SplitN(fields[1], "=", 2)
+	if len(when) != 2 || when[1] == "" || strings.HasPrefix(when[1], "!") {
+		return errors.New("Invalid rule schedule %q", fields[1])
+	}
+	switch strings.ToLower(when[0]) {
+	case "during":
+		p.Schedule = when[1]
+	case "outside":
+		p.Schedule = "!" + when[1]
+	default:
+		return errors.New("Invalid rule schedule %q", fields[1])
+	}
+	return nil
+}
+
+// parseBandwidth parses a bandwidth like 512KB/s, returning false if s isn't
+// one. Units are powers of 1024.
+func parseBandwidth(s string) (int64, bool) {
+	upper := strings.ToUpper(s)
+	if !strings.HasSuffix(upper, "B/S") {
+		return 0, false
+	}
+	number := upper[:len(upper)-3]
+	multiplier := float64(1)
+	for i, unit := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(number, unit) {
+			number = number[:len(number)-1]
+			multiplier = math.Pow(1024, float64(i+1))
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return -1, true
+	}
+	return int64(value * multiplier), true
+}
+
+// evaluator applies a list of policies to requests. Throttled requests are
+// rejected with the throttled reason, which is specific to the kind of rules
+// so that bans (see access.Jail) don't count them as abuse.
+type evaluator struct {
+	schedules *schedule.Engine
+	policies  []*Policy
+	actions   *expvar.Map
+	throttled errorpages.Reason
+	throttle  *throttle
+}
+
+func newEvaluator(schedules *schedule.Engine, policies []*Policy, actions *expvar.Map, throttled errorpages.Reason) *evaluator {
+	return &evaluator{
+		schedules: schedules,
+		policies:  policies,
+		actions:   actions,
+		throttled: throttled,
+		throttle:  newThrottle(),
+	}
+}
+
+// apply evaluates the policies whose schedule is active and for which matches
+// returns true, calling block to reject blocked requests. The lowest bandwidth
+// of matching throttles applies.
+func (e *evaluator) apply(cs *filters.ConnectionState, req *http.Request, next filters.Next, client string, info *dialer.ClientInfo,
+	matches func(i int) bool, block filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	var bandwidth int64
+	for i, p := range e.policies {
+		if p.Schedule != "" && !e.schedules.Active(p.Schedule) {
+			continue
+		}
+		if !matches(i) {
+			continue
+		}
+		e.actions.Add(p.Action.String(), 1)
+		switch p.Action {
+		case ActionAllow:
+			return throttleBandwidth(cs, req, next, bandwidth)
+		case ActionBlock:
+			return block(cs, req)
+		case ActionThrottle:
+			if p.Bandwidth > 0 {
+				if bandwidth == 0 || p.Bandwidth < bandwidth {
+					bandwidth = p.Bandwidth
+				}
+			} else if !e.throttle.allow(i, client, p) {
+				return fail(cs, req, http.StatusTooManyRequests, e.throttled, "Throttling requests from %v to %v", client, req.URL.Host)
+			}
+		case ActionRoute:
+			if info != nil {
+				info.Route = p.Route
+			}
+		}
+	}
+	return throttleBandwidth(cs, req, next, bandwidth)
+}
+
+// throttleBandwidth paces the response body or, for CONNECT requests, the
+// tunnel to bandwidth bytes per second, if set.
+func throttleBandwidth(cs *filters.ConnectionState, req *http.Request, next filters.Next, bandwidth int64) (*http.Response, *filters.ConnectionState, error) {
+	if bandwidth <= 0 {
+		return next(cs, req)
+	}
+	if req.Method == http.MethodConnect {
+		// Spliced tunnels bypass the wrapped upstream connection
+		tunnel.DisableSplicing(cs.Downstream())
+	}
+	resp, nextCS, err := next(cs, req)
+	if err != nil {
+		return resp, nextCS, err
+	}
+	if req.Method == http.MethodConnect {
+		if upstream := nextCS.Upstream(); upstream != nil {
+			nextCS.SetUpstream(faults.Throttle(upstream, bandwidth))
+		}
+	} else if resp != nil && resp.Body != nil {
+		resp.Body = faults.ThrottleBody(resp.Body, bandwidth)
+	}
+	return resp, nextCS, err
+}
+
+// clientOf returns the IP of the client making req and its ClientInfo, if
+// any.
+func clientOf(req *http.Request) (string, *dialer.ClientInfo) {
+	info := dialer.ClientInfoFrom(req.Context())
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if info != nil {
+		client = info.IP
+	}
+	return client, info
+}
+
+// hostOf returns the requested host without port.
+func hostOf(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		host = req.URL.Host
+	}
+	return host
+}
+
+// throttle keeps token buckets per rule and client.
+type throttle struct {
+	buckets *lru.Cache
+	mx      sync.Mutex
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newThrottle() *throttle {
+	buckets, _ := lru.New(maxThrottledClients)
+	return &throttle{buckets: buckets, now: time.Now}
+}
+
+func (t *throttle) allow(ruleIndex int, client string, p *Policy) bool {
+	burst := float64(p.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	key := strconv.Itoa(ruleIndex) + "|" + client
+	now := t.now()
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	var b *bucket
+	if existing, found := t.buckets.Get(key); found {
+		b = existing.(*bucket)
+		b.tokens += now.Sub(b.last).Seconds() * p.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	} else {
+		b = &bucket{tokens: burst}
+		t.buckets.Add(key, b)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,38 @@
+package proxyfilters
+
+import (
+	"net/http"
+
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/metrics"
+	"github.com/getlantern/http-proxy/validation"
+)
+
+// InvalidRequests counts requests rejected by ValidateRequests, broken down by
+// reason.
+var InvalidRequests = metrics.Map("invalid_requests")
+
+// ValidateRequests rejects requests with ambiguous framing or targets, which
+// could otherwise be used to smuggle requests past the proxy or its upstreams,
+// with a 400 response carrying the reason. It validates the raw request head
+// recorded by the slowloris listener (see listeners.RequestHead) and falls
+// back to validation.ValidateRequest, which can catch less, if that isn't
+// available. Rejected requests close the connection.
+var ValidateRequests = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	var err error
+	if head := listeners.RequestHead(cs.Downstream(), cs.RequestNumber()); head != nil {
+		err = validation.ValidateHead(head)
+	} else {
+		err = validation.ValidateRequest(req)
+	}
+	if err != nil {
+		reason := errorpages.ReasonOf(err)
+		InvalidRequests.Add(string(reason), 1)
+		log.Debugf("Rejecting invalid request from %v: %v", req.RemoteAddr, err)
+		return errorpages.Default.Response(req, http.StatusBadRequest, reason, err), cs, err
+	}
+	return next(cs, req)
+})
@@ -0,0 +1,81 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/proxy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/validation"
+)
+
+func TestValidateRequests(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		resp.WriteHeader(http.StatusOK)
+	}))
+	defer origin.Close()
+	originHost := origin.Listener.Addr().String()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	p, _ := proxy.New(&proxy.Opts{Filter: ValidateRequests})
+	go p.Serve(listeners.NewSlowlorisListener(l, &listeners.SlowlorisOpts{}))
+
+	invalidCount := func(reason errorpages.Reason) int64 {
+		if v, ok := InvalidRequests.Get(string(reason)).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	for _, tc := range []struct {
+		head   string
+		reason errorpages.Reason
+	}{
+		{"GET http://" + originHost + "/ HTTP/1.1\r\nHost: " + originHost + "\r\n\r\n", ""},
+		{"POST http://" + originHost + "/ HTTP/1.1\r\nHost: " + originHost + "\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", validation.ContentLengthWithTransferEncoding},
+		{"POST http://" + originHost + "/ HTTP/1.1\r\nHost: " + originHost + "\r\nContent-Length: 0\r\nContent-Length: 0\r\n\r\n", validation.DuplicateContentLength},
+		{"GET http://" + originHost + "/ HTTP/1.1\r\nHost: " + originHost + "\r\nX-Folded: a\r\n b\r\n\r\n", validation.ObsoleteLineFolding},
+		{"GET http://" + originHost + "/ HTTP/1.1\r\nHost: evil.com\r\n\r\n", validation.HostMismatch},
+		{"CONNECT " + originHost + "/path HTTP/1.1\r\n\r\n", validation.InvalidConnectTarget},
+	} {
+		before := invalidCount(tc.reason)
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		// Send a valid request first so that request numbers beyond the first
+		// get exercised too. Its Upgrade header doesn't get answered with 101,
+		// so the connection doesn't turn into a tunnel.
+		_, err = conn.Write([]byte("GET http://" + originHost + "/ HTTP/1.1\r\nHost: " + originHost + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n" + tc.head))
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, err = http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		if tc.reason == "" {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		} else {
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, string(tc.reason))
+			assert.Equal(t, string(tc.reason), resp.Header.Get(errorpages.ReasonHeader))
+			assert.True(t, resp.Close, "connection should be closed after invalid request")
+			assert.Equal(t, before+1, invalidCount(tc.reason))
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,160 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy/v2"
+	"github.com/getlantern/proxy/v2/filters"
+
+	"github.com/getlantern/http-proxy/circuitbreaker"
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/metrics"
+	"github.com/getlantern/http-proxy/websocket"
+)
+
+const (
+	websocketHandshakeTimeout = 30 * time.Second
+)
+
+var (
+	websocketConnections = metrics.Counter("websocket_connections")
+	websocketIdleClosed  = metrics.Counter("websocket_idle_closed")
+	websocketFrames      = metrics.Map("websocket_frames")
+	websocketBytes       = metrics.Map("websocket_bytes")
+	websocketMessages    = metrics.Map("websocket_messages")
+)
+
+// WebSockets handles plain HTTP WebSocket upgrade requests, which can't be
+// forwarded like other requests because they rely on hop-by-hop headers. It
+// applies the origin and subprotocol policies in opts, performs the handshake
+// with the origin itself using dial and, if the origin switches protocols,
+// proxies the frames in both directions, counting them and closing the
+// connection once it's been idle for opts.IdleTimeout. Upgrades inside CONNECT
+// tunnels are opaque to the proxy and aren't affected. Other requests pass
+// through.
+func WebSockets(dial proxy.DialFunc, opts *websocket.Opts) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		if !websocket.IsUpgrade(req) {
+			return next(cs, req)
+		}
+		if err := websocket.CheckRequest(opts, req); err != nil {
+			return fail(cs, req, http.StatusForbidden, errorpages.ReasonOf(err), "Rejecting WebSocket upgrade to %v: %v", req.URL.Host, err)
+		}
+
+		op := ops.Begin("websocket_handshake").Set("websocket_host", req.URL.Host)
+		defer op.End()
+
+		upstream, br, resp, err := websocketHandshake(dial, req)
+		if err != nil {
+			op.FailIf(err)
+			if isCircuitOpen(err) {
+				return circuitbreaker.ServiceUnavailable(req, err), cs, err
+			}
+			return fail(cs, req, http.StatusBadGateway, errorpages.UpstreamUnavailable, "Unable to upgrade connection to %v: %v", req.URL.Host, err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			// The origin declined, pass its response on and don't reuse the
+			// connection to it.
+			resp.Body = &closingBody{ReadCloser: resp.Body, conn: upstream}
+			resp.Close = true
+			return resp, cs, nil
+		}
+		if protocol := resp.Header.Get("Sec-Websocket-Protocol"); protocol != "" && !websocket.SubprotocolAllowed(opts, protocol) {
+			upstream.Close()
+			return fail(cs, req, http.StatusBadGateway, websocket.SubprotocolNotAllowed, "Origin %v negotiated subprotocol that isn't allowed: %v", req.URL.Host, protocol)
+		}
+
+		if requestID := req.Header.Get(errorpages.RequestIDHeader); requestID != "" && resp.Header.Get(errorpages.RequestIDHeader) == "" {
+			resp.Header.Set(errorpages.RequestIDHeader, requestID)
+		}
+		if err := resp.Write(cs.Downstream()); err != nil {
+			upstream.Close()
+			return nil, cs, err
+		}
+		websocketConnections.Add(1)
+
+		start := time.Now()
+		host := req.URL.Host
+		conn := websocket.Wrap(upstream, br, req, opts, func(stats *websocket.Stats, idle bool) {
+			if idle {
+				websocketIdleClosed.Add(1)
+			}
+			for _, dir := range []websocket.Direction{websocket.ClientToServer, websocket.ServerToClient} {
+				websocketFrames.Add(dir.String(), stats.Frames[dir])
+				websocketBytes.Add(dir.String(), stats.Bytes[dir])
+				websocketMessages.Add(dir.String(), stats.Messages[dir])
+			}
+			log.Debugf("WebSocket connection to %v closed after %v: %d/%d frames and %d/%d bytes sent/received",
+				host, time.Since(start), stats.Frames[websocket.ClientToServer], stats.Frames[websocket.ServerToClient],
+				stats.Bytes[websocket.ClientToServer], stats.Bytes[websocket.ServerToClient])
+		})
+		nextCS := cs.Clone()
+		nextCS.SetUpstream(conn)
+		return nil, nextCS, nil
+	})
+}
+
+// websocketHandshake sends the upgrade request to the origin and reads its
+// response. The returned reader holds anything the origin sent after the
+// response.
+func websocketHandshake(dial proxy.DialFunc, req *http.Request) (net.Conn, *bufio.Reader, *http.Response, error) {
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	conn, err := dial(req.Context(), false, "tcp", addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if req.URL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: req.URL.Hostname()})
+	}
+	conn.SetDeadline(time.Now().Add(websocketHandshakeTimeout))
+
+	outReq := req.Clone(req.Context())
+	for name := range outReq.Header {
+		if strings.HasPrefix(name, "Proxy-") {
+			outReq.Header.Del(name)
+		}
+	}
+	if outReq.Header.Get("User-Agent") == "" {
+		// Keep net/http from adding its own
+		outReq.Header["User-Agent"] = []string{""}
+	}
+	if err := outReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, br, resp, nil
+}
+
+// closingBody closes the connection a response was read from along with its
+// body.
+type closingBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *closingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
@@ -0,0 +1,132 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/errorpages"
+	"github.com/getlantern/http-proxy/websocket"
+)
+
+// echoWebSocket is an origin that accepts upgrades and echoes back the payload
+// of every frame it receives, unmasked.
+func echoWebSocket(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !websocket.IsUpgrade(req) {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := resp.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: %v\r\n\r\n", req.Header.Get("Sec-Websocket-Protocol"))
+		brw.Flush()
+		for {
+			header := make([]byte, 6)
+			if _, err := io.ReadFull(brw, header); err != nil {
+				return
+			}
+			payload := make([]byte, header[1]&0x7f)
+			if _, err := io.ReadFull(brw, payload); err != nil {
+				return
+			}
+			for i := range payload {
+				payload[i] ^= header[2+i%4]
+			}
+			brw.Write(append([]byte{header[0], byte(len(payload))}, payload...))
+			brw.Flush()
+		}
+	}))
+}
+
+func TestWebSockets(t *testing.T) {
+	origin := echoWebSocket(t)
+	defer origin.Close()
+
+	messages := make(chan *websocket.Message, 10)
+	opts := &websocket.Opts{
+		AllowedOrigins:      []string{"https://example.com"},
+		AllowedSubprotocols: []string{"chat"},
+		OnMessage: func(msg *websocket.Message) {
+			messages <- msg
+		},
+	}
+	var dialer net.Dialer
+	dial := func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	pl, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer pl.Close()
+	p, _ := proxy.New(&proxy.Opts{Filter: WebSockets(dial, opts)})
+	go p.Serve(pl)
+
+	conn, _, resp := upgradeTo(t, pl.Addr().String(), origin.URL, "https://evil.example", "chat")
+	conn.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, string(websocket.OriginNotAllowed), resp.Header.Get(errorpages.ReasonHeader))
+
+	conn, _, resp = upgradeTo(t, pl.Addr().String(), origin.URL, "https://example.com", "other")
+	conn.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, string(websocket.SubprotocolNotAllowed), resp.Header.Get(errorpages.ReasonHeader))
+
+	conn, br, resp := upgradeTo(t, pl.Addr().String(), origin.URL, "https://example.com", "other, chat")
+	defer conn.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "chat", resp.Header.Get("Sec-Websocket-Protocol"), "only allowed subprotocols should be offered")
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+	mask := []byte{9, 8, 7, 6}
+	payload := []byte("Hello")
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+	_, err = conn.Write(append(append([]byte{0x81, 0x80 | byte(len(payload))}, mask...), masked...))
+	require.NoError(t, err)
+	echo := make([]byte, 2+len(payload))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(br, echo)
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{0x81, byte(len(payload))}, payload...), echo)
+
+	for _, dir := range []websocket.Direction{websocket.ClientToServer, websocket.ServerToClient} {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, dir, msg.Direction)
+			assert.Equal(t, websocket.OpText, msg.Opcode)
+			assert.Equal(t, "Hello", string(msg.Payload))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v message", dir)
+		}
+	}
+}
+
+func upgradeTo(t *testing.T, proxyAddr string, url string, origin string, protocols string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodGet, url+"/chat", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Sec-Websocket-Protocol", protocols)
+	require.NoError(t, req.WriteProxy(conn))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	return conn, br, resp
+}
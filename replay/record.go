@@ -0,0 +1,213 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/http-proxy/har"
+)
+
+// Record is a recorded request. In JSON lines files, every line is a Record.
+type Record struct {
+	// Time is when the request was made. Requests are replayed with the same
+	// spacing. Records without a time are replayed right away.
+	Time time.Time `json:"time,omitempty"`
+
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+
+	// Status is the status code of the recorded response, if known.
+	Status int `json:"status,omitempty"`
+
+	// ResponseSize is the size of the recorded response body, if known.
+	ResponseSize int64 `json:"response_size,omitempty"`
+
+	// Offset is when to replay the request, relative to the first one.
+	Offset time.Duration `json:"-"`
+}
+
+// headers that aren't replayed because they apply to the recorded connection
+// or are set when sending.
+var skippedHeaders = map[string]bool{
+	"Connection":          true,
+	"Content-Length":      true,
+	"Host":                true,
+	"Keep-Alive":          true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// LoadFile loads records from a file (see Load).
+func LoadFile(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("Unable to open %v: %v", path, err)
+	}
+	defer f.Close()
+	records, err := Load(f)
+	if err != nil {
+		return nil, errors.New("Unable to load %v: %v", path, err)
+	}
+	return records, nil
+}
+
+// Load loads records from a HAR file or a file with a JSON Record per line,
+// sorted by time and with offsets relative to the first one. CONNECT requests
+// are skipped since the traffic inside tunnels isn't recorded.
+func Load(r io.Reader) ([]*Record, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	if isHAR(data) {
+		records, err = fromHAR(data)
+	} else {
+		records, err = fromJSONLines(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := records[:0]
+	for _, record := range records {
+		if record.Method == "" {
+			record.Method = http.MethodGet
+		}
+		if record.Method == http.MethodConnect {
+			continue
+		}
+		u, err := url.Parse(record.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.New("Invalid URL %q, expected an absolute http(s) URL", record.URL)
+		}
+		filtered = append(filtered, record)
+	}
+	return Merge(filtered), nil
+}
+
+// Merge sorts records (possibly loaded from several files) by time and sets
+// their offsets relative to the first one.
+func Merge(records []*Record) []*Record {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	var first time.Time
+	for _, record := range records {
+		if record.Time.IsZero() {
+			continue
+		}
+		if first.IsZero() {
+			first = record.Time
+		}
+		record.Offset = record.Time.Sub(first)
+	}
+	return records
+}
+
+func isHAR(data []byte) bool {
+	var probe struct {
+		Log json.RawMessage `json:"log"`
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return false
+	}
+	// A HAR file is a single object, JSON lines files have more than one
+	d := json.NewDecoder(bytes.NewReader(trimmed))
+	if err := d.Decode(&probe); err != nil || probe.Log == nil {
+		return false
+	}
+	return !d.More()
+}
+
+func fromJSONLines(data []byte) ([]*Record, error) {
+	var records []*Record
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		record := &Record{}
+		if err := json.Unmarshal(text, record); err != nil {
+			return nil, errors.New("Invalid record on line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func fromHAR(data []byte) ([]*Record, error) {
+	h := &har.HAR{}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, errors.New("Invalid HAR file: %v", err)
+	}
+	records := make([]*Record, 0, len(h.Log.Entries))
+	for i, entry := range h.Log.Entries {
+		if entry.Request == nil {
+			return nil, errors.New("Entry %d has no request", i)
+		}
+		record := &Record{
+			Method: entry.Request.Method,
+			URL:    entry.Request.URL,
+			Header: make(http.Header),
+		}
+		if entry.StartedDateTime != "" {
+			started, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+			if err != nil {
+				return nil, errors.New("Invalid start time of entry %d: %v", i, err)
+			}
+			record.Time = started
+		}
+		for _, header := range entry.Request.Headers {
+			name := http.CanonicalHeaderKey(header.Name)
+			if skippedHeaders[name] || header.Value == har.Redacted || strings.HasPrefix(name, ":") {
+				continue
+			}
+			record.Header.Add(name, header.Value)
+		}
+		if postData := entry.Request.PostData; postData != nil {
+			record.Body = postData.Text
+			if strings.Contains(postData.Comment, "base64") {
+				body, err := base64.StdEncoding.DecodeString(postData.Text)
+				if err != nil {
+					return nil, errors.New("Invalid body of entry %d: %v", i, err)
+				}
+				record.Body = string(body)
+			}
+		}
+		if entry.Response != nil {
+			record.Status = entry.Response.Status
+			if entry.Response.Content != nil {
+				record.ResponseSize = entry.Response.Content.Size
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
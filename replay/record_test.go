@@ -0,0 +1,73 @@
+package replay
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/har"
+)
+
+func TestLoadJSONLines(t *testing.T) {
+	records, err := Load(strings.NewReader(`
+{"time": "2021-03-01T10:00:01Z", "method": "POST", "url": "http://example.com/b", "body": "data", "status": 201}
+{"time": "2021-03-01T10:00:00Z", "url": "http://example.com/a", "header": {"Accept": ["*/*"]}}
+
+{"method": "CONNECT", "url": "http://example.com:443"}
+`))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "http://example.com/a", records[0].URL)
+	assert.Equal(t, http.MethodGet, records[0].Method)
+	assert.Equal(t, time.Duration(0), records[0].Offset)
+	assert.Equal(t, "*/*", records[0].Header.Get("Accept"))
+	assert.Equal(t, "data", records[1].Body)
+	assert.Equal(t, 201, records[1].Status)
+	assert.Equal(t, time.Second, records[1].Offset)
+
+	_, err = Load(strings.NewReader(`{"url": "/relative"}`))
+	assert.Error(t, err)
+	_, err = Load(strings.NewReader("{\"url\": \"http://example.com\"}\nnot json"))
+	assert.Error(t, err)
+}
+
+func TestLoadHAR(t *testing.T) {
+	h := &har.HAR{Log: &har.Log{Version: har.Version, Entries: []*har.Entry{
+		{
+			StartedDateTime: "2021-03-01T10:00:00.250+01:00",
+			Request: &har.Request{
+				Method: http.MethodPut,
+				URL:    "https://example.com/upload",
+				Headers: []*har.NameValue{
+					{Name: "authorization", Value: har.Redacted},
+					{Name: "Content-Length", Value: "3"},
+					{Name: "Content-Type", Value: "application/octet-stream"},
+				},
+				PostData: &har.PostData{Text: "AAEC", Comment: "base64"},
+			},
+			Response: &har.Response{Status: 204, Content: &har.Content{}},
+		},
+		{
+			StartedDateTime: "2021-03-01T10:00:00.000+01:00",
+			Request:         &har.Request{Method: http.MethodGet, URL: "http://example.com/"},
+			Response:        &har.Response{Status: 200, Content: &har.Content{Size: 1234}},
+		},
+	}}}
+	data, err := json.Marshal(h)
+	require.NoError(t, err)
+
+	records, err := Load(strings.NewReader(string(data)))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "http://example.com/", records[0].URL)
+	assert.Equal(t, int64(1234), records[0].ResponseSize)
+	assert.Equal(t, 250*time.Millisecond, records[1].Offset)
+	assert.Equal(t, http.Header{"Content-Type": {"application/octet-stream"}}, records[1].Header, "redacted and hop-by-hop headers should be skipped")
+	assert.Equal(t, "\x00\x01\x02", records[1].Body)
+	assert.Equal(t, 204, records[1].Status)
+}
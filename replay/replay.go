@@ -0,0 +1,222 @@
+// Package replay replays recorded requests against a running proxy and
+// reports how it performed, for catching performance regressions before a
+// rollout. Requests are sent through the proxy to local stand-in origins (see
+// StandIn) instead of the recorded ones, so that results don't depend on the
+// internet.
+package replay
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	defaultConcurrency = 10
+	defaultTimeout     = 30 * time.Second
+)
+
+var (
+	log = golog.LoggerFor("replay")
+)
+
+// Opts configures a replay.
+type Opts struct {
+	// Proxy is the address of the proxy, like "localhost:8080".
+	Proxy string
+
+	// Concurrency caps the number of requests in flight. Defaults to 10.
+	Concurrency int
+
+	// TimeScale scales the recorded spacing of requests. 1 replays them at the
+	// recorded pace, 0.5 twice as fast and 0 as fast as possible.
+	TimeScale float64
+
+	// Origins maps recorded hosts (without port) to the addresses of stand-in
+	// origins to send their requests to instead. "*" matches all hosts.
+	// Requests for hosts without a stand-in are sent to the recorded origin.
+	Origins map[string]string
+
+	// Timeout limits how long each request may take. Defaults to 30 seconds.
+	Timeout time.Duration
+
+	// Transport sends the requests. Defaults to an http.Transport using Proxy.
+	Transport http.RoundTripper
+}
+
+// ParseOrigins parses a comma separated list of host=address pairs, like
+// "example.com=127.0.0.1:9000,*=127.0.0.1:9001".
+func ParseOrigins(s string) (map[string]string, error) {
+	origins := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		hostAndAddr := strings.SplitN(part, "=", 2)
+		if len(hostAndAddr) != 2 || hostAndAddr[0] == "" {
+			return nil, errors.New("Invalid origin %q, expected host=address", part)
+		}
+		if _, _, err := net.SplitHostPort(hostAndAddr[1]); err != nil {
+			return nil, errors.New("Invalid origin address %q: %v", hostAndAddr[1], err)
+		}
+		origins[strings.ToLower(hostAndAddr[0])] = hostAndAddr[1]
+	}
+	return origins, nil
+}
+
+// Run replays records until they're all done or ctx is done.
+func Run(ctx context.Context, opts *Opts, records []*Record) (*Report, error) {
+	o := *opts
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultConcurrency
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+	if o.TimeScale < 0 {
+		return nil, errors.New("Invalid time scale %v", o.TimeScale)
+	}
+	if o.Transport == nil {
+		if o.Proxy == "" {
+			return nil, errors.New("No proxy given")
+		}
+		proxyURL := &url.URL{Scheme: "http", Host: o.Proxy}
+		transport := &http.Transport{
+			Proxy:               http.ProxyURL(proxyURL),
+			MaxIdleConnsPerHost: o.Concurrency,
+			DisableCompression:  true,
+		}
+		defer transport.CloseIdleConnections()
+		o.Transport = transport
+	}
+
+	report := newReport()
+	queue := make(chan *Record)
+	var wg sync.WaitGroup
+	for i := 0; i < o.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range queue {
+				report.add(send(ctx, &o, record))
+			}
+		}()
+	}
+
+	start := time.Now()
+	report.start(start)
+	timer := time.NewTimer(0)
+	<-timer.C
+dispatch:
+	for _, record := range records {
+		due := start.Add(time.Duration(float64(record.Offset) * o.TimeScale))
+		if wait := time.Until(due); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+		select {
+		case queue <- record:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+	report.finish(time.Now())
+	return report, ctx.Err()
+}
+
+// result is the outcome of a single request.
+type result struct {
+	latency time.Duration
+	status  int
+	bytes   int64
+	err     error
+
+	// mismatch is set if the status differs from the recorded one
+	mismatch bool
+}
+
+func send(ctx context.Context, opts *Opts, record *Record) *result {
+	req, err := newRequest(opts, record)
+	if err != nil {
+		return &result{err: err}
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := opts.Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		log.Debugf("%v %v failed: %v", record.Method, record.URL, err)
+		return &result{latency: time.Since(start), err: err}
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	r := &result{
+		latency:  time.Since(start),
+		status:   resp.StatusCode,
+		bytes:    n,
+		err:      err,
+		mismatch: record.Status > 0 && record.Status != resp.StatusCode,
+	}
+	if r.mismatch {
+		log.Debugf("%v %v returned %d instead of %d", record.Method, record.URL, resp.StatusCode, record.Status)
+	}
+	return r
+}
+
+// newRequest creates the request for record, sent to the record's stand-in
+// origin if it has one. The proxy routes by the Host header, so the recorded
+// host is passed along in HostHeader instead.
+func newRequest(opts *Opts, record *Record) (*http.Request, error) {
+	var body io.Reader
+	if record.Body != "" {
+		body = strings.NewReader(record.Body)
+	}
+	req, err := http.NewRequest(record.Method, record.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range record.Header {
+		if skippedHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	host := strings.ToLower(req.URL.Hostname())
+	origin, found := opts.Origins[host]
+	if !found {
+		origin, found = opts.Origins["*"]
+	}
+	if found {
+		req.Header.Set(HostHeader, req.URL.Host)
+		req.Host = origin
+		req.URL.Host = origin
+		req.URL.Scheme = "http"
+		if record.Status > 0 {
+			req.Header.Set(StatusHeader, strconv.Itoa(record.Status))
+		}
+		if record.ResponseSize > 0 {
+			req.Header.Set(SizeHeader, strconv.FormatInt(record.ResponseSize, 10))
+		}
+	}
+	return req, nil
+}
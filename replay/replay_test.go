@@ -0,0 +1,108 @@
+package replay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOrigins(t *testing.T) {
+	origins, err := ParseOrigins("Example.com=127.0.0.1:9000, *=127.0.0.1:9001")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"example.com": "127.0.0.1:9000", "*": "127.0.0.1:9001"}, origins)
+	for _, invalid := range []string{"example.com", "=127.0.0.1:9000", "example.com=127.0.0.1"} {
+		_, err := ParseOrigins(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRun(t *testing.T) {
+	standIn := httptest.NewServer(StandIn)
+	defer standIn.Close()
+	hosts := make(chan string, 10)
+	other := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		hosts <- req.Header.Get(HostHeader)
+		resp.WriteHeader(http.StatusTeapot)
+	}))
+	defer other.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	p, err := proxy.New(&proxy.Opts{})
+	require.NoError(t, err)
+	go p.Serve(l)
+
+	records := Merge([]*Record{
+		{Method: http.MethodGet, URL: "http://example.com/a", Status: 200, ResponseSize: 100000},
+		{Method: http.MethodPost, URL: "https://example.com/b", Body: "data", Status: 201, Time: time.Unix(0, 0)},
+		{Method: http.MethodGet, URL: "http://example.com/c", Status: 500, Time: time.Unix(0, int64(200*time.Millisecond))},
+		{Method: http.MethodGet, URL: "http://other.org/", Status: 200, Time: time.Unix(0, int64(400*time.Millisecond))},
+	})
+	start := time.Now()
+	report, err := Run(context.Background(), &Opts{
+		Proxy:     l.Addr().String(),
+		TimeScale: 0.5,
+		Origins: map[string]string{
+			"*":         standIn.Listener.Addr().String(),
+			"other.org": other.Listener.Addr().String(),
+		},
+	}, records)
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "recorded spacing should be scaled")
+	assert.Equal(t, "other.org", <-hosts, "stand-in should get the recorded host")
+
+	assert.Equal(t, 4, report.Requests())
+	assert.Equal(t, 0, report.Failed())
+	assert.Equal(t, 1, report.Mismatched())
+	assert.Equal(t, 0.25, report.ErrorRate())
+	assert.Equal(t, map[int]int{200: 1, 201: 1, 500: 1, 418: 1}, report.Statuses())
+	assert.True(t, report.Percentile(50) > 0)
+	assert.True(t, report.Percentile(50) <= report.Percentile(99))
+	assert.True(t, report.Throughput() > 0)
+	assert.True(t, report.BytesPerSecond() > 0)
+	summary := report.Summary()
+	assert.Equal(t, 4, summary.Requests)
+	assert.Contains(t, summary.Latency, "p99")
+	assert.Contains(t, summary.Latency, "max")
+}
+
+func TestRunFailures(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	report, err := Run(context.Background(), &Opts{Proxy: addr, Concurrency: 2}, []*Record{
+		{Method: http.MethodGet, URL: "http://example.com/"},
+		{Method: http.MethodGet, URL: "http://example.com/"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Failed())
+	assert.Equal(t, 1.0, report.ErrorRate())
+	assert.Equal(t, time.Duration(0), report.Percentile(99))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Run(ctx, &Opts{Proxy: addr}, []*Record{{Method: http.MethodGet, URL: "http://example.com/", Offset: time.Hour}})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestPercentile(t *testing.T) {
+	r := newReport()
+	for i := 1; i <= 100; i++ {
+		r.add(&result{latency: time.Duration(101-i) * time.Millisecond, status: 200})
+	}
+	r.finish(time.Now())
+	assert.Equal(t, 50*time.Millisecond, r.Percentile(50))
+	assert.Equal(t, 99*time.Millisecond, r.Percentile(99))
+	assert.Equal(t, 100*time.Millisecond, r.Percentile(100))
+	assert.Equal(t, 1*time.Millisecond, r.Percentile(0))
+}
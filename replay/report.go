@@ -0,0 +1,212 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Report summarizes a replay.
+type Report struct {
+	mx        sync.Mutex
+	started   time.Time
+	elapsed   time.Duration
+	latencies []time.Duration
+	requests  int
+	failed    int
+	mismatch  int
+	statuses  map[int]int
+	bytes     int64
+}
+
+func newReport() *Report {
+	return &Report{statuses: make(map[int]int)}
+}
+
+func (r *Report) start(t time.Time) {
+	r.started = t
+}
+
+func (r *Report) finish(t time.Time) {
+	r.mx.Lock()
+	r.elapsed = t.Sub(r.started)
+	sort.Slice(r.latencies, func(i, j int) bool {
+		return r.latencies[i] < r.latencies[j]
+	})
+	r.mx.Unlock()
+}
+
+func (r *Report) add(res *result) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.requests++
+	r.bytes += res.bytes
+	if res.status > 0 {
+		r.statuses[res.status]++
+	}
+	if res.mismatch {
+		r.mismatch++
+	}
+	if res.err != nil {
+		r.failed++
+		return
+	}
+	r.latencies = append(r.latencies, res.latency)
+}
+
+// Requests is the number of requests sent.
+func (r *Report) Requests() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.requests
+}
+
+// Failed is the number of requests that didn't get a complete response.
+func (r *Report) Failed() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.failed
+}
+
+// Mismatched is the number of responses whose status differed from the
+// recorded one.
+func (r *Report) Mismatched() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.mismatch
+}
+
+// ErrorRate is the fraction of requests that failed or whose response status
+// differed from the recorded one.
+func (r *Report) ErrorRate() float64 {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.requests == 0 {
+		return 0
+	}
+	return float64(r.failed+r.mismatch) / float64(r.requests)
+}
+
+// Statuses counts responses by status code.
+func (r *Report) Statuses() map[int]int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	statuses := make(map[int]int, len(r.statuses))
+	for status, count := range r.statuses {
+		statuses[status] = count
+	}
+	return statuses
+}
+
+// Percentile returns the latency below which the given percentage of complete
+// responses were received, like 99 for the 99th percentile.
+func (r *Report) Percentile(p float64) time.Duration {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	// nearest rank
+	rank := int(math.Ceil(p / 100 * float64(len(r.latencies))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(r.latencies) {
+		rank = len(r.latencies)
+	}
+	return r.latencies[rank-1]
+}
+
+// Elapsed is how long the replay took.
+func (r *Report) Elapsed() time.Duration {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.elapsed
+}
+
+// Throughput is the number of requests per second.
+func (r *Report) Throughput() float64 {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(r.requests) / r.elapsed.Seconds()
+}
+
+// BytesPerSecond is the number of response body bytes received per second.
+func (r *Report) BytesPerSecond() float64 {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(r.bytes) / r.elapsed.Seconds()
+}
+
+// Summary is a report in a form suitable for JSON.
+type Summary struct {
+	Requests       int            `json:"requests"`
+	Failed         int            `json:"failed"`
+	Mismatched     int            `json:"mismatched"`
+	ErrorRate      float64        `json:"error_rate"`
+	ElapsedSeconds float64        `json:"elapsed_seconds"`
+	Throughput     float64        `json:"requests_per_second"`
+	BytesPerSecond float64        `json:"bytes_per_second"`
+	Latency        map[string]int `json:"latency_ms"`
+	Statuses       map[int]int    `json:"statuses"`
+}
+
+var percentiles = []float64{50, 90, 95, 99, 100}
+
+// Summary summarizes the report.
+func (r *Report) Summary() *Summary {
+	s := &Summary{
+		Requests:       r.Requests(),
+		Failed:         r.Failed(),
+		Mismatched:     r.Mismatched(),
+		ErrorRate:      r.ErrorRate(),
+		ElapsedSeconds: r.Elapsed().Seconds(),
+		Throughput:     r.Throughput(),
+		BytesPerSecond: r.BytesPerSecond(),
+		Latency:        make(map[string]int, len(percentiles)),
+		Statuses:       r.Statuses(),
+	}
+	for _, p := range percentiles {
+		s.Latency[percentileName(p)] = int(r.Percentile(p) / time.Millisecond)
+	}
+	return s
+}
+
+func percentileName(p float64) string {
+	if p == 100 {
+		return "max"
+	}
+	return fmt.Sprintf("p%v", p)
+}
+
+// Print writes a human readable summary to w.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "Requests:    %d in %v\n", r.Requests(), r.Elapsed().Round(time.Millisecond))
+	fmt.Fprintf(w, "Throughput:  %.1f requests/s, %.1f KiB/s\n", r.Throughput(), r.BytesPerSecond()/1024)
+	fmt.Fprintf(w, "Error rate:  %.2f%% (%d failed, %d unexpected status)\n", r.ErrorRate()*100, r.Failed(), r.Mismatched())
+	fmt.Fprint(w, "Latency:    ")
+	for _, p := range percentiles {
+		fmt.Fprintf(w, " %v=%v", percentileName(p), r.Percentile(p).Round(time.Microsecond))
+	}
+	fmt.Fprintln(w)
+	statuses := r.Statuses()
+	codes := make([]int, 0, len(statuses))
+	for status := range statuses {
+		codes = append(codes, status)
+	}
+	sort.Ints(codes)
+	fmt.Fprint(w, "Statuses:   ")
+	for _, status := range codes {
+		fmt.Fprintf(w, " %d=%d", status, statuses[status])
+	}
+	fmt.Fprintln(w)
+}
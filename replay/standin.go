@@ -0,0 +1,55 @@
+package replay
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	// StatusHeader tells a StandIn which status to respond with.
+	StatusHeader = "X-Replay-Status"
+
+	// SizeHeader tells a StandIn how large a body to respond with.
+	SizeHeader = "X-Replay-Size"
+
+	// HostHeader carries the recorded host of requests sent to a StandIn.
+	HostHeader = "X-Replay-Host"
+
+	maxStandInSize = 64 * 1024 * 1024
+)
+
+var filler = make([]byte, 32*1024)
+
+// StandIn is an origin that stands in for recorded origins. It responds with
+// the status and body size given by StatusHeader and SizeHeader, which replays
+// set from the recorded responses, or 200 OK and an empty body.
+var StandIn = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+	status, err := strconv.Atoi(req.Header.Get(StatusHeader))
+	if err != nil || status < 200 || status > 599 {
+		status = http.StatusOK
+	}
+	size, err := strconv.ParseInt(req.Header.Get(SizeHeader), 10, 64)
+	if err != nil || size < 0 {
+		size = 0
+	}
+	if size > maxStandInSize {
+		size = maxStandInSize
+	}
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		size = 0
+	}
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	resp.WriteHeader(status)
+	for size > 0 && req.Method != http.MethodHead {
+		chunk := filler
+		if int64(len(chunk)) > size {
+			chunk = chunk[:size]
+		}
+		n, err := resp.Write(chunk)
+		if err != nil {
+			return
+		}
+		size -= int64(n)
+	}
+})
@@ -0,0 +1,420 @@
+// Package resolver provides a caching DNS resolver that is shared by the dial
+// path and by filters (like BlockLocal) so that a given host is only resolved
+// once per TTL.
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultTimeout     = 5 * time.Second
+	defaultMaxTTL      = 1 * time.Hour
+	defaultNegativeTTL = 30 * time.Second
+	defaultSystemTTL   = 1 * time.Minute
+	defaultMaxEntries  = 10000
+)
+
+var (
+	log = golog.LoggerFor("resolver")
+)
+
+// Opts are used to configure a Resolver
+type Opts struct {
+	// Servers are the upstream DNS servers to query, tried in order until one
+	// of them answers. Supported forms are:
+	//
+	//   8.8.8.8, 8.8.8.8:53 or udp://8.8.8.8:53 - plain DNS over UDP (falls back
+	//                                              to TCP on truncation)
+	//   tcp://8.8.8.8:53                         - plain DNS over TCP
+	//   tls://1.1.1.1:853                        - DNS-over-TLS (RFC 7858)
+	//   https://1.1.1.1/dns-query                - DNS-over-HTTPS (RFC 8484)
+	//
+	// If empty, the system resolver is used, though results are still cached.
+	Servers []string
+
+	// Hosts are static overrides mapping host names to IP addresses. These take
+	// precedence over anything returned from upstream.
+	Hosts map[string][]string
+
+	// Timeout bounds how long to wait for each upstream server. Defaults to 5
+	// seconds.
+	Timeout time.Duration
+
+	// MinTTL and MaxTTL clamp the TTLs returned by upstream servers. MaxTTL
+	// defaults to 1 hour.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// NegativeTTL is how long to cache failed lookups (NXDOMAIN or no records).
+	// If the upstream includes an SOA record, its negative TTL is used instead
+	// as long as it is smaller. Defaults to 30 seconds.
+	NegativeTTL time.Duration
+
+	// SystemTTL is how long to cache results from the system resolver, which
+	// doesn't tell us the real TTL. Defaults to 1 minute.
+	SystemTTL time.Duration
+
+	// MaxEntries caps the number of cached hosts. Defaults to 10000.
+	MaxEntries int
+
+	// TLSConfig, if specified, is used as the basis for DNS-over-TLS and
+	// DNS-over-HTTPS connections.
+	TLSConfig *tls.Config
+}
+
+// Resolver is a caching DNS resolver. It is safe for concurrent use.
+type Resolver struct {
+	opts      Opts
+	upstreams []upstream
+	hosts     map[string][]net.IP
+	cache     *lru.Cache
+	now       func() time.Time
+
+	pending   map[string]*lookup
+	pendingMx sync.Mutex
+}
+
+type entry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type lookup struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// New constructs a new Resolver using the given options.
+func New(opts *Opts) (*Resolver, error) {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	r := &Resolver{
+		opts:    *opts,
+		hosts:   make(map[string][]net.IP, len(opts.Hosts)),
+		now:     time.Now,
+		pending: make(map[string]*lookup),
+	}
+	if r.opts.Timeout <= 0 {
+		r.opts.Timeout = defaultTimeout
+	}
+	if r.opts.MaxTTL <= 0 {
+		r.opts.MaxTTL = defaultMaxTTL
+	}
+	if r.opts.NegativeTTL <= 0 {
+		r.opts.NegativeTTL = defaultNegativeTTL
+	}
+	if r.opts.SystemTTL <= 0 {
+		r.opts.SystemTTL = defaultSystemTTL
+	}
+	if r.opts.MaxEntries <= 0 {
+		r.opts.MaxEntries = defaultMaxEntries
+	}
+	r.cache, _ = lru.New(r.opts.MaxEntries)
+
+	for host, addrs := range opts.Hosts {
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, errors.New("Invalid IP address %v for host %v", addr, host)
+			}
+			ips = append(ips, ip)
+		}
+		r.hosts[normalize(host)] = ips
+	}
+
+	for _, server := range opts.Servers {
+		u, err := parseUpstream(server, r.opts.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+
+	return r, nil
+}
+
+// LookupIP resolves the given host to its IP addresses, consulting the static
+// hosts and the cache before querying upstream. IP literals are returned as is.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := normalize(host)
+	if ips, found := r.hosts[name]; found {
+		return ips, nil
+	}
+
+	if cached, found := r.cache.Get(name); found {
+		e := cached.(*entry)
+		if r.now().Before(e.expires) {
+			return e.ips, e.err
+		}
+	}
+
+	// Make sure that concurrent lookups for the same host only hit upstream once
+	r.pendingMx.Lock()
+	l, found := r.pending[name]
+	if !found {
+		l = &lookup{done: make(chan struct{})}
+		r.pending[name] = l
+		go r.doLookup(name, l)
+	}
+	r.pendingMx.Unlock()
+
+	select {
+	case <-l.done:
+		return l.ips, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// LookupIPAddr is like LookupIP but returns net.IPAddrs, mirroring
+// net.Resolver.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+// Dial resolves the host in addr using this Resolver and dials the resulting
+// IP addresses in order until one of them succeeds.
+func (r *Resolver) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	var lastErr error
+	for _, ip := range ips {
+		conn, dialErr := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if dialErr == nil {
+			return conn, nil
+		}
+		lastErr = dialErr
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// Flush removes all cached entries.
+func (r *Resolver) Flush() {
+	r.cache.Purge()
+}
+
+func (r *Resolver) doLookup(name string, l *lookup) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout*time.Duration(len(r.upstreams)+1))
+	defer cancel()
+
+	var ttl time.Duration
+	if len(r.upstreams) == 0 {
+		l.ips, ttl, l.err = r.lookupSystem(ctx, name)
+	} else {
+		l.ips, ttl, l.err = r.lookupUpstream(ctx, name)
+	}
+	if ttl > 0 {
+		r.cache.Add(name, &entry{ips: l.ips, err: l.err, expires: r.now().Add(ttl)})
+	}
+
+	r.pendingMx.Lock()
+	delete(r.pending, name)
+	r.pendingMx.Unlock()
+	close(l.done)
+}
+
+func (r *Resolver) lookupSystem(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, r.opts.NegativeTTL, err
+		}
+		// Don't cache transient errors
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, r.clampTTL(r.opts.SystemTTL), nil
+}
+
+func (r *Resolver) lookupUpstream(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, u := range r.upstreams {
+		ips, ttl, err := r.queryUpstream(ctx, u, name)
+		if err == nil || isNotFound(err) {
+			return ips, ttl, err
+		}
+		log.Debugf("Unable to resolve %v using %v: %v", name, u, err)
+		lastErr = err
+	}
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true}
+}
+
+// queryUpstream queries A and AAAA records for name in parallel.
+func (r *Resolver) queryUpstream(ctx context.Context, u upstream, name string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	defer cancel()
+
+	type result struct {
+		ips         []net.IP
+		ttl         time.Duration
+		negativeTTL time.Duration
+		rcode       dnsmessage.RCode
+		err         error
+	}
+	results := make(chan *result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			res := &result{}
+			res.ips, res.ttl, res.negativeTTL, res.rcode, res.err = r.query(ctx, u, name, qtype)
+			results <- res
+		}(qtype)
+	}
+
+	var ips []net.IP
+	ttl := r.opts.MaxTTL
+	negativeTTL := r.opts.NegativeTTL
+	notFound := 0
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			return nil, 0, res.err
+		}
+		switch res.rcode {
+		case dnsmessage.RCodeSuccess:
+			// okay
+		case dnsmessage.RCodeNameError:
+			notFound++
+		default:
+			return nil, 0, errors.New("%v returned %v", u, res.rcode)
+		}
+		ips = append(ips, res.ips...)
+		if len(res.ips) > 0 && res.ttl < ttl {
+			ttl = res.ttl
+		}
+		if res.negativeTTL > 0 && res.negativeTTL < negativeTTL {
+			negativeTTL = res.negativeTTL
+		}
+	}
+
+	if len(ips) == 0 {
+		err := &net.DNSError{Err: "no such host", Name: name, Server: u.String(), IsNotFound: true}
+		if notFound == 0 {
+			err.Err = "no suitable address found"
+		}
+		return nil, negativeTTL, err
+	}
+	return ips, r.clampTTL(ttl), nil
+}
+
+func (r *Resolver) query(ctx context.Context, u upstream, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, time.Duration, dnsmessage.RCode, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, 0, 0, errors.New("Invalid host name %v: %v", name, err)
+	}
+	id := uint16(rand.Int())
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := q.Pack()
+	if err != nil {
+		return nil, 0, 0, 0, errors.New("Unable to pack DNS query: %v", err)
+	}
+
+	b, err = u.exchange(ctx, b)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(b); err != nil {
+		return nil, 0, 0, 0, errors.New("Unable to unpack DNS response from %v: %v", u, err)
+	}
+	if resp.ID != id || !resp.Response {
+		return nil, 0, 0, 0, errors.New("Mismatched DNS response from %v", u)
+	}
+
+	var ips []net.IP
+	var ttl, negativeTTL time.Duration
+	for _, answer := range resp.Answers {
+		var ip net.IP
+		switch rr := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(rr.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(rr.AAAA[:])
+		default:
+			// CNAMEs and the like, the recursive server has already followed them
+			continue
+		}
+		answerTTL := time.Duration(answer.Header.TTL) * time.Second
+		if len(ips) == 0 || answerTTL < ttl {
+			ttl = answerTTL
+		}
+		ips = append(ips, ip)
+	}
+	for _, authority := range resp.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			// Per RFC 2308, the negative TTL is the minimum of the SOA's TTL and its
+			// MINIMUM field.
+			negativeTTL = time.Duration(authority.Header.TTL) * time.Second
+			if min := time.Duration(soa.MinTTL) * time.Second; min < negativeTTL {
+				negativeTTL = min
+			}
+		}
+	}
+	return ips, ttl, negativeTTL, resp.RCode, nil
+}
+
+func (r *Resolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < r.opts.MinTTL {
+		ttl = r.opts.MinTTL
+	}
+	if ttl > r.opts.MaxTTL {
+		ttl = r.opts.MaxTTL
+	}
+	return ttl
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,406 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCaching(t *testing.T) {
+	s := newDNSServer(t)
+	defer s.Close()
+
+	r, now := newTestResolver(t, &Opts{Servers: []string{s.udpAddr}})
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"}, sorted(ips))
+	assert.EqualValues(t, 2, s.Queries(), "should have queried A and AAAA")
+
+	_, err = r.LookupIP(context.Background(), "EXAMPLE.com.")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, s.Queries(), "second lookup should be served from cache")
+
+	now.Add(59 * time.Second)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, s.Queries(), "cache entry should still be valid")
+
+	now.Add(2 * time.Second)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, s.Queries(), "cache entry should have expired after TTL")
+}
+
+func TestNegativeCaching(t *testing.T) {
+	s := newDNSServer(t)
+	defer s.Close()
+
+	r, now := newTestResolver(t, &Opts{Servers: []string{s.udpAddr}, NegativeTTL: 20 * time.Second})
+	_, err := r.LookupIP(context.Background(), "doesnotexist.com")
+	if assert.Error(t, err) {
+		dnsErr, ok := err.(*net.DNSError)
+		if assert.True(t, ok) {
+			assert.True(t, dnsErr.IsNotFound)
+		}
+	}
+	assert.EqualValues(t, 2, s.Queries())
+
+	_, err = r.LookupIP(context.Background(), "doesnotexist.com")
+	assert.Error(t, err)
+	assert.EqualValues(t, 2, s.Queries(), "failure should have been cached")
+
+	// The SOA in the test zone has a MINIMUM of 10 seconds, which is smaller than
+	// our NegativeTTL.
+	now.Add(11 * time.Second)
+	_, err = r.LookupIP(context.Background(), "doesnotexist.com")
+	assert.Error(t, err)
+	assert.EqualValues(t, 4, s.Queries(), "negative entry should have expired")
+}
+
+func TestStaticHosts(t *testing.T) {
+	s := newDNSServer(t)
+	defer s.Close()
+
+	r, _ := newTestResolver(t, &Opts{
+		Servers: []string{s.udpAddr},
+		Hosts:   map[string][]string{"Example.com": {"10.0.0.1"}},
+	})
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, sorted(ips))
+	assert.EqualValues(t, 0, s.Queries())
+
+	ips, err = r.LookupIP(context.Background(), "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, sorted(ips))
+
+	_, err = New(&Opts{Hosts: map[string][]string{"bad": {"notanip"}}})
+	assert.Error(t, err)
+}
+
+func TestTruncatedFallsBackToTCP(t *testing.T) {
+	s := newDNSServer(t, func(s *dnsServer) { s.truncateUDP = true })
+	defer s.Close()
+
+	r, _ := newTestResolver(t, &Opts{Servers: []string{"udp://" + s.udpAddr}})
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Len(t, ips, 2)
+	assert.EqualValues(t, 2, atomic.LoadInt64(&s.tcpQueries))
+}
+
+func TestTCP(t *testing.T) {
+	s := newDNSServer(t)
+	defer s.Close()
+
+	r, _ := newTestResolver(t, &Opts{Servers: []string{"tcp://" + s.tcpAddr}})
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Len(t, ips, 2)
+	assert.EqualValues(t, 2, atomic.LoadInt64(&s.tcpQueries))
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	s := newDNSServer(t)
+	defer s.Close()
+
+	r, _ := newTestResolver(t, &Opts{
+		Servers:   []string{"tls://" + s.tlsAddr},
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Len(t, ips, 2)
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	s := newDNSServer(t)
+	defer s.Close()
+
+	r, _ := newTestResolver(t, &Opts{
+		Servers:   []string{s.dohURL},
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Len(t, ips, 2)
+}
+
+func TestFailover(t *testing.T) {
+	s := newDNSServer(t)
+	defer s.Close()
+
+	// Nothing listens on this port, so the first server will fail
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	r, _ := newTestResolver(t, &Opts{Servers: []string{"tcp://" + deadAddr, s.udpAddr}})
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Len(t, ips, 2)
+}
+
+func TestConcurrentLookupsCoalesced(t *testing.T) {
+	s := newDNSServer(t, func(s *dnsServer) { s.delay = 50 * time.Millisecond })
+	defer s.Close()
+
+	r, _ := newTestResolver(t, &Opts{Servers: []string{s.udpAddr}})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.LookupIP(context.Background(), "example.com")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 2, s.Queries())
+}
+
+func TestDial(t *testing.T) {
+	s := newDNSServer(t)
+	defer s.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	r, _ := newTestResolver(t, &Opts{Servers: []string{s.udpAddr}})
+	client := &http.Client{Transport: &http.Transport{DialContext: r.Dial}}
+	resp, err := client.Get("http://localtest.me:" + port)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body))
+	assert.EqualValues(t, 2, s.Queries())
+}
+
+type fakeClock struct {
+	mx  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mx.Lock()
+	c.now = c.now.Add(d)
+	c.mx.Unlock()
+}
+
+func newTestResolver(t *testing.T, opts *Opts) (*Resolver, *fakeClock) {
+	r, err := New(opts)
+	require.NoError(t, err)
+	clock := &fakeClock{now: time.Now()}
+	r.now = clock.Now
+	return r, clock
+}
+
+func sorted(ips []net.IP) []string {
+	result := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			result = append(result, ip.String())
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			result = append(result, ip.String())
+		}
+	}
+	return result
+}
+
+// dnsServer is a minimal in-process authoritative DNS server for testing,
+// serving over UDP, TCP, TLS and HTTPS.
+type dnsServer struct {
+	t           *testing.T
+	udp         net.PacketConn
+	tcp         net.Listener
+	tls         net.Listener
+	doh         *httptest.Server
+	udpAddr     string
+	tcpAddr     string
+	tlsAddr     string
+	dohURL      string
+	truncateUDP bool
+	delay       time.Duration
+	queries     int64
+	tcpQueries  int64
+}
+
+func newDNSServer(t *testing.T, configure ...func(s *dnsServer)) *dnsServer {
+	s := &dnsServer{t: t}
+	for _, c := range configure {
+		c(s)
+	}
+	var err error
+	// Listen for UDP and TCP on the same port so that truncated UDP responses
+	// can be retried over TCP.
+	for i := 0; i < 10; i++ {
+		s.tcp, err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		s.udp, err = net.ListenPacket("udp", s.tcp.Addr().String())
+		if err == nil {
+			break
+		}
+		s.tcp.Close()
+	}
+	require.NoError(t, err)
+	s.udpAddr = s.udp.LocalAddr().String()
+	s.tcpAddr = s.tcp.Addr().String()
+
+	s.doh = httptest.NewUnstartedServer(http.HandlerFunc(s.serveDoH))
+	s.doh.StartTLS()
+	s.dohURL = s.doh.URL + "/dns-query"
+	s.tls, err = tls.Listen("tcp", "127.0.0.1:0", s.doh.TLS)
+	require.NoError(t, err)
+	s.tlsAddr = s.tls.Addr().String()
+
+	go s.serveUDP()
+	go s.serveStream(s.tcp, &s.tcpQueries)
+	go s.serveStream(s.tls, nil)
+	return s
+}
+
+func (s *dnsServer) Queries() int64 {
+	return atomic.LoadInt64(&s.queries)
+}
+
+func (s *dnsServer) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+	s.tls.Close()
+	s.doh.Close()
+}
+
+func (s *dnsServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := s.answer(buf[:n], s.truncateUDP)
+		s.udp.WriteTo(resp, addr)
+	}
+}
+
+func (s *dnsServer) serveStream(l net.Listener, counter *int64) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			if counter != nil {
+				atomic.AddInt64(counter, 1)
+			}
+			resp := s.answer(query, false)
+			binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+			conn.Write(append(length[:], resp...))
+		}()
+	}
+}
+
+func (s *dnsServer) serveDoH(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dnsMessageContentType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	query, _ := ioutil.ReadAll(req.Body)
+	w.Header().Set("Content-Type", dnsMessageContentType)
+	w.Write(s.answer(query, false))
+}
+
+func (s *dnsServer) answer(query []byte, truncate bool) []byte {
+	time.Sleep(s.delay)
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil || len(q.Questions) != 1 {
+		s.t.Errorf("Invalid query: %v", err)
+		return nil
+	}
+	if !truncate {
+		// Truncated responses don't count since they get retried over TCP
+		atomic.AddInt64(&s.queries, 1)
+	}
+	question := q.Questions[0]
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 q.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   q.RecursionDesired,
+			RecursionAvailable: true,
+			Truncated:          truncate,
+		},
+		Questions: q.Questions,
+	}
+	if truncate {
+		b, _ := resp.Pack()
+		return b
+	}
+
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	switch question.Name.String() {
+	case "example.com.":
+		if question.Type == dnsmessage.TypeA {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: [4]byte{93, 184, 216, 34}}})
+		} else if question.Type == dnsmessage.TypeAAAA {
+			var aaaa [16]byte
+			copy(aaaa[:], net.ParseIP("2606:2800:220:1:248:1893:25c8:1946"))
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: aaaa}})
+		}
+	case "localtest.me.":
+		if question.Type == dnsmessage.TypeA {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}})
+		}
+	default:
+		resp.RCode = dnsmessage.RCodeNameError
+		zone := dnsmessage.MustNewName("com.")
+		resp.Authorities = append(resp.Authorities, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 900},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.com."),
+				MBox:   dnsmessage.MustNewName("admin.com."),
+				MinTTL: 10,
+			},
+		})
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		s.t.Errorf("Unable to pack response: %v", err)
+	}
+	return b
+}
@@ -0,0 +1,203 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsMessageContentType = "application/dns-message"
+	maxMessageSize        = 65535
+)
+
+// upstream is a DNS server that we can exchange messages with.
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+func parseUpstream(server string, tlsConfig *tls.Config) (upstream, error) {
+	server = strings.TrimSpace(server)
+	scheme := "udp"
+	addr := server
+	if idx := strings.Index(server, "://"); idx > 0 {
+		scheme = strings.ToLower(server[:idx])
+		addr = server[idx+3:]
+	}
+
+	switch scheme {
+	case "udp":
+		return &udpUpstream{addr: withDefaultPort(addr, "53")}, nil
+	case "tcp":
+		return &tcpUpstream{addr: withDefaultPort(addr, "53")}, nil
+	case "tls":
+		addr = withDefaultPort(addr, "853")
+		host, _, _ := net.SplitHostPort(addr)
+		cfg := &tls.Config{}
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		return &tcpUpstream{addr: addr, tlsConfig: cfg}, nil
+	case "https":
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, errors.New("Invalid DNS-over-HTTPS server %v: %v", server, err)
+		}
+		tr := &http.Transport{
+			Proxy:             nil,
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}
+		return &httpsUpstream{url: u.String(), client: &http.Client{Transport: tr}}, nil
+	default:
+		return nil, errors.New("Unsupported DNS server scheme %v in %v", scheme, server)
+	}
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// udpUpstream is a plain DNS server reached over UDP. If a response is
+// truncated, the query is retried over TCP as required by RFC 1035.
+type udpUpstream struct {
+	addr string
+}
+
+func (u *udpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(query)
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 || binary.BigEndian.Uint16(buf) != id {
+			// Not the response we're looking for, could be a stale or spoofed one
+			continue
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err == nil && h.Truncated {
+			log.Tracef("Response from %v truncated, retrying over TCP", u.addr)
+			return (&tcpUpstream{addr: u.addr}).exchange(ctx, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+// tcpUpstream is a DNS server reached over TCP, or over TLS if tlsConfig is
+// set. Messages are prefixed with their 2 byte length.
+type tcpUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func (u *tcpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if u.tlsConfig != nil {
+		tlsConn := tls.Client(conn, u.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, errors.New("TLS handshake with %v failed: %v", u.addr, err)
+		}
+		conn = tlsConn
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (u *tcpUpstream) String() string {
+	if u.tlsConfig != nil {
+		return "tls://" + u.addr
+	}
+	return "tcp://" + u.addr
+}
+
+// httpsUpstream is a DNS-over-HTTPS server.
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected response status from %v: %v", u.url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
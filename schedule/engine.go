@@ -0,0 +1,102 @@
+package schedule
+
+import (
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// Opts configures an Engine.
+type Opts struct {
+	// Schedules are the schedules by name.
+	Schedules map[string]*Schedule
+
+	// Now tells the time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Engine tells whether named schedules are active. It is safe for concurrent
+// use.
+type Engine struct {
+	schedules map[string]*Schedule
+	now       func() time.Time
+}
+
+// New creates an Engine.
+func New(opts *Opts) *Engine {
+	e := &Engine{
+		schedules: opts.Schedules,
+		now:       opts.Now,
+	}
+	if e.schedules == nil {
+		e.schedules = make(map[string]*Schedule)
+	}
+	if e.now == nil {
+		e.now = time.Now
+	}
+	return e
+}
+
+// ParseSchedules parses a semicolon separated list of named schedules of the
+// form name=spec (see Parse), like
+// "business=TZ=Europe/Berlin Mon-Fri 09:00-17:00; night=22:00-06:00".
+func ParseSchedules(s string) (map[string]*Schedule, error) {
+	schedules := make(map[string]*Schedule)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		nameAndSpec := strings.SplitN(part, "=", 2)
+		name := strings.TrimSpace(nameAndSpec[0])
+		if len(nameAndSpec) != 2 || name == "" {
+			return nil, errors.New("Invalid schedule %q, expected name=spec", part)
+		}
+		schedule, err := Parse(nameAndSpec[1])
+		if err != nil {
+			return nil, err
+		}
+		schedules[name] = schedule
+	}
+	return schedules, nil
+}
+
+// Check returns an error if any of the given schedule references (see
+// Active) names an unknown schedule.
+func (e *Engine) Check(refs ...string) error {
+	for _, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		if _, found := e.schedules[strings.TrimPrefix(ref, "!")]; !found {
+			return errors.New("Unknown schedule %v", strings.TrimPrefix(ref, "!"))
+		}
+	}
+	return nil
+}
+
+// Active checks whether the schedule referenced by ref is active now. A
+// reference is the name of a schedule, or the name prefixed with "!" for
+// whenever that schedule is not active. An empty reference is always active,
+// an unknown schedule never is.
+func (e *Engine) Active(ref string) bool {
+	if ref == "" {
+		return true
+	}
+	if e == nil {
+		return false
+	}
+	name := strings.TrimPrefix(ref, "!")
+	schedule, found := e.schedules[name]
+	if !found {
+		log.Debugf("Unknown schedule %v", name)
+		return false
+	}
+	return schedule.Active(e.now()) != (name != ref)
+}
+
+// Now returns the current time according to the engine's clock.
+func (e *Engine) Now() time.Time {
+	return e.now()
+}
@@ -0,0 +1,307 @@
+// Package schedule decides whether time-based policies are in effect. A
+// Schedule is a set of windows, each either a weekday/time-of-day range like
+// "Mon-Fri 09:00-17:00" or a cron-like expression like "* 9-16 * * 1-5"
+// (minute, hour, day of month, month and day of week) that is active during
+// every minute it matches, evaluated in a configurable time zone. An Engine
+// holds named schedules and tells the time with an injectable clock so that
+// filters can consult it on every request and tests are deterministic.
+package schedule
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+const (
+	// Blocked is the errorpages.Reason for requests blocked by a host rule.
+	Blocked errorpages.Reason = "rule-blocked"
+
+	// Throttled is the errorpages.Reason for requests rejected by a host
+	// rule's throttle.
+	Throttled errorpages.Reason = "rule-throttled"
+)
+
+var log = golog.LoggerFor("schedule")
+
+var weekdays = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+var months = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// Schedule is a set of windows in a time zone. It's active whenever any of its
+// windows is.
+type Schedule struct {
+	spec     string
+	location *time.Location
+	windows  []window
+}
+
+type window interface {
+	active(t time.Time) bool
+}
+
+// Parse parses a schedule. Windows are separated by "|" and the spec may
+// start with a time zone like "TZ=Europe/Berlin", otherwise times are UTC.
+// For example:
+//
+//	TZ=America/New_York Mon-Fri 09:00-17:00 | Sat 10:00-14:00
+//	22:00-06:00
+//	Sat,Sun
+//	*/15 9-17 * * mon-fri
+//
+// Time ranges include their start and exclude their end. Ranges that end
+// before they start, like 22:00-06:00, continue into the next day.
+func Parse(spec string) (*Schedule, error) {
+	s := &Schedule{spec: strings.TrimSpace(spec), location: time.UTC}
+	rest := s.spec
+	if strings.HasPrefix(strings.ToUpper(rest), "TZ=") {
+		fields := strings.SplitN(rest, " ", 2)
+		location, err := time.LoadLocation(fields[0][3:])
+		if err != nil {
+			return nil, errors.New("Unknown time zone in schedule %q: %v", spec, err)
+		}
+		s.location = location
+		rest = ""
+		if len(fields) == 2 {
+			rest = fields[1]
+		}
+	}
+	for _, part := range strings.Split(rest, "|") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		var w window
+		var err error
+		if len(fields) == 5 {
+			w, err = parseCron(fields)
+		} else {
+			w, err = parseWindow(fields)
+		}
+		if err != nil {
+			return nil, errors.New("Invalid schedule %q: %v", spec, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	if len(s.windows) == 0 {
+		return nil, errors.New("Empty schedule %q", spec)
+	}
+	return s, nil
+}
+
+// Active checks whether the schedule is active at the given time.
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.location)
+	for _, w := range s.windows {
+		if w.active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// dayWindow is a time of day range on some days of the week.
+type dayWindow struct {
+	days  [7]bool
+	start int // minute of day
+	end   int // minute of day, up to 24*60
+}
+
+func parseWindow(fields []string) (window, error) {
+	w := &dayWindow{start: 0, end: 24 * 60}
+	daysSet := false
+	timesSet := false
+	for _, field := range fields {
+		if strings.Contains(field, ":") {
+			if timesSet {
+				return nil, errors.New("More than one time range")
+			}
+			bounds := strings.SplitN(field, "-", 2)
+			if len(bounds) != 2 {
+				return nil, errors.New("Invalid time range %q", field)
+			}
+			var err error
+			if w.start, err = parseTimeOfDay(bounds[0]); err != nil {
+				return nil, err
+			}
+			if w.end, err = parseTimeOfDay(bounds[1]); err != nil {
+				return nil, err
+			}
+			if w.start == w.end {
+				return nil, errors.New("Empty time range %q", field)
+			}
+			timesSet = true
+			continue
+		}
+		if daysSet {
+			return nil, errors.New("More than one list of days")
+		}
+		for _, item := range strings.Split(field, ",") {
+			from, to, err := parseRange(item, weekdays, 0, 7)
+			if err != nil {
+				return nil, err
+			}
+			for day := from; day <= to; day++ {
+				w.days[day%7] = true
+			}
+			if to < from {
+				// Wrapping range like Fri-Mon
+				for day := from; day <= to+7; day++ {
+					w.days[day%7] = true
+				}
+			}
+		}
+		daysSet = true
+	}
+	if !daysSet {
+		for day := range w.days {
+			w.days[day] = true
+		}
+	}
+	return w, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, errors.New("Invalid time %q", s)
+	}
+	hour, err1 := strconv.Atoi(parts[0])
+	minute, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, errors.New("Invalid time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func (w *dayWindow) active(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// Overnight, the part after midnight belongs to the previous day
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// cron is a cron-like expression.
+type cron struct {
+	minutes     [60]bool
+	hours       [24]bool
+	daysOfMonth [32]bool
+	months      [13]bool
+	weekdays    [7]bool
+	anyDOM      bool
+	anyDOW      bool
+}
+
+func parseCron(fields []string) (window, error) {
+	c := &cron{
+		anyDOM: fields[2] == "*",
+		anyDOW: fields[4] == "*",
+	}
+	for _, f := range []struct {
+		field    string
+		names    map[string]int
+		min, max int
+		set      func(int)
+	}{
+		{fields[0], nil, 0, 59, func(i int) { c.minutes[i] = true }},
+		{fields[1], nil, 0, 23, func(i int) { c.hours[i] = true }},
+		{fields[2], nil, 1, 31, func(i int) { c.daysOfMonth[i] = true }},
+		{fields[3], months, 1, 12, func(i int) { c.months[i] = true }},
+		{fields[4], weekdays, 0, 7, func(i int) { c.weekdays[i%7] = true }},
+	} {
+		for _, item := range strings.Split(f.field, ",") {
+			step := 1
+			if slash := strings.Index(item, "/"); slash >= 0 {
+				var err error
+				step, err = strconv.Atoi(item[slash+1:])
+				if err != nil || step < 1 {
+					return nil, errors.New("Invalid step in %q", item)
+				}
+				item = item[:slash]
+			}
+			from, to := f.min, f.max
+			if item != "*" {
+				var err error
+				from, to, err = parseRange(item, f.names, f.min, f.max)
+				if err != nil {
+					return nil, err
+				}
+				if to < from {
+					return nil, errors.New("Invalid range %q", item)
+				}
+			}
+			for i := from; i <= to; i += step {
+				f.set(i)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *cron) active(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[t.Month()] {
+		return false
+	}
+	dom := c.daysOfMonth[t.Day()]
+	dow := c.weekdays[t.Weekday()]
+	// Like cron, if both days of month and of week are restricted, either
+	// one matching is enough
+	switch {
+	case c.anyDOM && c.anyDOW:
+		return true
+	case c.anyDOM:
+		return dow
+	case c.anyDOW:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// parseRange parses a single value or a range like "1-5" or "mon-fri".
+func parseRange(s string, names map[string]int, min, max int) (int, int, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	from, err := parseValue(bounds[0], names, min, max)
+	if err != nil {
+		return 0, 0, err
+	}
+	to := from
+	if len(bounds) == 2 {
+		to, err = parseValue(bounds[1], names, min, max)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return from, to, nil
+}
+
+func parseValue(s string, names map[string]int, min, max int) (int, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	if len(lower) >= 3 {
+		if value, found := names[lower[:3]]; found {
+			return value, nil
+		}
+	}
+	value, err := strconv.Atoi(lower)
+	if err != nil || value < min || value > max {
+		return 0, errors.New("Invalid value %q", s)
+	}
+	return value, nil
+}
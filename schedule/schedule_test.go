@@ -0,0 +1,124 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 2024-01-01 was a Monday
+func at(day int, hour int, minute int) time.Time {
+	return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestWindows(t *testing.T) {
+	s, err := Parse("Mon-Fri 09:00-17:00 | Sat 10:00-12:30")
+	require.NoError(t, err)
+	assert.True(t, s.Active(at(1, 9, 0)), "start is included")
+	assert.True(t, s.Active(at(5, 16, 59)))
+	assert.False(t, s.Active(at(5, 17, 0)), "end is excluded")
+	assert.False(t, s.Active(at(1, 8, 59)))
+	assert.True(t, s.Active(at(6, 12, 29)))
+	assert.False(t, s.Active(at(6, 12, 30)))
+	assert.False(t, s.Active(at(7, 11, 0)), "Sunday")
+
+	s, err = Parse("Fri 22:00-06:00")
+	require.NoError(t, err)
+	assert.True(t, s.Active(at(5, 23, 0)))
+	assert.True(t, s.Active(at(6, 5, 59)), "overnight window continues into Saturday")
+	assert.False(t, s.Active(at(6, 22, 0)))
+	assert.False(t, s.Active(at(5, 5, 0)), "Friday morning belongs to Thursday's window")
+
+	s, err = Parse("sat,sun")
+	require.NoError(t, err)
+	assert.True(t, s.Active(at(6, 0, 0)))
+	assert.True(t, s.Active(at(7, 23, 59)))
+	assert.False(t, s.Active(at(8, 0, 0)))
+
+	s, err = Parse("Fri-Mon 00:00-24:00")
+	require.NoError(t, err)
+	assert.True(t, s.Active(at(1, 12, 0)))
+	assert.False(t, s.Active(at(2, 12, 0)))
+	assert.True(t, s.Active(at(5, 12, 0)))
+}
+
+func TestTimeZone(t *testing.T) {
+	s, err := Parse("TZ=America/New_York Mon-Fri 09:00-17:00")
+	require.NoError(t, err)
+	assert.False(t, s.Active(at(1, 9, 0)), "09:00 UTC is 04:00 in New York")
+	assert.True(t, s.Active(at(1, 14, 0)))
+	assert.True(t, s.Active(at(1, 21, 59)))
+	assert.False(t, s.Active(at(1, 22, 0)))
+
+	_, err = Parse("TZ=Nowhere/Special 09:00-17:00")
+	assert.Error(t, err)
+}
+
+func TestCron(t *testing.T) {
+	s, err := Parse("*/15 9-16 * * mon-fri")
+	require.NoError(t, err)
+	assert.True(t, s.Active(at(1, 9, 0)))
+	assert.True(t, s.Active(at(1, 16, 45)))
+	assert.False(t, s.Active(at(1, 16, 46)))
+	assert.False(t, s.Active(at(1, 17, 0)))
+	assert.False(t, s.Active(at(6, 9, 0)))
+
+	s, err = Parse("* * 1 * 0")
+	require.NoError(t, err)
+	assert.True(t, s.Active(at(1, 3, 3)), "first of the month")
+	assert.True(t, s.Active(at(7, 3, 3)), "Sunday")
+	assert.False(t, s.Active(at(2, 3, 3)))
+
+	s, err = Parse("0-29 * * jan,mar 7")
+	require.NoError(t, err)
+	assert.True(t, s.Active(at(7, 0, 29)), "7 is Sunday too")
+	assert.False(t, s.Active(at(7, 0, 30)))
+}
+
+func TestInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"TZ=UTC",
+		"Mon-Fri 09:00",
+		"Mon-Fri 09:00-09:00",
+		"Mon-Fri 25:00-26:00",
+		"Mon 09:00-10:00 11:00-12:00",
+		"Funday 09:00-10:00",
+		"60 * * * *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+	} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestEngine(t *testing.T) {
+	schedules, err := ParseSchedules("business=Mon-Fri 09:00-17:00; night = 22:00-06:00")
+	require.NoError(t, err)
+	now := at(1, 10, 0)
+	e := New(&Opts{Schedules: schedules, Now: func() time.Time { return now }})
+
+	assert.True(t, e.Active(""))
+	assert.True(t, e.Active("business"))
+	assert.False(t, e.Active("!business"))
+	assert.False(t, e.Active("night"))
+	assert.True(t, e.Active("!night"))
+	assert.False(t, e.Active("unknown"))
+	assert.False(t, e.Active("!unknown"))
+
+	now = at(1, 23, 0)
+	assert.False(t, e.Active("business"))
+	assert.True(t, e.Active("night"))
+
+	assert.NoError(t, e.Check("", "business", "!night"))
+	assert.Error(t, e.Check("business", "!unknown"))
+
+	_, err = ParseSchedules("business")
+	assert.Error(t, err)
+	_, err = ParseSchedules("business=Mon-Fri 9-5")
+	assert.Error(t, err)
+}
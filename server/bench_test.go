@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/fdcount"
+	"github.com/getlantern/grtrack"
+	"github.com/getlantern/measured"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+const (
+	benchPayloadSize = 16 * 1024
+	soakConnections  = 2000
+	soakConcurrency  = 50
+	soakLogInterval  = 10 * time.Second
+	soakCloseTimeout = 10 * time.Second
+)
+
+var (
+	soak = flag.Duration("soak", 0, "keep TestSoak opening connections for this long instead of a fixed number of them")
+
+	benchPayload = bytes.Repeat([]byte("x"), benchPayloadSize)
+)
+
+// newBenchOrigin starts an origin that responds to every request with
+// benchPayload.
+func newBenchOrigin() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Length", fmt.Sprint(len(benchPayload)))
+		resp.Write(benchPayload)
+	}))
+}
+
+// newBenchServer starts a Server with the default listener chain, i.e.
+// limited, idle and measured listeners, and returns its address and a
+// function that shuts it down.
+func newBenchServer(tb testing.TB) (string, func()) {
+	s := New(&Opts{IdleTimeout: 30 * time.Second})
+	s.AddListenerWrappers(
+		func(ls net.Listener) net.Listener {
+			return listeners.NewLimitedListener(ls, 0)
+		},
+		func(ls net.Listener) net.Listener {
+			return listeners.NewIdleConnListener(ls, 30*time.Second)
+		},
+		func(ls net.Listener) net.Listener {
+			return listeners.NewMeasuredListener(ls, time.Minute, func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+			})
+		},
+	)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	ready := make(chan string, 1)
+	go s.Serve(l, func(addr string) {
+		ready <- addr
+	})
+	return <-ready, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	}
+}
+
+// benchConn is a client connection to the proxy.
+type benchConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func dialBench(addr string) (*benchConn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &benchConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// connect opens a tunnel to host.
+func (c *benchConn) connect(host string) error {
+	if _, err := fmt.Fprintf(c, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(c.br, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT failed with %v", resp.Status)
+	}
+	return nil
+}
+
+// get requests target from host, through the proxy if target is an absolute
+// URL or else through a tunnel, and returns the size of the response body.
+func (c *benchConn) get(target, host string) (int64, error) {
+	if _, err := fmt.Fprintf(c, "GET %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, host); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(c.br, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET failed with %v", resp.Status)
+	}
+	return n, err
+}
+
+// roundTrip opens a new connection to the proxy, makes a single request to
+// host through it, either directly or through a tunnel, and closes it.
+func roundTrip(addr, host string, tunnel bool) error {
+	conn, err := dialBench(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	target := "http://" + host + "/"
+	if tunnel {
+		if err := conn.connect(host); err != nil {
+			return err
+		}
+		target = "/"
+	}
+	_, err = conn.get(target, host)
+	return err
+}
+
+// BenchmarkHTTP measures the throughput of plain HTTP requests over
+// keep-alive connections.
+func BenchmarkHTTP(b *testing.B) {
+	origin := newBenchOrigin()
+	defer origin.Close()
+	addr, stop := newBenchServer(b)
+	defer stop()
+	host := origin.Listener.Addr().String()
+	target := "http://" + host + "/"
+
+	b.SetBytes(benchPayloadSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := dialBench(addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+		for pb.Next() {
+			if _, err := conn.get(target, host); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkHTTPConnection measures connection setup plus a single plain HTTP
+// request.
+func BenchmarkHTTPConnection(b *testing.B) {
+	benchmarkConnections(b, false)
+}
+
+// BenchmarkCONNECT measures the throughput of requests through established
+// CONNECT tunnels.
+func BenchmarkCONNECT(b *testing.B) {
+	origin := newBenchOrigin()
+	defer origin.Close()
+	addr, stop := newBenchServer(b)
+	defer stop()
+	host := origin.Listener.Addr().String()
+
+	b.SetBytes(benchPayloadSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := dialBench(addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+		if err := conn.connect(host); err != nil {
+			b.Error(err)
+			return
+		}
+		for pb.Next() {
+			if _, err := conn.get("/", host); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkCONNECTConnection measures connection and tunnel setup plus a
+// single request through the tunnel.
+func BenchmarkCONNECTConnection(b *testing.B) {
+	benchmarkConnections(b, true)
+}
+
+func benchmarkConnections(b *testing.B, tunnel bool) {
+	origin := newBenchOrigin()
+	defer origin.Close()
+	addr, stop := newBenchServer(b)
+	defer stop()
+	host := origin.Listener.Addr().String()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := roundTrip(addr, host, tunnel); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// TestSoak opens thousands of connections, alternating between plain HTTP
+// and CONNECT, and checks that no goroutines or file descriptors leak. Run it
+// with -soak to keep it going for longer, like -soak=1h.
+func TestSoak(t *testing.T) {
+	origin := newBenchOrigin()
+	defer origin.Close()
+	addr, stop := newBenchServer(t)
+	defer stop()
+	host := origin.Listener.Addr().String()
+
+	_, fds, err := fdcount.Matching("TCP")
+	if err != nil {
+		t.Logf("Not checking file descriptors: %v", err)
+	}
+	goroutines := grtrack.Start()
+	baseline := runtime.NumGoroutine()
+
+	var deadline time.Time
+	if *soak > 0 {
+		deadline = time.Now().Add(*soak)
+	}
+	var opened, failed int64
+	next := func() (int64, bool) {
+		n := atomic.AddInt64(&opened, 1)
+		if deadline.IsZero() {
+			return n, n <= soakConnections
+		}
+		return n, time.Now().Before(deadline)
+	}
+
+	done := make(chan struct{})
+	if *soak > 0 {
+		go func() {
+			ticker := time.NewTicker(soakLogInterval)
+			defer ticker.Stop()
+			var ms runtime.MemStats
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					runtime.ReadMemStats(&ms)
+					t.Logf("%d connections, %d failed, %d goroutines, %d KiB heap",
+						atomic.LoadInt64(&opened), atomic.LoadInt64(&failed), runtime.NumGoroutine(), ms.HeapInuse/1024)
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < soakConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n, ok := next()
+				if !ok {
+					return
+				}
+				if err := roundTrip(addr, host, n%2 == 0); err != nil {
+					if atomic.AddInt64(&failed, 1) == 1 {
+						t.Errorf("Connection %d failed: %v", n, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	assert.Zero(t, atomic.LoadInt64(&failed), "no connection should fail")
+
+	// Connections close asynchronously on the server, tunnels take a moment
+	for start := time.Now(); runtime.NumGoroutine() > baseline && time.Since(start) < soakCloseTimeout; {
+		time.Sleep(50 * time.Millisecond)
+	}
+	goroutines.Check(t)
+	if fds != nil {
+		assert.NoError(t, fds.AssertDelta(0), "no file descriptors should leak")
+	}
+}
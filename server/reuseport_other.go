@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"net"
+
+	"github.com/getlantern/errors"
+)
+
+func listenReusePort(network, addr string) (net.Listener, error) {
+	return nil, errors.New("Multiple acceptors are only supported on Linux")
+}
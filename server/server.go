@@ -2,11 +2,12 @@ package server
 
 import (
 	"context"
-	"io/ioutil"
+	stderrors "errors"
 	"net"
 	"net/http"
 	"reflect"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/errors"
@@ -16,12 +17,27 @@ import (
 	"github.com/getlantern/proxy/v2/filters"
 	"github.com/getlantern/tlsdefaults"
 
+	"github.com/getlantern/http-proxy/circuitbreaker"
+	"github.com/getlantern/http-proxy/dialer"
+	"github.com/getlantern/http-proxy/errorpages"
 	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/resolver"
+	"github.com/getlantern/http-proxy/tracing"
+	"github.com/getlantern/http-proxy/tunnel"
+)
+
+const (
+	defaultDialTimeout   = 30 * time.Second
+	shutdownPollInterval = 100 * time.Millisecond
 )
 
 var (
 	testingLocal = false
 	log          = golog.LoggerFor("server")
+
+	// ErrServerClosed is returned by the serving methods after a call to
+	// Shutdown.
+	ErrServerClosed = stderrors.New("server closed")
 )
 
 // A ListenerGenerator generates a new listener from an existing one.
@@ -34,10 +50,30 @@ type Opts struct {
 	Filter       filters.Filter
 	Dial         proxy.DialFunc
 
+	// Resolver, if specified, is used to resolve upstream hosts when Dial is
+	// not specified. Share it with filters like BlockLocalWithResolver so that
+	// hosts are only resolved once per TTL.
+	Resolver *resolver.Resolver
+
 	// OKDoesNotWaitForUpstream can be set to true in order to immediately return
 	// OK to CONNECT requests.
 	OKDoesNotWaitForUpstream bool
 
+	// Acceptors is the number of listeners that ListenAndServeHTTP and
+	// ListenAndServeHTTPS open on the address using SO_REUSEPORT (Linux only),
+	// each with its own accept loop and copy of the listener wrapper chain.
+	// Use listeners.NewSharedLimitedListener to enforce connection limits
+	// across all of them. Defaults to a single listener without SO_REUSEPORT.
+	Acceptors int
+
+	// UnixSocket configures the permissions of Unix domain sockets opened by
+	// Listen for "unix:" addresses, see listeners.ListenUnix.
+	UnixSocket listeners.UnixOpts
+
+	// DisableSplice can be set to true in order to always copy CONNECT tunnel
+	// data through user space instead of splicing it (see package tunnel).
+	DisableSplice bool
+
 	// OnError provides a callback that's invoked if the proxy encounters an
 	// error while proxying for the given client connection.
 	OnError func(conn net.Conn, err error)
@@ -55,21 +91,63 @@ type Opts struct {
 
 // Server is an HTTP proxy server.
 type Server struct {
+	// Keep 64-bit words at the top to make sure 64-bit alignment, see
+	// https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	activeConns int64
+
 	// Allow is a function that determines whether or not to allow connections
-	// from the given IP address. If unspecified, all connections are allowed.
+	// from the given IP address. For connections over Unix domain sockets, it
+	// gets the peer credentials instead, see listeners.ParsePeerCred. If
+	// unspecified, all connections are allowed.
 	Allow              func(string) bool
 	proxy              proxy.Proxy
 	listenerGenerators []ListenerGenerator
 	onError            func(conn net.Conn, err error)
 	onAcceptError      func(err error) (fatalErr error)
+	splice             bool
+	acceptors          int
+	unixOpts           listeners.UnixOpts
+
+	mx           sync.Mutex
+	listeners    []net.Listener
+	shuttingDown bool
+
+	// clients tracks the dialer.ClientInfo for each client connection, keyed by
+	// remote address
+	clients sync.Map
 }
 
 // New constructs a new HTTP proxy server using the given options
 func New(opts *Opts) *Server {
+	if opts.Dial == nil && opts.Resolver != nil {
+		opts.Dial = func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, defaultDialTimeout)
+			defer cancel()
+			return opts.Resolver.Dial(ctx, network, addr)
+		}
+	}
+	if !opts.DisableSplice {
+		dial := opts.Dial
+		if dial == nil {
+			dial = func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, defaultDialTimeout)
+				defer cancel()
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}
+		}
+		opts.Dial = tunnel.WrapDial(dial)
+	}
+	s := &Server{splice: !opts.DisableSplice, acceptors: opts.Acceptors, unixOpts: opts.UnixSocket}
+	filter := opts.Filter
+	if filter == nil {
+		filter = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			return next(cs, req)
+		})
+	}
 	p, _ := proxy.New(&proxy.Opts{
 		IdleTimeout:         opts.IdleTimeout,
 		Dial:                opts.Dial,
-		Filter:              opts.Filter,
+		Filter:              filters.Join(filters.FilterFunc(renderErrors), filters.FilterFunc(s.closeWhenShuttingDown), filters.FilterFunc(s.attachClientInfo), filter),
 		BufferSource:        opts.BufferSource,
 		OKWaitsForUpstream:  !opts.OKDoesNotWaitForUpstream,
 		OKSendsServerTiming: true,
@@ -78,11 +156,7 @@ func New(opts *Opts) *Server {
 			if read {
 				status = http.StatusBadRequest
 			}
-			return &http.Response{
-				Request:    req,
-				StatusCode: status,
-				Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
-			}
+			return errorResponse(req, status, err)
 		},
 	})
 
@@ -92,11 +166,47 @@ func New(opts *Opts) *Server {
 	if opts.OnAcceptError == nil {
 		opts.OnAcceptError = func(err error) (fatalErr error) { return err }
 	}
-	return &Server{
-		proxy:         p,
-		onError:       opts.OnError,
-		onAcceptError: opts.OnAcceptError,
+	s.proxy = p
+	s.onError = opts.OnError
+	s.onAcceptError = opts.OnAcceptError
+	return s
+}
+
+// attachClientInfo attaches the connection's dialer.ClientInfo to the request
+// so that it's available to filters and to dials for plain HTTP requests. The
+// route chosen for the previous request on the connection is cleared, so that
+// the filters can choose one for this request.
+func (s *Server) attachClientInfo(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	if info, found := s.clients.Load(req.RemoteAddr); found {
+		info.(*dialer.ClientInfo).Route = ""
+		req = req.WithContext(dialer.WithClientInfo(req.Context(), info.(*dialer.ClientInfo)))
+	}
+	return next(cs, req)
+}
+
+// renderErrors replaces error responses that weren't rendered by errorpages,
+// like the proxy's own 502 for failed CONNECT dials, so that internal error
+// details don't leak to clients.
+func renderErrors(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	resp, cs, err := next(cs, req)
+	if err != nil && resp != nil && resp.StatusCode >= 400 && !errorpages.IsRendered(resp) {
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		resp = errorResponse(req, resp.StatusCode, err)
+	}
+	return resp, cs, err
+}
+
+func errorResponse(req *http.Request, status int, err error) *http.Response {
+	if resp := circuitbreaker.ServiceUnavailable(req, err); resp != nil {
+		return resp
+	}
+	var netErr net.Error
+	if status == http.StatusBadGateway && stderrors.As(err, &netErr) && netErr.Timeout() {
+		status = http.StatusGatewayTimeout
 	}
+	return errorpages.Default.Response(req, status, "", err)
 }
 
 func (s *Server) AddListenerWrappers(listenerGens ...ListenerGenerator) {
@@ -106,26 +216,115 @@ func (s *Server) AddListenerWrappers(listenerGens ...ListenerGenerator) {
 }
 
 func (s *Server) ListenAndServeHTTP(addr string, readyCb func(addr string)) error {
-	listener, err := net.Listen("tcp", addr)
+	ls, err := s.Listen(addr)
 	if err != nil {
 		return err
 	}
 	log.Debugf("Listen http on %s", addr)
-	return s.serve(s.wrapListenerIfNecessary(listener), readyCb)
+	return s.ServeListeners(ls, readyCb)
 }
 
 func (s *Server) ListenAndServeHTTPS(addr, keyfile, certfile string, readyCb func(addr string)) error {
-	l, err := net.Listen("tcp", addr)
+	ls, err := s.Listen(addr)
 	if err != nil {
 		return err
 	}
+	log.Debugf("Listen https on %s", addr)
+	return s.ServeListenersTLS(ls, keyfile, certfile, readyCb)
+}
 
-	listener, err := tlsdefaults.NewListener(s.wrapListenerIfNecessary(l), keyfile, certfile)
-	if err != nil {
-		return err
+// ServeListeners serves HTTP on the given listeners, which were opened with
+// Listen or otherwise, like the ones inherited through socket activation.
+// Each listener gets its own accept loop and copy of the listener wrapper
+// chain.
+func (s *Server) ServeListeners(ls []net.Listener, readyCb func(addr string)) error {
+	wrapped := make([]net.Listener, 0, len(ls))
+	for _, l := range ls {
+		wrapped = append(wrapped, s.wrapListenerIfNecessary(l))
+	}
+	return s.serveAll(wrapped, readyCb)
+}
+
+// ServeListenersTLS is like ServeListeners but serves HTTPS.
+func (s *Server) ServeListenersTLS(ls []net.Listener, keyfile, certfile string, readyCb func(addr string)) error {
+	wrapped := make([]net.Listener, 0, len(ls))
+	for _, l := range ls {
+		tl, err := tlsdefaults.NewListener(s.wrapListenerIfNecessary(l), keyfile, certfile)
+		if err != nil {
+			closeAll(ls)
+			return err
+		}
+		wrapped = append(wrapped, tl)
+	}
+	return s.serveAll(wrapped, readyCb)
+}
+
+// Listen opens the configured number of listeners on addr, see
+// Opts.Acceptors. Addresses starting with "unix:" refer to Unix domain
+// sockets, which always get a single listener.
+func (s *Server) Listen(addr string) ([]net.Listener, error) {
+	if listeners.IsUnixAddr(addr) {
+		l, err := listeners.ListenUnix(addr, &s.unixOpts)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	if s.acceptors <= 1 {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	ls := make([]net.Listener, 0, s.acceptors)
+	for i := 0; i < s.acceptors; i++ {
+		l, err := listenReusePort("tcp", addr)
+		if err != nil {
+			closeAll(ls)
+			return nil, err
+		}
+		if i == 0 {
+			// Use the actual port in case addr specified port 0
+			addr = l.Addr().String()
+		}
+		ls = append(ls, l)
+	}
+	log.Debugf("Opened %d listeners on %v with SO_REUSEPORT", len(ls), addr)
+	return ls, nil
+}
+
+// serveAll serves on all of the given listeners, each with its own accept
+// loop, until one of them fails.
+func (s *Server) serveAll(ls []net.Listener, readyCb func(addr string)) error {
+	if len(ls) == 1 {
+		return s.serve(ls[0], readyCb)
+	}
+
+	wrapped := make([]net.Listener, 0, len(ls))
+	for _, l := range ls {
+		wrapped = append(wrapped, s.wrapListener(l))
+	}
+	if readyCb != nil {
+		readyCb(wrapped[0].Addr().String())
+	}
+
+	errCh := make(chan error, len(wrapped))
+	for _, l := range wrapped {
+		go func(l net.Listener) {
+			errCh <- s.acceptLoop(l)
+		}(l)
+	}
+	err := <-errCh
+	closeAll(ls)
+	return err
+}
+
+func closeAll(ls []net.Listener) {
+	for _, l := range ls {
+		l.Close()
 	}
-	log.Debugf("Listen https on %s", addr)
-	return s.serve(listener, readyCb)
 }
 
 func (s *Server) Serve(listener net.Listener, readyCb func(addr string)) error {
@@ -133,20 +332,34 @@ func (s *Server) Serve(listener net.Listener, readyCb func(addr string)) error {
 }
 
 func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
-	l := listeners.NewDefaultListener(listener)
+	l := s.wrapListener(listener)
+	if readyCb != nil {
+		readyCb(l.Addr().String())
+	}
+	return s.acceptLoop(l)
+}
 
+// wrapListener applies the default listener and the listener wrappers.
+func (s *Server) wrapListener(listener net.Listener) net.Listener {
+	l := listeners.NewDefaultListener(listener)
 	for _, wrap := range s.listenerGenerators {
 		l = wrap(l)
 	}
+	return l
+}
 
-	if readyCb != nil {
-		readyCb(l.Addr().String())
+func (s *Server) acceptLoop(l net.Listener) error {
+	if !s.trackListener(l) {
+		l.Close()
+		return ErrServerClosed
 	}
-
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				// delay code based on net/http.Server
 				if tempDelay == 0 {
@@ -169,7 +382,63 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 	}
 }
 
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.listeners = append(s.listeners, l)
+	return true
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.shuttingDown
+}
+
+// Shutdown gracefully shuts down the server like http.Server.Shutdown does. It
+// closes all listeners, so that serving returns ErrServerClosed, and then
+// waits until all client connections are closed or ctx is done, in which case
+// it returns ctx.Err(). While shutting down, keep-alive connections are closed
+// after their current request.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mx.Lock()
+	s.shuttingDown = true
+	ls := s.listeners
+	s.listeners = nil
+	s.mx.Unlock()
+	closeAll(ls)
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		active := atomic.LoadInt64(&s.activeConns)
+		if active == 0 {
+			return nil
+		}
+		log.Debugf("Waiting for %d connections to close", active)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeWhenShuttingDown closes keep-alive connections after the current
+// request while shutting down.
+func (s *Server) closeWhenShuttingDown(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	resp, cs, err := next(cs, req)
+	if resp != nil && req.Method != http.MethodConnect && s.isShuttingDown() {
+		resp.Close = true
+	}
+	return resp, cs, err
+}
+
 func (s *Server) handle(conn net.Conn) {
+	atomic.AddInt64(&s.activeConns, 1)
 	wrapConn, isWrapConn := conn.(listeners.WrapConn)
 	if isWrapConn {
 		wrapConn.OnState(http.StateNew)
@@ -178,13 +447,20 @@ func (s *Server) handle(conn net.Conn) {
 }
 
 func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.WrapConn) {
+	defer atomic.AddInt64(&s.activeConns, -1)
 	clientIP := ""
+	dialCtx := context.Background()
 	remoteAddr := conn.RemoteAddr()
 	if remoteAddr != nil {
 		clientIP, _, _ = net.SplitHostPort(remoteAddr.String())
+		info := &dialer.ClientInfo{IP: clientIP, Peer: listeners.PeerCredentials(conn)}
+		dialCtx = dialer.WithClientInfo(dialCtx, info)
+		s.clients.Store(remoteAddr.String(), info)
+		defer s.clients.Delete(remoteAddr.String())
 	}
 	op := ops.Begin("http_proxy_handle").Set("client_ip", clientIP)
 	defer op.End()
+	tracing.Start(op, tracing.Server)
 
 	defer func() {
 		p := recover()
@@ -197,7 +473,13 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 		}
 	}()
 
-	err := s.proxy.Handle(context.Background(), conn, conn)
+	var downstream net.Conn = conn
+	if s.splice {
+		tc := tunnel.Wrap(conn)
+		dialCtx = tunnel.WithDownstream(dialCtx, tc)
+		downstream = tc
+	}
+	err := s.proxy.Handle(dialCtx, downstream, downstream)
 	if err != nil {
 		op.FailIf(errors.New("Error handling connection from %v: %v", conn.RemoteAddr(), err))
 		s.onError(conn, err)
@@ -219,6 +501,9 @@ func safeClose(conn net.Conn) {
 }
 
 func (s *Server) wrapListenerIfNecessary(l net.Listener) net.Listener {
+	if l.Addr().Network() == "unix" {
+		l = listeners.NewUnixPeerListener(l)
+	}
 	if s.Allow != nil {
 		log.Debug("Wrapping listener with Allow")
 		return &allowinglistener{l, s.Allow}
@@ -244,6 +529,8 @@ func (l *allowinglistener) Accept() (net.Conn, error) {
 		ip = addr.IP.String()
 	case *net.UDPAddr:
 		ip = addr.IP.String()
+	case *listeners.PeerAddr:
+		ip, _, _ = net.SplitHostPort(addr.String())
 	default:
 		log.Errorf("Remote addr %v is of unknown type %v, unable to determine IP", remoteAddr, reflect.TypeOf(remoteAddr))
 		return conn, err
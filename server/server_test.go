@@ -3,6 +3,7 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -12,9 +13,12 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,7 +28,9 @@ import (
 	"github.com/getlantern/proxy/v2/filters"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/getlantern/http-proxy/dialer"
 	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/resolver"
 )
 
 const (
@@ -440,6 +446,260 @@ func TestDisconnectingServer(t *testing.T) {
 	}
 }
 
+func TestResolver(t *testing.T) {
+	r, err := resolver.New(&resolver.Opts{
+		Hosts: map[string][]string{"origin.test": {"127.0.0.1"}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := New(&Opts{IdleTimeout: 30 * time.Second, Resolver: r})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) {
+		ready <- addr
+	})
+	addr := <-ready
+
+	testFn := func(conn net.Conn, originURL *url.URL) {
+		_, port, _ := net.SplitHostPort(originURL.Host)
+		_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: origin.test:" + port + "\r\n\r\n"))
+		if !assert.NoError(t, err, "should write GET request") {
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(buf), originResponse, "should resolve origin.test using static hosts")
+	}
+	testRoundTrip(t, addr, false, httpOriginServer, testFn)
+}
+
+func TestClientInfo(t *testing.T) {
+	dialedFor := make(chan *dialer.ClientInfo, 1)
+	srv := New(&Opts{
+		IdleTimeout: 30 * time.Second,
+		Filter: filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			info := dialer.ClientInfoFrom(req.Context())
+			if assert.NotNil(t, info, "filters should see client info") {
+				assert.Equal(t, "127.0.0.1", info.IP)
+				info.User = "alice"
+			}
+			return next(cs, req)
+		}),
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			dialedFor <- dialer.ClientInfoFrom(ctx)
+			return net.Dial(network, addr)
+		},
+	})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) {
+		ready <- addr
+	})
+	addr := <-ready
+
+	for _, method := range []string{http.MethodGet, http.MethodConnect} {
+		testFn := func(conn net.Conn, originURL *url.URL) {
+			req := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", method, originURL.Host, originURL.Host)
+			if method == http.MethodGet {
+				req = fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", originURL.Host)
+			}
+			_, err := conn.Write([]byte(req))
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			info := <-dialedFor
+			if assert.NotNil(t, info, "dial should see client info for %v", method) {
+				assert.Equal(t, "127.0.0.1", info.IP)
+				assert.Equal(t, "alice", info.User, "user set by filter should be visible when dialing for %v", method)
+			}
+		}
+		testRoundTrip(t, addr, false, httpOriginServer, testFn)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	srv := New(&Opts{
+		IdleTimeout: 30 * time.Second,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return nil, errors.New("secret internal failure dialing %v", addr)
+		},
+	})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) {
+		ready <- addr
+	})
+	addr := <-ready
+
+	for _, method := range []string{http.MethodGet, http.MethodConnect} {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		target := "http://origin.test/"
+		if method == http.MethodConnect {
+			target = "origin.test:443"
+		}
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: origin.test\r\nAccept: application/json\r\nX-Request-Id: req-1\r\n\r\n", method, target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if assert.NoError(t, err, method) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode, method)
+			assert.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"), method)
+			assert.Contains(t, string(body), `"reason":"upstream-unavailable"`, method)
+			assert.Contains(t, string(body), `"request_id":"req-1"`, method)
+			assert.NotContains(t, string(body), "secret", method)
+		}
+		conn.Close()
+	}
+}
+
+func TestAcceptors(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Multiple acceptors are only supported on Linux")
+	}
+	srv := New(&Opts{IdleTimeout: 30 * time.Second, Acceptors: 4})
+	limit := listeners.NewConnLimit(100)
+	var chains int32
+	srv.AddListenerWrappers(func(ls net.Listener) net.Listener {
+		atomic.AddInt32(&chains, 1)
+		return listeners.NewSharedLimitedListener(ls, limit)
+	})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) {
+		ready <- addr
+	})
+	addr := <-ready
+	assert.EqualValues(t, 4, atomic.LoadInt32(&chains), "each acceptor should have its own listener chain")
+
+	proxyURL, _ := url.Parse("http://" + addr)
+	for i := 0; i < 20; i++ {
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+		resp, err := client.Get(httpOriginURL)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, originResponse, string(body))
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv := New(&Opts{IdleTimeout: 30 * time.Second})
+	ready := make(chan string)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServeHTTP("localhost:0", func(addr string) {
+			ready <- addr
+		})
+	}()
+	addr := <-ready
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	roundTrip := func() *http.Response {
+		fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\n\r\n", httpOriginURL, httpOriginServer.server.Listener.Addr())
+		resp, err := http.ReadResponse(br, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		ioutil.ReadAll(resp.Body)
+		return resp
+	}
+	assert.False(t, roundTrip().Close, "keep-alive connection should stay open before shutdown")
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(context.Background())
+	}()
+	assert.Equal(t, ErrServerClosed, <-served)
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err, "should not accept new connections while shutting down")
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown should wait for open connections")
+	case <-time.After(2 * shutdownPollInterval):
+	}
+
+	assert.True(t, roundTrip().Close, "connection should be closed after the current request while shutting down")
+	select {
+	case err := <-shutdownErr:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown should finish once connections are closed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, srv.Shutdown(ctx), "shutting down again should be a no-op")
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Peer credentials are only supported on Linux")
+	}
+	dir, err := ioutil.TempDir("", "server")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+
+	allowed := make(chan string, 1)
+	peers := make(chan *listeners.PeerCred, 1)
+	srv := New(&Opts{
+		IdleTimeout: 30 * time.Second,
+		UnixSocket:  listeners.UnixOpts{Mode: 0600},
+		Filter: filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			peers <- dialer.ClientInfoFrom(req.Context()).Peer
+			return next(cs, req)
+		}),
+	})
+	srv.Allow = func(identity string) bool {
+		allowed <- identity
+		return true
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("unix:"+path, func(addr string) {
+		ready <- addr
+	})
+	assert.Equal(t, path, <-ready)
+	fi, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	proxyURL, _ := url.Parse("http://proxy.local")
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get(httpOriginURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, originResponse, string(body))
+
+	expected := &listeners.PeerCred{PID: int32(os.Getpid()), UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}
+	assert.Equal(t, expected.String(), <-allowed)
+	assert.Equal(t, expected, <-peers)
+}
+
 func TestPanicRecover(t *testing.T) {
 	req := "GET / HTTP/1.1\r\nHost: thehost.com\r\n\r\n"
 	conn := mockconn.New(&bytes.Buffer{}, strings.NewReader(req))
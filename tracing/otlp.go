@@ -0,0 +1,368 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+const (
+	defaultServiceName   = "http-proxy"
+	defaultBatchSize     = 512
+	defaultQueueSize     = 4096
+	defaultFlushInterval = 5 * time.Second
+	defaultTimeout       = 10 * time.Second
+
+	tracesPath = "/v1/traces"
+	scopeName  = "github.com/getlantern/http-proxy"
+
+	statusError = 2
+)
+
+var (
+	log = golog.LoggerFor("tracing")
+
+	exportedCount = metrics.Counter("tracing_spans_exported")
+	droppedCount  = metrics.Counter("tracing_spans_dropped")
+)
+
+// Opts configures an Exporter.
+type Opts struct {
+	// Endpoint is the base URL of the OTLP/HTTP collector, for example
+	// http://localhost:4318. Spans are posted to Endpoint + "/v1/traces"
+	// unless Endpoint already ends with that path. Required.
+	Endpoint string
+
+	// Headers are added to every export request, typically for
+	// authentication.
+	Headers map[string]string
+
+	// ServiceName identifies us to the collector. Defaults to "http-proxy".
+	ServiceName string
+
+	// ResourceAttributes are added to the exported resource.
+	ResourceAttributes map[string]string
+
+	// BatchSize is the maximum number of spans per export request. Defaults to
+	// 512.
+	BatchSize int
+
+	// QueueSize is the maximum number of spans waiting to be exported. Spans
+	// are dropped when the queue is full. Defaults to 4096.
+	QueueSize int
+
+	// FlushInterval is how often queued spans are exported. Defaults to 5
+	// seconds.
+	FlushInterval time.Duration
+
+	// Timeout for export requests. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// Exporter exports spans to an OTLP/HTTP collector using the JSON encoding.
+// Register its Report method with ops.RegisterReporter.
+type Exporter struct {
+	opts     Opts
+	url      string
+	client   *http.Client
+	resource resource
+
+	queue     chan *span
+	flush     chan chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewExporter constructs a new Exporter and starts exporting in the
+// background.
+func NewExporter(opts *Opts) (*Exporter, error) {
+	if opts == nil || opts.Endpoint == "" {
+		return nil, errors.New("OTLP endpoint required")
+	}
+	e := &Exporter{opts: *opts}
+	if e.opts.ServiceName == "" {
+		e.opts.ServiceName = defaultServiceName
+	}
+	if e.opts.BatchSize <= 0 {
+		e.opts.BatchSize = defaultBatchSize
+	}
+	if e.opts.QueueSize <= 0 {
+		e.opts.QueueSize = defaultQueueSize
+	}
+	if e.opts.FlushInterval <= 0 {
+		e.opts.FlushInterval = defaultFlushInterval
+	}
+	if e.opts.Timeout <= 0 {
+		e.opts.Timeout = defaultTimeout
+	}
+	e.url = strings.TrimSuffix(e.opts.Endpoint, "/")
+	if !strings.HasSuffix(e.url, tracesPath) {
+		e.url += tracesPath
+	}
+	e.client = &http.Client{Timeout: e.opts.Timeout}
+
+	e.resource.Attributes = append(e.resource.Attributes, attribute("service.name", e.opts.ServiceName))
+	for key, value := range e.opts.ResourceAttributes {
+		e.resource.Attributes = append(e.resource.Attributes, attribute(key, value))
+	}
+	sortAttributes(e.resource.Attributes)
+
+	e.queue = make(chan *span, e.opts.QueueSize)
+	e.flush = make(chan chan struct{})
+	e.stop = make(chan struct{})
+	e.stopped = make(chan struct{})
+	go e.run()
+	return e, nil
+}
+
+// Report is an ops.Reporter that queues ops marked with Start for export.
+func (e *Exporter) Report(failure error, ctx map[string]interface{}) {
+	s := toSpan(failure, ctx, time.Now())
+	if s == nil {
+		return
+	}
+	select {
+	case e.queue <- s:
+	default:
+		droppedCount.Add(1)
+	}
+}
+
+// Flush exports all queued spans and waits for the export to finish.
+func (e *Exporter) Flush() {
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+		<-done
+	case <-e.stopped:
+	}
+}
+
+// Close exports all queued spans and stops the Exporter.
+func (e *Exporter) Close() {
+	e.closeOnce.Do(func() {
+		close(e.stop)
+	})
+	<-e.stopped
+}
+
+func (e *Exporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(e.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, e.opts.BatchSize)
+	drain := func() {
+		for {
+			select {
+			case s := <-e.queue:
+				batch = append(batch, s)
+				if len(batch) == e.opts.BatchSize {
+					e.export(batch)
+					batch = batch[:0]
+				}
+			default:
+				if len(batch) > 0 {
+					e.export(batch)
+					batch = batch[:0]
+				}
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) == e.opts.BatchSize {
+				e.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			drain()
+		case done := <-e.flush:
+			drain()
+			close(done)
+		case <-e.stop:
+			drain()
+			return
+		}
+	}
+}
+
+func (e *Exporter) export(spans []*span) {
+	body, err := json.Marshal(&exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource: e.resource,
+			ScopeSpans: []scopeSpans{{
+				Scope: scope{Name: scopeName},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Errorf("Unable to encode %d spans: %v", len(spans), err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("Unable to build export request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.opts.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Errorf("Unable to export %d spans to %v: %v", len(spans), e.url, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Errorf("Unexpected response exporting %d spans to %v: %v", len(spans), e.url, resp.Status)
+		return
+	}
+	exportedCount.Add(int64(len(spans)))
+}
+
+// toSpan converts an ended op's context into a span, or returns nil if the op
+// wasn't marked with Start. Child ops that weren't marked inherit their
+// parent's span fields, so we only export an op if it is the one that was
+// marked.
+func toSpan(failure error, ctx map[string]interface{}, end time.Time) *span {
+	name, _ := ctx["op"].(string)
+	spanOp, _ := ctx[keySpanOp].(string)
+	traceID, _ := ctx[KeyTraceID].(string)
+	spanID, _ := ctx[KeySpanID].(string)
+	start, _ := ctx[keySpanStart].(time.Time)
+	if name == "" || name != spanOp || traceID == "" || spanID == "" || start.IsZero() {
+		return nil
+	}
+	kind, _ := ctx[keySpanKind].(Kind)
+	if kind == 0 {
+		kind = Internal
+	}
+	parentSpanID, _ := ctx[KeyParentSpanID].(string)
+	s := &span{
+		TraceID:      traceID,
+		SpanID:       spanID,
+		ParentSpanID: parentSpanID,
+		Name:         name,
+		Kind:         int(kind),
+		Start:        strconv.FormatInt(start.UnixNano(), 10),
+		End:          strconv.FormatInt(end.UnixNano(), 10),
+	}
+	for key, value := range ctx {
+		switch key {
+		case "op", KeyTraceID, KeySpanID, KeyParentSpanID, keySpanOp, keySpanKind, keySpanStart:
+			continue
+		}
+		s.Attributes = append(s.Attributes, attribute(key, value))
+	}
+	sortAttributes(s.Attributes)
+	if failure != nil {
+		s.Status.Code = statusError
+		s.Status.Message = failure.Error()
+	}
+	return s
+}
+
+// The following types mirror the JSON encoding of the OTLP trace protocol, see
+// https://github.com/open-telemetry/opentelemetry-proto.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope   `json:"scope"`
+	Spans []*span `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type span struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []keyValue `json:"attributes,omitempty"`
+	Status       status     `json:"status"`
+}
+
+type status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value value  `json:"value"`
+}
+
+type value struct {
+	String *string  `json:"stringValue,omitempty"`
+	Int    *string  `json:"intValue,omitempty"`
+	Double *float64 `json:"doubleValue,omitempty"`
+	Bool   *bool    `json:"boolValue,omitempty"`
+}
+
+func attribute(key string, v interface{}) keyValue {
+	kv := keyValue{Key: key}
+	switch t := v.(type) {
+	case bool:
+		kv.Value.Bool = &t
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		s := fmt.Sprint(t)
+		kv.Value.Int = &s
+	case float32:
+		f := float64(t)
+		kv.Value.Double = &f
+	case float64:
+		kv.Value.Double = &t
+	case string:
+		kv.Value.String = &t
+	default:
+		s := fmt.Sprint(t)
+		kv.Value.String = &s
+	}
+	return kv
+}
+
+func sortAttributes(attrs []keyValue) {
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].Key < attrs[j].Key
+	})
+}
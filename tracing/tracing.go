@@ -0,0 +1,123 @@
+// Package tracing turns ops into OpenTelemetry spans. Ops that should become
+// spans are marked using Start, which records span IDs and the start time in
+// the op's context. An Exporter registered as an ops.Reporter then exports
+// those ops as spans via OTLP when they end.
+//
+// Ops nest based on the goroutine's ops context, so ops started within a
+// traced op become its children. When work moves to another goroutine, like
+// the dials made by http.Transport, the parent span can travel in a
+// context.Context instead (see WithSpanContext and StartFromContext).
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// Keys used in the ops context.
+const (
+	KeyTraceID      = "trace_id"
+	KeySpanID       = "span_id"
+	KeyParentSpanID = "parent_span_id"
+
+	keySpanOp    = "span_op"
+	keySpanKind  = "span_kind"
+	keySpanStart = "span_start"
+)
+
+// Kind is the OpenTelemetry span kind.
+type Kind int
+
+// Span kinds, numbered as in OTLP.
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+	Client   Kind = 3
+)
+
+// SpanContext identifies a span.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// IsValid indicates whether this SpanContext identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// Start marks the given op, which must have just begun, as a span. The span's
+// parent is the span of the enclosing op, if any. Otherwise, a new trace is
+// started.
+func Start(op ops.Op, kind Kind) SpanContext {
+	current := ops.AsMap(nil, false)
+	traceID, _ := current[KeyTraceID].(string)
+	parentSpanID, _ := current[KeySpanID].(string)
+	return start(op, current, traceID, parentSpanID, kind)
+}
+
+// StartFromContext is like Start, but uses the span attached to ctx as the
+// parent if there is one.
+func StartFromContext(ctx context.Context, op ops.Op, kind Kind) SpanContext {
+	if parent := SpanContextFrom(ctx); parent.IsValid() {
+		return start(op, ops.AsMap(nil, false), parent.TraceID, parent.SpanID, kind)
+	}
+	return Start(op, kind)
+}
+
+// StartRemote is like Start, but continues a trace whose parent span lives in
+// another process, as identified by a W3C traceparent for example.
+func StartRemote(op ops.Op, traceID string, parentSpanID string, kind Kind) SpanContext {
+	return start(op, ops.AsMap(nil, false), traceID, parentSpanID, kind)
+}
+
+func start(op ops.Op, current map[string]interface{}, traceID string, parentSpanID string, kind Kind) SpanContext {
+	if traceID == "" {
+		traceID = NewTraceID()
+		parentSpanID = ""
+	}
+	sc := SpanContext{TraceID: traceID, SpanID: NewSpanID()}
+	op.Set(KeyTraceID, sc.TraceID).
+		Set(KeySpanID, sc.SpanID).
+		Set(keySpanOp, current["op"]).
+		Set(keySpanKind, kind).
+		Set(keySpanStart, time.Now())
+	if parentSpanID != "" {
+		op.Set(KeyParentSpanID, parentSpanID)
+	}
+	return sc
+}
+
+type spanContextKey struct{}
+
+// WithSpanContext attaches the given SpanContext to ctx.
+func WithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFrom returns the SpanContext attached to ctx, which is invalid if
+// there isn't one.
+func SpanContextFrom(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// NewTraceID generates a random 16 byte trace ID in hex.
+func NewTraceID() string {
+	return randomHex(16)
+}
+
+// NewSpanID generates a random 8 byte span ID in hex.
+func NewSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
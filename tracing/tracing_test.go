@@ -0,0 +1,186 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/ops"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collector is an in-memory stand-in for an OTLP/HTTP collector.
+type collector struct {
+	*httptest.Server
+	mx       sync.Mutex
+	requests []*exportRequest
+	headers  []http.Header
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, tracesPath, req.URL.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		er := &exportRequest{}
+		if !assert.NoError(t, json.NewDecoder(req.Body).Decode(er)) {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.mx.Lock()
+		c.requests = append(c.requests, er)
+		c.headers = append(c.headers, req.Header)
+		c.mx.Unlock()
+		resp.Write([]byte("{}"))
+	}))
+	return c
+}
+
+// spans returns all received spans keyed by name.
+func (c *collector) spans() map[string]*span {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	result := make(map[string]*span)
+	for _, er := range c.requests {
+		for _, rs := range er.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					result[s.Name] = s
+				}
+			}
+		}
+	}
+	return result
+}
+
+func attr(s *span, key string) interface{} {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			switch {
+			case kv.Value.String != nil:
+				return *kv.Value.String
+			case kv.Value.Int != nil:
+				return *kv.Value.Int
+			case kv.Value.Bool != nil:
+				return *kv.Value.Bool
+			case kv.Value.Double != nil:
+				return *kv.Value.Double
+			}
+		}
+	}
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	c := newCollector(t)
+	defer c.Close()
+
+	e, err := NewExporter(&Opts{
+		Endpoint:           c.URL,
+		Headers:            map[string]string{"Authorization": "Bearer token"},
+		ResourceAttributes: map[string]string{"deployment.environment": "test"},
+	})
+	require.NoError(t, err)
+	defer e.Close()
+	ops.RegisterReporter(e.Report)
+
+	connOp := ops.Begin("test_connection").Set("client_ip", "127.0.0.1")
+	connSpan := Start(connOp, Server)
+
+	requestOp := ops.Begin("test_request")
+	requestSpan := Start(requestOp, Server)
+	ctx := WithSpanContext(context.Background(), requestSpan)
+
+	// Untraced ops aren't exported even though they inherit span fields
+	ops.Begin("test_untraced").End()
+
+	// Dial happens on another goroutine, like in http.Transport
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dialOp := ops.Begin("test_dial").Set("dial_addr", "origin:80").Set("attempts", 2)
+		StartFromContext(ctx, dialOp, Client)
+		dialOp.FailIf(errors.New("connection refused"))
+		dialOp.End()
+	}()
+	wg.Wait()
+
+	requestOp.End()
+	connOp.End()
+	e.Flush()
+
+	spans := c.spans()
+	assert.Len(t, spans, 3)
+	conn, request, dial := spans["test_connection"], spans["test_request"], spans["test_dial"]
+	require.NotNil(t, conn)
+	require.NotNil(t, request)
+	require.NotNil(t, dial)
+
+	assert.Equal(t, connSpan.TraceID, conn.TraceID)
+	assert.Equal(t, connSpan.SpanID, conn.SpanID)
+	assert.Empty(t, conn.ParentSpanID)
+	assert.Equal(t, int(Server), conn.Kind)
+	assert.Equal(t, "127.0.0.1", attr(conn, "client_ip"))
+
+	assert.Equal(t, conn.TraceID, request.TraceID)
+	assert.Equal(t, conn.SpanID, request.ParentSpanID)
+	assert.Equal(t, "127.0.0.1", attr(request, "client_ip"), "should inherit attributes")
+
+	assert.Equal(t, conn.TraceID, dial.TraceID)
+	assert.Equal(t, request.SpanID, dial.ParentSpanID)
+	assert.Equal(t, int(Client), dial.Kind)
+	assert.Equal(t, "origin:80", attr(dial, "dial_addr"))
+	assert.Equal(t, "2", attr(dial, "attempts"))
+	assert.Equal(t, statusError, dial.Status.Code)
+	assert.Equal(t, "connection refused", dial.Status.Message)
+	assert.Equal(t, 0, request.Status.Code)
+	assert.True(t, dial.Start <= dial.End)
+
+	c.mx.Lock()
+	assert.Equal(t, "Bearer token", c.headers[0].Get("Authorization"))
+	resourceAttrs := c.requests[0].ResourceSpans[0].Resource.Attributes
+	c.mx.Unlock()
+	if assert.Len(t, resourceAttrs, 2) {
+		assert.Equal(t, "deployment.environment", resourceAttrs[0].Key)
+		assert.Equal(t, "service.name", resourceAttrs[1].Key)
+		assert.Equal(t, "http-proxy", *resourceAttrs[1].Value.String)
+	}
+}
+
+func TestStartRemote(t *testing.T) {
+	op := ops.Begin("test_remote")
+	sc := StartRemote(op, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", Server)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID)
+	s := toSpan(nil, ops.AsMap(nil, false), time.Now())
+	if assert.NotNil(t, s) {
+		assert.Equal(t, "00f067aa0ba902b7", s.ParentSpanID)
+		assert.Equal(t, sc.SpanID, s.SpanID)
+	}
+	op.End()
+}
+
+func TestBatching(t *testing.T) {
+	c := newCollector(t)
+	defer c.Close()
+
+	e, err := NewExporter(&Opts{Endpoint: c.URL + tracesPath, BatchSize: 2})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		op := ops.Begin("test_batch")
+		Start(op, Internal)
+		e.Report(nil, ops.AsMap(nil, false))
+		op.End()
+	}
+	e.Close()
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	assert.Len(t, c.requests, 3)
+}
@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	supported = true
+
+	// maxSpliceSize is how much we move per splice call, the pipe in between
+	// the sockets limits this further
+	maxSpliceSize = 1 << 20
+
+	spliceMove     = 0x1 // SPLICE_F_MOVE
+	spliceNonblock = 0x2 // SPLICE_F_NONBLOCK
+)
+
+// splice moves data from src to dst through a pipe until src hits EOF, calling
+// onTransfer with the number of bytes after each chunk written to dst. Blocking
+// happens in the runtime poller, so deadlines on either connection apply.
+func splice(dst *net.TCPConn, src *net.TCPConn, onTransfer func(int)) error {
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return os.NewSyscallError("pipe2", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	rsrc, err := src.SyscallConn()
+	if err != nil {
+		return err
+	}
+	rdst, err := dst.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	for {
+		var n int64
+		var serr error
+		err := rsrc.Read(func(fd uintptr) bool {
+			for {
+				n, serr = syscall.Splice(int(fd), nil, p[1], nil, maxSpliceSize, spliceMove|spliceNonblock)
+				if serr != syscall.EINTR {
+					return serr != syscall.EAGAIN
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if serr != nil {
+			return opError(src, serr)
+		}
+		if n == 0 {
+			// EOF
+			return nil
+		}
+
+		for remaining := n; remaining > 0; {
+			var m int64
+			err := rdst.Write(func(fd uintptr) bool {
+				for {
+					m, serr = syscall.Splice(p[0], nil, int(fd), nil, int(remaining), spliceMove|spliceNonblock)
+					if serr != syscall.EINTR {
+						return serr != syscall.EAGAIN
+					}
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if serr != nil {
+				return opError(dst, serr)
+			}
+			remaining -= m
+		}
+		onTransfer(int(n))
+	}
+}
+
+func opError(conn *net.TCPConn, err error) error {
+	return &net.OpError{Op: "splice", Net: "tcp", Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: os.NewSyscallError("splice", err)}
+}
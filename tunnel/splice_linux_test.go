@@ -0,0 +1,59 @@
+package tunnel
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// BenchmarkTunnel compares the throughput and CPU time of CONNECT tunnels with
+// and without splice. Data is echoed by the origin, so every byte passes
+// through the proxy twice. Run with:
+//
+//	go test -run none -bench Tunnel ./tunnel
+func BenchmarkTunnel(b *testing.B) {
+	b.Run("copy", func(b *testing.B) { benchmarkTunnel(b, false) })
+	b.Run("splice", func(b *testing.B) { benchmarkTunnel(b, true) })
+}
+
+func benchmarkTunnel(b *testing.B, splice bool) {
+	const chunkSize = 64 << 10
+
+	origin, stopOrigin := startOrigin(b)
+	defer stopOrigin()
+	proxyAddr, stopProxy := startProxy(b, splice, func(l net.Listener) net.Listener { return l })
+	defer stopProxy()
+
+	conn, br := connect(b, proxyAddr, origin, nil)
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(ioutil.Discard, br, int64(b.N)*chunkSize)
+		done <- err
+	}()
+
+	chunk := make([]byte, chunkSize)
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	cpuBefore := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		_, err := conn.Write(chunk)
+		require.NoError(b, err)
+	}
+	require.NoError(b, <-done)
+	b.StopTimer()
+	// CPU time of the whole process, including the client and origin, which
+	// are the same in both cases
+	b.ReportMetric(float64(cpuTime(b)-cpuBefore)/float64(b.N), "cpu-ns/op")
+}
+
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	require.NoError(b, syscall.Getrusage(syscall.RUSAGE_SELF, &usage))
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
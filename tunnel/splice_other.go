@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+const supported = false
+
+func splice(dst *net.TCPConn, src *net.TCPConn, onTransfer func(int)) error {
+	return errors.New("splice is only supported on Linux")
+}
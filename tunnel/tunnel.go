@@ -0,0 +1,269 @@
+// Package tunnel speeds up CONNECT tunnels by moving data directly between the
+// client and upstream sockets with splice(2) on Linux instead of copying it
+// through user space buffers.
+//
+// The proxy copies tunneled data by reading from one connection and writing
+// to the other. Client connections wrapped with Wrap and upstream connections
+// dialed through WrapDial are paired up when the CONNECT dial happens, after
+// which a Read on either one pumps all data from its socket into the peer's
+// socket until EOF. This only happens when both connections are plain TCP
+// connections underneath their wrappers, everything else (TLS, Unix sockets,
+// other platforms) is copied as usual.
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy/v2"
+
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/metrics"
+)
+
+var (
+	log = golog.LoggerFor("tunnel")
+
+	// SplicedTunnels counts tunnels that moved their data with splice.
+	SplicedTunnels = metrics.Counter("tunnel_spliced")
+
+	// SplicedBytes counts bytes moved with splice, in both directions.
+	SplicedBytes = metrics.Counter("tunnel_spliced_bytes")
+)
+
+type downstreamKey struct{}
+
+// WithDownstream returns a copy of ctx carrying the given client connection so
+// that WrapDial can pair it with the upstream connection of a CONNECT tunnel.
+func WithDownstream(ctx context.Context, downstream *Conn) context.Context {
+	return context.WithValue(ctx, downstreamKey{}, downstream)
+}
+
+// WrapDial wraps the given dial function so that connections dialed for
+// CONNECT requests are paired with the client connection from the dial
+// context (see WithDownstream) for zero-copy tunneling.
+func WrapDial(dial proxy.DialFunc) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		if err != nil || !isCONNECT {
+			return conn, err
+		}
+		downstream, _ := ctx.Value(downstreamKey{}).(*Conn)
+		if downstream == nil {
+			return conn, nil
+		}
+		upstream := Wrap(conn)
+		if !Pair(downstream, upstream) {
+			return conn, nil
+		}
+		return upstream, nil
+	}
+}
+
+// Conn is a net.Conn that can be paired with another Conn to splice data
+// between their underlying sockets.
+type Conn struct {
+	listeners.WrapConnEmbeddable
+	net.Conn
+
+	raw       *net.TCPConn
+	observers []listeners.DirectTransferObserver
+
+	// yielded is only accessed from Read
+	yielded bool
+
+	mx         sync.RWMutex
+	peer       *Conn
+	noSplice   bool
+	onTransfer []func(recv int, sent int, done bool)
+	endOnce    sync.Once
+}
+
+// Wrap wraps the given connection, finding the raw TCP connection underneath
+// it by walking the chain of connections exposing Wrapped().
+func Wrap(conn net.Conn) *Conn {
+	sac, _ := conn.(listeners.WrapConnEmbeddable)
+	c := &Conn{WrapConnEmbeddable: sac, Conn: conn}
+	c.raw, c.observers = unwrap(conn)
+	return c
+}
+
+type wrapped interface {
+	Wrapped() net.Conn
+}
+
+// unwrap finds the raw TCP connection underlying conn, along with the
+// wrappers on the way that need to know about direct transfers.
+func unwrap(conn net.Conn) (*net.TCPConn, []listeners.DirectTransferObserver) {
+	var observers []listeners.DirectTransferObserver
+	for conn != nil {
+		if observer, ok := conn.(listeners.DirectTransferObserver); ok {
+			observers = append(observers, observer)
+		}
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, observers
+		case wrapped:
+			conn = c.Wrapped()
+		default:
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+// Pair pairs the given client and upstream connections for splicing,
+// returning false if that isn't possible.
+func Pair(downstream *Conn, upstream *Conn) bool {
+	if !supported || downstream.raw == nil || upstream.raw == nil {
+		return false
+	}
+	if downstream.getPeer() != nil || upstream.getPeer() != nil || downstream.splicingDisabled() {
+		return false
+	}
+	// Wrappers like idletiming leave deadlines on the raw connections that
+	// don't apply to us
+	downstream.raw.SetReadDeadline(time.Time{})
+	upstream.raw.SetReadDeadline(time.Time{})
+	downstream.begin(upstream)
+	upstream.begin(downstream)
+	SplicedTunnels.Add(1)
+	log.Tracef("Splicing between %v and %v", downstream.RemoteAddr(), upstream.RemoteAddr())
+	return true
+}
+
+func (c *Conn) begin(peer *Conn) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.peer = peer
+	for _, observer := range c.observers {
+		c.onTransfer = append(c.onTransfer, observer.BeginDirectTransfer())
+	}
+}
+
+// DisableSplicing keeps the client connection conn (or the Conn it wraps) from
+// being paired, so that data tunneled over it passes through the wrappers of
+// the upstream connection. Filters that need to see or shape tunneled data call
+// this before the CONNECT dial.
+func DisableSplicing(conn net.Conn) {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *Conn:
+			c.mx.Lock()
+			c.noSplice = true
+			c.mx.Unlock()
+			return
+		case wrapped:
+			conn = c.Wrapped()
+		default:
+			return
+		}
+	}
+}
+
+func (c *Conn) splicingDisabled() bool {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.noSplice
+}
+
+func (c *Conn) getPeer() *Conn {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.peer
+}
+
+func (c *Conn) transferred(recv int, sent int) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	for _, onTransfer := range c.onTransfer {
+		onTransfer(recv, sent, false)
+	}
+}
+
+func (c *Conn) end() {
+	c.endOnce.Do(func() {
+		c.mx.RLock()
+		defer c.mx.RUnlock()
+		for _, onTransfer := range c.onTransfer {
+			onTransfer(0, 0, true)
+		}
+	})
+}
+
+// Read reads from the wrapped connection until the connection is paired.
+// After that, it splices everything from this connection's socket into the
+// peer's socket and returns io.EOF once done.
+func (c *Conn) Read(b []byte) (int, error) {
+	peer := c.getPeer()
+	if peer == nil {
+		return c.Conn.Read(b)
+	}
+	if !c.yielded {
+		// The proxy may have buffered data that it prepends to our stream with
+		// preconn, which reads from us in the same call. Return nothing at
+		// first so that the buffered data gets written before we splice.
+		c.yielded = true
+		return 0, nil
+	}
+	// We're the only writer on the peer's socket now
+	peer.raw.SetWriteDeadline(time.Time{})
+	err := splice(peer.raw, c.raw, func(n int) {
+		c.transferred(n, 0)
+		peer.transferred(0, n)
+		SplicedBytes.Add(int64(n))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 0, io.EOF
+}
+
+// SetDeadline implements net.Conn, also applying the deadline to the raw
+// connection once paired.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if c.getPeer() != nil {
+		c.raw.SetDeadline(t)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn, also applying the deadline to the raw
+// connection once paired. The proxy uses this to stop tunneling in one
+// direction once the other is done.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.getPeer() != nil {
+		c.raw.SetReadDeadline(t)
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Close implements net.Conn.
+func (c *Conn) Close() error {
+	c.end()
+	return c.Conn.Close()
+}
+
+// OnState implements listeners.WrapConn.
+func (c *Conn) OnState(s http.ConnState) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+// ControlMessage implements listeners.WrapConn.
+func (c *Conn) ControlMessage(msgType string, data interface{}) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+// Wrapped implements listeners.WrapConn.
+func (c *Conn) Wrapped() net.Conn {
+	return c.Conn
+}
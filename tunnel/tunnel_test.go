@@ -0,0 +1,190 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/getlantern/proxy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+// startOrigin starts a TCP server that echoes everything back.
+func startOrigin(tb testing.TB) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// startProxy starts a proxy that handles connections like server.Server does,
+// with the given listener wrapper applied to client connections.
+func startProxy(tb testing.TB, splice bool, wrap func(net.Listener) net.Listener) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	p, err := proxy.New(&proxy.Opts{
+		OKWaitsForUpstream: true,
+		Dial: WrapDial(func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}),
+	})
+	require.NoError(tb, err)
+
+	wl := wrap(listeners.NewDefaultListener(l))
+	go func() {
+		for {
+			conn, err := wl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ctx := context.Background()
+				tc := Wrap(conn)
+				if splice {
+					ctx = WithDownstream(ctx, tc)
+				}
+				p.Handle(ctx, tc, tc)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// connect opens a CONNECT tunnel to origin through the proxy, sending the
+// given initial data along with the CONNECT request.
+func connect(tb testing.TB, proxyAddr string, origin string, initial []byte) (*net.TCPConn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(tb, err)
+	_, err = fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n%s", origin, origin, initial)
+	require.NoError(tb, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(tb, err)
+	require.Equal(tb, http.StatusOK, resp.StatusCode)
+	return conn.(*net.TCPConn), br
+}
+
+func TestSplice(t *testing.T) {
+	origin, stopOrigin := startOrigin(t)
+	defer stopOrigin()
+
+	finalStats := make(chan *measured.Stats, 1)
+	proxyAddr, stopProxy := startProxy(t, true, func(l net.Listener) net.Listener {
+		l = listeners.NewMeasuredListener(l, time.Hour, func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+			if final {
+				finalStats <- stats
+			}
+		})
+		return listeners.NewIdleConnListener(l, 5*time.Second)
+	})
+	defer stopProxy()
+
+	splicedTunnels := SplicedTunnels.Value()
+	splicedBytes := SplicedBytes.Value()
+
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	conn, br := connect(t, proxyAddr, origin, data[:10])
+	defer conn.Close()
+	go func() {
+		conn.Write(data[10:])
+		conn.CloseWrite()
+	}()
+	echoed, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, echoed), "echoed data should match")
+
+	select {
+	case stats := <-finalStats:
+		assert.True(t, stats.RecvTotal >= len(data), "received bytes should be measured")
+		assert.True(t, stats.SentTotal >= len(data), "sent bytes should be measured")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+	if supported {
+		assert.Equal(t, splicedTunnels+1, SplicedTunnels.Value())
+		// The initial data was buffered by the proxy and copied as usual
+		assert.Equal(t, splicedBytes+int64(2*len(data)-10), SplicedBytes.Value())
+	}
+}
+
+func TestSpliceIdle(t *testing.T) {
+	origin, stopOrigin := startOrigin(t)
+	defer stopOrigin()
+	proxyAddr, stopProxy := startProxy(t, true, func(l net.Listener) net.Listener {
+		return listeners.NewIdleConnListener(l, 300*time.Millisecond)
+	})
+	defer stopProxy()
+
+	conn, br := connect(t, proxyAddr, origin, nil)
+	defer conn.Close()
+	// Activity keeps the tunnel open
+	for i := 0; i < 6; i++ {
+		_, err := conn.Write([]byte{byte(i)})
+		require.NoError(t, err)
+		b, err := br.ReadByte()
+		require.NoError(t, err)
+		assert.Equal(t, byte(i), b)
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Inactivity closes it
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err := br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "idle tunnel should have been closed")
+}
+
+func TestNoSpliceWithoutTCP(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	assert.False(t, Pair(Wrap(a), Wrap(b)))
+}
+
+func TestDisableSplicing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer dialed.Close()
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+
+	downstream := Wrap(accepted)
+	DisableSplicing(&wrappingConn{downstream})
+	assert.False(t, Pair(downstream, Wrap(dialed)))
+}
+
+type wrappingConn struct {
+	net.Conn
+}
+
+func (c *wrappingConn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,324 @@
+// Package upgrade supports systemd socket activation and zero-downtime binary
+// upgrades.
+//
+// With socket activation, systemd opens the listening sockets and passes them
+// to the process as file descriptors 3 and up, announced through the
+// LISTEN_FDS and LISTEN_PID environment variables (see sd_listen_fds(3)).
+// Inherited picks them up.
+//
+// Upgrades use the same mechanism: the running process execs a fresh copy of
+// its binary, passing its listening sockets along, waits for the child to
+// call Ready, and then drains its own connections while the child accepts new
+// ones. No connection is refused in the process since the sockets stay open
+// throughout.
+package upgrade
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	envListenFDs     = "LISTEN_FDS"
+	envListenPID     = "LISTEN_PID"
+	envListenFDNames = "LISTEN_FDNAMES"
+
+	// envReadyFD tells a child started by Upgrade which file descriptor to
+	// signal readiness on
+	envReadyFD = "HTTP_PROXY_READY_FD"
+
+	// listenFDsStart is the first file descriptor passed by systemd
+	listenFDsStart = 3
+
+	defaultReadyTimeout = 30 * time.Second
+	defaultDrainTimeout = 5 * time.Minute
+)
+
+var (
+	log = golog.LoggerFor("upgrade")
+
+	// ErrUpgrading is returned by Upgrade when another upgrade is in progress.
+	ErrUpgrading = errors.New("Upgrade already in progress")
+)
+
+// Inherited returns the listeners passed to this process by systemd or by a
+// parent process during an upgrade, or nil if there are none. The related
+// environment variables are cleared so they don't leak to child processes.
+func Inherited() ([]net.Listener, error) {
+	return inherited(listenFDsStart)
+}
+
+func inherited(start int) ([]net.Listener, error) {
+	fdsString := os.Getenv(envListenFDs)
+	pidString := os.Getenv(envListenPID)
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenPID)
+	os.Unsetenv(envListenFDNames)
+	if fdsString == "" {
+		return nil, nil
+	}
+	// systemd sets LISTEN_PID, our parent doesn't know our PID in advance and
+	// leaves it empty
+	if pidString != "" && pidString != strconv.Itoa(os.Getpid()) {
+		log.Debugf("Ignoring %v meant for process %v", envListenFDs, pidString)
+		return nil, nil
+	}
+	numFDs, err := strconv.Atoi(fdsString)
+	if err != nil || numFDs < 0 {
+		return nil, errors.New("Invalid %v %q", envListenFDs, fdsString)
+	}
+
+	ls := make([]net.Listener, 0, numFDs)
+	for i := 0; i < numFDs; i++ {
+		fd := start + i
+		closeOnExec(fd)
+		name := "listener"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		// FileListener dups the descriptor, so we close ours either way
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, errors.New("Unable to use inherited file descriptor %d (%v): %v", fd, name, err)
+		}
+		ls = append(ls, l)
+	}
+	log.Debugf("Inherited %d listeners", len(ls))
+	return ls, nil
+}
+
+// Ready tells the parent process that started us during an upgrade, if any,
+// that we're serving so that it can start draining. It does nothing when not
+// started by Upgrade.
+func Ready() error {
+	fdString := os.Getenv(envReadyFD)
+	os.Unsetenv(envReadyFD)
+	if fdString == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(fdString)
+	if err != nil {
+		return errors.New("Invalid %v %q", envReadyFD, fdString)
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		return errors.New("Unable to signal readiness to parent: %v", err)
+	}
+	return nil
+}
+
+// Opts configures an Upgrader.
+type Opts struct {
+	// Listeners are the listening sockets to pass to the new process. They
+	// need to be backed by files, like *net.TCPListener and *net.UnixListener.
+	Listeners []net.Listener
+
+	// Drain is called once the new process is ready. It should stop accepting
+	// connections and wait for open ones to finish until ctx is done, like
+	// server.Server.Shutdown.
+	Drain func(ctx context.Context) error
+
+	// DrainTimeout caps how long Drain may take. Defaults to 5 minutes.
+	DrainTimeout time.Duration
+
+	// ReadyTimeout caps how long to wait for the new process to call Ready.
+	// Defaults to 30 seconds.
+	ReadyTimeout time.Duration
+
+	// Args are the arguments for the new process. Defaults to the arguments
+	// of the current process.
+	Args []string
+
+	// Env is added to the environment of the new process.
+	Env []string
+
+	// Stdout and Stderr are where the output of the new process goes.
+	// Default to os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Upgrader replaces the current process with a new one without downtime.
+type Upgrader struct {
+	opts      Opts
+	upgrading int32
+}
+
+// New creates an Upgrader.
+func New(opts *Opts) *Upgrader {
+	u := &Upgrader{opts: *opts}
+	if u.opts.ReadyTimeout <= 0 {
+		u.opts.ReadyTimeout = defaultReadyTimeout
+	}
+	if u.opts.DrainTimeout <= 0 {
+		u.opts.DrainTimeout = defaultDrainTimeout
+	}
+	if u.opts.Args == nil {
+		u.opts.Args = os.Args[1:]
+	}
+	if u.opts.Stdout == nil {
+		u.opts.Stdout = os.Stdout
+	}
+	if u.opts.Stderr == nil {
+		u.opts.Stderr = os.Stderr
+	}
+	return u
+}
+
+// Upgrade starts a new copy of the current executable, passing it our
+// listeners, and waits until it's ready. It returns the PID of the new
+// process. If the new process fails to become ready, it's killed and we carry
+// on as before.
+func (u *Upgrader) Upgrade() (int, error) {
+	// Ignore upgrade requests while one is in progress
+	if !atomic.CompareAndSwapInt32(&u.upgrading, 0, 1) {
+		return 0, ErrUpgrading
+	}
+	defer atomic.StoreInt32(&u.upgrading, 0)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, errors.New("Unable to determine executable: %v", err)
+	}
+
+	files := make([]*os.File, 0, len(u.opts.Listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range u.opts.Listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, errors.New("Listener on %v isn't backed by a file", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, errors.New("Unable to get file for listener on %v: %v", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, errors.New("Unable to create readiness pipe: %v", err)
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(executable, u.opts.Args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = u.opts.Stdout
+	cmd.Stderr = u.opts.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(childEnv(),
+		envListenFDs+"="+strconv.Itoa(len(u.opts.Listeners)),
+		envReadyFD+"="+strconv.Itoa(listenFDsStart+len(u.opts.Listeners)))
+	cmd.Env = append(cmd.Env, u.opts.Env...)
+	if err := cmd.Start(); err != nil {
+		return 0, errors.New("Unable to start new process: %v", err)
+	}
+	// Close our copy of the write end so that reading fails if the child dies
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := readyR.Read(b)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			log.Debugf("New process %d is ready", cmd.Process.Pid)
+			return cmd.Process.Pid, nil
+		}
+		// Wait for the output of the killed process to be copied
+		cmd.Process.Kill()
+		<-exited
+		return 0, errors.New("New process %d failed before becoming ready: %v", cmd.Process.Pid, err)
+	case err := <-exited:
+		return 0, errors.New("New process exited before becoming ready: %v", err)
+	case <-time.After(u.opts.ReadyTimeout):
+		cmd.Process.Kill()
+		<-exited
+		return 0, errors.New("New process %d didn't become ready within %v", cmd.Process.Pid, u.opts.ReadyTimeout)
+	}
+}
+
+// Drain drains the current process using Opts.Drain, waiting at most
+// DrainTimeout.
+func (u *Upgrader) Drain() error {
+	if u.opts.Drain == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), u.opts.DrainTimeout)
+	defer cancel()
+	if err := u.opts.Drain(ctx); err != nil {
+		return errors.New("Unable to drain connections within %v: %v", u.opts.DrainTimeout, err)
+	}
+	return nil
+}
+
+// HandleSignals upgrades whenever the process receives the upgrade signal
+// (SIGUSR2) and calls exit once the upgrade has been completed and this
+// process is drained. Failed upgrades are logged and leave the process
+// running.
+func (u *Upgrader) HandleSignals(exit func()) {
+	if upgradeSignal == nil {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, upgradeSignal)
+	go func() {
+		for range signals {
+			log.Debug("Upgrading")
+			if _, err := u.Upgrade(); err != nil {
+				log.Errorf("Upgrade failed: %v", err)
+				continue
+			}
+			signal.Stop(signals)
+			if err := u.Drain(); err != nil {
+				log.Error(err)
+			}
+			exit()
+			return
+		}
+	}()
+}
+
+func childEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case envListenFDs, envListenPID, envListenFDNames, envReadyFD:
+			// Replaced for the child
+		default:
+			env = append(env, kv)
+		}
+	}
+	return env
+}
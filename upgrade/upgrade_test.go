@@ -0,0 +1,97 @@
+package upgrade
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const envTestChild = "UPGRADE_TEST_CHILD"
+
+func TestNoInherited(t *testing.T) {
+	ls, err := Inherited()
+	assert.NoError(t, err)
+	assert.Empty(t, ls, "should have no listeners without LISTEN_FDS")
+}
+
+func TestUpgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Passing listeners to child processes isn't supported on Windows")
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	drained := make(chan bool, 1)
+	u := New(&Opts{
+		Listeners: []net.Listener{l},
+		Args:      []string{"-test.run=^TestChild$"},
+		Env:       []string{envTestChild + "=1"},
+		Drain: func(ctx context.Context) error {
+			drained <- true
+			return l.Close()
+		},
+		ReadyTimeout: 10 * time.Second,
+		// The child keeps running after the test, so don't wait on its output
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+	})
+	_, err = u.Upgrade()
+	require.NoError(t, err)
+	require.NoError(t, u.Drain())
+	assert.True(t, <-drained)
+
+	// Our listener is closed, so only the child can answer now
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "child", string(b))
+}
+
+func TestFailedUpgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Passing listeners to child processes isn't supported on Windows")
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// The child exits without ever becoming ready
+	var stdout bytes.Buffer
+	u := New(&Opts{
+		Listeners: []net.Listener{l},
+		Args:      []string{"-test.run=^$"},
+		Stdout:    &stdout,
+		Stderr:    ioutil.Discard,
+	})
+	_, err = u.Upgrade()
+	assert.Error(t, err)
+	assert.Contains(t, stdout.String(), "PASS", "output of the child should go to Stdout")
+}
+
+// TestChild is the new process started by TestUpgrade.
+func TestChild(t *testing.T) {
+	if os.Getenv(envTestChild) == "" {
+		t.Skip("Only runs as the child of TestUpgrade")
+	}
+	ls, err := Inherited()
+	require.NoError(t, err)
+	require.Len(t, ls, 1)
+	require.NoError(t, Ready())
+	conn, err := ls[0].Accept()
+	require.NoError(t, err)
+	conn.Write([]byte("child"))
+	conn.Close()
+	ls[0].Close()
+}
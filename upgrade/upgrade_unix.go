@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package upgrade
+
+import (
+	"os"
+	"syscall"
+)
+
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
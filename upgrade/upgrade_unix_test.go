@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package upgrade
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInherited(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	// Give inherited its own descriptor to take ownership of
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	require.NoError(t, err)
+
+	os.Setenv(envListenFDs, "1")
+	os.Setenv(envListenPID, strconv.Itoa(os.Getpid()+1))
+	ls, err := inherited(fd)
+	require.NoError(t, err)
+	assert.Empty(t, ls, "should ignore listeners meant for another process")
+	assert.Empty(t, os.Getenv(envListenFDs))
+
+	os.Setenv(envListenFDs, "1")
+	os.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+	ls, err = inherited(fd)
+	require.NoError(t, err)
+	require.Len(t, ls, 1)
+	defer ls[0].Close()
+	assert.Equal(t, l.Addr().String(), ls[0].Addr().String())
+	assert.Empty(t, os.Getenv(envListenPID))
+
+	os.Setenv(envListenFDs, "bad")
+	_, err = inherited(fd)
+	assert.Error(t, err)
+}
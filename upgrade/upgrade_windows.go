@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package upgrade
+
+import (
+	"os"
+)
+
+// Windows has no SIGUSR2, so upgrades can't be triggered by signal there
+var upgradeSignal os.Signal
+
+func closeOnExec(fd int) {}
@@ -7,6 +7,8 @@ import (
 
 	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/errorpages"
 )
 
 type ErrorHandler interface {
@@ -19,6 +21,7 @@ var (
 	DefaultHandler ErrorHandler = &StdHandler{}
 )
 
+// StdHandler responds with an error page rendered by errorpages.Default.
 type StdHandler struct {
 }
 
@@ -29,7 +32,11 @@ func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err err
 		cause = structured.RootCause()
 	}
 	statusCode := http.StatusInternalServerError
-	if e, ok := cause.(net.Error); ok {
+	var reason errorpages.Reason
+	if e, ok := err.(*errorpages.Error); ok {
+		statusCode = e.Status
+		reason = e.Reason
+	} else if e, ok := cause.(net.Error); ok {
 		if e.Timeout() {
 			statusCode = http.StatusGatewayTimeout
 		} else {
@@ -39,8 +46,7 @@ func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err err
 		statusCode = http.StatusBadGateway
 	}
 	log.Errorf("Responding with %d due to %v: %v", statusCode, cause, desc)
-	w.WriteHeader(statusCode)
-	w.Write([]byte(http.StatusText(statusCode)))
+	errorpages.Default.ServeHTTP(w, req, statusCode, reason, err)
 }
 
 type ErrorHandlerFunc func(http.ResponseWriter, *http.Request, error)
@@ -0,0 +1,95 @@
+package validation
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// FuzzValidateHead checks ValidateHead against net/http and net/textproto,
+// which parse independently of us:
+//
+//   - heads with both Content-Length and Transfer-Encoding, or with several
+//     Content-Length headers, are rejected
+//   - complete heads that are accepted parse with http.ReadRequest, with the
+//     same method and framing
+//
+// go test runs it on the seed corpus in testdata/corpus, fuzz it with:
+//
+//	go test -run '^$' -fuzz FuzzValidateHead ./validation
+func FuzzValidateHead(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*"))
+	require.NoError(f, err)
+	for _, file := range files {
+		head, err := ioutil.ReadFile(file)
+		require.NoError(f, err)
+		f.Add(head)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if ValidateHead(data) != nil {
+			return
+		}
+		if header := readHeader(data); header != nil {
+			contentLengths := len(header["Content-Length"])
+			if contentLengths > 1 {
+				t.Fatal("Accepted request with multiple Content-Length headers")
+			}
+			if contentLengths > 0 && len(header["Transfer-Encoding"]) > 0 {
+				t.Fatal("Accepted request with both Content-Length and Transfer-Encoding")
+			}
+		}
+		// Leading empty lines aside, as the listener strips those
+		head := bytes.TrimLeft(data, "\r\n")
+		if !bytes.Contains(head, []byte("\n\n")) && !bytes.Contains(head, []byte("\n\r\n")) {
+			// Without the empty line that terminates the header fields,
+			// net/http fails reading past the end
+			return
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil {
+			t.Fatalf("Accepted request that net/http can't parse: %v", err)
+		}
+		method, _, _ := parseRequestLine(bytes.TrimSuffix(bytes.SplitN(head, []byte("\n"), 2)[0], []byte("\r")))
+		if req.Method != method {
+			t.Fatalf("Accepted method %q that net/http parses as %q", method, req.Method)
+		}
+		if cl := req.Header.Get("Content-Length"); cl != "" {
+			expected, _ := strconv.ParseInt(cl, 10, 64)
+			if req.ContentLength != expected {
+				t.Fatalf("Accepted Content-Length %q that net/http parses as %d", cl, req.ContentLength)
+			}
+		}
+		if len(req.TransferEncoding) > 0 && req.ContentLength >= 0 {
+			t.Fatal("Accepted request with ambiguous framing")
+		}
+	})
+}
+
+// readHeader parses the header fields of head with net/textproto, returning
+// nil if it can't.
+func readHeader(head []byte) textproto.MIMEHeader {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(head)))
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return nil
+		}
+		if line != "" {
+			break
+		}
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil
+	}
+	return header
+}
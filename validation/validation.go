@@ -0,0 +1,308 @@
+// Package validation implements strict checks on HTTP/1.x request heads that
+// reject requests which different HTTP implementations might interpret
+// differently, like those used for request smuggling. The checks operate on
+// the raw request head because net/http normalizes away much of what matters
+// (folded lines, duplicate Content-Length, the Host header of absolute-form
+// requests) while parsing.
+package validation
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+// Reasons for rejecting a request.
+const (
+	MalformedRequest                  errorpages.Reason = "malformed-request"
+	ContentLengthWithTransferEncoding errorpages.Reason = "content-length-with-transfer-encoding"
+	DuplicateContentLength            errorpages.Reason = "duplicate-content-length"
+	InvalidContentLength              errorpages.Reason = "invalid-content-length"
+	InvalidTransferEncoding           errorpages.Reason = "invalid-transfer-encoding"
+	ObsoleteLineFolding               errorpages.Reason = "obsolete-line-folding"
+	InvalidHeaderName                 errorpages.Reason = "invalid-header-name"
+	InvalidHeaderValue                errorpages.Reason = "invalid-header-value"
+	DuplicateHost                     errorpages.Reason = "duplicate-host"
+	HostMismatch                      errorpages.Reason = "host-mismatch"
+	InvalidConnectTarget              errorpages.Reason = "invalid-connect-target"
+)
+
+const (
+	maxContentLengthDigits = 18
+)
+
+func invalid(reason errorpages.Reason, description string, params ...interface{}) error {
+	return errorpages.NewError(http.StatusBadRequest, reason, description, params...)
+}
+
+// ValidateHead validates the raw head of a request, that is its request line
+// and header fields up to and including the empty line that terminates them.
+// It returns an *errorpages.Error with status 400 and the reason for rejecting
+// the request, or nil if the request is acceptable.
+func ValidateHead(head []byte) error {
+	lines := bytes.Split(head, []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimSuffix(line, []byte("\r"))
+	}
+	// Skip empty lines preceding the request line
+	for len(lines) > 0 && len(lines[0]) == 0 {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 {
+		return invalid(MalformedRequest, "Empty request")
+	}
+
+	method, target, err := parseRequestLine(lines[0])
+	if err != nil {
+		return err
+	}
+
+	var contentLengths, transferEncodings, hosts []string
+	for _, line := range lines[1:] {
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return invalid(ObsoleteLineFolding, "Obsolete line folding")
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || !isToken(string(line[:colon])) {
+			return invalid(InvalidHeaderName, "Invalid header name in %q", truncate(line))
+		}
+		name := string(line[:colon])
+		value := strings.Trim(string(line[colon+1:]), " \t")
+		if !isValidValue(value) {
+			return invalid(InvalidHeaderValue, "Invalid value for header %v", name)
+		}
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			contentLengths = append(contentLengths, value)
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			transferEncodings = append(transferEncodings, value)
+		case strings.EqualFold(name, "Host"):
+			hosts = append(hosts, value)
+		}
+	}
+
+	if err := checkFraming(contentLengths, transferEncodings); err != nil {
+		return err
+	}
+	if len(hosts) > 1 {
+		return invalid(DuplicateHost, "Multiple Host headers")
+	}
+	host := ""
+	if len(hosts) == 1 {
+		host = hosts[0]
+	}
+	return checkTarget(method, target, host)
+}
+
+// ValidateRequest applies the checks that are still possible on a request
+// parsed by net/http. Use it when the raw head isn't available. By then,
+// net/http has already rejected conflicting Content-Length headers and
+// unsupported transfer codings, but it also hides some of what ValidateHead
+// catches: it drops Content-Length in favor of Transfer-Encoding, merges
+// identical Content-Length headers, unfolds obsolete line folding and replaces
+// Host with the host of an absolute request target.
+func ValidateRequest(req *http.Request) error {
+	if req.ProtoMajor != 1 {
+		return invalid(MalformedRequest, "Unsupported protocol %v", req.Proto)
+	}
+	for name := range req.Header {
+		if !isToken(name) {
+			return invalid(InvalidHeaderName, "Invalid header name %q", name)
+		}
+	}
+	if len(req.TransferEncoding) > 0 {
+		if req.ContentLength >= 0 {
+			return invalid(ContentLengthWithTransferEncoding, "Both Content-Length and Transfer-Encoding specified")
+		}
+		if err := checkFraming(nil, req.TransferEncoding); err != nil {
+			return err
+		}
+	}
+	if err := checkFraming(req.Header["Content-Length"], nil); err != nil {
+		return err
+	}
+	if req.RequestURI == "" {
+		// Not read from a client
+		return nil
+	}
+	// Compares the host of absolute targets with req.Host, in case anything
+	// changed either of them after parsing
+	return checkTarget(req.Method, req.RequestURI, req.Host)
+}
+
+func parseRequestLine(line []byte) (string, string, error) {
+	parts := strings.Split(string(line), " ")
+	if len(parts) != 3 || !isToken(parts[0]) || parts[1] == "" || !isHTTP1(parts[2]) {
+		return "", "", invalid(MalformedRequest, "Malformed request line %q", truncate(line))
+	}
+	for _, c := range parts[1] {
+		if c <= ' ' || c == 0x7f {
+			return "", "", invalid(MalformedRequest, "Malformed request target")
+		}
+	}
+	return parts[0], parts[1], nil
+}
+
+// isHTTP1 tells whether version is HTTP/1.x with a single digit minor
+// version, like net/http expects.
+func isHTTP1(version string) bool {
+	return len(version) == len("HTTP/1.1") && strings.HasPrefix(version, "HTTP/1.") && version[7] >= '0' && version[7] <= '9'
+}
+
+func checkFraming(contentLengths []string, transferEncodings []string) error {
+	if len(contentLengths) > 0 && len(transferEncodings) > 0 {
+		return invalid(ContentLengthWithTransferEncoding, "Both Content-Length and Transfer-Encoding specified")
+	}
+	if len(contentLengths) > 1 {
+		return invalid(DuplicateContentLength, "Multiple Content-Length headers")
+	}
+	if len(contentLengths) == 1 {
+		cl := contentLengths[0]
+		if strings.Contains(cl, ",") {
+			return invalid(DuplicateContentLength, "Content-Length with multiple values")
+		}
+		if cl == "" || len(cl) > maxContentLengthDigits || strings.Trim(cl, "0123456789") != "" {
+			return invalid(InvalidContentLength, "Invalid Content-Length %q", cl)
+		}
+	}
+	if len(transferEncodings) > 0 {
+		// net/http only supports chunked, so that's all we accept too
+		codings := strings.Split(strings.Join(transferEncodings, ","), ",")
+		if len(codings) != 1 || !strings.EqualFold(strings.Trim(codings[0], " \t"), "chunked") {
+			return invalid(InvalidTransferEncoding, "Unsupported Transfer-Encoding %q", strings.Join(transferEncodings, ", "))
+		}
+	}
+	return nil
+}
+
+func checkTarget(method string, target string, host string) error {
+	if method == http.MethodConnect {
+		return checkConnectTarget(target, host)
+	}
+	if target == "*" {
+		if method != http.MethodOptions {
+			return invalid(MalformedRequest, "Asterisk target only allowed for OPTIONS")
+		}
+		return nil
+	}
+	// Like net/http, which doesn't allow fragments or invalid escapes either
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return invalid(MalformedRequest, "Malformed request target")
+	}
+	if strings.HasPrefix(target, "/") {
+		return nil
+	}
+
+	// absolute-form
+	if u.Host == "" || (!strings.EqualFold(u.Scheme, "http") && !strings.EqualFold(u.Scheme, "https")) {
+		return invalid(MalformedRequest, "Malformed request target")
+	}
+	if host != "" && !sameAuthority(u.Host, host, defaultPort(u.Scheme)) {
+		return invalid(HostMismatch, "Host %q doesn't match request target %q", host, u.Host)
+	}
+	return nil
+}
+
+func checkConnectTarget(target string, host string) error {
+	h, port, err := net.SplitHostPort(target)
+	if err != nil || h == "" || strings.ContainsAny(target, "/?#@") {
+		return invalid(InvalidConnectTarget, "Invalid CONNECT target %q", target)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 || strings.Trim(port, "0123456789") != "" {
+		return invalid(InvalidConnectTarget, "Invalid port in CONNECT target %q", target)
+	}
+	// Brackets are only for IPv6 literals
+	bracketed := strings.HasPrefix(target, "[")
+	if !isValidHost(h) || bracketed && (net.ParseIP(h) == nil || !strings.Contains(h, ":")) {
+		return invalid(InvalidConnectTarget, "Invalid host in CONNECT target %q", target)
+	}
+	if host != "" && !sameAuthority(target, host, "") {
+		return invalid(HostMismatch, "Host %q doesn't match CONNECT target %q", host, target)
+	}
+	return nil
+}
+
+// sameAuthority compares two authorities (host and optional port), treating a
+// missing port as the given default port.
+func sameAuthority(a string, b string, defaultPort string) bool {
+	normalize := func(authority string) string {
+		authority = strings.ToLower(authority)
+		h, port, err := net.SplitHostPort(authority)
+		if err != nil {
+			h, port = strings.Trim(authority, "[]"), defaultPort
+		}
+		if port == "" {
+			port = defaultPort
+		}
+		return net.JoinHostPort(h, port)
+	}
+	return normalize(a) == normalize(b)
+}
+
+func defaultPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+func isValidHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for _, c := range host {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isToken checks for a token as defined in RFC 7230 section 3.2.6.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isValidValue rejects control characters other than horizontal tab.
+func isValidValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func truncate(b []byte) string {
+	const max = 64
+	if len(b) > max {
+		return string(b[:max]) + "..."
+	}
+	return string(b)
+}
@@ -0,0 +1,146 @@
+package validation
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+// expectedReasons maps the files in testdata/corpus to the reason we expect
+// them to be rejected for, or "" if they're valid.
+var expectedReasons = map[string]errorpages.Reason{
+	"valid-get":             "",
+	"valid-absolute":        "",
+	"valid-post":            "",
+	"valid-chunked":         "",
+	"valid-connect":         "",
+	"valid-connect-ipv6":    "",
+	"valid-leading-crlf":    "",
+	"cl-te":                 ContentLengthWithTransferEncoding,
+	"te-cl":                 ContentLengthWithTransferEncoding,
+	"duplicate-cl":          DuplicateContentLength,
+	"duplicate-cl-same":     DuplicateContentLength,
+	"cl-list":               DuplicateContentLength,
+	"cl-signed":             InvalidContentLength,
+	"te-xchunked":           InvalidTransferEncoding,
+	"te-identity-chunked":   InvalidTransferEncoding,
+	"te-duplicate":          InvalidTransferEncoding,
+	"obs-fold":              ObsoleteLineFolding,
+	"obs-fold-te":           ObsoleteLineFolding,
+	"space-before-colon":    InvalidHeaderName,
+	"invalid-name":          InvalidHeaderName,
+	"missing-colon":         InvalidHeaderName,
+	"nul-value":             InvalidHeaderValue,
+	"duplicate-host":        DuplicateHost,
+	"host-mismatch":         HostMismatch,
+	"host-mismatch-port":    HostMismatch,
+	"connect-no-port":       InvalidConnectTarget,
+	"connect-bad-port":      InvalidConnectTarget,
+	"connect-path":          InvalidConnectTarget,
+	"connect-userinfo":      InvalidConnectTarget,
+	"connect-brackets":      InvalidConnectTarget,
+	"connect-host-mismatch": HostMismatch,
+	"bad-request-line":      MalformedRequest,
+	"bad-version":           MalformedRequest,
+	"host-fragment":         MalformedRequest,
+	"http2-preface":         MalformedRequest,
+}
+
+func TestCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*"))
+	require.NoError(t, err)
+	require.Len(t, files, len(expectedReasons), "every corpus file should have an expectation")
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		expected, found := expectedReasons[name]
+		if !assert.True(t, found, "no expectation for %v", name) {
+			continue
+		}
+		head, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+
+		err = ValidateHead(head)
+		assert.Equal(t, expected, errorpages.ReasonOf(err), name)
+		if err != nil {
+			assert.Equal(t, http.StatusBadRequest, err.(*errorpages.Error).Status, name)
+			continue
+		}
+		// Everything we accept should also be acceptable to net/http, leading
+		// empty lines aside as the listener strips those
+		head = bytes.TrimLeft(head, "\r\n")
+		_, parseErr := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		assert.NoError(t, parseErr, name)
+	}
+}
+
+// parsedReasons maps the files in testdata/corpus that net/http parses to the
+// reason ValidateRequest rejects them for, or "" if it can't tell once
+// net/http has parsed them.
+var parsedReasons = map[string]errorpages.Reason{
+	"valid-get":             "",
+	"valid-absolute":        "",
+	"valid-post":            "",
+	"valid-chunked":         "",
+	"valid-connect":         "",
+	"valid-connect-ipv6":    "",
+	"valid-leading-crlf":    "",
+	"cl-te":                 "",
+	"te-cl":                 "",
+	"duplicate-cl-same":     "",
+	"obs-fold":              "",
+	"obs-fold-te":           "",
+	"space-before-colon":    InvalidHeaderName,
+	"host-mismatch":         "",
+	"host-mismatch-port":    "",
+	"connect-no-port":       InvalidConnectTarget,
+	"connect-bad-port":      InvalidConnectTarget,
+	"connect-path":          InvalidConnectTarget,
+	"connect-userinfo":      InvalidConnectTarget,
+	"connect-host-mismatch": "",
+	"http2-preface":         MalformedRequest,
+}
+
+func TestValidateRequest(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*"))
+	require.NoError(t, err)
+	for _, file := range files {
+		name := filepath.Base(file)
+		head, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(bytes.TrimLeft(head, "\r\n"))))
+		expected, found := parsedReasons[name]
+		if err != nil {
+			assert.False(t, found, "net/http should parse %v", name)
+			continue
+		}
+		if !assert.True(t, found, "no expectation for %v", name) {
+			continue
+		}
+		assert.Equal(t, expected, errorpages.ReasonOf(ValidateRequest(req)), name)
+	}
+
+	// Fields changed after parsing
+	req, _ := http.ReadRequest(bufio.NewReader(strings.NewReader("GET http://example.com/ HTTP/1.1\r\n\r\n")))
+	req.Host = "example.org"
+	assert.Equal(t, HostMismatch, errorpages.ReasonOf(ValidateRequest(req)))
+	req, _ = http.ReadRequest(bufio.NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n")))
+	req.ContentLength = 5
+	assert.Equal(t, ContentLengthWithTransferEncoding, errorpages.ReasonOf(ValidateRequest(req)))
+}
+
+func TestSameAuthority(t *testing.T) {
+	assert.True(t, sameAuthority("example.com", "EXAMPLE.COM:80", "80"))
+	assert.True(t, sameAuthority("[::1]:443", "[::1]", "443"))
+	assert.False(t, sameAuthority("example.com", "example.com:8080", "80"))
+	assert.False(t, sameAuthority("example.com:443", "example.com", ""))
+}
@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the frame and payload byte counts of a connection, indexed by
+// Direction.
+type Stats struct {
+	Frames   [2]int64
+	Bytes    [2]int64
+	Messages [2]int64
+}
+
+// Conn wraps the upstream side of an upgraded connection. Since the proxy
+// writes what the client sends to it and reads what the server sends from it,
+// it sees the frames in both directions.
+type Conn struct {
+	// Keep 64-bit words at the top to make sure 64-bit alignment, see
+	// https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	stats        Stats
+	lastActivity int64
+
+	net.Conn
+	reader    *bufio.Reader
+	opts      *Opts
+	parsers   [2]*parser
+	idleTimer *time.Timer
+	closeOnce sync.Once
+	onClose   func(stats *Stats, idle bool)
+	idle      int32
+}
+
+// Wrap wraps the upstream side of an upgraded connection. reader is what the
+// response to the upgrade request was read from and may hold frames that
+// followed it, or nil. onClose is called with the final stats once the
+// connection is closed, including when it's closed for being idle.
+func Wrap(upstream net.Conn, reader *bufio.Reader, req *http.Request, opts *Opts, onClose func(stats *Stats, idle bool)) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(upstream)
+	}
+	c := &Conn{
+		Conn:         upstream,
+		reader:       reader,
+		opts:         opts,
+		onClose:      onClose,
+		lastActivity: time.Now().UnixNano(),
+	}
+	for _, dir := range []Direction{ClientToServer, ServerToClient} {
+		c.parsers[dir] = &parser{dir: dir, conn: c, req: req}
+	}
+	if opts.IdleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(opts.IdleTimeout, c.checkIdle)
+	}
+	return c
+}
+
+// Read reads frames sent by the server.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	if n > 0 {
+		c.parsers[ServerToClient].feed(b[:n])
+	}
+	return n, err
+}
+
+// Write writes frames sent by the client.
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.parsers[ClientToServer].feed(b[:n])
+	}
+	return n, err
+}
+
+// Close closes the upstream connection.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		if c.onClose != nil {
+			c.onClose(c.Stats(), atomic.LoadInt32(&c.idle) == 1)
+		}
+	})
+	return err
+}
+
+// Stats returns the current stats.
+func (c *Conn) Stats() *Stats {
+	stats := &Stats{}
+	for dir := range stats.Frames {
+		stats.Frames[dir] = atomic.LoadInt64(&c.stats.Frames[dir])
+		stats.Bytes[dir] = atomic.LoadInt64(&c.stats.Bytes[dir])
+		stats.Messages[dir] = atomic.LoadInt64(&c.stats.Messages[dir])
+	}
+	return stats
+}
+
+func (c *Conn) checkIdle() {
+	idleFor := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+	if idleFor < c.opts.IdleTimeout {
+		c.idleTimer.Reset(c.opts.IdleTimeout - idleFor)
+		return
+	}
+	log.Debugf("Closing WebSocket connection to %v after %v without frames", c.RemoteAddr(), idleFor)
+	atomic.StoreInt32(&c.idle, 1)
+	c.Close()
+}
+
+func (c *Conn) onFrame(dir Direction, length int64) {
+	atomic.AddInt64(&c.stats.Frames[dir], 1)
+	atomic.AddInt64(&c.stats.Bytes[dir], length)
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+const (
+	finBit     = 0x80
+	rsv1Bit    = 0x40
+	opcodeMask = 0x0f
+	maskBit    = 0x80
+	lengthMask = 0x7f
+)
+
+// parser follows the frames in one direction of a connection. It doesn't
+// validate them, that's left to the endpoints.
+type parser struct {
+	dir  Direction
+	conn *Conn
+	req  *http.Request
+
+	header    []byte
+	remaining int64
+	inPayload bool
+	fin       bool
+	opcode    Opcode
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	// the data message being assembled
+	msg msgState
+	// the control frame being assembled, which may be interleaved with the
+	// fragments of a data message
+	control msgState
+}
+
+type msgState struct {
+	opcode     Opcode
+	payload    []byte
+	size       int64
+	compressed bool
+}
+
+func (p *parser) feed(b []byte) {
+	for len(b) > 0 {
+		if !p.inPayload {
+			b = p.readHeader(b)
+			continue
+		}
+		n := int64(len(b))
+		if n > p.remaining {
+			n = p.remaining
+		}
+		p.payload(b[:n])
+		p.remaining -= n
+		b = b[n:]
+		if p.remaining == 0 {
+			p.endFrame()
+		}
+	}
+}
+
+// readHeader consumes header bytes, returning what's left of b.
+func (p *parser) readHeader(b []byte) []byte {
+	for len(b) > 0 {
+		p.header = append(p.header, b[0])
+		b = b[1:]
+		if len(p.header) < 2 {
+			continue
+		}
+		needed := 2
+		switch p.header[1] & lengthMask {
+		case 126:
+			needed += 2
+		case 127:
+			needed += 8
+		}
+		if p.header[1]&maskBit != 0 {
+			needed += 4
+		}
+		if len(p.header) < needed {
+			continue
+		}
+		p.startFrame()
+		return b
+	}
+	return b
+}
+
+func (p *parser) startFrame() {
+	h := p.header
+	p.fin = h[0]&finBit != 0
+	p.opcode = Opcode(h[0] & opcodeMask)
+	compressed := h[0]&rsv1Bit != 0
+	length := int64(h[1] & lengthMask)
+	pos := 2
+	switch length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(h[2:4]))
+		pos = 4
+	case 127:
+		length = int64(binary.BigEndian.Uint64(h[2:10]) &^ (1 << 63))
+		pos = 10
+	}
+	p.masked = h[1]&maskBit != 0
+	if p.masked {
+		copy(p.mask[:], h[pos:pos+4])
+	}
+	p.maskPos = 0
+	p.header = p.header[:0]
+	p.remaining = length
+	p.inPayload = true
+	p.conn.onFrame(p.dir, length)
+
+	if p.conn.opts.OnMessage == nil {
+		return
+	}
+	switch {
+	case p.opcode.IsControl():
+		p.control = msgState{opcode: p.opcode}
+	case p.opcode != OpContinuation:
+		p.msg = msgState{opcode: p.opcode, compressed: compressed}
+	}
+	if length == 0 {
+		p.endFrame()
+	}
+}
+
+func (p *parser) current() *msgState {
+	if p.opcode.IsControl() {
+		return &p.control
+	}
+	return &p.msg
+}
+
+func (p *parser) payload(b []byte) {
+	if p.conn.opts.OnMessage == nil {
+		return
+	}
+	m := p.current()
+	m.size += int64(len(b))
+	room := p.conn.opts.maxMessageSize() - len(m.payload)
+	if room <= 0 {
+		p.maskPos += len(b)
+		return
+	}
+	if len(b) > room {
+		b = b[:room]
+	}
+	start := len(m.payload)
+	m.payload = append(m.payload, b...)
+	if p.masked {
+		for i := start; i < len(m.payload); i++ {
+			m.payload[i] ^= p.mask[p.maskPos%4]
+			p.maskPos++
+		}
+	}
+}
+
+func (p *parser) endFrame() {
+	p.inPayload = false
+	if !p.fin && !p.opcode.IsControl() {
+		return
+	}
+	atomic.AddInt64(&p.conn.stats.Messages[p.dir], 1)
+	if p.conn.opts.OnMessage == nil {
+		return
+	}
+	m := p.current()
+	p.conn.opts.OnMessage(&Message{
+		Request:    p.req,
+		Direction:  p.dir,
+		Opcode:     m.opcode,
+		Payload:    m.payload,
+		Size:       m.size,
+		Truncated:  m.size > int64(len(m.payload)),
+		Compressed: m.compressed,
+	})
+	*m = msgState{}
+}
@@ -0,0 +1,169 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func frame(fin bool, opcode Opcode, mask []byte, payload []byte) []byte {
+	var b bytes.Buffer
+	first := byte(opcode)
+	if fin {
+		first |= finBit
+	}
+	b.WriteByte(first)
+	second := byte(0)
+	if mask != nil {
+		second = maskBit
+	}
+	switch {
+	case len(payload) < 126:
+		b.WriteByte(second | byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b.WriteByte(second | 126)
+		binary.Write(&b, binary.BigEndian, uint16(len(payload)))
+	default:
+		b.WriteByte(second | 127)
+		binary.Write(&b, binary.BigEndian, uint64(len(payload)))
+	}
+	if mask == nil {
+		b.Write(payload)
+		return b.Bytes()
+	}
+	b.Write(mask)
+	for i, c := range payload {
+		b.WriteByte(c ^ mask[i%4])
+	}
+	return b.Bytes()
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	var mx sync.Mutex
+	var messages []*Message
+	opts := &Opts{
+		MaxMessageSize: 100,
+		OnMessage: func(msg *Message) {
+			mx.Lock()
+			messages = append(messages, msg)
+			mx.Unlock()
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/chat", nil)
+	closed := make(chan *Stats, 1)
+	conn := Wrap(client, nil, req, opts, func(stats *Stats, idle bool) {
+		assert.False(t, idle)
+		closed <- stats
+	})
+
+	mask := []byte{1, 2, 3, 4}
+	long := bytes.Repeat([]byte("a"), 300)
+	var sent bytes.Buffer
+	sent.Write(frame(false, OpText, mask, []byte("Hello, ")))
+	sent.Write(frame(true, OpPing, mask, []byte("ping")))
+	sent.Write(frame(true, OpContinuation, mask, []byte("World")))
+	sent.Write(frame(true, OpBinary, mask, long))
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		// Write one byte at a time to make sure that frames are parsed across
+		// writes
+		for _, b := range sent.Bytes() {
+			if _, err := conn.Write([]byte{b}); err != nil {
+				return
+			}
+		}
+	}()
+	received := make([]byte, sent.Len())
+	n := 0
+	for n < len(received) {
+		read, err := server.Read(received[n:])
+		require.NoError(t, err)
+		n += read
+	}
+	assert.Equal(t, sent.Bytes(), received, "frames should pass unmodified")
+	<-written
+
+	go server.Write(frame(true, OpText, nil, make([]byte, 70000)))
+	buf := make([]byte, 70010)
+	n = 0
+	for n < len(buf) {
+		read, err := conn.Read(buf[n:])
+		require.NoError(t, err)
+		n += read
+	}
+
+	conn.Close()
+	stats := <-closed
+	assert.EqualValues(t, 4, stats.Frames[ClientToServer])
+	assert.EqualValues(t, 7+4+5+300, stats.Bytes[ClientToServer])
+	assert.EqualValues(t, 3, stats.Messages[ClientToServer])
+	assert.EqualValues(t, 1, stats.Frames[ServerToClient])
+	assert.EqualValues(t, 70000, stats.Bytes[ServerToClient])
+
+	mx.Lock()
+	defer mx.Unlock()
+	if assert.Len(t, messages, 4) {
+		assert.Equal(t, OpPing, messages[0].Opcode)
+		assert.Equal(t, "ping", string(messages[0].Payload))
+		assert.Equal(t, OpText, messages[1].Opcode)
+		assert.Equal(t, "Hello, World", string(messages[1].Payload), "fragments should be reassembled and unmasked")
+		assert.Equal(t, ClientToServer, messages[1].Direction)
+		assert.Equal(t, req, messages[1].Request)
+		assert.Equal(t, OpBinary, messages[2].Opcode)
+		assert.Len(t, messages[2].Payload, 100)
+		assert.EqualValues(t, 300, messages[2].Size)
+		assert.True(t, messages[2].Truncated)
+		assert.Equal(t, ServerToClient, messages[3].Direction)
+		assert.EqualValues(t, 70000, messages[3].Size)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	closed := make(chan bool, 1)
+	conn := Wrap(client, nil, nil, &Opts{IdleTimeout: 100 * time.Millisecond}, func(stats *Stats, idle bool) {
+		closed <- idle
+	})
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Pings keep the connection open
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err := conn.Write(frame(true, OpPing, []byte{1, 2, 3, 4}, nil))
+		require.NoError(t, err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("connection with pings should not be closed")
+	default:
+	}
+
+	select {
+	case idle := <-closed:
+		assert.True(t, idle)
+	case <-time.After(time.Second):
+		t.Fatal("idle connection should have been closed")
+	}
+	_, err := conn.Write([]byte{0})
+	assert.Error(t, err)
+}
@@ -0,0 +1,235 @@
+// Package websocket adds WebSocket awareness to the proxy. It recognizes
+// upgrade requests, applies origin and subprotocol policies to them and, once
+// a connection has been upgraded, follows the frames passing through it to
+// count them, enforce an idle timeout and optionally hand complete messages to
+// a hook for auditing. See proxyfilters.WebSockets for the filter that uses
+// it.
+package websocket
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+const (
+	defaultMaxMessageSize = 1 << 20
+)
+
+// Reasons for rejecting upgrade requests.
+const (
+	OriginNotAllowed      errorpages.Reason = "websocket-origin-not-allowed"
+	SubprotocolNotAllowed errorpages.Reason = "websocket-subprotocol-not-allowed"
+)
+
+var log = golog.LoggerFor("websocket")
+
+// Opcode identifies the type of a frame.
+type Opcode byte
+
+// Opcodes defined by RFC 6455 section 5.2.
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xa
+)
+
+// IsControl checks whether this is a control frame opcode (close, ping and
+// pong).
+func (o Opcode) IsControl() bool {
+	return o&0x8 != 0
+}
+
+func (o Opcode) String() string {
+	switch o {
+	case OpContinuation:
+		return "continuation"
+	case OpText:
+		return "text"
+	case OpBinary:
+		return "binary"
+	case OpClose:
+		return "close"
+	case OpPing:
+		return "ping"
+	case OpPong:
+		return "pong"
+	default:
+		return "reserved"
+	}
+}
+
+// Direction is the direction in which a frame travels.
+type Direction int
+
+const (
+	// ClientToServer is for frames sent by the client.
+	ClientToServer Direction = iota
+	// ServerToClient is for frames sent by the server.
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client_to_server"
+	}
+	return "server_to_client"
+}
+
+// Message is a complete message (or control frame) seen on a connection.
+type Message struct {
+	// Request is the upgrade request that established the connection.
+	Request   *http.Request
+	Direction Direction
+	Opcode    Opcode
+
+	// Payload is the unmasked payload, up to Opts.MaxMessageSize bytes.
+	Payload []byte
+
+	// Size is the full size of the payload.
+	Size int64
+
+	// Truncated indicates that Payload only holds the beginning of the
+	// message.
+	Truncated bool
+
+	// Compressed indicates that the payload is compressed by an extension
+	// like permessage-deflate and appears as is on the wire.
+	Compressed bool
+}
+
+// Opts configures WebSocket handling.
+type Opts struct {
+	// AllowedOrigins lists the values of the Origin header that are allowed,
+	// like "https://example.com". An entry like "https://*.example.com"
+	// allows all subdomains. If empty, all origins are allowed.
+	AllowedOrigins []string
+
+	// RequireOrigin rejects upgrade requests without an Origin header, which
+	// browsers always send. By default, they're allowed.
+	RequireOrigin bool
+
+	// AllowedSubprotocols lists the subprotocols that may be negotiated. Other
+	// subprotocols offered by the client are removed from the request, and
+	// requests that only offer other subprotocols are rejected. If empty, all
+	// subprotocols are allowed.
+	AllowedSubprotocols []string
+
+	// IdleTimeout closes connections on which no complete frame, including
+	// pings and pongs, has been seen in either direction for this long. Zero
+	// disables the timeout.
+	IdleTimeout time.Duration
+
+	// OnMessage, if specified, is called with every message and control frame
+	// seen on a connection. It's called synchronously while proxying, and
+	// concurrently for the two directions, so it should return quickly.
+	OnMessage func(msg *Message)
+
+	// MaxMessageSize caps the payload passed to OnMessage. Defaults to 1 MiB.
+	MaxMessageSize int
+}
+
+func (opts *Opts) maxMessageSize() int {
+	if opts.MaxMessageSize > 0 {
+		return opts.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+// IsUpgrade checks whether req asks to upgrade the connection to WebSocket.
+func IsUpgrade(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		headerContainsToken(req.Header, "Connection", "upgrade") &&
+		headerContainsToken(req.Header, "Upgrade", "websocket")
+}
+
+// CheckRequest applies the origin and subprotocol policies to an upgrade
+// request, removing disallowed subprotocols from it. It returns an
+// *errorpages.Error with status 403 if the request isn't allowed.
+func CheckRequest(opts *Opts, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		if opts.RequireOrigin {
+			return errorpages.NewError(http.StatusForbidden, OriginNotAllowed, "Missing Origin")
+		}
+	} else if len(opts.AllowedOrigins) > 0 && !originAllowed(opts.AllowedOrigins, origin) {
+		return errorpages.NewError(http.StatusForbidden, OriginNotAllowed, "Origin not allowed: %v", origin)
+	}
+
+	if len(opts.AllowedSubprotocols) == 0 {
+		return nil
+	}
+	offered := headerTokens(req.Header, "Sec-Websocket-Protocol")
+	if len(offered) == 0 {
+		return nil
+	}
+	var allowed []string
+	for _, protocol := range offered {
+		if SubprotocolAllowed(opts, protocol) {
+			allowed = append(allowed, protocol)
+		}
+	}
+	if len(allowed) == 0 {
+		return errorpages.NewError(http.StatusForbidden, SubprotocolNotAllowed, "Subprotocols not allowed: %v", strings.Join(offered, ", "))
+	}
+	req.Header.Set("Sec-Websocket-Protocol", strings.Join(allowed, ", "))
+	return nil
+}
+
+// SubprotocolAllowed checks whether the given subprotocol may be negotiated.
+func SubprotocolAllowed(opts *Opts, protocol string) bool {
+	if len(opts.AllowedSubprotocols) == 0 {
+		return true
+	}
+	for _, candidate := range opts.AllowedSubprotocols {
+		if candidate == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func originAllowed(allowed []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == origin {
+			return true
+		}
+		if wildcard := strings.Index(pattern, "://*."); wildcard >= 0 {
+			scheme, suffix := pattern[:wildcard+3], pattern[wildcard+4:]
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, suffix) && len(origin) > len(scheme)+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, t := range headerTokens(header, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/errorpages"
+)
+
+func TestIsUpgrade(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/chat", nil)
+	assert.False(t, IsUpgrade(req))
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	assert.True(t, IsUpgrade(req))
+	req.Header.Set("Upgrade", "h2c")
+	assert.False(t, IsUpgrade(req))
+}
+
+func TestCheckRequest(t *testing.T) {
+	opts := &Opts{
+		AllowedOrigins:      []string{"https://example.com", "https://*.example.org"},
+		AllowedSubprotocols: []string{"chat.v2", "chat.v1"},
+	}
+	check := func(origin, protocols string) (http.Header, errorpages.Reason) {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/chat", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if protocols != "" {
+			req.Header.Set("Sec-Websocket-Protocol", protocols)
+		}
+		return req.Header, errorpages.ReasonOf(CheckRequest(opts, req))
+	}
+
+	_, reason := check("https://example.com", "")
+	assert.Empty(t, reason)
+	_, reason = check("https://chat.example.org", "")
+	assert.Empty(t, reason)
+	_, reason = check("https://example.org", "")
+	assert.Equal(t, OriginNotAllowed, reason)
+	_, reason = check("http://example.com", "")
+	assert.Equal(t, OriginNotAllowed, reason)
+	_, reason = check("", "")
+	assert.Empty(t, reason, "missing origin should be allowed by default")
+	opts.RequireOrigin = true
+	_, reason = check("", "")
+	assert.Equal(t, OriginNotAllowed, reason)
+
+	header, reason := check("https://example.com", "chat.v3, chat.v1")
+	assert.Empty(t, reason)
+	assert.Equal(t, "chat.v1", header.Get("Sec-Websocket-Protocol"), "disallowed subprotocols should be removed")
+	_, reason = check("https://example.com", "chat.v3")
+	assert.Equal(t, SubprotocolNotAllowed, reason)
+}